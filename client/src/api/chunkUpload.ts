@@ -1,3 +1,5 @@
+import { sha256File } from "../utils/sha256";
+
 const CHUNK_SIZE = 5 * 1024 * 1024; // 5MB per chunk
 const PARALLEL = 1; // 順番に送信（並列だとCloudflareに制限される）
 
@@ -20,6 +22,34 @@ interface ChunkUploadOptions {
   onSendProgress: (percent: number) => void;
 }
 
+// サーバーにアップロードセッションを作り、受信済みのチャンク番号を返す（同じ uploadId なら続きから再開する）
+async function openSession(
+  BASE_URL: string,
+  token: string,
+  collectionId: string,
+  uploadId: string,
+  file: File,
+  sha256: string
+): Promise<Set<number>> {
+  const res = await fetch(`${BASE_URL}/v1/collections/${collectionId}/uploads`, {
+    method: "POST",
+    headers: {
+      "Authorization": `Bearer ${token}`,
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ id: uploadId, file_name: file.name, size: file.size, chunk_size: CHUNK_SIZE, sha256 }),
+  });
+  if (res.ok) return new Set();
+  if (res.status !== 409) throw new Error(`Upload session failed: ${res.status}`);
+
+  const statusRes = await fetch(`${BASE_URL}/v1/uploads/${uploadId}`, {
+    headers: { "Authorization": `Bearer ${token}` },
+  });
+  if (!statusRes.ok) throw new Error(`Upload session failed: ${statusRes.status}`);
+  const status = await statusRes.json();
+  return new Set<number>(status.received ?? []);
+}
+
 async function uploadChunk(
   BASE_URL: string,
   token: string,
@@ -66,12 +96,16 @@ export async function uploadFileInChunks(opts: ChunkUploadOptions): Promise<Resp
     // フォールバック
   }
 
-  let completed = 0;
+  // 結合後にサーバーが内容を検証するため、ファイル全体のハッシュを先に計算する
+  const sha256 = await sha256File(file);
+  const received = await openSession(BASE_URL, token, collectionId, uploadId, file, sha256);
+  let completed = received.size;
 
-  // PARALLEL 個ずつ並列送信
+  // PARALLEL 個ずつ並列送信（受信済みのチャンクは飛ばす）
   for (let i = 0; i < totalChunks; i += PARALLEL) {
     const batch = [];
     for (let j = i; j < Math.min(i + PARALLEL, totalChunks); j++) {
+      if (received.has(j)) continue;
       const start = j * CHUNK_SIZE;
       const end = Math.min(start + CHUNK_SIZE, file.size);
       batch.push(uploadChunk(BASE_URL, token, collectionId, uploadId, file.name, totalChunks, j, file.slice(start, end)));
@@ -1,6 +1,7 @@
 import { createContext, useContext, useRef, useState, useCallback } from "react";
 import type { ReactNode } from "react";
 import { uploadFileInChunks } from "../api/chunkUpload";
+import { randomUUID } from "../utils/uuid";
 
 const BASE_URL = import.meta.env.VITE_API_BASE_URL ?? "";
 
@@ -55,7 +56,7 @@ export function UploadProvider({ children }: { children: ReactNode }) {
 
   const startUpload = useCallback((opts: StartUploadOpts): string => {
     const { file, collectionId, trimStart, trimEnd, volume, resolution, fps, outputName, uploadedBy } = opts;
-    const uploadId = crypto.randomUUID?.() ?? Math.random().toString(36).slice(2) + Date.now().toString(36);
+    const uploadId = randomUUID();
     const baseName = (outputName?.trim() || file.name.replace(/\.[^.]+$/, "")) + ".mp4";
     const renamedFile = new File([file], baseName, { type: file.type });
 
@@ -116,8 +117,8 @@ export function UploadProvider({ children }: { children: ReactNode }) {
               if (Notification.permission === "granted") {
                 new Notification("アップロード完了", { body: baseName });
               }
-            } else if (d.phase === "error") {
-              updateJob(uploadId, { phase: "error", error: d.message ?? "エラー" });
+            } else if (d.phase === "error" || d.phase === "cancelled") {
+              updateJob(uploadId, { phase: "error", error: d.phase === "cancelled" ? "キャンセルされました" : d.message ?? "エラー" });
               clearInterval(pollingTimers.current[uploadId]);
               delete pollingTimers.current[uploadId];
             }
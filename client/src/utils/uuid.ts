@@ -0,0 +1,11 @@
+// サーバーはアップロード ID に UUID だけを受け付ける。
+// crypto.randomUUID は安全なオリジン（HTTPS / localhost）でしか使えないため、
+// LAN から HTTP で開いた場合は crypto.getRandomValues（どこでも使える）で v4 UUID を作る。
+export function randomUUID(): string {
+  if (typeof crypto.randomUUID === "function") return crypto.randomUUID();
+  const b = crypto.getRandomValues(new Uint8Array(16));
+  b[6] = (b[6] & 0x0f) | 0x40; // version 4
+  b[8] = (b[8] & 0x3f) | 0x80; // variant 10
+  const hex = Array.from(b, x => x.toString(16).padStart(2, "0")).join("");
+  return `${hex.slice(0, 8)}-${hex.slice(8, 12)}-${hex.slice(12, 16)}-${hex.slice(16, 20)}-${hex.slice(20)}`;
+}
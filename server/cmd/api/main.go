@@ -1,10 +1,15 @@
 package main
 
 import (
+	"cmp"
+	"context"
+	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/BBSHSH/HideMe/server/internal/config"
@@ -12,6 +17,7 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/BBSHSH/HideMe/server/internal/handlers"
 	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
 	"github.com/BBSHSH/HideMe/server/internal/storage"
 	"github.com/gin-gonic/gin"
 )
@@ -32,6 +38,35 @@ func main() {
 	cfg := config.Global
 	log.Printf("config: port=%d, public_url=%s", cfg.Server.Port, cfg.Public.URL)
 
+	// ./api backup・./api restore [-force] <アーカイブ> はサーバーを起動せずに実行して終わる
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+	var restoreArchive string
+	switch command {
+	case "", "serve", "backup":
+	case "restore":
+		// DB は開く（マイグレーションが走る）前に置き換える
+		flags := flag.NewFlagSet("restore", flag.ExitOnError)
+		force := flags.Bool("force", false, "overwrite the existing database")
+		flags.Parse(os.Args[2:])
+		if flags.NArg() != 1 {
+			log.Fatalf("usage: api restore [-force] <archive>")
+		}
+		restoreArchive = flags.Arg(0)
+		if err := service.RestoreDatabase(restoreArchive, cfg.Database.Path, *force); err != nil {
+			log.Fatalf("failed to restore db: %v", err)
+		}
+		log.Printf("restore: database restored from %s", restoreArchive)
+	default:
+		log.Fatalf("unknown command: %s", command)
+	}
+
+	if err := service.ConfigureTemp(cfg.Temp.Dir, cfg.Temp.MinFreeMB*1024*1024); err != nil {
+		log.Fatalf("failed to init temp dir: %v", err)
+	}
+
 	dbPath := cfg.Database.Path
 	database, err := db.Open(dbPath)
 	if err != nil {
@@ -40,22 +75,137 @@ func main() {
 	defer database.Close()
 
 	// ストレージ初期化
-	var store storage.Storage
-	switch cfg.Storage.Type {
-	case "local":
-		store = storage.NewLocalStorage(cfg.Storage.Local.BaseDir)
-		log.Printf("storage: local  dir=%s", cfg.Storage.Local.BaseDir)
-	case "nas":
-		// NAS (SMB) の設定
-		store = storage.NewNASStorage(storage.NASConfig{
+	// NAS は SFTP / SMB セッションをプールするため、全ハンドラで 1 つのインスタンスを共有する
+	localStore := storage.NewLocalStorage(cfg.Storage.Local.BaseDir)
+	var nasStore storage.Storage
+	var sftpStore *storage.NASStorage // ホスト鍵の管理は SFTP のみ
+	switch cfg.Storage.NAS.Protocol {
+	case "", "sftp":
+		sftpStore = storage.NewNASStorage(storage.NASConfig{
 			Host:           cfg.Storage.NAS.Host,
 			User:           cfg.Storage.NAS.User,
 			Password:       cfg.Storage.NAS.Password,
 			Share:          cfg.Storage.NAS.Share,
 			Port:           cfg.Storage.NAS.Port,
 			PrivateKeyPath: cfg.Storage.NAS.PrivateKeyPath,
+			PoolSize:       cfg.Storage.NAS.PoolSize,
+			IdleTimeout:    cfg.Storage.NAS.PoolIdleTimeout,
+
+			KnownHostsPath:     cfg.Storage.NAS.KnownHosts,
+			HostKeyFingerprint: cfg.Storage.NAS.HostKeyFingerprint,
+			TrustOnFirstUse:    cfg.Storage.NAS.HostKeyTOFU,
+			HostKeys:           db.HostKeyStore{DB: database},
+		})
+		defer sftpStore.Close()
+		nasStore = sftpStore
+	case "smb":
+		smbStore := storage.NewSMBStorage(storage.SMBConfig{
+			Host:           cfg.Storage.NAS.Host,
+			User:           cfg.Storage.NAS.User,
+			Password:       cfg.Storage.NAS.Password,
+			Domain:         cfg.Storage.NAS.Domain,
+			Share:          cfg.Storage.NAS.Share,
+			Port:           cfg.Storage.NAS.Port,
+			RequireSigning: cfg.Storage.NAS.RequireSigning,
+			PoolSize:       cfg.Storage.NAS.PoolSize,
+			IdleTimeout:    cfg.Storage.NAS.PoolIdleTimeout,
+		})
+		defer smbStore.Close()
+		nasStore = smbStore
+	default:
+		log.Fatalf("unknown nas protocol: %s", cfg.Storage.NAS.Protocol)
+	}
+
+	// S3 は storage_type = 's3' の既存行を読むため、設定があれば常に用意する
+	var s3Store storage.Storage
+	if cfg.Storage.S3.Bucket != "" {
+		s3Store = newS3Store(cfg)
+	}
+
+	// ミラーも storage_type = 'mirror' の既存行を読むため、設定があれば常に用意する
+	var mirrorStore *storage.MirrorStorage
+	if len(cfg.Storage.Mirror.Replicas) > 0 {
+		mirrorStore = newMirrorStore(cfg, database, map[string]storage.Storage{
+			"local": localStore, "nas": nasStore, "s3": s3Store,
 		})
-		log.Printf("storage: nas  host=%s  share=%s", cfg.Storage.NAS.Host, cfg.Storage.NAS.Share)
+		mirrorStore.SetTempDir(service.TempDir())
+	}
+
+	// ハンドラが使うストア。暗号化 → 重複排除の順に各バックエンドを包む
+	// （重複排除は平文のハッシュで判定する。暗号化しているときはブロブ名から内容が分からないよう、マスター鍵から導出した鍵の HMAC にする。
+	// NAS → ローカル移行とプール統計は包む前のストアを使う）
+	var masterKey storage.MasterKey
+	var previousKeys []storage.MasterKey
+	if cfg.Storage.Encryption.Enabled {
+		masterKey, previousKeys = loadMasterKeys(cfg)
+		log.Printf("storage: encryption enabled  key=%s", masterKey.ID())
+	}
+	if cfg.Storage.Dedup {
+		log.Printf("storage: dedup enabled")
+	}
+	wrap := func(raw storage.Storage, backend string) storage.Storage {
+		if raw == nil {
+			return nil
+		}
+		st := raw
+		if cfg.Storage.Encryption.Enabled {
+			enc, err := storage.NewEncryptedStorage(st, masterKey, previousKeys, cfg.Storage.Encryption.ChunkSizeKB*1024)
+			if err != nil {
+				log.Fatalf("failed to init storage encryption: %v", err)
+			}
+			enc.SetRequireEncrypted(cfg.Storage.Encryption.RequireEncrypted)
+			st = enc
+		}
+		if cfg.Storage.Dedup {
+			dedup := storage.NewDedupStorage(st, backend, db.BlobIndex{DB: database})
+			dedup.SetTempDir(service.TempDir())
+			if cfg.Storage.Encryption.Enabled {
+				dedup.SetHashKey(masterKey.DeriveKey("dedup"))
+			}
+			st = dedup
+		}
+		return st
+	}
+	// NAS の読み込みキャッシュは暗号化より下に置く（ディスクには暗号化されたまま保存される）
+	nasCached := nasStore
+	if cfg.Storage.Cache.Dir != "" {
+		maxMB := cmp.Or(cfg.Storage.Cache.MaxSizeMB, 10240)
+		cached, err := storage.NewCachedStorage(nasStore, cfg.Storage.Cache.Dir, int64(maxMB)*1024*1024)
+		if err != nil {
+			log.Fatalf("failed to init nas cache: %v", err)
+		}
+		nasCached = cached
+		log.Printf("storage: nas cache  dir=%s  max=%dMB", cfg.Storage.Cache.Dir, maxMB)
+	}
+	localFiles, nasFiles, s3Files := wrap(localStore, "local"), wrap(nasCached, "nas"), wrap(s3Store, "s3")
+	var mirrorFiles storage.Storage
+	if mirrorStore != nil {
+		mirrorFiles = wrap(mirrorStore, "mirror")
+		if cfg.Storage.Mirror.RepairInterval > 0 {
+			service.StartReplicaRepairLoop(context.Background(), database, mirrorStore, time.Duration(cfg.Storage.Mirror.RepairInterval)*time.Second)
+		}
+	}
+
+	var store storage.Storage
+	switch cfg.Storage.Type {
+	case "local":
+		store = localFiles
+		log.Printf("storage: local  dir=%s", cfg.Storage.Local.BaseDir)
+	case "nas":
+		store = nasFiles
+		log.Printf("storage: nas  protocol=%s  host=%s  share=%s", cmp.Or(cfg.Storage.NAS.Protocol, "sftp"), cfg.Storage.NAS.Host, cfg.Storage.NAS.Share)
+	case "s3":
+		if s3Store == nil {
+			log.Fatalf("storage type s3 requires storage.s3.bucket")
+		}
+		store = s3Files
+		log.Printf("storage: s3  endpoint=%s  bucket=%s", cfg.Storage.S3.Endpoint, cfg.Storage.S3.Bucket)
+	case "mirror":
+		if mirrorFiles == nil {
+			log.Fatalf("storage type mirror requires storage.mirror.replicas")
+		}
+		store = mirrorFiles
+		log.Printf("storage: mirror  replicas=%v  write_quorum=%d", cfg.Storage.Mirror.Replicas, cfg.Storage.Mirror.WriteQuorum)
 	default:
 		log.Fatalf("unknown storage type: %s", cfg.Storage.Type)
 	}
@@ -63,17 +213,82 @@ func main() {
 	// ストレージセレクター
 	storeFor := func(storageType string) storage.Storage {
 		if storageType == "local" {
-			return storage.NewLocalStorage(cfg.Storage.Local.BaseDir)
+			return localFiles
+		}
+		if storageType == "s3" && s3Files != nil {
+			return s3Files
+		}
+		if storageType == "mirror" && mirrorFiles != nil {
+			return mirrorFiles
 		}
 		// NAS（デフォルト）
-		return storage.NewNASStorage(storage.NASConfig{
-			Host:           cfg.Storage.NAS.Host,
-			User:           cfg.Storage.NAS.User,
-			Password:       cfg.Storage.NAS.Password,
-			Share:          cfg.Storage.NAS.Share,
-			Port:           cfg.Storage.NAS.Port,
-			PrivateKeyPath: cfg.Storage.NAS.PrivateKeyPath,
-		})
+		return nasFiles
+	}
+
+	// 移行は包む前のストア同士でバイト列をそのまま複製する。再起動で中断した移行は続きから再開する
+	rawStores := map[string]storage.Storage{"local": localStore, "nas": nasStore}
+	if s3Store != nil {
+		rawStores["s3"] = s3Store
+	}
+	if mirrorStore != nil {
+		rawStores["mirror"] = mirrorStore
+	}
+
+	// バックアップは包む前のストアのバイト列をそのまま残す。ミラーの中身は各レプリカ側に入るので含めない
+	backupStores := map[string]storage.Storage{}
+	for name, st := range rawStores {
+		if name != "mirror" {
+			backupStores[name] = st
+		}
+	}
+	backupOpts := service.BackupOptions{
+		Dir:         cfg.Backup.Dir,
+		Incremental: cfg.Backup.Incremental,
+		FullEvery:   cfg.Backup.FullEvery,
+		Keep:        cfg.Backup.Keep,
+	}
+	switch command {
+	case "backup":
+		m, err := service.RunBackup(context.Background(), database, backupStores, backupOpts)
+		if err != nil {
+			log.Fatalf("backup failed: %v", err)
+		}
+		log.Printf("backup: %s (%s, %d file(s))", filepath.Join(cfg.Backup.Dir, m.Name), m.Kind, len(m.Blobs))
+		return
+	case "restore":
+		m, err := service.ReadBackupManifest(restoreArchive)
+		if err != nil {
+			log.Fatalf("failed to read backup manifest: %v", err)
+		}
+		restored, skipped, err := service.RestoreBlobs(context.Background(), filepath.Dir(restoreArchive), m, backupStores)
+		if err != nil {
+			log.Fatalf("restore failed after %d file(s): %v", restored, err)
+		}
+		log.Printf("restore: %d file(s) restored, %d already present", restored, skipped)
+		return
+	}
+
+	service.ResumeInterruptedMigration(database, rawStores)
+	janitorOpts := service.JanitorOptions{
+		TTL:         time.Duration(cfg.Temp.TTLHours) * time.Hour,
+		ProgressTTL: time.Duration(cfg.Temp.ProgressTTL) * time.Second,
+	}
+	service.RelayProgressToChat()
+	// 待ちのジョブの入力を守ってから janitor を動かす（janitor は起動直後に 1 回目を走らせる）
+	service.StartEncodeQueue(context.Background(), database, storeFor, service.EncodeQueueOptions{
+		Workers:     cfg.Encode.Workers,
+		MaxAttempts: cfg.Encode.MaxAttempts,
+		RetryDelay:  time.Duration(cfg.Encode.RetryDelay) * time.Second,
+	})
+	service.StartJanitorLoop(context.Background(), database, janitorOpts, time.Duration(cfg.Temp.JanitorInterval)*time.Second)
+	if cfg.Backup.Interval > 0 {
+		service.StartBackupLoop(context.Background(), database, backupStores, backupOpts, time.Duration(cfg.Backup.Interval)*time.Second)
+	}
+
+	var trashRetention time.Duration
+	if cfg.Trash.RetentionDays > 0 {
+		trashRetention = time.Duration(cfg.Trash.RetentionDays) * 24 * time.Hour
+		service.StartTrashPurgeLoop(context.Background(), database, storeFor, trashRetention, time.Duration(cfg.Trash.PurgeInterval)*time.Second)
 	}
 
 	router := gin.New()
@@ -119,21 +334,34 @@ func main() {
 	api.POST("/files/upload", handlers.UploadFile(store))
 	api.GET("/all-files", handlers.ListAllFiles(database))
 	api.GET("/files/*name", handlers.DownloadFile(database, storeFor))
-	api.GET("/stats", handlers.GetStats(database, store))
+	api.GET("/stats", handlers.GetStats(database, store, storeFor))
 	// collections (adminのみ)
 	api.GET("/collections", handlers.ListCollections(database))
 	api.POST("/collections/upload-image", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.UploadCollectionImage(store))
 	api.POST("/collections", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.CreateCollection(database))
 	api.PUT("/collections/:id", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.UpdateCollection(database))
-	api.DELETE("/collections/:id", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.DeleteCollection(database, store))
+	api.DELETE("/collections/:id", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.DeleteCollection(database))
 	// collection files
 	api.GET("/collections/:id/files", handlers.ListCollectionFiles(database))
 	api.POST("/collections/:id/files", middleware.RequireAuth(), handlers.UploadToCollection(store, database, cfg.Storage.Type))
-	api.POST("/collections/:id/chunk", middleware.RequireAuth(), handlers.UploadChunk())
+	api.POST("/collections/:id/uploads", middleware.RequireAuth(), handlers.CreateUploadSession(database))
+	api.POST("/collections/:id/chunk", middleware.RequireAuth(), handlers.UploadChunk(database))
 	api.POST("/collections/:id/merge", middleware.RequireAuth(), handlers.MergeAndUpload(store, database, cfg.Storage.Type))
 	api.PATCH("/collections/:id/files/:fileID", middleware.RequireAuth(), handlers.PatchCollectionFile(database, storeFor, cfg.Storage.Type))
-	api.DELETE("/collections/:id/files/:fileID", middleware.RequireAuth(), handlers.DeleteCollectionFile(database, storeFor))
+	api.DELETE("/collections/:id/files/:fileID", middleware.RequireAuth(), handlers.DeleteCollectionFile(database))
 	api.POST("/collections/:id/files/:fileID/view", middleware.RequireAuth(), handlers.RecordView(database))
+	api.GET("/collections/:id/zip", handlers.DownloadCollectionZip(database, storeFor, cfg.Zip.MaxBytes, cfg.Zip.MaxFiles))
+	api.POST("/collections/:id/zip", handlers.DownloadCollectionZip(database, storeFor, cfg.Zip.MaxBytes, cfg.Zip.MaxFiles))
+	// 中身の差し替えと旧バージョン
+	api.POST("/collections/:id/files/:fileID/replace", middleware.RequireAuth(), handlers.ReplaceCollectionFile(store, database, storeFor, cfg.Storage.Type, cfg.Versions.Keep))
+	api.GET("/collections/:id/files/:fileID/versions", middleware.RequireAuth(), handlers.ListFileVersions(database))
+	api.GET("/collections/:id/files/:fileID/versions/:version/download", middleware.RequireAuth(), handlers.DownloadFileVersion(database, storeFor))
+	api.POST("/collections/:id/files/:fileID/versions/:version/restore", middleware.RequireAuth(), handlers.RestoreFileVersion(database, storeFor, cfg.Versions.Keep))
+	api.PUT("/admin/collections/:id/versions", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.SetVersionRetention(database))
+	// ゴミ箱（復元・完全削除は admin only）
+	api.GET("/trash", middleware.RequireAuth(), handlers.ListTrash(database, trashRetention))
+	api.POST("/admin/trash/:kind/:id/restore", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.RestoreTrashItem(database))
+	api.DELETE("/admin/trash/:kind/:id", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.PurgeTrashItem(database, storeFor))
 
 	// SSE: アップロード進捗（Cloudflare非経由の場合）
 	api.GET("/upload-progress/:uploadId", handlers.SSEUploadProgress())
@@ -141,26 +369,64 @@ func main() {
 	api.GET("/upload-status/:uploadId", handlers.PollUploadProgress())
 	// WebSocket アップロード（Cloudflare経由でも高速）
 	api.GET("/ws-upload", handlers.WSUpload(store, database, cfg.Storage.Type))
+	// 自分の処理中のアップロード一覧（進捗はチャットの WebSocket にも upload_progress で流れる）
+	api.GET("/uploads/active", middleware.RequireAuth(), handlers.ListActiveUploads())
+	// チャンクアップロードのセッション（受信済みチャンクの確認・中止）
+	api.GET("/uploads/:uploadId", middleware.RequireAuth(), handlers.GetUploadSession(database))
+	api.DELETE("/uploads/:uploadId", middleware.RequireAuth(), handlers.DeleteUploadSession(database))
+	// 受け付けたアップロードの取り消し（受信中の WebSocket・保存中・エンコード中・順番待ち）
+	api.POST("/uploads/:uploadId/cancel", middleware.RequireAuth(), handlers.CancelUpload(database))
+	// tus（再開できるアップロード。標準の tus クライアントで使える）
+	api.OPTIONS("/tus", handlers.TusOptions(cfg.Upload.TusMaxBytes))
+	api.OPTIONS("/tus/:uploadId", handlers.TusOptions(cfg.Upload.TusMaxBytes))
+	api.POST("/tus", middleware.RequireAuth(), handlers.TusCreate(database, cfg.Upload.TusMaxBytes))
+	api.HEAD("/tus/:uploadId", middleware.RequireAuth(), handlers.TusHead())
+	api.PATCH("/tus/:uploadId", middleware.RequireAuth(), handlers.TusPatch(store, database, cfg.Storage.Type))
+	api.DELETE("/tus/:uploadId", middleware.RequireAuth(), handlers.TusDelete())
 
 	// ストレージ移植（admin only）
-	nasStore := storage.NewNASStorage(storage.NASConfig{
-		Host:           cfg.Storage.NAS.Host,
-		User:           cfg.Storage.NAS.User,
-		Password:       cfg.Storage.NAS.Password,
-		Share:          cfg.Storage.NAS.Share,
-		Port:           cfg.Storage.NAS.Port,
-		PrivateKeyPath: cfg.Storage.NAS.PrivateKeyPath,
-	})
-	localStore := storage.NewLocalStorage(cfg.Storage.Local.BaseDir)
-	api.POST("/admin/migrate-storage", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.StartMigration(nasStore, localStore, database))
-	api.GET("/admin/migrate-status", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetMigrateStatus())
+	api.POST("/admin/migrate-storage", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.StartMigration(database, rawStores))
+	api.POST("/admin/migrate-storage/pause", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.PauseMigration(database))
+	api.POST("/admin/migrate-storage/resume", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.ResumeMigration(database, rawStores))
+	api.POST("/admin/migrate-storage/cancel", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.CancelMigration(database))
+	api.GET("/admin/migrate-status", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetMigrateStatus(database))
 	api.POST("/admin/force-logout", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.ForceLogoutAll(database))
+	api.GET("/admin/storage/pool", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetStoragePoolStats(nasStore))
+	api.GET("/admin/storage/host-key", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetNASHostKey(sftpStore))
+	api.POST("/admin/repair-storage-keys", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.RepairStorageKeys(database, storeFor))
+	api.POST("/admin/storage/host-key/repin", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.RepinNASHostKey(sftpStore))
+	api.GET("/admin/storage/replicas", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetReplicaStatus(database, mirrorStore))
+	api.POST("/admin/storage/replicas/repair", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.StartReplicaRepair(database, mirrorStore))
+	api.GET("/admin/storage/reconcile", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetStorageReconcile(database))
+	api.POST("/admin/storage/reconcile", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.StartStorageReconcile(database, rawStores))
+	api.POST("/admin/storage/reconcile/resolve", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.ResolveStorageFindings(database, rawStores))
+	api.POST("/admin/storage/reencrypt", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.StartReencrypt(database, store, storeFor))
+	api.GET("/admin/storage/reencrypt-status", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetReencryptStatus())
+	api.GET("/admin/janitor", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.GetJanitorReport())
+	api.POST("/admin/janitor/run", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.RunJanitor(database, janitorOpts))
+
+	// 動画のエンコードキュー（本人のジョブ。admin は全員分）
+	api.GET("/encode-jobs", middleware.RequireAuth(), handlers.ListEncodeJobs(database))
+	api.GET("/encode-jobs/:id", middleware.RequireAuth(), handlers.GetEncodeJob(database))
+	api.POST("/encode-jobs/:id/cancel", middleware.RequireAuth(), handlers.CancelEncodeJob(database))
+	api.PUT("/admin/encode-jobs/:id/priority", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.SetEncodeJobPriority(database))
+
+	// 容量制限
+	api.GET("/storage-usage", middleware.RequireAuth(), handlers.GetStorageUsage(database))
+	api.GET("/admin/quotas", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.ListQuotas(database))
+	api.PUT("/admin/quotas", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.SetQuota(database))
+	api.DELETE("/admin/quotas/:scope/:target", middleware.RequireAuth(), middleware.RequireAdmin(), handlers.DeleteQuota(database))
 
 	// アクティビティ
 	api.GET("/activity", middleware.RequireAuth(), handlers.ListActivity(database))
 	// メンバー一覧
 	api.GET("/members", middleware.RequireAuth(), handlers.ListMembers(database))
 
+	// アプリパスワード（WebDAV クライアント用）
+	api.GET("/app-passwords", middleware.RequireAuth(), handlers.ListAppPasswords(database))
+	api.POST("/app-passwords", middleware.RequireAuth(), handlers.CreateAppPassword(database))
+	api.DELETE("/app-passwords/:id", middleware.RequireAuth(), handlers.DeleteAppPassword(database))
+
 	// users (DM 相手選択用)
 	api.GET("/users", middleware.RequireAuth(), handlers.ListUsers(database))
 
@@ -181,6 +447,16 @@ func main() {
 	api.POST("/chat/channels/:id/voice/join", middleware.RequireAuth(), handlers.VoiceJoin())
 	api.POST("/chat/channels/:id/voice/leave", middleware.RequireAuth(), handlers.VoiceLeave())
 
+	// WebDAV（コレクションをフォルダとして見せる。認証は handlers.WebDAV の中で行う）
+	if !cfg.WebDAV.Disabled {
+		dav := handlers.WebDAV(store, database, storeFor, cfg.Storage.Type, cfg.Versions.Keep, cfg.WebDAV.EncodeVideos)
+		davChain := []gin.HandlerFunc{middleware.UpdateLastSeen(database), middleware.CheckForceLogout(database), dav}
+		for _, method := range []string{"GET", "HEAD", "PUT", "DELETE", "OPTIONS", "PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+			router.Handle(method, "/dav", davChain...)
+			router.Handle(method, "/dav/*path", davChain...)
+		}
+	}
+
 	port := fmt.Sprintf("%d", cfg.Server.Port)
 	server := &http.Server{
 		Addr:              ":" + port,
@@ -216,3 +492,64 @@ func main() {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+func newS3Store(cfg *config.Config) *storage.S3Storage {
+	s3, err := storage.NewS3Storage(storage.S3Config{
+		Endpoint:  cfg.Storage.S3.Endpoint,
+		Bucket:    cfg.Storage.S3.Bucket,
+		AccessKey: cfg.Storage.S3.AccessKey,
+		SecretKey: cfg.Storage.S3.SecretKey,
+		Region:    cfg.Storage.S3.Region,
+		UseSSL:    cfg.Storage.S3.UseSSL,
+		Prefix:    cfg.Storage.S3.Prefix,
+		PartSize:  uint64(cfg.Storage.S3.PartSizeMB) * 1024 * 1024,
+	})
+	if err != nil {
+		log.Fatalf("failed to init s3 storage: %v", err)
+	}
+	return s3
+}
+
+// loadMasterKeys は暗号化のマスター鍵（と復号用の旧鍵）を設定から読み込む
+func loadMasterKeys(cfg *config.Config) (storage.MasterKey, []storage.MasterKey) {
+	var key storage.MasterKey
+	var err error
+	switch {
+	case cfg.Storage.Encryption.Key != "":
+		key, err = storage.ParseMasterKey(cfg.Storage.Encryption.Key)
+	case cfg.Storage.Encryption.KeyFile != "":
+		key, err = storage.LoadMasterKeyFile(cfg.Storage.Encryption.KeyFile)
+	default:
+		log.Fatalf("storage encryption requires storage.encryption.key, key_file or HIDEME_MASTER_KEY")
+	}
+	if err != nil {
+		log.Fatalf("failed to load master key: %v", err)
+	}
+
+	var previous []storage.MasterKey
+	for _, path := range cfg.Storage.Encryption.PreviousKeyFiles {
+		k, err := storage.LoadMasterKeyFile(path)
+		if err != nil {
+			log.Fatalf("failed to load previous master key: %v", err)
+		}
+		previous = append(previous, k)
+	}
+	return key, previous
+}
+
+// newMirrorStore は storage.mirror.replicas に並べたバックエンドでミラーを作る
+func newMirrorStore(cfg *config.Config, database *sql.DB, backends map[string]storage.Storage) *storage.MirrorStorage {
+	var replicas []storage.Replica
+	for _, name := range cfg.Storage.Mirror.Replicas {
+		st := backends[name]
+		if st == nil {
+			log.Fatalf("mirror replica %q is unknown or not configured", name)
+		}
+		replicas = append(replicas, storage.Replica{Name: name, Store: st})
+	}
+	mirror, err := storage.NewMirrorStorage(replicas, db.ReplicaIndex{DB: database}, cfg.Storage.Mirror.WriteQuorum)
+	if err != nil {
+		log.Fatalf("failed to init mirror storage: %v", err)
+	}
+	return mirror
+}
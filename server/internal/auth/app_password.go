@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// AppPasswordPrefix はアプリパスワードの先頭に付ける目印（ログや設定ファイルで見分けるため）
+const AppPasswordPrefix = "hmapp_"
+
+// NewAppPassword は WebDAV クライアントなどに渡すアプリパスワードを生成し、平文と保存用のハッシュを返す。
+// 平文は作成時に一度だけ表示し、DB にはハッシュだけを残す。
+func NewAppPassword() (token, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = AppPasswordPrefix + hex.EncodeToString(b)
+	return token, HashAppPassword(token), nil
+}
+
+// HashAppPassword はアプリパスワードの照合用ハッシュを返す。
+// 十分に長いランダム値なので bcrypt ではなく SHA-256 で引けるようにする。
+func HashAppPassword(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"log"
 	"os"
 
@@ -23,31 +24,124 @@ type Config struct {
 	} `yaml:"database"`
 
 	Storage struct {
-		Type string `yaml:"type"` // "local" or "nas"
+		Type  string `yaml:"type"`  // "local", "nas", "s3" or "mirror"
+		Dedup bool   `yaml:"dedup"` // 同じ内容のアップロードを 1 つのブロブにまとめる（SHA-256）
 		Local struct {
 			BaseDir string `yaml:"base_dir"`
 		} `yaml:"local"`
 		NAS struct {
-			Host           string `yaml:"host"`
-			User           string `yaml:"user"`
-			Password       string `yaml:"password"`
-			Share          string `yaml:"share"`
-			Port           int    `yaml:"port"`
-			PrivateKeyPath string `yaml:"private_key"`
+			Protocol        string `yaml:"protocol"` // "sftp"（デフォルト）or "smb"
+			Host            string `yaml:"host"`
+			User            string `yaml:"user"`
+			Password        string `yaml:"password"`
+			Share           string `yaml:"share"` // SFTP はディレクトリ、SMB は "共有名/ディレクトリ"
+			Port            int    `yaml:"port"`  // デフォルト SFTP 22 / SMB 445
+			PrivateKeyPath  string `yaml:"private_key"`
+			PoolSize        int    `yaml:"pool_size"`         // SFTP / SMB セッションの上限（デフォルト 8）
+			PoolIdleTimeout int    `yaml:"pool_idle_timeout"` // 秒。アイドルのセッションを閉じるまでの時間（デフォルト 300）
+			// ホスト鍵の検証（SFTP のみ。いずれか 1 つを設定しないと NAS に接続しない）
+			KnownHosts         string `yaml:"known_hosts"`          // 例: /etc/hideme/known_hosts
+			HostKeyFingerprint string `yaml:"host_key_fingerprint"` // 例: SHA256:AbCd...（ssh-keygen -lf で確認）
+			HostKeyTOFU        bool   `yaml:"host_key_tofu"`        // 初回接続時の鍵を DB に保存して以後照合する
+			// SMB のみ
+			Domain         string `yaml:"domain"`          // NTLM 認証のドメイン（ワークグループなら空）
+			RequireSigning bool   `yaml:"require_signing"` // SMB 署名を必須にする
 		} `yaml:"nas"`
+		// S3 互換オブジェクトストレージ（MinIO / Garage など）
+		S3 struct {
+			Endpoint   string `yaml:"endpoint"` // 例: 192.168.1.20:9000（スキームなし）
+			Bucket     string `yaml:"bucket"`
+			AccessKey  string `yaml:"access_key"`
+			SecretKey  string `yaml:"secret_key"`
+			Region     string `yaml:"region"` // Garage は "garage"、MinIO は空で可
+			UseSSL     bool   `yaml:"use_ssl"`
+			Prefix     string `yaml:"prefix"`       // バケット内のキー接頭辞（例: hideme/uploads）
+			PartSizeMB int    `yaml:"part_size_mb"` // マルチパートの 1 パートのサイズ（デフォルト 16MB）
+		} `yaml:"s3"`
+		// NAS の読み込みキャッシュ（dir を設定すると有効。読まれたファイルをローカルディスクに複製する）
+		Cache struct {
+			Dir       string `yaml:"dir"`         // 例: ./cache/nas
+			MaxSizeMB int    `yaml:"max_size_mb"` // キャッシュの上限（デフォルト 10240MB）
+		} `yaml:"cache"`
+		// 複数のバックエンドへの二重書き込み（type: mirror で新規アップロードに使う）
+		Mirror struct {
+			Replicas       []string `yaml:"replicas"`        // 例: [local, nas]（先頭ほど読み込みを優先）
+			WriteQuorum    int      `yaml:"write_quorum"`    // アップロード成功に必要な書き込み数（デフォルト 1）
+			RepairInterval int      `yaml:"repair_interval"` // 秒。欠けたレプリカの修復間隔（デフォルト 600、負の値で無効）
+		} `yaml:"mirror"`
+		// 保存時の暗号化（AES-256-GCM）。マスター鍵は key / key_file / 環境変数 HIDEME_MASTER_KEY のいずれかで渡す
+		Encryption struct {
+			Enabled          bool     `yaml:"enabled"`
+			Key              string   `yaml:"key"`                // 32 バイトの hex / base64
+			KeyFile          string   `yaml:"key_file"`           // 例: /etc/hideme/master.key
+			PreviousKeyFiles []string `yaml:"previous_key_files"` // 鍵の入れ替え後も旧鍵で暗号化されたファイルを読むため
+			ChunkSizeKB      int      `yaml:"chunk_size_kb"`      // 暗号化チャンクのサイズ（デフォルト 64KB）
+			// true にすると暗号化されていないファイルを読まない。
+			// 導入前のファイルを POST /v1/admin/storage/reencrypt で全て暗号化してから有効にする
+			RequireEncrypted bool `yaml:"require_encrypted"`
+		} `yaml:"encryption"`
 	} `yaml:"storage"`
 
+	// ゴミ箱。削除したファイル・コレクションは retention_days 日が過ぎたら実体ごと消える
+	Trash struct {
+		RetentionDays int `yaml:"retention_days"` // デフォルト 30、負の値で自動では消さない
+		PurgeInterval int `yaml:"purge_interval"` // 秒。期限切れを消す間隔（デフォルト 3600）
+	} `yaml:"trash"`
+
+	// ファイルの置き換え時に残す旧バージョン
+	Versions struct {
+		Keep int `yaml:"keep"` // 1 ファイルあたりの保持数（デフォルト 10、コレクションごとに上書き可、負の値で残さない）
+	} `yaml:"versions"`
+
+	// WebDAV（/dav/）。コレクションをフォルダ、ファイルを表示名で見せる
+	WebDAV struct {
+		Disabled     bool `yaml:"disabled"`
+		EncodeVideos bool `yaml:"encode_videos"` // PUT した動画をブラウザからのアップロードと同じくエンコードする（サイズが変わるので rclone などの検証とは相性が悪い）
+	} `yaml:"webdav"`
+
+	// コレクションの ZIP ダウンロード（/v1/collections/:id/zip）
+	Zip struct {
+		MaxBytes int64 `yaml:"max_bytes"` // 1 つの ZIP に入れられる合計サイズ（デフォルト 20GiB）
+		MaxFiles int   `yaml:"max_files"` // 1 つの ZIP に入れられるファイル数（デフォルト 5000）
+	} `yaml:"zip"`
+
+	// バックアップ（./api backup・./api restore <アーカイブ> でも実行できる）
+	Backup struct {
+		Dir         string `yaml:"dir"`         // 保存先（デフォルト ./backups）
+		Interval    int    `yaml:"interval"`    // 定期実行の間隔（秒、0 なら定期実行しない）
+		Incremental bool   `yaml:"incremental"` // 前回から変わったファイルだけを入れる
+		FullEvery   int    `yaml:"full_every"`  // 増分をこの回数続けたらフルを取る（デフォルト 7）
+		Keep        int    `yaml:"keep"`        // 残すフルバックアップの数（0 なら消さない）
+	} `yaml:"backup"`
+
+	// アップロードの一時ファイルと、その片付け（janitor）
+	Temp struct {
+		Dir             string `yaml:"dir"`              // 置き場（デフォルト OS の一時フォルダ）
+		TTLHours        int    `yaml:"ttl_hours"`        // この時間触られていない一時ファイル・チャンクのセッションを消す（デフォルト 24）
+		ProgressTTL     int    `yaml:"progress_ttl"`     // 秒。更新の止まったアップロードの進捗（履歴）を残す時間（デフォルト 3600）
+		JanitorInterval int    `yaml:"janitor_interval"` // 秒（デフォルト 1800）
+		MinFreeMB       int64  `yaml:"min_free_mb"`      // アップロードを受け付けた後も残す空き容量（デフォルト 1024、負の値で確認しない）
+	} `yaml:"temp"`
+
+	// 動画のエンコードキュー（受け付けた動画は順番にエンコードする。再起動しても続きから処理する）
+	Encode struct {
+		Workers     int `yaml:"workers"`      // 同時に動かす ffmpeg の数（デフォルト 2）
+		MaxAttempts int `yaml:"max_attempts"` // 失敗したときに試す回数の上限（デフォルト 3）
+		RetryDelay  int `yaml:"retry_delay"`  // 秒。1 回目の再試行までの待ち時間（試すごとに倍になる。デフォルト 30）
+	} `yaml:"encode"`
+
 	Discord struct {
-		ClientID    string `yaml:"client_id"`
+		ClientID     string `yaml:"client_id"`
 		ClientSecret string `yaml:"client_secret"`
-		GuildID    string `yaml:"guild_id"`
+		GuildID      string `yaml:"guild_id"`
 		RequiredRole string `yaml:"required_role"`
 	} `yaml:"discord"`
 
 	Upload struct {
 		// true にすると大きいファイルのアップロードを DirectURL に直接送信（Cloudflare 制限回避）
 		UseDirectURL bool   `yaml:"use_direct_url"`
-		DirectURL    string `yaml:"direct_url"` // 例: http://グローバルIP:8080
+		DirectURL    string `yaml:"direct_url"`    // 例: http://グローバルIP:8080
+		TusMaxBytes  int64  `yaml:"tus_max_bytes"` // tus（/v1/tus）で受け付ける 1 ファイルの上限（0 なら無制限）
 	} `yaml:"upload"`
 
 	TLS struct {
@@ -78,20 +172,6 @@ func Load(path string) error {
 		Database: struct {
 			Path string `yaml:"path"`
 		}{Path: "./hideme.db"},
-		Storage: struct {
-			Type string `yaml:"type"`
-			Local struct {
-				BaseDir string `yaml:"base_dir"`
-			} `yaml:"local"`
-			NAS struct {
-				Host           string `yaml:"host"`
-				User           string `yaml:"user"`
-				Password       string `yaml:"password"`
-				Share          string `yaml:"share"`
-				Port           int    `yaml:"port"`
-				PrivateKeyPath string `yaml:"private_key"`
-			} `yaml:"nas"`
-		}{Type: "local"},
 		Public: struct {
 			URL         string `yaml:"url"`
 			FrontendURL string `yaml:"frontend_url"`
@@ -119,10 +199,63 @@ func Load(path string) error {
 		log.Printf("[CONFIG] %s not found, using defaults + env vars", path)
 	}
 
+	// 負の値はプールを作れない（0 はデフォルト）
+	if Global.Storage.NAS.PoolSize < 0 {
+		return fmt.Errorf("storage.nas.pool_size must not be negative: %d", Global.Storage.NAS.PoolSize)
+	}
+	if Global.Storage.NAS.PoolIdleTimeout < 0 {
+		return fmt.Errorf("storage.nas.pool_idle_timeout must not be negative: %d", Global.Storage.NAS.PoolIdleTimeout)
+	}
+
 	// 空の場合のデフォルト補完
 	if Global.Storage.Type == "" {
 		Global.Storage.Type = "local"
 	}
+	if Global.Storage.Mirror.RepairInterval == 0 {
+		Global.Storage.Mirror.RepairInterval = 600
+	}
+	if Global.Trash.RetentionDays == 0 {
+		Global.Trash.RetentionDays = 30
+	}
+	if Global.Trash.PurgeInterval <= 0 {
+		Global.Trash.PurgeInterval = 3600
+	}
+	if Global.Versions.Keep == 0 {
+		Global.Versions.Keep = 10
+	}
+	if Global.Zip.MaxBytes <= 0 {
+		Global.Zip.MaxBytes = 20 << 30
+	}
+	if Global.Zip.MaxFiles <= 0 {
+		Global.Zip.MaxFiles = 5000
+	}
+	if Global.Backup.Dir == "" {
+		Global.Backup.Dir = "./backups"
+	}
+	if Global.Backup.FullEvery == 0 {
+		Global.Backup.FullEvery = 7
+	}
+	if Global.Temp.TTLHours <= 0 {
+		Global.Temp.TTLHours = 24
+	}
+	if Global.Temp.ProgressTTL <= 0 {
+		Global.Temp.ProgressTTL = 3600
+	}
+	if Global.Temp.JanitorInterval <= 0 {
+		Global.Temp.JanitorInterval = 1800
+	}
+	if Global.Temp.MinFreeMB == 0 {
+		Global.Temp.MinFreeMB = 1024
+	}
+	if Global.Encode.Workers <= 0 {
+		Global.Encode.Workers = 2
+	}
+	if Global.Encode.MaxAttempts <= 0 {
+		Global.Encode.MaxAttempts = 3
+	}
+	if Global.Encode.RetryDelay <= 0 {
+		Global.Encode.RetryDelay = 30
+	}
 	if Global.Storage.Local.BaseDir == "" {
 		Global.Storage.Local.BaseDir = "./uploads"
 	}
@@ -153,6 +286,15 @@ func Load(path string) error {
 	if clientSecret := os.Getenv("DISCORD_CLIENT_SECRET"); clientSecret != "" {
 		Global.Discord.ClientSecret = clientSecret
 	}
+	if mk := os.Getenv("HIDEME_MASTER_KEY"); mk != "" {
+		Global.Storage.Encryption.Key = mk
+	}
+	if ak := os.Getenv("S3_ACCESS_KEY"); ak != "" {
+		Global.Storage.S3.AccessKey = ak
+	}
+	if sk := os.Getenv("S3_SECRET_KEY"); sk != "" {
+		Global.Storage.S3.SecretKey = sk
+	}
 
 	return nil
 }
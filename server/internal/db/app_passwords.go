@@ -0,0 +1,86 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrAppPasswordNotFound = errors.New("app password not found")
+
+// AppPassword は WebDAV クライアントなど用のアプリパスワード（ハッシュは返さない）
+type AppPassword struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func CreateAppPassword(db *sql.DB, userID, name, tokenHash string) (AppPassword, error) {
+	p := AppPassword{ID: uuid.NewString(), Name: name, CreatedAt: time.Now().UTC()}
+	_, err := db.Exec(
+		`INSERT INTO app_passwords (id, user_id, name, token_hash, created_at) VALUES (?, ?, ?, ?, ?)`,
+		p.ID, userID, name, tokenHash, p.CreatedAt,
+	)
+	return p, err
+}
+
+// ListAppPasswords はユーザーのアプリパスワードを新しい順に返す
+func ListAppPasswords(db *sql.DB, userID string) ([]AppPassword, error) {
+	rows, err := db.Query(
+		`SELECT id, name, created_at, last_used_at FROM app_passwords WHERE user_id = ? ORDER BY created_at DESC`, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []AppPassword{}
+	for rows.Next() {
+		var p AppPassword
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		items = append(items, p)
+	}
+	return items, rows.Err()
+}
+
+// DeleteAppPassword はユーザー本人のアプリパスワードを取り消す
+func DeleteAppPassword(db *sql.DB, id, userID string) error {
+	res, err := db.Exec(`DELETE FROM app_passwords WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAppPasswordNotFound
+	}
+	return nil
+}
+
+// GetAppPasswordMember はアプリパスワードのハッシュから持ち主を返し、最終使用日時を更新する
+func GetAppPasswordMember(db *sql.DB, tokenHash string) (Member, error) {
+	var userID string
+	err := db.QueryRow(`SELECT user_id FROM app_passwords WHERE token_hash = ?`, tokenHash).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Member{}, ErrAppPasswordNotFound
+	}
+	if err != nil {
+		return Member{}, err
+	}
+	m, err := GetMember(db, userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return Member{}, ErrAppPasswordNotFound // 持ち主のアカウントが消えた
+	}
+	if err != nil {
+		return Member{}, err
+	}
+	_, _ = db.Exec(`UPDATE app_passwords SET last_used_at = ? WHERE token_hash = ?`, time.Now().UTC(), tokenHash)
+	return m, nil
+}
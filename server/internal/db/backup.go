@@ -0,0 +1,15 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SnapshotTo は稼働中の DB の一貫したコピーを path に書き出す（VACUUM INTO。WAL の内容も含まれる）。
+// path に既にファイルがあるとエラーになる。
+func SnapshotTo(db *sql.DB, path string) error {
+	if _, err := db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return fmt.Errorf("snapshot db: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// BlobIndex は重複排除したブロブの参照数を blobs テーブルで管理する。
+// storage.BlobIndex を満たす。
+type BlobIndex struct {
+	DB *sql.DB
+}
+
+func (b BlobIndex) AcquireBlob(backend, key string) (bool, error) {
+	res, err := b.DB.Exec(`UPDATE blobs SET refs = refs + 1 WHERE backend = ? AND key = ?`, backend, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (b BlobIndex) RegisterBlob(backend, key, sha256 string, size int64) error {
+	// 同じ内容が同時にアップロードされた場合は後から来た方が参照数を足す
+	_, err := b.DB.Exec(
+		`INSERT INTO blobs (backend, key, sha256, size, refs) VALUES (?, ?, ?, ?, 1)
+		 ON CONFLICT(backend, key) DO UPDATE SET refs = refs + 1`,
+		backend, key, sha256, size,
+	)
+	return err
+}
+
+func (b BlobIndex) ReleaseBlob(backend, key string) (int, bool, error) {
+	tx, err := b.DB.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var refs int
+	err = tx.QueryRow(
+		`UPDATE blobs SET refs = refs - 1 WHERE backend = ? AND key = ? RETURNING refs`,
+		backend, key,
+	).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if refs <= 0 {
+		if _, err := tx.Exec(`DELETE FROM blobs WHERE backend = ? AND key = ?`, backend, key); err != nil {
+			return 0, false, err
+		}
+		refs = 0
+	}
+	return refs, true, tx.Commit()
+}
+
+// DedupStats は重複排除の効果（統計画面用）
+type DedupStats struct {
+	Blobs      int   `json:"blobs"`
+	References int   `json:"references"`
+	StoredB    int64 `json:"stored_bytes"`
+	SavedB     int64 `json:"saved_bytes"`
+}
+
+func GetDedupStats(db *sql.DB) (DedupStats, error) {
+	var s DedupStats
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(refs), 0), COALESCE(SUM(size), 0), COALESCE(SUM((refs - 1) * size), 0)
+		FROM blobs
+	`).Scan(&s.Blobs, &s.References, &s.StoredB, &s.SavedB)
+	return s, err
+}
+
+// MoveBlob はブロブの台帳を別のバックエンドへ付け替える（NAS → ローカル移行用）。
+// 移行先に同じブロブが既にあれば参照数を合算する。
+func MoveBlob(db *sql.DB, fromBackend, toBackend, key string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE blobs SET refs = refs + (SELECT refs FROM blobs WHERE backend = ? AND key = ?)
+		 WHERE backend = ? AND key = ? AND EXISTS (SELECT 1 FROM blobs WHERE backend = ? AND key = ?)`,
+		fromBackend, key, toBackend, key, fromBackend, key,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		_, err = tx.Exec(`DELETE FROM blobs WHERE backend = ? AND key = ?`, fromBackend, key)
+	} else {
+		_, err = tx.Exec(`UPDATE blobs SET backend = ? WHERE backend = ? AND key = ?`, toBackend, fromBackend, key)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -34,7 +34,7 @@ func CreateCollection(db *sql.DB, name, description, color, icon, imageURL, genr
 func GetCollectionByID(db *sql.DB, id string) (Collection, error) {
 	var c Collection
 	err := db.QueryRow(
-		`SELECT id, name, description, color, icon, COALESCE(image_url,''), COALESCE(genre,'') FROM collections WHERE id = ?`, id,
+		`SELECT id, name, description, color, icon, COALESCE(image_url,''), COALESCE(genre,'') FROM collections WHERE id = ? AND deleted_at IS NULL`, id,
 	).Scan(&c.ID, &c.Name, &c.Description, &c.Color, &c.Icon, &c.ImageURL, &c.Genre)
 	if errors.Is(err, sql.ErrNoRows) {
 		return Collection{}, ErrCollectionNotFound
@@ -43,7 +43,7 @@ func GetCollectionByID(db *sql.DB, id string) (Collection, error) {
 }
 
 func ListCollections(db *sql.DB) ([]Collection, error) {
-	rows, err := db.Query(`SELECT id, name, description, color, icon, COALESCE(image_url,''), COALESCE(genre,'') FROM collections`)
+	rows, err := db.Query(`SELECT id, name, description, color, icon, COALESCE(image_url,''), COALESCE(genre,'') FROM collections WHERE deleted_at IS NULL`)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +69,11 @@ func UpdateCollection(db *sql.DB, id, name, description, color, icon, imageURL,
 }
 
 func DeleteCollection(db *sql.DB, id string) error {
+	if _, err := db.Exec(
+		`DELETE FROM file_versions WHERE file_id IN (SELECT id FROM collection_files WHERE collection_id = ?)`, id,
+	); err != nil {
+		return err
+	}
 	_, err := db.Exec(`DELETE FROM collections WHERE id = ?`, id)
 	return err
 }
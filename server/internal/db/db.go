@@ -125,6 +125,147 @@ func migrate(db *sql.DB) error {
 			uploaded_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
 		);
 
+		CREATE TABLE IF NOT EXISTS nas_host_keys (
+			host        TEXT PRIMARY KEY,
+			key_type    TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			pinned_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS blobs (
+			backend    TEXT NOT NULL,
+			key        TEXT NOT NULL,
+			sha256     TEXT NOT NULL,
+			size       INTEGER NOT NULL DEFAULT 0,
+			refs       INTEGER NOT NULL DEFAULT 1,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (backend, key)
+		);
+
+		CREATE TABLE IF NOT EXISTS storage_quotas (
+			scope      TEXT NOT NULL, -- 'user' / 'role' / 'collection'
+			target     TEXT NOT NULL, -- ユーザー ID / ロール名 / コレクション ID
+			max_bytes  INTEGER NOT NULL,
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (scope, target)
+		);
+
+		CREATE TABLE IF NOT EXISTS file_replicas (
+			name       TEXT NOT NULL, -- ミラー上の保存キー
+			replica    TEXT NOT NULL, -- 'local' / 'nas' / 's3'
+			state      TEXT NOT NULL, -- 'ok' / 'missing'
+			error      TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (name, replica)
+		);
+
+		CREATE TABLE IF NOT EXISTS storage_migrations (
+			id            TEXT PRIMARY KEY,
+			source        TEXT NOT NULL, -- 'local' / 'nas' / 's3' / 'mirror'
+			target        TEXT NOT NULL,
+			collection_id TEXT NOT NULL DEFAULT '', -- '' = 全コレクション
+			delete_source INTEGER NOT NULL DEFAULT 0,
+			status        TEXT NOT NULL, -- 'running' / 'paused' / 'canceled' / 'done' / 'error'
+			error         TEXT NOT NULL DEFAULT '',
+			created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS storage_migration_items (
+			migration_id TEXT NOT NULL REFERENCES storage_migrations(id) ON DELETE CASCADE,
+			name         TEXT NOT NULL, -- 保存キー
+			kind         TEXT NOT NULL, -- 'file' / 'icon'
+			thumbnail    TEXT NOT NULL DEFAULT '', -- 本体と一緒に移すサムネイルのキー
+			size         INTEGER NOT NULL DEFAULT 0,
+			status       TEXT NOT NULL DEFAULT 'pending', -- 'pending' / 'done' / 'failed'
+			checksum     TEXT NOT NULL DEFAULT '', -- 検証済みの SHA-256
+			error        TEXT NOT NULL DEFAULT '',
+			updated_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (migration_id, name)
+		);
+
+		CREATE TABLE IF NOT EXISTS storage_findings (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind        TEXT NOT NULL, -- 'orphan'（DB に無いファイル） / 'dangling'（実体の無い DB の参照）
+			backend     TEXT NOT NULL, -- orphan: 見つかったバックエンド / dangling: 参照先のバックエンド
+			name        TEXT NOT NULL, -- 保存キー
+			size        INTEGER NOT NULL DEFAULT 0,
+			file_id     TEXT NOT NULL DEFAULT '', -- dangling: collection_files.id または collections.id
+			ref_column  TEXT NOT NULL DEFAULT '', -- dangling: 'file_name' / 'thumbnail_name' / 'image_url'
+			found_in    TEXT NOT NULL DEFAULT '', -- dangling: 同じキーが見つかった別のバックエンド
+			status      TEXT NOT NULL DEFAULT 'open', -- 'open' / 'quarantined' / 'deleted' / 'relinked'
+			detail      TEXT NOT NULL DEFAULT '',
+			detected_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			resolved_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS file_versions (
+			file_id        TEXT NOT NULL REFERENCES collection_files(id) ON DELETE CASCADE,
+			version        INTEGER NOT NULL, -- 古い内容から順に 1, 2, ...（現在の内容は collection_files 側）
+			file_name      TEXT NOT NULL,    -- 保存キー
+			original_name  TEXT NOT NULL DEFAULT '',
+			file_size      INTEGER NOT NULL DEFAULT 0,
+			thumbnail_name TEXT NOT NULL DEFAULT '', -- 置き換え時にサムネイルも差し替えた場合だけ
+			storage_type   TEXT NOT NULL DEFAULT 'nas',
+			uploaded_by    TEXT NOT NULL DEFAULT '',
+			uploaded_at    DATETIME NOT NULL,
+			replaced_by    TEXT NOT NULL DEFAULT '',
+			replaced_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (file_id, version)
+		);
+
+		CREATE TABLE IF NOT EXISTS app_passwords (
+			id           TEXT PRIMARY KEY,
+			user_id      TEXT NOT NULL, -- users.id または discord_users.id
+			name         TEXT NOT NULL, -- 例: "rclone (自宅 PC)"
+			token_hash   TEXT NOT NULL UNIQUE, -- SHA-256（平文は作成時に一度だけ返す）
+			created_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_used_at DATETIME
+		);
+
+		CREATE TABLE IF NOT EXISTS upload_sessions (
+			id            TEXT PRIMARY KEY,
+			user_id       TEXT NOT NULL,
+			collection_id TEXT NOT NULL,
+			file_name     TEXT NOT NULL,
+			file_size     INTEGER NOT NULL,
+			chunk_size    INTEGER NOT NULL,
+			total_chunks  INTEGER NOT NULL,
+			sha256        TEXT NOT NULL DEFAULT '', -- 申告された全体の SHA-256（hex。空なら結合時に検証しない）
+			status        TEXT NOT NULL DEFAULT 'open', -- 'open'（チャンク受付中） / 'merging'（結合・処理中）
+			created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			updated_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS encode_jobs (
+			id            TEXT PRIMARY KEY, -- upload ID（進捗はこの ID で流れる）
+			owner_id      TEXT NOT NULL,    -- アップロードしたユーザー（ジョブを見る・取り消せる）
+			uploaded_by   TEXT NOT NULL,    -- ファイルを記録するユーザー
+			username      TEXT NOT NULL DEFAULT '', -- アクティビティに出す名前（空なら記録しない）
+			avatar        TEXT NOT NULL DEFAULT '',
+			collection_id TEXT NOT NULL,
+			storage_type  TEXT NOT NULL,
+			file_name     TEXT NOT NULL,    -- 元のファイル名
+			input_path    TEXT NOT NULL,    -- エンコード前の一時ファイル（ジョブが終わったら消す）
+			quota_key     TEXT NOT NULL DEFAULT '',
+			trim_start    REAL NOT NULL DEFAULT 0,
+			trim_end      REAL NOT NULL DEFAULT 0,
+			volume        INTEGER NOT NULL DEFAULT 100,
+			resolution    TEXT NOT NULL DEFAULT '720p',
+			fps           INTEGER NOT NULL DEFAULT 30,
+			priority      INTEGER NOT NULL DEFAULT 0, -- 大きいほど先に処理する
+			status        TEXT NOT NULL DEFAULT 'queued', -- 'queued' / 'running' / 'done' / 'failed' / 'cancelled'
+			attempts      INTEGER NOT NULL DEFAULT 0,
+			max_attempts  INTEGER NOT NULL DEFAULT 3,
+			next_run_at   DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP, -- 再試行の待ち時間が明けるまで取り出さない
+			error         TEXT NOT NULL DEFAULT '',
+			file_id       TEXT NOT NULL DEFAULT '', -- 成功したら collection_files.id
+			created_at    DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			started_at    DATETIME,
+			finished_at   DATETIME
+		);
+		CREATE INDEX IF NOT EXISTS idx_encode_jobs_queue ON encode_jobs (status, priority DESC, created_at);
+
 		CREATE TABLE IF NOT EXISTS activity_log (
 			id         TEXT PRIMARY KEY,
 			type       TEXT NOT NULL,
@@ -148,7 +289,14 @@ func migrate(db *sql.DB) error {
 		`ALTER TABLE collection_files ADD COLUMN display_name TEXT`,
 		`ALTER TABLE collections ADD COLUMN genre TEXT NOT NULL DEFAULT ''`,
 		`ALTER TABLE users ADD COLUMN last_seen_at DATETIME`,
+		`ALTER TABLE collection_files ADD COLUMN original_name TEXT`,
 		`ALTER TABLE discord_users ADD COLUMN last_seen_at DATETIME`,
+		`ALTER TABLE collection_files ADD COLUMN deleted_at DATETIME`, // ゴミ箱（NULL 以外は削除済み）
+		`ALTER TABLE collection_files ADD COLUMN deleted_by TEXT`,
+		`ALTER TABLE collections ADD COLUMN deleted_at DATETIME`,
+		`ALTER TABLE collections ADD COLUMN deleted_by TEXT`,
+		`ALTER TABLE collection_files ADD COLUMN replaced_at DATETIME`, // 内容を置き換えた日時（NULL なら uploaded_at のまま）
+		`ALTER TABLE collections ADD COLUMN max_versions INTEGER`,      // 残す旧バージョン数（NULL なら設定の既定値）
 	} {
 		if _, err := db.Exec(ddl); err != nil {
 			if !isDuplicateColumn(err) {
@@ -157,6 +305,11 @@ func migrate(db *sql.DB) error {
 		}
 	}
 
+	// 保存キー導入前の行は file_name がそのまま元のファイル名
+	if _, err := db.Exec(`UPDATE collection_files SET original_name = file_name WHERE original_name IS NULL`); err != nil {
+		return fmt.Errorf("backfill original_name: %w", err)
+	}
+
 	// ③ uploaded_by の外部キー制約を除去する
 	//    旧スキーマは uploaded_by TEXT REFERENCES users(id) だったが、
 	//    Discord ユーザーは discord_users テーブルにあるため INSERT 時に
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrEncodeJobNotFound = errors.New("encode job not found")
+	// ErrEncodeJobState はジョブが操作できる状態に無い場合のエラー（取り消し済み・処理中など）
+	ErrEncodeJobState = errors.New("encode job is not in a state that allows this")
+)
+
+const (
+	EncodeJobQueued    = "queued"
+	EncodeJobRunning   = "running"
+	EncodeJobDone      = "done"
+	EncodeJobFailed    = "failed"
+	EncodeJobCancelled = "cancelled"
+)
+
+// EncodeJob は動画のエンコード → 保存 → DB 記録のジョブ 1 件
+type EncodeJob struct {
+	ID           string     `json:"id"`
+	OwnerID      string     `json:"owner_id"`
+	UploadedBy   string     `json:"uploaded_by"`
+	Username     string     `json:"-"`
+	Avatar       string     `json:"-"`
+	CollectionID string     `json:"collection_id"`
+	StorageType  string     `json:"storage_type"`
+	FileName     string     `json:"file_name"`
+	InputPath    string     `json:"-"`
+	QuotaKey     string     `json:"-"`
+	TrimStart    float64    `json:"trim_start"`
+	TrimEnd      float64    `json:"trim_end"`
+	Volume       int        `json:"volume"`
+	Resolution   string     `json:"resolution"`
+	FPS          int        `json:"fps"`
+	Priority     int        `json:"priority"`
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	MaxAttempts  int        `json:"max_attempts"`
+	NextRunAt    time.Time  `json:"next_run_at"`
+	Error        string     `json:"error,omitempty"`
+	FileID       string     `json:"file_id,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+const encodeJobColumns = `id, owner_id, uploaded_by, username, avatar, collection_id, storage_type, file_name, input_path, quota_key,
+	trim_start, trim_end, volume, resolution, fps, priority, status, attempts, max_attempts, next_run_at, error, file_id,
+	created_at, started_at, finished_at`
+
+func scanEncodeJob(row interface{ Scan(...any) error }) (EncodeJob, error) {
+	var j EncodeJob
+	var started, finished sql.NullTime
+	err := row.Scan(&j.ID, &j.OwnerID, &j.UploadedBy, &j.Username, &j.Avatar, &j.CollectionID, &j.StorageType, &j.FileName, &j.InputPath, &j.QuotaKey,
+		&j.TrimStart, &j.TrimEnd, &j.Volume, &j.Resolution, &j.FPS, &j.Priority, &j.Status, &j.Attempts, &j.MaxAttempts, &j.NextRunAt, &j.Error, &j.FileID,
+		&j.CreatedAt, &started, &finished)
+	if started.Valid {
+		j.StartedAt = &started.Time
+	}
+	if finished.Valid {
+		j.FinishedAt = &finished.Time
+	}
+	return j, err
+}
+
+func CreateEncodeJob(db *sql.DB, j EncodeJob) (EncodeJob, error) {
+	now := time.Now().UTC()
+	j.Status, j.Attempts, j.NextRunAt, j.CreatedAt = EncodeJobQueued, 0, now, now
+	_, err := db.Exec(
+		`INSERT INTO encode_jobs (id, owner_id, uploaded_by, username, avatar, collection_id, storage_type, file_name, input_path, quota_key,
+			trim_start, trim_end, volume, resolution, fps, priority, status, attempts, max_attempts, next_run_at, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		j.ID, j.OwnerID, j.UploadedBy, j.Username, j.Avatar, j.CollectionID, j.StorageType, j.FileName, j.InputPath, j.QuotaKey,
+		j.TrimStart, j.TrimEnd, j.Volume, j.Resolution, j.FPS, j.Priority, j.Status, j.Attempts, j.MaxAttempts, j.NextRunAt, j.CreatedAt,
+	)
+	return j, err
+}
+
+func GetEncodeJob(db *sql.DB, id string) (EncodeJob, error) {
+	j, err := scanEncodeJob(db.QueryRow(`SELECT `+encodeJobColumns+` FROM encode_jobs WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return EncodeJob{}, ErrEncodeJobNotFound
+	}
+	return j, err
+}
+
+// ListEncodeJobs は新しい順にジョブを返す。ownerID・status が空でなければそれで絞り込む。
+func ListEncodeJobs(db *sql.DB, ownerID, status string, limit int) ([]EncodeJob, error) {
+	query := `SELECT ` + encodeJobColumns + ` FROM encode_jobs WHERE 1 = 1`
+	var args []any
+	if ownerID != "" {
+		query += ` AND owner_id = ?`
+		args = append(args, ownerID)
+	}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []EncodeJob{}
+	for rows.Next() {
+		j, err := scanEncodeJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// ListEncodeJobsByStatus は status のジョブを古い順に返す（起動時の復旧用）
+func ListEncodeJobsByStatus(db *sql.DB, status string) ([]EncodeJob, error) {
+	rows, err := db.Query(`SELECT `+encodeJobColumns+` FROM encode_jobs WHERE status = ? ORDER BY created_at`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []EncodeJob
+	for rows.Next() {
+		j, err := scanEncodeJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// RequeueRunningEncodeJobs は処理中のまま止まったジョブ（再起動前に動いていたもの）を待ちに戻し、その数を返す
+func RequeueRunningEncodeJobs(db *sql.DB) (int, error) {
+	res, err := db.Exec(`UPDATE encode_jobs SET status = ?, started_at = NULL WHERE status = ?`, EncodeJobQueued, EncodeJobRunning)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// ClaimNextEncodeJob は待ち時間が明けたジョブを優先度の高い順・古い順に 1 件取り出して処理中にする。
+// 無ければ ErrEncodeJobNotFound。
+func ClaimNextEncodeJob(db *sql.DB) (EncodeJob, error) {
+	for {
+		var id string
+		err := db.QueryRow(
+			`SELECT id FROM encode_jobs WHERE status = ? AND next_run_at <= ? ORDER BY priority DESC, created_at LIMIT 1`,
+			EncodeJobQueued, time.Now().UTC(),
+		).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return EncodeJob{}, ErrEncodeJobNotFound
+		}
+		if err != nil {
+			return EncodeJob{}, err
+		}
+		now := time.Now().UTC()
+		res, err := db.Exec(
+			`UPDATE encode_jobs SET status = ?, attempts = attempts + 1, started_at = ? WHERE id = ? AND status = ?`,
+			EncodeJobRunning, now, id, EncodeJobQueued,
+		)
+		if err != nil {
+			return EncodeJob{}, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue // 他のワーカーが先に取った・取り消された
+		}
+		return GetEncodeJob(db, id)
+	}
+}
+
+// RetryEncodeJob は失敗したジョブを at まで待たせてから待ちに戻す
+func RetryEncodeJob(db *sql.DB, id, errMsg string, at time.Time) error {
+	_, err := db.Exec(
+		`UPDATE encode_jobs SET status = ?, error = ?, next_run_at = ? WHERE id = ? AND status = ?`,
+		EncodeJobQueued, errMsg, at.UTC(), id, EncodeJobRunning,
+	)
+	return err
+}
+
+// FinishEncodeJob は処理中のジョブを done / failed で終える
+func FinishEncodeJob(db *sql.DB, id, status, errMsg, fileID string) error {
+	_, err := db.Exec(
+		`UPDATE encode_jobs SET status = ?, error = ?, file_id = ?, finished_at = ? WHERE id = ? AND status = ?`,
+		status, errMsg, fileID, time.Now().UTC(), id, EncodeJobRunning,
+	)
+	return err
+}
+
+// CancelQueuedEncodeJob は待ちのジョブを取り消す（処理中・終了済みなら ErrEncodeJobState）
+func CancelQueuedEncodeJob(db *sql.DB, id string) error {
+	res, err := db.Exec(
+		`UPDATE encode_jobs SET status = ?, finished_at = ? WHERE id = ? AND status = ?`,
+		EncodeJobCancelled, time.Now().UTC(), id, EncodeJobQueued,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := GetEncodeJob(db, id); err != nil {
+			return err
+		}
+		return ErrEncodeJobState
+	}
+	return nil
+}
+
+// SetEncodeJobPriority は待ちのジョブの優先度を変える
+func SetEncodeJobPriority(db *sql.DB, id string, priority int) error {
+	res, err := db.Exec(`UPDATE encode_jobs SET priority = ? WHERE id = ? AND status = ?`, priority, id, EncodeJobQueued)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := GetEncodeJob(db, id); err != nil {
+			return err
+		}
+		return ErrEncodeJobState
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrVersionNotFound = errors.New("file version not found")
+
+// FileVersion は置き換える前の内容 1 件。保存キー（とサムネイル）はこの行が持つ。
+type FileVersion struct {
+	FileID        string    `json:"file_id"`
+	Version       int       `json:"version"`
+	FileName      string    `json:"file_name"`
+	OriginalName  string    `json:"original_name"`
+	FileSize      int64     `json:"file_size"`
+	ThumbnailName string    `json:"thumbnail_name,omitempty"`
+	StorageType   string    `json:"storage_type"`
+	UploadedBy    string    `json:"uploaded_by"`
+	UploadedAt    time.Time `json:"uploaded_at"`
+	ReplacedBy    string    `json:"replaced_by"`
+	ReplacedAt    time.Time `json:"replaced_at"`
+}
+
+// FileContents は collection_files の 1 行が指す内容（置き換え・復元用）
+type FileContents struct {
+	FileName      string
+	OriginalName  string
+	FileSize      int64
+	ThumbnailName string // "" なら現在のサムネイルをそのまま使う
+	StorageType   string
+	UploadedBy    string
+}
+
+// ReplaceFileContents は現在の内容を旧バージョンとして残し、行を新しい内容に差し替える。
+// ID・表示名・視聴回数などはそのまま。新しいサムネイルを指定しなかった場合、現在のサムネイルは行に残る。
+func ReplaceFileContents(db *sql.DB, fileID string, next FileContents, replacedBy string) (FileVersion, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return FileVersion{}, err
+	}
+	defer tx.Rollback()
+
+	v, err := archiveCurrent(tx, fileID, next.ThumbnailName != "", replacedBy)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if err := setContents(tx, fileID, next); err != nil {
+		return FileVersion{}, err
+	}
+	return v, tx.Commit()
+}
+
+// RestoreFileVersion は旧バージョンを現在の内容に戻す。現在の内容は新しい旧バージョンとして残る。
+func RestoreFileVersion(db *sql.DB, fileID string, version int, restoredBy string) (FileVersion, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return FileVersion{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanFileVersion(tx.QueryRow(
+		`SELECT `+fileVersionColumns+` FROM file_versions WHERE file_id = ? AND version = ?`, fileID, version,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return FileVersion{}, ErrVersionNotFound
+	}
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM file_versions WHERE file_id = ? AND version = ?`, fileID, version); err != nil {
+		return FileVersion{}, err
+	}
+	archived, err := archiveCurrent(tx, fileID, old.ThumbnailName != "", restoredBy)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if err := setContents(tx, fileID, FileContents{
+		FileName:      old.FileName,
+		OriginalName:  old.OriginalName,
+		FileSize:      old.FileSize,
+		ThumbnailName: old.ThumbnailName,
+		StorageType:   old.StorageType,
+		UploadedBy:    old.UploadedBy,
+	}); err != nil {
+		return FileVersion{}, err
+	}
+	return archived, tx.Commit()
+}
+
+// archiveCurrent は行の現在の内容を次の番号の旧バージョンとして保存する。
+// withThumbnail の場合はサムネイルも旧バージョン側に移す。
+func archiveCurrent(tx *sql.Tx, fileID string, withThumbnail bool, replacedBy string) (FileVersion, error) {
+	v := FileVersion{FileID: fileID, ReplacedBy: replacedBy, ReplacedAt: time.Now().UTC()}
+	var thumb string
+	var replacedAt sql.NullTime
+	err := tx.QueryRow(
+		`SELECT file_name, COALESCE(original_name,''), COALESCE(file_size,0), COALESCE(thumbnail_name,''),
+		        COALESCE(storage_type,'nas'), COALESCE(uploaded_by,''), uploaded_at, replaced_at,
+		        (SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = ?)
+		 FROM collection_files WHERE id = ?`, fileID, fileID,
+	).Scan(&v.FileName, &v.OriginalName, &v.FileSize, &thumb, &v.StorageType, &v.UploadedBy, &v.UploadedAt, &replacedAt, &v.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FileVersion{}, ErrFileNotFound
+	}
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if replacedAt.Valid {
+		v.UploadedAt = replacedAt.Time // 前回置き換えたときにアップロードされた内容
+	}
+	if withThumbnail {
+		v.ThumbnailName = thumb
+	}
+	_, err = tx.Exec(
+		`INSERT INTO file_versions (file_id, version, file_name, original_name, file_size, thumbnail_name,
+		                            storage_type, uploaded_by, uploaded_at, replaced_by, replaced_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		v.FileID, v.Version, v.FileName, v.OriginalName, v.FileSize, v.ThumbnailName,
+		v.StorageType, v.UploadedBy, v.UploadedAt, v.ReplacedBy, v.ReplacedAt,
+	)
+	return v, err
+}
+
+func setContents(tx *sql.Tx, fileID string, c FileContents) error {
+	_, err := tx.Exec(
+		`UPDATE collection_files
+		 SET file_name = ?, original_name = ?, file_size = ?, storage_type = ?, uploaded_by = ?, replaced_at = ?,
+		     thumbnail_name = CASE WHEN ? != '' THEN ? ELSE thumbnail_name END
+		 WHERE id = ?`,
+		c.FileName, c.OriginalName, c.FileSize, c.StorageType, c.UploadedBy, time.Now().UTC(),
+		c.ThumbnailName, c.ThumbnailName, fileID,
+	)
+	return err
+}
+
+const fileVersionColumns = `file_id, version, file_name, original_name, file_size, thumbnail_name,
+	storage_type, uploaded_by, uploaded_at, replaced_by, replaced_at`
+
+func scanFileVersion(row interface{ Scan(...any) error }) (FileVersion, error) {
+	var v FileVersion
+	err := row.Scan(&v.FileID, &v.Version, &v.FileName, &v.OriginalName, &v.FileSize, &v.ThumbnailName,
+		&v.StorageType, &v.UploadedBy, &v.UploadedAt, &v.ReplacedBy, &v.ReplacedAt)
+	return v, err
+}
+
+// ListFileVersions はファイルの旧バージョンを新しい順に返す
+func ListFileVersions(db *sql.DB, fileID string) ([]FileVersion, error) {
+	rows, err := db.Query(
+		`SELECT `+fileVersionColumns+` FROM file_versions WHERE file_id = ? ORDER BY version DESC`, fileID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []FileVersion{}
+	for rows.Next() {
+		v, err := scanFileVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func GetFileVersion(db *sql.DB, fileID string, version int) (FileVersion, error) {
+	v, err := scanFileVersion(db.QueryRow(
+		`SELECT `+fileVersionColumns+` FROM file_versions WHERE file_id = ? AND version = ?`, fileID, version,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return FileVersion{}, ErrVersionNotFound
+	}
+	return v, err
+}
+
+// PruneFileVersions は新しい keep 件を残して古い旧バージョンを DB から消し、消したものを返す
+// （保存キーの実体は呼び出し側で消す）
+func PruneFileVersions(db *sql.DB, fileID string, keep int) ([]FileVersion, error) {
+	rows, err := db.Query(
+		`SELECT `+fileVersionColumns+` FROM file_versions WHERE file_id = ?
+		 ORDER BY version DESC LIMIT -1 OFFSET ?`, fileID, keep,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []FileVersion
+	for rows.Next() {
+		v, err := scanFileVersion(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pruned = append(pruned, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, v := range pruned {
+		if _, err := db.Exec(`DELETE FROM file_versions WHERE file_id = ? AND version = ?`, v.FileID, v.Version); err != nil {
+			return nil, err
+		}
+	}
+	return pruned, nil
+}
+
+// CollectionVersionRetention はコレクションに設定された旧バージョンの保持数を返す（未設定なら ok = false）
+func CollectionVersionRetention(db *sql.DB, collectionID string) (int, bool, error) {
+	var keep sql.NullInt64
+	err := db.QueryRow(`SELECT max_versions FROM collections WHERE id = ?`, collectionID).Scan(&keep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, ErrCollectionNotFound
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return int(keep.Int64), keep.Valid, nil
+}
+
+// SetCollectionVersionRetention はコレクションの旧バージョンの保持数を設定する（nil で既定値に戻す）
+func SetCollectionVersionRetention(db *sql.DB, collectionID string, keep *int) error {
+	res, err := db.Exec(`UPDATE collections SET max_versions = ? WHERE id = ? AND deleted_at IS NULL`, keep, collectionID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCollectionNotFound
+	}
+	return nil
+}
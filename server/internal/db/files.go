@@ -11,7 +11,8 @@ import (
 type CollectionFile struct {
 	ID            string    `json:"id"`
 	CollectionID  string    `json:"collection_id"`
-	FileName      string    `json:"file_name"`
+	FileName      string    `json:"file_name"`     // ストレージ上の保存キー
+	OriginalName  string    `json:"original_name"` // アップロード時のファイル名
 	FileSize      int64     `json:"file_size"`
 	ThumbnailName string    `json:"thumbnail_name"`
 	StorageType   string    `json:"storage_type"` // "nas" or "local"
@@ -24,7 +25,8 @@ type CollectionFileWithUploader struct {
 	ID             string    `json:"id"`
 	CollectionID   string    `json:"collection_id"`
 	FileName       string    `json:"file_name"`
-	DisplayName    string    `json:"display_name"`
+	OriginalName   string    `json:"original_name"`
+	DisplayName    string    `json:"display_name"` // 未設定なら original_name
 	FileSize       int64     `json:"file_size"`
 	ThumbnailName  string    `json:"thumbnail_name"`
 	StorageType    string    `json:"storage_type"` // "nas" or "local"
@@ -37,14 +39,28 @@ type CollectionFileWithUploader struct {
 
 var ErrFileNotFound = errors.New("file not found")
 
-func AddFileToCollection(db *sql.DB, collectionID, fileName, thumbnailName, storageType string, fileSize int64, uploadedBy string) (CollectionFile, error) {
+// notTrashed は collection_files（別名 cf）のうちゴミ箱に入っていない行の条件。
+// コレクションごとゴミ箱に入れた場合、中のファイルの行には印を付けない。
+const notTrashed = `cf.deleted_at IS NULL AND NOT EXISTS (
+	SELECT 1 FROM collections tc WHERE tc.id = cf.collection_id AND tc.deleted_at IS NOT NULL)`
+
+// Label はログやアクティビティ表示用の名前（元のファイル名、無ければ保存キー）を返す
+func (f CollectionFile) Label() string {
+	if f.OriginalName != "" {
+		return f.OriginalName
+	}
+	return f.FileName
+}
+
+// AddFileToCollection は保存キー fileName と元のファイル名 originalName を記録する
+func AddFileToCollection(db *sql.DB, collectionID, fileName, originalName, thumbnailName, storageType string, fileSize int64, uploadedBy string) (CollectionFile, error) {
 	if storageType == "" {
 		storageType = "nas"
 	}
 	id := uuid.NewString()
 	_, err := db.Exec(
-		`INSERT INTO collection_files (id, collection_id, file_name, file_size, thumbnail_name, storage_type, uploaded_by) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		id, collectionID, fileName, fileSize, thumbnailName, storageType, uploadedBy,
+		`INSERT INTO collection_files (id, collection_id, file_name, original_name, file_size, thumbnail_name, storage_type, uploaded_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, collectionID, fileName, originalName, fileSize, thumbnailName, storageType, uploadedBy,
 	)
 	if err != nil {
 		return CollectionFile{}, err
@@ -55,10 +71,10 @@ func AddFileToCollection(db *sql.DB, collectionID, fileName, thumbnailName, stor
 func GetFileByID(db *sql.DB, id string) (CollectionFile, error) {
 	var f CollectionFile
 	err := db.QueryRow(
-		`SELECT id, collection_id, file_name, file_size,
+		`SELECT id, collection_id, file_name, COALESCE(original_name,''), file_size,
 		        COALESCE(thumbnail_name,''), COALESCE(storage_type,'nas'), COALESCE(uploaded_by,''), uploaded_at
-		 FROM collection_files WHERE id = ?`, id,
-	).Scan(&f.ID, &f.CollectionID, &f.FileName, &f.FileSize, &f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt)
+		 FROM collection_files cf WHERE id = ? AND `+notTrashed, id,
+	).Scan(&f.ID, &f.CollectionID, &f.FileName, &f.OriginalName, &f.FileSize, &f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return CollectionFile{}, ErrFileNotFound
 	}
@@ -72,7 +88,8 @@ func ListFilesByCollectionWithUploader(db *sql.DB, collectionID string) ([]Colle
 			cf.id,
 			cf.collection_id,
 			cf.file_name,
-			COALESCE(cf.display_name, '')    AS display_name,
+			COALESCE(cf.original_name, '')   AS original_name,
+			COALESCE(NULLIF(cf.display_name, ''), cf.original_name, '') AS display_name,
 			cf.file_size,
 			COALESCE(cf.thumbnail_name, '')  AS thumbnail_name,
 			COALESCE(cf.storage_type, 'nas') AS storage_type,
@@ -87,7 +104,7 @@ func ListFilesByCollectionWithUploader(db *sql.DB, collectionID string) ([]Colle
 		LEFT JOIN discord_users du ON du.id = cf.uploaded_by
 		LEFT JOIN (SELECT DISTINCT user_id, username FROM activity_log WHERE type = 'upload') al
 		          ON al.user_id = cf.uploaded_by
-		WHERE cf.collection_id = ?
+		WHERE cf.collection_id = ? AND `+notTrashed+`
 		ORDER BY cf.uploaded_at DESC
 	`, collectionID)
 	if err != nil {
@@ -100,7 +117,7 @@ func ListFilesByCollectionWithUploader(db *sql.DB, collectionID string) ([]Colle
 		var f CollectionFileWithUploader
 		var discordID string
 		if err := rows.Scan(
-			&f.ID, &f.CollectionID, &f.FileName, &f.DisplayName, &f.FileSize,
+			&f.ID, &f.CollectionID, &f.FileName, &f.OriginalName, &f.DisplayName, &f.FileSize,
 			&f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt,
 			&f.UploaderName, &f.UploaderAvatar, &discordID, &f.ViewCount,
 		); err != nil {
@@ -125,8 +142,9 @@ func IncrementViewCount(db *sql.DB, fileID string) error {
 
 func ListFilesByCollection(db *sql.DB, collectionID string) ([]CollectionFile, error) {
 	rows, err := db.Query(
-		`SELECT id, collection_id, file_name, file_size, COALESCE(thumbnail_name,''), uploaded_by, uploaded_at
-		 FROM collection_files WHERE collection_id = ? ORDER BY uploaded_at DESC`,
+		`SELECT id, collection_id, file_name, COALESCE(original_name,''), file_size, COALESCE(thumbnail_name,''),
+		        COALESCE(storage_type,'nas'), COALESCE(uploaded_by,''), uploaded_at
+		 FROM collection_files cf WHERE collection_id = ? AND `+notTrashed+` ORDER BY uploaded_at DESC`,
 		collectionID,
 	)
 	if err != nil {
@@ -137,7 +155,7 @@ func ListFilesByCollection(db *sql.DB, collectionID string) ([]CollectionFile, e
 	var files []CollectionFile
 	for rows.Next() {
 		var f CollectionFile
-		if err := rows.Scan(&f.ID, &f.CollectionID, &f.FileName, &f.FileSize, &f.ThumbnailName, &f.UploadedBy, &f.UploadedAt); err != nil {
+		if err := rows.Scan(&f.ID, &f.CollectionID, &f.FileName, &f.OriginalName, &f.FileSize, &f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt); err != nil {
 			return nil, err
 		}
 		files = append(files, f)
@@ -147,8 +165,9 @@ func ListFilesByCollection(db *sql.DB, collectionID string) ([]CollectionFile, e
 
 func ListRecentFiles(db *sql.DB, limit int) ([]CollectionFile, error) {
 	rows, err := db.Query(
-		`SELECT id, collection_id, file_name, file_size, COALESCE(thumbnail_name,''), uploaded_by, uploaded_at
-		 FROM collection_files ORDER BY uploaded_at DESC LIMIT ?`,
+		`SELECT id, collection_id, file_name, COALESCE(original_name,''), file_size, COALESCE(thumbnail_name,''),
+		        COALESCE(storage_type,'nas'), COALESCE(uploaded_by,''), uploaded_at
+		 FROM collection_files cf WHERE `+notTrashed+` ORDER BY uploaded_at DESC LIMIT ?`,
 		limit,
 	)
 	if err != nil {
@@ -159,7 +178,7 @@ func ListRecentFiles(db *sql.DB, limit int) ([]CollectionFile, error) {
 	var files []CollectionFile
 	for rows.Next() {
 		var f CollectionFile
-		if err := rows.Scan(&f.ID, &f.CollectionID, &f.FileName, &f.FileSize, &f.ThumbnailName, &f.UploadedBy, &f.UploadedAt); err != nil {
+		if err := rows.Scan(&f.ID, &f.CollectionID, &f.FileName, &f.OriginalName, &f.FileSize, &f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt); err != nil {
 			return nil, err
 		}
 		files = append(files, f)
@@ -183,6 +202,10 @@ func UpdateCollectionFile(db *sql.DB, fileID, displayName, thumbnailName, collec
 }
 
 func DeleteFileFromCollection(db *sql.DB, id string) error {
+	// foreign_keys はコネクションごとの設定なので ON DELETE CASCADE に頼らない
+	if _, err := db.Exec(`DELETE FROM file_versions WHERE file_id = ?`, id); err != nil {
+		return err
+	}
 	_, err := db.Exec(`DELETE FROM collection_files WHERE id = ?`, id)
 	return err
 }
@@ -193,6 +216,7 @@ type RecentFileItem struct {
 	CollectionID   string `json:"collection_id"`
 	CollectionName string `json:"collection_name"`
 	FileName       string `json:"file_name"`
+	OriginalName   string `json:"original_name"`
 	DisplayName    string `json:"display_name"`
 	FileSize       int64  `json:"file_size"`
 	ThumbnailName  string `json:"thumbnail_name"`
@@ -207,7 +231,8 @@ type RecentFileItem struct {
 func ListAllFilesJoin(db *sql.DB) ([]RecentFileItem, error) {
 	rows, err := db.Query(`
 		SELECT cf.id, cf.collection_id, COALESCE(col.name,'') AS collection_name,
-		       cf.file_name, COALESCE(cf.display_name,'') AS display_name, cf.file_size,
+		       cf.file_name, COALESCE(cf.original_name,'') AS original_name,
+		       COALESCE(NULLIF(cf.display_name,''), cf.original_name, '') AS display_name, cf.file_size,
 		       COALESCE(cf.thumbnail_name,''),
 		       COALESCE(cf.uploaded_by,''),
 		       COALESCE(u.username, du.username, al.username, '') AS uploader_name,
@@ -223,7 +248,7 @@ func ListAllFilesJoin(db *sql.DB) ([]RecentFileItem, error) {
 		LEFT JOIN discord_users  du ON du.id  = cf.uploaded_by
 		LEFT JOIN (SELECT DISTINCT user_id, username FROM activity_log WHERE type = 'upload') al
 		          ON al.user_id = cf.uploaded_by
-		WHERE cf.collection_id IS NOT NULL AND cf.collection_id != ''
+		WHERE cf.collection_id IS NOT NULL AND cf.collection_id != '' AND ` + notTrashed + `
 		ORDER BY cf.uploaded_at DESC LIMIT 100
 	`)
 	if err != nil {
@@ -235,7 +260,7 @@ func ListAllFilesJoin(db *sql.DB) ([]RecentFileItem, error) {
 	for rows.Next() {
 		var f RecentFileItem
 		if err := rows.Scan(&f.ID, &f.CollectionID, &f.CollectionName,
-			&f.FileName, &f.DisplayName, &f.FileSize, &f.ThumbnailName,
+			&f.FileName, &f.OriginalName, &f.DisplayName, &f.FileSize, &f.ThumbnailName,
 			&f.UploadedBy, &f.UploaderName, &f.UploaderAvatar,
 			&f.UploadedAt, &f.ViewCount); err != nil {
 			return nil, err
@@ -247,3 +272,71 @@ func ListAllFilesJoin(db *sql.DB) ([]RecentFileItem, error) {
 	}
 	return files, rows.Err()
 }
+
+// KeyCollision は同じ保存キーを共有している行の集まり
+// （保存キー導入前に同名ファイルで上書きされたもの）
+type KeyCollision struct {
+	StorageType string   `json:"storage_type"`
+	Column      string   `json:"column"` // "file_name" / "thumbnail_name"
+	Key         string   `json:"key"`
+	FileIDs     []string `json:"file_ids"` // uploaded_at の新しい順
+}
+
+// FindKeyCollisions は同じストレージ上の同じキーを複数行が指しているものを返す。
+// 重複排除のブロブ（blobs にあるキー）は参照数で管理された意図的な共有なので除く。
+func FindKeyCollisions(db *sql.DB) ([]KeyCollision, error) {
+	var result []KeyCollision
+	for _, column := range []string{"file_name", "thumbnail_name"} {
+		// column は固定値なので埋め込んで問題ない
+		rows, err := db.Query(`
+			SELECT id, COALESCE(storage_type,'nas') AS st, ` + column + ` AS k
+			FROM collection_files
+			WHERE COALESCE(` + column + `,'') != ''
+			  AND (COALESCE(storage_type,'nas'), ` + column + `) IN (
+				SELECT COALESCE(storage_type,'nas'), ` + column + `
+				FROM collection_files
+				WHERE COALESCE(` + column + `,'') != ''
+				  AND NOT EXISTS (
+					SELECT 1 FROM blobs b
+					WHERE b.backend = COALESCE(collection_files.storage_type,'nas')
+					  AND b.key = collection_files.` + column + `)
+				GROUP BY COALESCE(storage_type,'nas'), ` + column + `
+				HAVING COUNT(*) > 1)
+			ORDER BY st, k, uploaded_at DESC`)
+		if err != nil {
+			return nil, err
+		}
+		var cur *KeyCollision
+		for rows.Next() {
+			var id, st, key string
+			if err := rows.Scan(&id, &st, &key); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if cur == nil || cur.StorageType != st || cur.Key != key {
+				result = append(result, KeyCollision{StorageType: st, Column: column, Key: key})
+				cur = &result[len(result)-1]
+			}
+			cur.FileIDs = append(cur.FileIDs, id)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// UpdateFileKey は行の保存キー（file_name または thumbnail_name）を差し替える
+func UpdateFileKey(db *sql.DB, id, column, key string) error {
+	switch column {
+	case "file_name":
+		_, err := db.Exec(`UPDATE collection_files SET file_name = ? WHERE id = ?`, key, id)
+		return err
+	case "thumbnail_name":
+		_, err := db.Exec(`UPDATE collection_files SET thumbnail_name = ? WHERE id = ?`, key, id)
+		return err
+	}
+	return errors.New("unknown key column: " + column)
+}
@@ -0,0 +1,31 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// HostKeyStore は NAS の SSH ホスト鍵（TOFU でピン留めしたもの）を nas_host_keys に保存する。
+// storage.HostKeyStore を満たす。
+type HostKeyStore struct {
+	DB *sql.DB
+}
+
+func (s HostKeyStore) LoadHostKey(host string) (string, error) {
+	var fp string
+	err := s.DB.QueryRow(`SELECT fingerprint FROM nas_host_keys WHERE host = ?`, host).Scan(&fp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return fp, err
+}
+
+func (s HostKeyStore) SaveHostKey(host, keyType, fingerprint string) error {
+	_, err := s.DB.Exec(
+		`INSERT INTO nas_host_keys (host, key_type, fingerprint, pinned_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(host) DO UPDATE SET key_type = excluded.key_type, fingerprint = excluded.fingerprint, pinned_at = excluded.pinned_at`,
+		host, keyType, fingerprint, time.Now().UTC(),
+	)
+	return err
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 )
 
@@ -56,3 +57,24 @@ func ListMembers(db *sql.DB) ([]Member, error) {
 	}
 	return members, rows.Err()
 }
+
+// GetMember はパスワード・Discord どちらのユーザーでも ID から返す
+func GetMember(db *sql.DB, id string) (Member, error) {
+	var m Member
+	err := db.QueryRow(`
+		SELECT id, COALESCE(username,''), '', role, 'password' FROM users WHERE id = ?
+		UNION ALL
+		SELECT id,
+		       COALESCE(username,''),
+		       CASE WHEN COALESCE(discord_id,'') != '' AND COALESCE(avatar,'') != ''
+		            THEN 'https://cdn.discordapp.com/avatars/' || discord_id || '/' || avatar || '.png'
+		            ELSE '' END,
+		       role, 'discord'
+		FROM discord_users WHERE id = ?
+		LIMIT 1
+	`, id, id).Scan(&m.ID, &m.Username, &m.Avatar, &m.Role, &m.AuthMethod)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Member{}, ErrUserNotFound
+	}
+	return m, err
+}
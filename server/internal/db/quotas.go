@@ -0,0 +1,146 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	QuotaScopeUser       = "user"
+	QuotaScopeRole       = "role"
+	QuotaScopeCollection = "collection"
+)
+
+// Quota は 1 件の容量制限（ユーザー・ロール・コレクションごと）
+type Quota struct {
+	Scope     string    `json:"scope"`
+	Target    string    `json:"target"`
+	MaxBytes  int64     `json:"max_bytes"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func ListQuotas(db *sql.DB) ([]Quota, error) {
+	rows, err := db.Query(`SELECT scope, target, max_bytes, updated_at FROM storage_quotas ORDER BY scope, target`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotas := []Quota{}
+	for rows.Next() {
+		var q Quota
+		if err := rows.Scan(&q.Scope, &q.Target, &q.MaxBytes, &q.UpdatedAt); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, rows.Err()
+}
+
+// GetQuota は scope / target の上限を返す。未設定なら ok=false。
+func GetQuota(db *sql.DB, scope, target string) (maxBytes int64, ok bool, err error) {
+	err = db.QueryRow(
+		`SELECT max_bytes FROM storage_quotas WHERE scope = ? AND target = ?`, scope, target,
+	).Scan(&maxBytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	return maxBytes, err == nil, err
+}
+
+func SetQuota(db *sql.DB, scope, target string, maxBytes int64) error {
+	_, err := db.Exec(
+		`INSERT INTO storage_quotas (scope, target, max_bytes, updated_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(scope, target) DO UPDATE SET max_bytes = excluded.max_bytes, updated_at = excluded.updated_at`,
+		scope, target, maxBytes, time.Now().UTC(),
+	)
+	return err
+}
+
+func DeleteQuota(db *sql.DB, scope, target string) error {
+	_, err := db.Exec(`DELETE FROM storage_quotas WHERE scope = ? AND target = ?`, scope, target)
+	return err
+}
+
+// 使用量にはゴミ箱のファイル（完全に削除されるまで実体が残る）と旧バージョンの内容も含める。
+// 旧バージョンはその内容をアップロードした人の使用量になる。件数は collection_files の行だけを数える。
+
+// UserUsage はユーザーがアップロードしたファイルの合計サイズと件数を返す
+func UserUsage(db *sql.DB, userID string) (int64, int, error) {
+	var bytes int64
+	var files int
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(file_size), 0), COALESCE(SUM(is_file), 0) FROM (
+			SELECT file_size, 1 AS is_file FROM collection_files WHERE uploaded_by = ?
+			UNION ALL
+			SELECT file_size, 0 FROM file_versions WHERE uploaded_by = ?
+		)`, userID, userID,
+	).Scan(&bytes, &files)
+	return bytes, files, err
+}
+
+// CollectionUsage はコレクション内のファイルの合計サイズと件数を返す
+func CollectionUsage(db *sql.DB, collectionID string) (int64, int, error) {
+	var bytes int64
+	var files int
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(file_size), 0), COALESCE(SUM(is_file), 0) FROM (
+			SELECT file_size, 1 AS is_file FROM collection_files WHERE collection_id = ?
+			UNION ALL
+			SELECT v.file_size, 0 FROM file_versions v
+			JOIN collection_files cf ON cf.id = v.file_id
+			WHERE cf.collection_id = ?
+		)`, collectionID, collectionID,
+	).Scan(&bytes, &files)
+	return bytes, files, err
+}
+
+// FileUsage はファイル 1 件（旧バージョンを含む）の合計サイズを返す（コレクション間の移動で移る量）
+func FileUsage(db *sql.DB, fileID string) (int64, error) {
+	var bytes int64
+	err := db.QueryRow(`
+		SELECT COALESCE((SELECT file_size FROM collection_files WHERE id = ?), 0)
+		     + COALESCE((SELECT SUM(file_size) FROM file_versions WHERE file_id = ?), 0)`, fileID, fileID,
+	).Scan(&bytes)
+	return bytes, err
+}
+
+// CollectionUsageItem はユーザーのコレクションごとの使用量
+type CollectionUsageItem struct {
+	CollectionID   string `json:"collection_id"`
+	CollectionName string `json:"collection_name"`
+	UsedBytes      int64  `json:"used_bytes"`
+	Files          int    `json:"files"`
+}
+
+// UserUsageByCollection はユーザーの使用量をコレクションごとに集計する
+func UserUsageByCollection(db *sql.DB, userID string) ([]CollectionUsageItem, error) {
+	rows, err := db.Query(`
+		SELECT u.collection_id, COALESCE(c.name, ''), COALESCE(SUM(u.file_size), 0), COALESCE(SUM(u.is_file), 0)
+		FROM (
+			SELECT collection_id, file_size, 1 AS is_file FROM collection_files WHERE uploaded_by = ?
+			UNION ALL
+			SELECT cf.collection_id, v.file_size, 0 FROM file_versions v
+			JOIN collection_files cf ON cf.id = v.file_id
+			WHERE v.uploaded_by = ?
+		) u
+		LEFT JOIN collections c ON c.id = u.collection_id
+		GROUP BY u.collection_id
+		ORDER BY 3 DESC
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []CollectionUsageItem{}
+	for rows.Next() {
+		var it CollectionUsageItem
+		if err := rows.Scan(&it.CollectionID, &it.CollectionName, &it.UsedBytes, &it.Files); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
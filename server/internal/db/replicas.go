@@ -0,0 +1,110 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+// ReplicaIndex はミラーのファイルごとのレプリカの状態を file_replicas に保存する。
+// storage.ReplicaIndex を満たす。
+type ReplicaIndex struct {
+	DB *sql.DB
+}
+
+func (r ReplicaIndex) SetReplicaState(name, replica, state, errMsg string) error {
+	_, err := r.DB.Exec(
+		`INSERT INTO file_replicas (name, replica, state, error, updated_at) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT(name, replica) DO UPDATE SET state = excluded.state, error = excluded.error, updated_at = excluded.updated_at`,
+		name, replica, state, errMsg, time.Now().UTC(),
+	)
+	return err
+}
+
+func (r ReplicaIndex) ReplicaStates(name string) ([]storage.ReplicaState, error) {
+	return queryReplicaStates(r.DB,
+		`SELECT name, replica, state, error, updated_at FROM file_replicas WHERE name = ? ORDER BY replica`, name)
+}
+
+func (r ReplicaIndex) DeleteReplicaStates(name string) error {
+	_, err := r.DB.Exec(`DELETE FROM file_replicas WHERE name = ?`, name)
+	return err
+}
+
+// ListUnhealthyReplicas は ok でないレプリカの状態を古い順に返す（修復ジョブ・管理画面用）
+func ListUnhealthyReplicas(db *sql.DB, limit int) ([]storage.ReplicaState, error) {
+	return queryReplicaStates(db,
+		`SELECT name, replica, state, error, updated_at FROM file_replicas
+		 WHERE state != 'ok' ORDER BY updated_at LIMIT ?`, limit)
+}
+
+// ReplicaCount はレプリカ・状態ごとのファイル数
+type ReplicaCount struct {
+	Replica string `json:"replica"`
+	State   string `json:"state"`
+	Files   int    `json:"files"`
+}
+
+func CountReplicaStates(db *sql.DB) ([]ReplicaCount, error) {
+	rows, err := db.Query(`SELECT replica, state, COUNT(*) FROM file_replicas GROUP BY replica, state ORDER BY replica, state`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []ReplicaCount{}
+	for rows.Next() {
+		var c ReplicaCount
+		if err := rows.Scan(&c.Replica, &c.State, &c.Files); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// ListMirrorFileNames はミラーに保存されたファイル（本体とサムネイル、旧バージョンも含む）のキーを返す
+func ListMirrorFileNames(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT file_name FROM collection_files WHERE storage_type = 'mirror'
+		UNION
+		SELECT thumbnail_name FROM collection_files WHERE storage_type = 'mirror' AND COALESCE(thumbnail_name, '') != ''
+		UNION
+		SELECT file_name FROM file_versions WHERE storage_type = 'mirror'
+		UNION
+		SELECT thumbnail_name FROM file_versions WHERE storage_type = 'mirror' AND thumbnail_name != ''
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var n string
+		if err := rows.Scan(&n); err != nil {
+			return nil, err
+		}
+		names = append(names, n)
+	}
+	return names, rows.Err()
+}
+
+func queryReplicaStates(db *sql.DB, query string, args ...any) ([]storage.ReplicaState, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := []storage.ReplicaState{}
+	for rows.Next() {
+		var st storage.ReplicaState
+		if err := rows.Scan(&st.Name, &st.Replica, &st.State, &st.Error, &st.UpdatedAt); err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, rows.Err()
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const (
+	FindingOrphan   = "orphan"   // バックエンドにあるが DB から参照されていないファイル
+	FindingDangling = "dangling" // DB から参照されているがバックエンドに無いファイル
+)
+
+// StorageFinding は整合性チェックで見つかった不整合 1 件
+type StorageFinding struct {
+	ID         int64      `json:"id"`
+	Kind       string     `json:"kind"`
+	Backend    string     `json:"backend"`
+	Name       string     `json:"name"`
+	Size       int64      `json:"size"`
+	FileID     string     `json:"file_id,omitempty"`
+	Column     string     `json:"column,omitempty"`
+	FoundIn    string     `json:"found_in,omitempty"`
+	Status     string     `json:"status"`
+	Detail     string     `json:"detail,omitempty"`
+	DetectedAt time.Time  `json:"detected_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// StorageReference は DB 上の保存キーへの参照 1 件。
+// アイコン（collections.image_url）は保存先を記録していないので Backend が空になる。
+type StorageReference struct {
+	ID      string // collection_files.id（アイコンは collections.id）
+	Column  string // file_name / thumbnail_name / image_url / version（旧バージョンの本体・サムネイル）
+	Key     string
+	Backend string
+}
+
+// ListStorageReferences は collection_files と collections から保存キーへの参照をすべて集める
+func ListStorageReferences(db *sql.DB) ([]StorageReference, error) {
+	rows, err := db.Query(`
+		SELECT id, file_name, COALESCE(thumbnail_name, ''), COALESCE(storage_type, 'nas')
+		FROM collection_files`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []StorageReference
+	for rows.Next() {
+		var id, fileName, thumb, backend string
+		if err := rows.Scan(&id, &fileName, &thumb, &backend); err != nil {
+			return nil, err
+		}
+		refs = append(refs, StorageReference{ID: id, Column: "file_name", Key: fileName, Backend: backend})
+		if thumb != "" {
+			refs = append(refs, StorageReference{ID: id, Column: "thumbnail_name", Key: thumb, Backend: backend})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// 旧バージョンの保存キー（dangling の報告はしない。orphan と誤判定しないため）
+	versionRows, err := db.Query(`SELECT file_id, file_name, thumbnail_name, storage_type FROM file_versions`)
+	if err != nil {
+		return nil, err
+	}
+	defer versionRows.Close()
+	for versionRows.Next() {
+		var id, fileName, thumb, backend string
+		if err := versionRows.Scan(&id, &fileName, &thumb, &backend); err != nil {
+			return nil, err
+		}
+		refs = append(refs, StorageReference{ID: id, Column: "version", Key: fileName, Backend: backend})
+		if thumb != "" {
+			refs = append(refs, StorageReference{ID: id, Column: "version", Key: thumb, Backend: backend})
+		}
+	}
+	if err := versionRows.Err(); err != nil {
+		return nil, err
+	}
+	versionRows.Close()
+
+	iconRows, err := db.Query(`SELECT id, image_url FROM collections WHERE COALESCE(image_url, '') != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer iconRows.Close()
+	for iconRows.Next() {
+		var id, url string
+		if err := iconRows.Scan(&id, &url); err != nil {
+			return nil, err
+		}
+		refs = append(refs, StorageReference{ID: id, Column: "image_url", Key: url})
+	}
+	return refs, iconRows.Err()
+}
+
+// ReplaceStorageFindings は未対応（open）の結果を今回のチェック結果で置き換える。
+// 対応済みのものは履歴として残す。
+func ReplaceStorageFindings(db *sql.DB, findings []StorageFinding) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM storage_findings WHERE status = 'open'`); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(
+		`INSERT INTO storage_findings (kind, backend, name, size, file_id, ref_column, found_in, status, detail, detected_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, 'open', ?, ?)`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, f := range findings {
+		if _, err := stmt.Exec(f.Kind, f.Backend, f.Name, f.Size, f.FileID, f.Column, f.FoundIn, f.Detail, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const storageFindingColumns = `id, kind, backend, name, size, file_id, ref_column, found_in, status, detail, detected_at, resolved_at`
+
+// ListStorageFindings は status（空なら全件）の結果を新しい順に返す
+func ListStorageFindings(db *sql.DB, status string, limit int) ([]StorageFinding, error) {
+	query := `SELECT ` + storageFindingColumns + ` FROM storage_findings`
+	args := []any{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	args = append(args, limit)
+	return queryStorageFindings(db, query, args...)
+}
+
+// GetStorageFindings は指定した ID の結果を返す（存在しない ID は含まれない）
+func GetStorageFindings(db *sql.DB, ids []int64) ([]StorageFinding, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return queryStorageFindings(db,
+		`SELECT `+storageFindingColumns+` FROM storage_findings
+		 WHERE id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`) ORDER BY id`, args...)
+}
+
+func queryStorageFindings(db *sql.DB, query string, args ...any) ([]StorageFinding, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	findings := []StorageFinding{}
+	for rows.Next() {
+		var f StorageFinding
+		var resolved sql.NullTime
+		if err := rows.Scan(&f.ID, &f.Kind, &f.Backend, &f.Name, &f.Size, &f.FileID, &f.Column,
+			&f.FoundIn, &f.Status, &f.Detail, &f.DetectedAt, &resolved); err != nil {
+			return nil, err
+		}
+		if resolved.Valid {
+			f.ResolvedAt = &resolved.Time
+		}
+		findings = append(findings, f)
+	}
+	return findings, rows.Err()
+}
+
+// ResolveStorageFinding は未対応の結果を対応済みにする。既に対応済みなら false を返す。
+func ResolveStorageFinding(db *sql.DB, id int64, status, detail string) (bool, error) {
+	res, err := db.Exec(
+		`UPDATE storage_findings SET status = ?, detail = ?, resolved_at = ? WHERE id = ? AND status = 'open'`,
+		status, detail, time.Now().UTC(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// StorageFindingCounts は未対応の結果の件数
+type StorageFindingCounts struct {
+	Orphans     int   `json:"orphans"`
+	OrphanBytes int64 `json:"orphan_bytes"`
+	Dangling    int   `json:"dangling"`
+}
+
+func CountStorageFindings(db *sql.DB) (StorageFindingCounts, error) {
+	var c StorageFindingCounts
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(kind = 'orphan'), 0),
+		       COALESCE(SUM(CASE WHEN kind = 'orphan' THEN size ELSE 0 END), 0),
+		       COALESCE(SUM(kind = 'dangling'), 0)
+		FROM storage_findings WHERE status = 'open'`,
+	).Scan(&c.Orphans, &c.OrphanBytes, &c.Dangling)
+	return c, err
+}
+
+// SetFileStorageType は collection_files の 1 行の保存先を付け替える
+func SetFileStorageType(db *sql.DB, id, storageType string) error {
+	_, err := db.Exec(`UPDATE collection_files SET storage_type = ? WHERE id = ?`, storageType, id)
+	return err
+}
+
+// SetCollectionImage はコレクションのアイコンだけを書き換える（"" で外す）
+func SetCollectionImage(db *sql.DB, id, imageURL string) error {
+	_, err := db.Exec(`UPDATE collections SET image_url = ? WHERE id = ?`, imageURL, id)
+	return err
+}
+
+// ForgetBlob は重複排除の台帳からブロブを消す（実体を消した・隔離したとき用）
+func ForgetBlob(db *sql.DB, backend, key string) error {
+	_, err := db.Exec(`DELETE FROM blobs WHERE backend = ? AND key = ?`, backend, key)
+	return err
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"database/sql"
+	"path"
+	"strings"
+	"time"
+)
+
+// StorageMigration はバックエンド間の移行ジョブ 1 件
+type StorageMigration struct {
+	ID           string    `json:"id"`
+	Source       string    `json:"source"`
+	Target       string    `json:"target"`
+	CollectionID string    `json:"collection_id,omitempty"`
+	DeleteSource bool      `json:"delete_source"`
+	Status       string    `json:"status"` // running / paused / canceled / done / error
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// StorageMigrationItem は移行するファイル 1 件（本体はサムネイルと一緒に移す）
+type StorageMigrationItem struct {
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"` // file / icon
+	Thumbnails []string `json:"thumbnails,omitempty"`
+	Size       int64    `json:"size"`
+	Status     string   `json:"status"` // pending / done / failed / skipped
+	Checksum   string   `json:"checksum,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+const (
+	MigrationItemFile = "file"
+	MigrationItemIcon = "icon"
+)
+
+// PlanStorageMigration は source に保存されているファイルを移行対象として集める。
+// collectionID を指定するとそのコレクションのファイルだけにする（重複排除で同じキーを
+// 共有している他のコレクションの行も一緒に移る）。includeIcons の場合はコレクションのアイコンも含める。
+func PlanStorageMigration(db *sql.DB, source, collectionID string, includeIcons bool) ([]StorageMigrationItem, error) {
+	query := `
+		SELECT file_name, COALESCE(MAX(file_size), 0), COALESCE(GROUP_CONCAT(NULLIF(thumbnail_name, ''), char(10)), '')
+		FROM ` + storedFiles + `
+		WHERE COALESCE(storage_type,'nas') = ?`
+	args := []any{source}
+	if collectionID != "" {
+		query += ` AND file_name IN (SELECT file_name FROM ` + storedFiles + ` WHERE collection_id = ?)`
+		args = append(args, collectionID)
+	}
+	query += ` GROUP BY file_name ORDER BY MIN(uploaded_at)`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []StorageMigrationItem{}
+	seen := map[string]bool{}
+	for rows.Next() {
+		var it StorageMigrationItem
+		var thumbs string
+		if err := rows.Scan(&it.Name, &it.Size, &thumbs); err != nil {
+			return nil, err
+		}
+		it.Kind = MigrationItemFile
+		it.Status = "pending"
+		it.Thumbnails = splitThumbnails(thumbs)
+		seen[it.Name] = true
+		items = append(items, it)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if !includeIcons {
+		return items, nil
+	}
+	// アイコン（image_url の basename）は保存先を記録していないので存在するものだけ移す
+	iconRows, err := db.Query(`SELECT image_url FROM collections WHERE COALESCE(image_url,'') != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer iconRows.Close()
+	for iconRows.Next() {
+		var raw string
+		if err := iconRows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		name := path.Base(raw)
+		if name == "" || name == "." || name == "/" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		items = append(items, StorageMigrationItem{Name: name, Kind: MigrationItemIcon, Status: "pending"})
+	}
+	return items, iconRows.Err()
+}
+
+// storedFiles は保存されている内容すべて（現在の内容と旧バージョン）
+const storedFiles = `(
+	SELECT collection_id, file_name, file_size, thumbnail_name, storage_type, uploaded_at FROM collection_files
+	UNION ALL
+	SELECT cf.collection_id, v.file_name, v.file_size, v.thumbnail_name, v.storage_type, v.uploaded_at
+	FROM file_versions v JOIN collection_files cf ON cf.id = v.file_id
+)`
+
+func splitThumbnails(s string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, t := range strings.Split(s, "\n") {
+		if t != "" && !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// CreateStorageMigration は移行ジョブと対象ファイルを保存する
+func CreateStorageMigration(db *sql.DB, m StorageMigration, items []StorageMigrationItem) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec(
+		`INSERT INTO storage_migrations (id, source, target, collection_id, delete_source, status, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.ID, m.Source, m.Target, m.CollectionID, m.DeleteSource, m.Status, now, now,
+	); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(
+		`INSERT INTO storage_migration_items (migration_id, name, kind, thumbnail, size, status, updated_at)
+		 VALUES (?, ?, ?, ?, ?, 'pending', ?)`,
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, it := range items {
+		if _, err := stmt.Exec(m.ID, it.Name, it.Kind, strings.Join(it.Thumbnails, "\n"), it.Size, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const storageMigrationColumns = `id, source, target, collection_id, delete_source, status, error, created_at, updated_at`
+
+func scanStorageMigration(row interface{ Scan(...any) error }) (StorageMigration, error) {
+	var m StorageMigration
+	err := row.Scan(&m.ID, &m.Source, &m.Target, &m.CollectionID, &m.DeleteSource, &m.Status, &m.Error, &m.CreatedAt, &m.UpdatedAt)
+	return m, err
+}
+
+// ActiveStorageMigration は実行中または一時停止中の移行ジョブを返す（無ければ ok = false）
+func ActiveStorageMigration(db *sql.DB) (StorageMigration, bool, error) {
+	m, err := scanStorageMigration(db.QueryRow(
+		`SELECT ` + storageMigrationColumns + ` FROM storage_migrations
+		 WHERE status IN ('running', 'paused') ORDER BY created_at DESC LIMIT 1`,
+	))
+	if err == sql.ErrNoRows {
+		return StorageMigration{}, false, nil
+	}
+	return m, err == nil, err
+}
+
+// LatestStorageMigration は直近の移行ジョブを返す（無ければ ok = false）
+func LatestStorageMigration(db *sql.DB) (StorageMigration, bool, error) {
+	m, err := scanStorageMigration(db.QueryRow(
+		`SELECT ` + storageMigrationColumns + ` FROM storage_migrations ORDER BY created_at DESC LIMIT 1`,
+	))
+	if err == sql.ErrNoRows {
+		return StorageMigration{}, false, nil
+	}
+	return m, err == nil, err
+}
+
+// SetStorageMigrationStatus は移行ジョブの状態を更新する。
+// from を指定した場合は現在の状態がそのいずれかのときだけ更新し、更新したかどうかを返す。
+func SetStorageMigrationStatus(db *sql.DB, id, status, errMsg string, from ...string) (bool, error) {
+	query := `UPDATE storage_migrations SET status = ?, error = ?, updated_at = ? WHERE id = ?`
+	args := []any{status, errMsg, time.Now().UTC(), id}
+	if len(from) > 0 {
+		query += ` AND status IN (?` + strings.Repeat(`, ?`, len(from)-1) + `)`
+		for _, f := range from {
+			args = append(args, f)
+		}
+	}
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// PendingMigrationItems はまだ処理していないファイルを登録順に返す
+func PendingMigrationItems(db *sql.DB, id string, limit int) ([]StorageMigrationItem, error) {
+	return queryMigrationItems(db,
+		`SELECT name, kind, thumbnail, size, status, checksum, error FROM storage_migration_items
+		 WHERE migration_id = ? AND status = 'pending' ORDER BY rowid LIMIT ?`, id, limit)
+}
+
+// FailedMigrationItems は失敗したファイルを返す（管理画面用）
+func FailedMigrationItems(db *sql.DB, id string, limit int) ([]StorageMigrationItem, error) {
+	return queryMigrationItems(db,
+		`SELECT name, kind, thumbnail, size, status, checksum, error FROM storage_migration_items
+		 WHERE migration_id = ? AND status = 'failed' ORDER BY updated_at LIMIT ?`, id, limit)
+}
+
+func queryMigrationItems(db *sql.DB, query string, args ...any) ([]StorageMigrationItem, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []StorageMigrationItem
+	for rows.Next() {
+		var it StorageMigrationItem
+		var thumbs string
+		if err := rows.Scan(&it.Name, &it.Kind, &thumbs, &it.Size, &it.Status, &it.Checksum, &it.Error); err != nil {
+			return nil, err
+		}
+		it.Thumbnails = splitThumbnails(thumbs)
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// SetMigrationItemResult はファイル 1 件の処理結果を記録する
+func SetMigrationItemResult(db *sql.DB, id, name, status, checksum, errMsg string) error {
+	_, err := db.Exec(
+		`UPDATE storage_migration_items SET status = ?, checksum = ?, error = ?, updated_at = ?
+		 WHERE migration_id = ? AND name = ?`,
+		status, checksum, errMsg, time.Now().UTC(), id, name,
+	)
+	return err
+}
+
+// RetryFailedMigrationItems は失敗したファイルを未処理に戻す
+func RetryFailedMigrationItems(db *sql.DB, id string) (int64, error) {
+	res, err := db.Exec(
+		`UPDATE storage_migration_items SET status = 'pending', error = '', updated_at = ?
+		 WHERE migration_id = ? AND status = 'failed'`,
+		time.Now().UTC(), id,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// MigrationItemCounts は移行ジョブの状態ごとの件数
+type MigrationItemCounts struct {
+	Total      int   `json:"total"`
+	Pending    int   `json:"pending"`
+	Done       int   `json:"done"`
+	Failed     int   `json:"failed"`
+	Skipped    int   `json:"skipped"`
+	TotalBytes int64 `json:"total_bytes"`
+	DoneBytes  int64 `json:"done_bytes"`
+}
+
+func CountMigrationItems(db *sql.DB, id string) (MigrationItemCounts, error) {
+	var c MigrationItemCounts
+	err := db.QueryRow(`
+		SELECT COUNT(*),
+		       COALESCE(SUM(status = 'pending'), 0),
+		       COALESCE(SUM(status = 'done'), 0),
+		       COALESCE(SUM(status = 'failed'), 0),
+		       COALESCE(SUM(status = 'skipped'), 0),
+		       COALESCE(SUM(size), 0),
+		       COALESCE(SUM(CASE WHEN status = 'done' THEN size ELSE 0 END), 0)
+		FROM storage_migration_items WHERE migration_id = ?`, id,
+	).Scan(&c.Total, &c.Pending, &c.Done, &c.Failed, &c.Skipped, &c.TotalBytes, &c.DoneBytes)
+	return c, err
+}
+
+// MoveFileStorage は file_name を共有する from の行（旧バージョンも含む）をすべて to に付け替える
+func MoveFileStorage(db *sql.DB, fileName, from, to string) error {
+	if _, err := db.Exec(
+		`UPDATE collection_files SET storage_type = ? WHERE file_name = ? AND COALESCE(storage_type,'nas') = ?`,
+		to, fileName, from,
+	); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		`UPDATE file_versions SET storage_type = ? WHERE file_name = ? AND storage_type = ?`,
+		to, fileName, from,
+	)
+	return err
+}
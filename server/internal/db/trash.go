@@ -0,0 +1,206 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrCollectionTrashed = errors.New("collection is in the trash")
+
+// TrashItem はゴミ箱に入っているファイルまたはコレクション 1 件
+type TrashItem struct {
+	Kind           string    `json:"kind"` // file / collection
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	CollectionID   string    `json:"collection_id,omitempty"`
+	CollectionName string    `json:"collection_name,omitempty"`
+	FileSize       int64     `json:"file_size"` // コレクションは中のファイルの合計
+	Files          int       `json:"files,omitempty"`
+	UploadedBy     string    `json:"uploaded_by,omitempty"`
+	DeletedBy      string    `json:"deleted_by"`
+	DeletedAt      time.Time `json:"deleted_at"`
+}
+
+// TrashFile はファイルをゴミ箱に入れる（既にゴミ箱にあれば ErrFileNotFound）
+func TrashFile(db *sql.DB, id, deletedBy string) error {
+	res, err := db.Exec(
+		`UPDATE collection_files SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL`,
+		time.Now().UTC(), deletedBy, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrFileNotFound
+	}
+	return nil
+}
+
+// TrashCollection はコレクションを中のファイルごとゴミ箱に入れる
+func TrashCollection(db *sql.DB, id, deletedBy string) error {
+	res, err := db.Exec(
+		`UPDATE collections SET deleted_at = ?, deleted_by = ? WHERE id = ? AND deleted_at IS NULL`,
+		time.Now().UTC(), deletedBy, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCollectionNotFound
+	}
+	return nil
+}
+
+// ListTrash はゴミ箱の中身を削除日時の新しい順に返す。
+// userID を指定するとその人が削除した・アップロードしたものだけにする（"" なら全員分）。
+func ListTrash(db *sql.DB, userID string) ([]TrashItem, error) {
+	rows, err := db.Query(`
+		SELECT 'file', cf.id, COALESCE(NULLIF(cf.display_name, ''), cf.original_name, cf.file_name),
+		       COALESCE(cf.collection_id, ''), COALESCE(col.name, ''), COALESCE(cf.file_size, 0), 0,
+		       COALESCE(cf.uploaded_by, ''), COALESCE(cf.deleted_by, ''), cf.deleted_at
+		FROM collection_files cf
+		LEFT JOIN collections col ON col.id = cf.collection_id
+		WHERE cf.deleted_at IS NOT NULL AND col.deleted_at IS NULL
+		  AND (? = '' OR cf.deleted_by = ? OR cf.uploaded_by = ?)
+		UNION ALL
+		SELECT 'collection', c.id, c.name, '', '',
+		       COALESCE((SELECT SUM(file_size) FROM collection_files WHERE collection_id = c.id), 0),
+		       (SELECT COUNT(*) FROM collection_files WHERE collection_id = c.id),
+		       '', COALESCE(c.deleted_by, ''), c.deleted_at
+		FROM collections c
+		WHERE c.deleted_at IS NOT NULL AND (? = '' OR c.deleted_by = ?)
+		ORDER BY 10 DESC`,
+		userID, userID, userID, userID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []TrashItem{}
+	for rows.Next() {
+		var it TrashItem
+		if err := rows.Scan(&it.Kind, &it.ID, &it.Name, &it.CollectionID, &it.CollectionName, &it.FileSize, &it.Files,
+			&it.UploadedBy, &it.DeletedBy, &it.DeletedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	return items, rows.Err()
+}
+
+// RestoreFile はゴミ箱のファイルを元に戻す。コレクションごとゴミ箱にある場合は ErrCollectionTrashed。
+func RestoreFile(db *sql.DB, id string) error {
+	var collectionTrashed bool
+	err := db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM collections WHERE id = cf.collection_id AND deleted_at IS NOT NULL)
+		 FROM collection_files cf WHERE cf.id = ? AND cf.deleted_at IS NOT NULL`, id,
+	).Scan(&collectionTrashed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if collectionTrashed {
+		return ErrCollectionTrashed
+	}
+	_, err = db.Exec(`UPDATE collection_files SET deleted_at = NULL, deleted_by = NULL WHERE id = ?`, id)
+	return err
+}
+
+// RestoreCollection はゴミ箱のコレクションを元に戻す（個別にゴミ箱に入れたファイルはそのまま）
+func RestoreCollection(db *sql.DB, id string) error {
+	res, err := db.Exec(
+		`UPDATE collections SET deleted_at = NULL, deleted_by = NULL WHERE id = ? AND deleted_at IS NOT NULL`, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCollectionNotFound
+	}
+	return nil
+}
+
+// GetTrashedFile は個別にゴミ箱に入れたファイルを返す
+func GetTrashedFile(db *sql.DB, id string) (CollectionFile, error) {
+	var f CollectionFile
+	err := db.QueryRow(
+		`SELECT id, collection_id, file_name, COALESCE(original_name,''), file_size,
+		        COALESCE(thumbnail_name,''), COALESCE(storage_type,'nas'), COALESCE(uploaded_by,''), uploaded_at
+		 FROM collection_files WHERE id = ? AND deleted_at IS NOT NULL`, id,
+	).Scan(&f.ID, &f.CollectionID, &f.FileName, &f.OriginalName, &f.FileSize, &f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CollectionFile{}, ErrFileNotFound
+	}
+	return f, err
+}
+
+// GetTrashedCollection はゴミ箱に入っているコレクションを返す
+func GetTrashedCollection(db *sql.DB, id string) (Collection, error) {
+	var c Collection
+	err := db.QueryRow(
+		`SELECT id, name, description, color, icon, COALESCE(image_url,''), COALESCE(genre,'')
+		 FROM collections WHERE id = ? AND deleted_at IS NOT NULL`, id,
+	).Scan(&c.ID, &c.Name, &c.Description, &c.Color, &c.Icon, &c.ImageURL, &c.Genre)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Collection{}, ErrCollectionNotFound
+	}
+	return c, err
+}
+
+// ListCollectionFilesForPurge はコレクションの全ファイル（個別にゴミ箱に入れたものも含む）を返す
+func ListCollectionFilesForPurge(db *sql.DB, collectionID string) ([]CollectionFile, error) {
+	rows, err := db.Query(
+		`SELECT id, collection_id, file_name, COALESCE(original_name,''), file_size, COALESCE(thumbnail_name,''),
+		        COALESCE(storage_type,'nas'), COALESCE(uploaded_by,''), uploaded_at
+		 FROM collection_files WHERE collection_id = ?`,
+		collectionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []CollectionFile
+	for rows.Next() {
+		var f CollectionFile
+		if err := rows.Scan(&f.ID, &f.CollectionID, &f.FileName, &f.OriginalName, &f.FileSize, &f.ThumbnailName, &f.StorageType, &f.UploadedBy, &f.UploadedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// ExpiredTrash は before より前にゴミ箱に入れられたファイル・コレクションの ID を返す
+func ExpiredTrash(db *sql.DB, before time.Time) (fileIDs, collectionIDs []string, err error) {
+	fileIDs, err = queryIDs(db,
+		`SELECT id FROM collection_files WHERE deleted_at IS NOT NULL AND deleted_at < ? ORDER BY deleted_at`, before)
+	if err != nil {
+		return nil, nil, err
+	}
+	collectionIDs, err = queryIDs(db,
+		`SELECT id FROM collections WHERE deleted_at IS NOT NULL AND deleted_at < ? ORDER BY deleted_at`, before)
+	return fileIDs, collectionIDs, err
+}
+
+func queryIDs(db *sql.DB, query string, args ...any) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
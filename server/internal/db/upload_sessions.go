@@ -0,0 +1,126 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadSessionExists   = errors.New("upload session already exists")
+	// ErrUploadSessionBusy は結合・処理が始まっていてチャンクを受け付けない場合のエラー
+	ErrUploadSessionBusy = errors.New("upload session is being merged")
+)
+
+const (
+	UploadSessionOpen    = "open"
+	UploadSessionMerging = "merging"
+)
+
+// UploadSession はチャンクアップロード 1 件の申告内容（チャンクの実体は一時フォルダにある）
+type UploadSession struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	CollectionID string    `json:"collection_id"`
+	FileName     string    `json:"file_name"`
+	FileSize     int64     `json:"file_size"`
+	ChunkSize    int64     `json:"chunk_size"`
+	TotalChunks  int       `json:"total_chunks"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ChunkLength は index 番目のチャンクのバイト数（最後のチャンクだけ短い）
+func (s UploadSession) ChunkLength(index int) int64 {
+	if index == s.TotalChunks-1 {
+		return s.FileSize - int64(index)*s.ChunkSize
+	}
+	return s.ChunkSize
+}
+
+func CreateUploadSession(db *sql.DB, s UploadSession) (UploadSession, error) {
+	now := time.Now().UTC()
+	s.Status, s.CreatedAt, s.UpdatedAt = UploadSessionOpen, now, now
+	_, err := db.Exec(
+		`INSERT INTO upload_sessions (id, user_id, collection_id, file_name, file_size, chunk_size, total_chunks, sha256, status, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.UserID, s.CollectionID, s.FileName, s.FileSize, s.ChunkSize, s.TotalChunks, s.SHA256, s.Status, s.CreatedAt, s.UpdatedAt,
+	)
+	if err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return UploadSession{}, ErrUploadSessionExists
+	}
+	return s, err
+}
+
+func GetUploadSession(db *sql.DB, id string) (UploadSession, error) {
+	var s UploadSession
+	err := db.QueryRow(
+		`SELECT id, user_id, collection_id, file_name, file_size, chunk_size, total_chunks, sha256, status, created_at, updated_at
+		 FROM upload_sessions WHERE id = ?`, id,
+	).Scan(&s.ID, &s.UserID, &s.CollectionID, &s.FileName, &s.FileSize, &s.ChunkSize, &s.TotalChunks, &s.SHA256, &s.Status, &s.CreatedAt, &s.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UploadSession{}, ErrUploadSessionNotFound
+	}
+	return s, err
+}
+
+// TouchUploadSession はチャンクを受け取った日時を記録する
+func TouchUploadSession(db *sql.DB, id string) error {
+	_, err := db.Exec(`UPDATE upload_sessions SET updated_at = ? WHERE id = ?`, time.Now().UTC(), id)
+	return err
+}
+
+// SetUploadSessionStatus は状態が from のときだけ to に変える（結合の二重実行を防ぐ）
+func SetUploadSessionStatus(db *sql.DB, id, from, to string) error {
+	res, err := db.Exec(
+		`UPDATE upload_sessions SET status = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		to, time.Now().UTC(), id, from,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := GetUploadSession(db, id); err != nil {
+			return err
+		}
+		return ErrUploadSessionBusy
+	}
+	return nil
+}
+
+func DeleteUploadSession(db *sql.DB, id string) error {
+	_, err := db.Exec(`DELETE FROM upload_sessions WHERE id = ?`, id)
+	return err
+}
+
+// DeleteStaleUploadSessions は before より後にチャンクを受け取っていないセッションを消し、その ID を返す
+// （結合中のまま残ったものは処理中に再起動した場合なので同じく消す）
+func DeleteStaleUploadSessions(db *sql.DB, before time.Time) ([]string, error) {
+	rows, err := db.Query(`SELECT id FROM upload_sessions WHERE updated_at < ?`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := DeleteUploadSession(db, id); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// ListAppPasswords はログイン中のメンバーのアプリパスワードを返す
+// GET /v1/app-passwords
+func ListAppPasswords(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		items, err := db.ListAppPasswords(database, cl.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": items})
+	}
+}
+
+// CreateAppPassword は WebDAV クライアント用のアプリパスワードを発行する。
+// 平文の password はこのレスポンスでしか返さない（ユーザー名はログイン中のもの）。
+// POST /v1/app-passwords  {"name": "rclone"}
+func CreateAppPassword(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		var body struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.Name) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		token, hash, err := auth.NewAppPassword()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_generate"})
+			return
+		}
+		p, err := db.CreateAppPassword(database, cl.UserID, strings.TrimSpace(body.Name), hash)
+		if err != nil {
+			log.Printf("[APP-PASSWORD] create: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"app_password": p, "username": cl.Username, "password": token})
+	}
+}
+
+// DeleteAppPassword はアプリパスワードを取り消す（本人のものだけ）
+// DELETE /v1/app-passwords/:id
+func DeleteAppPassword(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		if err := db.DeleteAppPassword(database, c.Param("id"), cl.UserID); err != nil {
+			if errors.Is(err, db.ErrAppPasswordNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not_found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deleted": true})
+	}
+}
@@ -1,173 +1,492 @@
 package handlers
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/BBSHSH/HideMe/server/internal/auth"
-	"github.com/BBSHSH/HideMe/server/internal/chat"
 	"github.com/BBSHSH/HideMe/server/internal/db"
 	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/progress"
 	"github.com/BBSHSH/HideMe/server/internal/service"
 	"github.com/BBSHSH/HideMe/server/internal/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
+// チャンクアップロードは CreateUploadSession でセッションを作ってから、
+// UploadChunk でチャンクを送り（GetUploadSession で受信済みのチャンクを確かめて再開できる）、
+// MergeAndUpload で結合する。チャンクのサイズと数・持ち主はセッションの申告内容で検証する。
+const (
+	defaultChunkSize = 5 << 20
+	minChunkSize     = 256 << 10
+	maxChunkSize     = 95 << 20 // Cloudflare の 1 リクエスト 100MB 制限に収める
+	maxTotalChunks   = 100000
+)
+
+// chunkTmpDir はセッションのチャンク置き場（uploadID は DB にあるセッションの ID だけを渡す）
 func chunkTmpDir(uploadID string) string {
-	return filepath.Join(os.TempDir(), "hideme_chunk_"+uploadID)
+	return filepath.Join(service.TempDir(), "hideme_chunk_"+uploadID)
 }
 
-// UploadChunk receives a single chunk and writes it to a temp directory.
-// POST /v1/collections/:id/chunk
-func UploadChunk() gin.HandlerFunc {
+func chunkPath(uploadID string, index int) string {
+	return filepath.Join(chunkTmpDir(uploadID), fmt.Sprintf("chunk_%05d", index))
+}
+
+// receivedChunks は正しいサイズで受け取り済みのチャンク番号を返す
+func receivedChunks(s db.UploadSession) []int {
+	received := []int{}
+	for i := 0; i < s.TotalChunks; i++ {
+		if info, err := os.Stat(chunkPath(s.ID, i)); err == nil && info.Size() == s.ChunkLength(i) {
+			received = append(received, i)
+		}
+	}
+	return received
+}
+
+// uploadSessionFor は id のセッションを読み込む。本人のもの以外は（allowAdmin なら admin を除いて）見えないことにする。
+func uploadSessionFor(c *gin.Context, database *sql.DB, id string, allowAdmin bool) (db.UploadSession, bool) {
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "upload_id_required"})
+		return db.UploadSession{}, false
+	}
+	s, err := db.GetUploadSession(database, id)
+	if errors.Is(err, db.ErrUploadSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload_session_not_found"})
+		return s, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+		return s, false
+	}
+	cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+	if s.UserID != cl.UserID && !(allowAdmin && cl.Role == "admin") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "upload_session_not_found"})
+		return s, false
+	}
+	return s, true
+}
+
+// removeUploadSession はセッションとチャンクを捨て、容量の確保を解放する
+func removeUploadSession(database *sql.DB, id string) {
+	if err := db.DeleteUploadSession(database, id); err != nil {
+		log.Printf("[CHUNK] delete session %s: %v", id, err)
+	}
+	os.RemoveAll(chunkTmpDir(id))
+	service.ReleaseQuota(service.ChunkQuotaKey(id))
+}
+
+type createUploadSessionRequest struct {
+	ID        string `json:"id"` // 省略するとサーバーで決める（進捗の購読に使うため、クライアントが UUID を決めてもよい）
+	FileName  string `json:"file_name"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"` // 省略時 5MB
+	SHA256    string `json:"sha256"`     // ファイル全体の SHA-256（hex）。結合時に検証する
+}
+
+// CreateUploadSession はチャンクアップロードのセッションを作り、申告サイズで容量を確保する
+// POST /v1/collections/:id/uploads
+func CreateUploadSession(database *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		uploadID := c.GetHeader("X-Upload-ID")
-		chunkIndexStr := c.GetHeader("X-Chunk-Index")
-		totalChunksStr := c.GetHeader("X-Total-Chunks")
-		fileNameRaw := c.GetHeader("X-File-Name")
-		fileName, _ := url.QueryUnescape(fileNameRaw)
+		var req createUploadSessionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		if req.ID == "" {
+			req.ID = uuid.NewString()
+		} else if _, err := uuid.Parse(req.ID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_upload_id"})
+			return
+		}
+		if req.ChunkSize == 0 {
+			req.ChunkSize = defaultChunkSize
+		}
+		req.SHA256 = strings.ToLower(req.SHA256)
+		switch {
+		case strings.TrimSpace(req.FileName) == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file_name_required"})
+			return
+		case req.Size <= 0:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_size"})
+			return
+		case req.ChunkSize < minChunkSize || req.ChunkSize > maxChunkSize:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_chunk_size", "min": minChunkSize, "max": maxChunkSize})
+			return
+		case (req.Size+req.ChunkSize-1)/req.ChunkSize > maxTotalChunks:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "too_many_chunks", "max": maxTotalChunks})
+			return
+		case req.SHA256 == "":
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sha256_required"})
+			return
+		}
+		if b, err := hex.DecodeString(req.SHA256); err != nil || len(b) != sha256.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_sha256"})
+			return
+		}
+
+		collectionID := c.Param("id")
+		if _, err := db.GetCollectionByID(database, collectionID); err != nil {
+			if errors.Is(err, db.ErrCollectionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "collection_not_found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_collection"})
+			return
+		}
 
-		if uploadID == "" || chunkIndexStr == "" || totalChunksStr == "" || fileName == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "missing_headers"})
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		if err := service.CheckTempSpace(req.Size); err != nil {
+			c.JSON(quotaErrorBody(err))
 			return
 		}
 
-		chunkIndex, err := strconv.Atoi(chunkIndexStr)
+		// 先にセッションを作る。使用中の ID なら他人の容量の確保に触れずに断る
+		s, err := db.CreateUploadSession(database, db.UploadSession{
+			ID:           req.ID,
+			UserID:       cl.UserID,
+			CollectionID: collectionID,
+			FileName:     req.FileName,
+			FileSize:     req.Size,
+			ChunkSize:    req.ChunkSize,
+			TotalChunks:  int((req.Size + req.ChunkSize - 1) / req.ChunkSize),
+			SHA256:       req.SHA256,
+		})
 		if err != nil {
+			if errors.Is(err, db.ErrUploadSessionExists) {
+				c.JSON(http.StatusConflict, gin.H{"error": "upload_id_in_use"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+
+		// チャンクを受け取る前に申告サイズで容量制限を確認する（MergeAndUpload の完了まで確保）
+		if err := service.ReserveQuota(database, service.ChunkQuotaKey(s.ID), "", cl.UserID, cl.Role, collectionID, req.Size); err != nil {
+			removeUploadSession(database, s.ID)
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+		progress.Global.Begin(s.ID, cl.UserID, s.FileName)
+		log.Printf("[CHUNK] session %s: %s (%d bytes, %d chunks)", s.ID, s.FileName, s.FileSize, s.TotalChunks)
+		c.JSON(http.StatusCreated, s)
+	}
+}
+
+// GetUploadSession はセッションと受信済みのチャンク番号を返す（再開用。本人と admin のみ）
+// GET /v1/uploads/:uploadId
+func GetUploadSession(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := uploadSessionFor(c, database, c.Param("uploadId"), true)
+		if !ok {
+			return
+		}
+		received := receivedChunks(s)
+		var receivedBytes int64
+		for _, i := range received {
+			receivedBytes += s.ChunkLength(i)
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"session":        s,
+			"received":       received,
+			"received_bytes": receivedBytes,
+		})
+	}
+}
+
+// DeleteUploadSession はアップロードをやめてチャンクを捨てる（結合の開始後は不可。本人と admin のみ）
+// DELETE /v1/uploads/:uploadId
+func DeleteUploadSession(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := uploadSessionFor(c, database, c.Param("uploadId"), true)
+		if !ok {
+			return
+		}
+		if s.Status != db.UploadSessionOpen {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload_merging"})
+			return
+		}
+		removeUploadSession(database, s.ID)
+		c.JSON(http.StatusOK, gin.H{"deleted": true})
+	}
+}
+
+// UploadChunk receives a single chunk of an upload session and writes it to a temp directory.
+// 同じ番号の再送は上書きする。
+// POST /v1/collections/:id/chunk
+func UploadChunk(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := uploadSessionFor(c, database, c.GetHeader("X-Upload-ID"), false)
+		if !ok {
+			return
+		}
+		if s.CollectionID != c.Param("id") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "collection_mismatch"})
+			return
+		}
+		if s.Status != db.UploadSessionOpen {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload_merging"})
+			return
+		}
+
+		chunkIndex, err := strconv.Atoi(c.GetHeader("X-Chunk-Index"))
+		if err != nil || chunkIndex < 0 || chunkIndex >= s.TotalChunks {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_chunk_index"})
 			return
 		}
+		want := s.ChunkLength(chunkIndex)
+		if c.Request.ContentLength >= 0 && c.Request.ContentLength != want {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_chunk_size", "expected": want})
+			return
+		}
 
-		dir := chunkTmpDir(uploadID)
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		// 再起動で消えた確保を戻し、期限を延ばす（申告サイズ分なので二重には数えない）
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		if err := service.ReserveQuota(database, service.ChunkQuotaKey(s.ID), "", s.UserID, cl.Role, s.CollectionID, s.FileSize); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+
+		if err := os.MkdirAll(chunkTmpDir(s.ID), 0755); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_create_tmp_dir"})
 			return
 		}
 
-		chunkPath := filepath.Join(dir, fmt.Sprintf("chunk_%05d", chunkIndex))
-		f, err := os.Create(chunkPath)
+		// 書き終わって長さを確かめてから名前を付ける（途中で切れたチャンクを受信済みと数えない）
+		final := chunkPath(s.ID, chunkIndex)
+		partial := final + ".part"
+		f, err := os.Create(partial)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_create_chunk"})
 			return
 		}
-		defer f.Close()
-
-		if _, err := io.Copy(f, c.Request.Body); err != nil {
+		n, err := io.Copy(f, io.LimitReader(c.Request.Body, want+1))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(partial)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_write_chunk"})
+			return
+		}
+		if n != want {
+			os.Remove(partial)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_chunk_size", "expected": want})
+			return
+		}
+		if err := os.Rename(partial, final); err != nil {
+			os.Remove(partial)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_write_chunk"})
 			return
 		}
+		_ = db.TouchUploadSession(database, s.ID)
 
-		log.Printf("[CHUNK] received chunk %d/%s for %s (%s)", chunkIndex+1, totalChunksStr, fileName, uploadID)
+		log.Printf("[CHUNK] received chunk %d/%d for %s (%s)", chunkIndex+1, s.TotalChunks, s.FileName, s.ID)
 		c.JSON(http.StatusOK, gin.H{"chunk": chunkIndex, "received": true})
 	}
 }
 
-// MergeAndUpload merges all chunks and processes/uploads the resulting file.
+// MergeAndUpload merges all chunks of an upload session and processes/uploads the resulting file.
+// 結合したファイル全体をセッションの SHA-256 で検証し、合わなければセッションごと捨てる。
 // POST /v1/collections/:id/merge
 func MergeAndUpload(store storage.Storage, database *sql.DB, storageType string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		uploadID := c.GetHeader("X-Upload-ID")
-		totalChunksStr := c.GetHeader("X-Total-Chunks")
-		fileNameRaw := c.GetHeader("X-File-Name")
-		fileName, _ := url.QueryUnescape(fileNameRaw)
-
-		if uploadID == "" || totalChunksStr == "" || fileName == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "missing_headers"})
+		s, ok := uploadSessionFor(c, database, c.GetHeader("X-Upload-ID"), false)
+		if !ok {
 			return
 		}
-
-		totalChunks, err := strconv.Atoi(totalChunksStr)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_total_chunks"})
+		if s.CollectionID != c.Param("id") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "collection_mismatch"})
+			return
+		}
+		if s.SHA256 == "" {
+			// sha256 を必須にする前に作られたセッションは検証できないので、作り直してもらう
+			removeUploadSession(database, s.ID)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "sha256_required"})
+			return
+		}
+		if missing := s.TotalChunks - len(receivedChunks(s)); missing > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "chunks_missing", "missing": missing})
+			return
+		}
+		if err := db.SetUploadSessionStatus(database, s.ID, db.UploadSessionOpen, db.UploadSessionMerging); err != nil {
+			if errors.Is(err, db.ErrUploadSessionBusy) {
+				c.JSON(http.StatusConflict, gin.H{"error": "upload_merging"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
 			return
 		}
 
-		dir := chunkTmpDir(uploadID)
-		mergedPath := filepath.Join(os.TempDir(), "hideme_merged_"+uploadID+filepath.Ext(fileName))
+		// 失敗した場合はチャンクを残してセッションを受付中に戻す（成功時は保存の側に渡して消す）
+		keepSession := false
+		defer func() {
+			if !keepSession {
+				_ = db.SetUploadSessionStatus(database, s.ID, db.UploadSessionMerging, db.UploadSessionOpen)
+			}
+		}()
 
+		uploadID, fileName := s.ID, s.FileName
+		mergedPath := filepath.Join(service.TempDir(), "hideme_merged_"+uploadID+filepath.Ext(fileName))
 		out, err := os.Create(mergedPath)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_create_merged"})
 			return
 		}
 
-		for i := 0; i < totalChunks; i++ {
-			chunkPath := filepath.Join(dir, fmt.Sprintf("chunk_%05d", i))
-			chunk, err := os.Open(chunkPath)
+		sum := sha256.New()
+		w := io.MultiWriter(out, sum)
+		for i := 0; i < s.TotalChunks; i++ {
+			chunk, err := os.Open(chunkPath(uploadID, i))
 			if err != nil {
 				out.Close()
+				os.Remove(mergedPath)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("chunk_%d_missing", i)})
 				return
 			}
-			if _, err := io.Copy(out, chunk); err != nil {
-				chunk.Close()
+			n, err := io.Copy(w, chunk)
+			chunk.Close()
+			if err == nil && n != s.ChunkLength(i) {
+				err = fmt.Errorf("chunk %d is %d bytes, want %d", i, n, s.ChunkLength(i))
+			}
+			if err != nil {
+				log.Printf("[CHUNK] merge %s: %v", uploadID, err)
 				out.Close()
+				os.Remove(mergedPath)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_merge_chunks"})
 				return
 			}
-			chunk.Close()
 		}
-		out.Close()
+		if err := out.Close(); err != nil {
+			os.Remove(mergedPath)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_merge_chunks"})
+			return
+		}
+
+		if got := hex.EncodeToString(sum.Sum(nil)); got != s.SHA256 {
+			log.Printf("[CHUNK] %s: sha256 mismatch (got %s, want %s)", uploadID, got, s.SHA256)
+			os.Remove(mergedPath)
+			keepSession = true
+			removeUploadSession(database, uploadID)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "checksum_mismatch"})
+			return
+		}
 
-		log.Printf("[CHUNK] merged %d chunks → %s", totalChunks, fileName)
+		log.Printf("[CHUNK] merged %d chunks → %s", s.TotalChunks, fileName)
+		os.RemoveAll(chunkTmpDir(uploadID)) // 結合したファイルだけ残せばよい
 
-		collectionID := c.Param("id")
+		collectionID := s.CollectionID
 		trimStart, _ := strconv.ParseFloat(c.GetHeader("X-Trim-Start"), 64)
 		trimEnd, _ := strconv.ParseFloat(c.GetHeader("X-Trim-End"), 64)
 		volumeVal, _ := strconv.Atoi(c.GetHeader("X-Volume"))
-		if volumeVal == 0 {
-			volumeVal = 100
-		}
-		resolution := c.GetHeader("X-Resolution")
-		if resolution == "" {
-			resolution = "720p"
-		}
 		fpsVal, _ := strconv.Atoi(c.GetHeader("X-FPS"))
-		if fpsVal == 0 {
-			fpsVal = 30
+		opts := encodeOptions{
+			TrimStart:  trimStart,
+			TrimEnd:    trimEnd,
+			Volume:     volumeVal,
+			Resolution: c.GetHeader("X-Resolution"),
+			FPS:        fpsVal,
+			Skip:       c.GetHeader("X-Skip-Encode") == "true",
 		}
 
-		claims, _ := c.Get(middleware.ClaimsKey)
-		userID := ""
-		uploaderName := ""
-		uploaderAvatar := ""
-		if claims != nil {
+		var u uploader
+		if claims, _ := c.Get(middleware.ClaimsKey); claims != nil {
 			cl := claims.(*auth.Claims)
-			userID = cl.UserID
-			uploaderName = cl.Username
-			uploaderAvatar = cl.AvatarURL
+			u = uploader{OwnerID: cl.UserID, UserID: cl.UserID, Username: cl.Username, Avatar: cl.AvatarURL}
 			if cl.Role == "admin" {
 				if overrideID := c.GetHeader("X-Uploaded-By"); overrideID != "" {
-					userID = overrideID
+					u.UserID = overrideID
 				}
 			}
 		}
 
+		if err := processAssembledUpload(store, database, storageType, uploadID, collectionID, u, fileName, mergedPath, service.ChunkQuotaKey(uploadID), opts); err != nil {
+			log.Printf("[CHUNK] %s: failed to queue: %v", uploadID, err)
+			os.Remove(mergedPath)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_queue"})
+			return
+		}
+		// 結合したファイルと容量の確保はキューに渡したので、セッションだけ消す
+		keepSession = true
+		if err := db.DeleteUploadSession(database, uploadID); err != nil {
+			log.Printf("[CHUNK] delete session %s: %v", uploadID, err)
+		}
 		c.JSON(http.StatusAccepted, gin.H{"status": "processing", "upload_id": uploadID})
+	}
+}
 
-		skipEncode := c.GetHeader("X-Skip-Encode") == "true"
+// encodeOptions は動画のエンコード設定（0 や空の項目は withDefaults で既定値になる）
+type encodeOptions struct {
+	TrimStart  float64 `json:"trim_start"`
+	TrimEnd    float64 `json:"trim_end"`
+	Volume     int     `json:"volume"`
+	Resolution string  `json:"resolution"`
+	FPS        int     `json:"fps"`
+	Skip       bool    `json:"skip"` // エンコードせずにそのまま保存する
+}
 
-		go func() {
-			defer os.RemoveAll(dir)
-			defer os.Remove(mergedPath)
+func (o encodeOptions) withDefaults() encodeOptions {
+	if o.Volume == 0 {
+		o.Volume = 100
+	}
+	if o.Resolution == "" {
+		o.Resolution = "720p"
+	}
+	if o.FPS == 0 {
+		o.FPS = 30
+	}
+	return o
+}
 
-			if service.IsVideoFilename(fileName) && !skipEncode {
-				service.ProcessVideoBackground(store, database, storageType, uploadID, collectionID, userID, fileName, mergedPath, trimStart, trimEnd, volumeVal, resolution, fpsVal)
-			} else {
-				service.UploadNonVideoBackground(store, database, storageType, uploadID, collectionID, userID, fileName, mergedPath)
-			}
-			uid, uname, uavatar := userID, uploaderName, uploaderAvatar
-			db.LogActivity(database, "upload", uid, uname, uavatar, fileName)
-			chat.Global.Broadcast(chat.WSMessage{Type: "activity", Data: map[string]string{
-				"type": "upload", "user_id": uid, "username": uname, "avatar": uavatar, "detail": fileName,
-			}})
-		}()
+// uploader はアップロードしたユーザー、ファイルを記録するユーザーとアクティビティに出す名前
+type uploader struct {
+	OwnerID  string `json:"owner_id"` // アップロードしたユーザー（X-Uploaded-By で UserID を変えても本人のまま）
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar"`
+}
+
+// processAssembledUpload は受信し終わった path を、動画ならエンコードキューに入れ、それ以外はバックグラウンドでそのまま保存する
+// （結果は uploadID の進捗で通知する）。path と quotaKey の確保は、エラーが返らなければ保存の側で片付ける。
+func processAssembledUpload(store storage.Storage, database *sql.DB, storageType, uploadID, collectionID string, u uploader, fileName, path, quotaKey string, opts encodeOptions) error {
+	opts = opts.withDefaults()
+	if service.IsVideoFilename(fileName) && !opts.Skip {
+		_, err := service.EnqueueEncodeJob(database, db.EncodeJob{
+			ID:           uploadID,
+			OwnerID:      u.OwnerID,
+			UploadedBy:   u.UserID,
+			Username:     u.Username,
+			Avatar:       u.Avatar,
+			CollectionID: collectionID,
+			StorageType:  storageType,
+			FileName:     fileName,
+			InputPath:    path,
+			QuotaKey:     quotaKey,
+			TrimStart:    opts.TrimStart,
+			TrimEnd:      opts.TrimEnd,
+			Volume:       opts.Volume,
+			Resolution:   opts.Resolution,
+			FPS:          opts.FPS,
+			Priority:     service.EncodePriorityNormal,
+		})
+		return err
 	}
+	go func() {
+		defer service.ReleaseQuota(quotaKey)
+		defer os.Remove(path)
+		if service.UploadNonVideoBackground(store, database, storageType, uploadID, collectionID, u.OwnerID, u.UserID, fileName, path) {
+			service.BroadcastActivity(database, "upload", u.UserID, u.Username, u.Avatar, fileName)
+		}
+	}()
+	return nil
 }
@@ -8,13 +8,11 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/BBSHSH/HideMe/server/internal/auth"
@@ -28,11 +26,23 @@ import (
 )
 
 // SSEUploadProgress streams upload progress via Server-Sent Events.
+// 購読を始める前のイベントも流す。再接続時は Last-Event-ID（または ?last_event_id=）より後の分だけを流す。
+// サーバー側で登録されていない（アップロードが始まっていない・片付いた）uploadId は 404。
 func SSEUploadProgress() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		uploadID := c.Param("uploadId")
-		ch := progress.Global.Register(uploadID)
-		defer progress.Global.Close(uploadID)
+		lastID := c.GetHeader("Last-Event-ID")
+		if lastID == "" {
+			lastID = c.Query("last_event_id")
+		}
+		afterID, _ := strconv.ParseUint(lastID, 10, 64)
+		sub, ok := progress.Global.Subscribe(uploadID, afterID)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "upload_not_found"})
+			return
+		}
+		defer sub.Close()
+		ch := sub.C
 
 		c.Header("Content-Type", "text/event-stream")
 		c.Header("Cache-Control", "no-cache")
@@ -49,9 +59,9 @@ func SSEUploadProgress() gin.HandlerFunc {
 					return
 				}
 				data, _ := json.Marshal(ev)
-				fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+				fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", ev.ID, data)
 				c.Writer.Flush()
-				if ev.Phase == progress.PhaseDone || ev.Phase == progress.PhaseError {
+				if ev.Phase.Finished() {
 					return
 				}
 			case <-time.After(25 * time.Second):
@@ -72,13 +82,19 @@ func PollUploadProgress() gin.HandlerFunc {
 			c.JSON(http.StatusOK, gin.H{"phase": "waiting"})
 			return
 		}
-		if ev.Phase == progress.PhaseDone || ev.Phase == progress.PhaseError {
-			progress.Global.CleanLatest(uploadID)
-		}
 		c.JSON(http.StatusOK, ev)
 	}
 }
 
+// ListActiveUploads は自分の処理中のアップロードを返す（別のタブ・端末から進捗を追い直すため）
+// GET /v1/uploads/active
+func ListActiveUploads() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		c.JSON(http.StatusOK, gin.H{"items": progress.Global.Active(cl.UserID)})
+	}
+}
+
 func ListCollectionFiles(database *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		collectionID := c.Param("id")
@@ -94,10 +110,32 @@ func ListCollectionFiles(database *sql.DB) gin.HandlerFunc {
 	}
 }
 
-// uploadNonVideo saves a non-video file directly to storage without encoding.
-func uploadNonVideo(c *gin.Context, store storage.Storage, database *sql.DB, collectionID, storageType, userID string, file *multipart.FileHeader) {
-	uploadID := c.GetHeader("X-Upload-ID")
+// uploadedFile is the response for a finished upload. Deduplicated reports that the
+// content already existed in storage and only a new reference was recorded.
+type uploadedFile struct {
+	db.CollectionFile
+	Deduplicated bool `json:"deduplicated"`
+}
 
+// resolveUploadID はクライアントが付けたアップロード ID を検証する。
+// 一時ファイルの名前・エンコードジョブの ID・進捗のキーになるため、UUID でないものや使用中のものはサーバーで振り直す。
+func resolveUploadID(database *sql.DB, requested string) string {
+	id, err := uuid.Parse(requested)
+	if err != nil {
+		return uuid.NewString()
+	}
+	s := id.String()
+	if progress.Global.Has(s) {
+		return uuid.NewString()
+	}
+	if _, err := db.GetEncodeJob(database, s); !errors.Is(err, db.ErrEncodeJobNotFound) {
+		return uuid.NewString()
+	}
+	return s
+}
+
+// uploadNonVideo saves a non-video file directly to storage without encoding.
+func uploadNonVideo(c *gin.Context, store storage.Storage, database *sql.DB, collectionID, storageType, uploadID, userID string, file *multipart.FileHeader) {
 	src, err := file.Open()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_file"})
@@ -106,10 +144,11 @@ func uploadNonVideo(c *gin.Context, store storage.Storage, database *sql.DB, col
 	defer src.Close()
 
 	if uploadID != "" {
+		progress.Global.Begin(uploadID, userID, file.Filename)
 		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseNAS, Percent: 0})
 	}
 
-	item, err := store.Upload(c.Request.Context(), file.Filename, src, file.Size)
+	item, err := store.Upload(c.Request.Context(), storage.NewObjectKey(file.Filename), src, file.Size)
 	if err != nil {
 		if errors.Is(err, storage.ErrFileTooLarge) {
 			if uploadID != "" {
@@ -130,14 +169,14 @@ func uploadNonVideo(c *gin.Context, store storage.Storage, database *sql.DB, col
 	if thumb, err := c.FormFile("thumbnail"); err == nil {
 		if ts, err := thumb.Open(); err == nil {
 			defer ts.Close()
-			thumbPath := "thumbnails/" + filepath.Base(thumb.Filename)
+			thumbPath := storage.NewThumbnailKey(thumb.Filename)
 			if _, err := store.Upload(c.Request.Context(), thumbPath, ts, thumb.Size); err == nil {
 				thumbnailName = thumbPath
 			}
 		}
 	}
 
-	cf, err := db.AddFileToCollection(database, collectionID, item.Name, thumbnailName, storageType, item.Size, userID)
+	cf, err := db.AddFileToCollection(database, collectionID, item.Name, file.Filename, thumbnailName, storageType, item.Size, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_record_file"})
 		return
@@ -145,16 +184,19 @@ func uploadNonVideo(c *gin.Context, store storage.Storage, database *sql.DB, col
 
 	if uploadID != "" {
 		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseNAS, Percent: 100})
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID})
+		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID, Deduplicated: item.Deduplicated})
 	}
 
-	c.JSON(http.StatusCreated, cf)
+	c.JSON(http.StatusCreated, uploadedFile{CollectionFile: cf, Deduplicated: item.Deduplicated})
 }
 
 func UploadToCollection(store storage.Storage, database *sql.DB, storageType string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		collectionID := c.Param("id")
-		uploadID := c.GetHeader("X-Upload-ID")
+		uploadID := ""
+		if h := c.GetHeader("X-Upload-ID"); h != "" {
+			uploadID = resolveUploadID(database, h)
+		}
 
 		if _, err := db.GetCollectionByID(database, collectionID); err != nil {
 			if errors.Is(err, db.ErrCollectionNotFound) {
@@ -166,10 +208,36 @@ func UploadToCollection(store storage.Storage, database *sql.DB, storageType str
 		}
 
 		claims, ok := c.Get(middleware.ClaimsKey)
-		userID := ""
+		userID, role := "", ""
 		if ok && claims != nil {
 			userID = claims.(*auth.Claims).UserID
+			role = claims.(*auth.Claims).Role
+		}
+		// 本文を受け取っている間から進捗を購読できるように登録しておく（ファイル名は展開後に入れる）
+		if uploadID != "" {
+			progress.Global.Begin(uploadID, userID, "")
+		}
+
+		// multipart を一時ファイルに展開する前に、リクエストのサイズで容量制限を確認する
+		quotaKey := "multipart:" + uploadID
+		if uploadID == "" {
+			quotaKey = "multipart:" + uuid.NewString()
+		}
+		if err := service.CheckTempSpace(c.Request.ContentLength); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+		if err := service.ReserveQuota(database, quotaKey, "", userID, role, collectionID, c.Request.ContentLength); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
 		}
+		// 動画はエンコード後に DB に記録されるまで確保したままにする
+		keepQuota := false
+		defer func() {
+			if !keepQuota {
+				service.ReleaseQuota(quotaKey)
+			}
+		}()
 
 		file, err := c.FormFile("file")
 		if err != nil {
@@ -178,7 +246,7 @@ func UploadToCollection(store storage.Storage, database *sql.DB, storageType str
 		}
 
 		if !service.IsVideoFilename(file.Filename) {
-			uploadNonVideo(c, store, database, collectionID, storageType, userID, file)
+			uploadNonVideo(c, store, database, collectionID, storageType, uploadID, userID, file)
 			return
 		}
 
@@ -197,7 +265,10 @@ func UploadToCollection(store storage.Storage, database *sql.DB, storageType str
 			fpsVal = 30
 		}
 
-		tmpIn := filepath.Join(os.TempDir(), "hideme_in_"+uploadID+filepath.Ext(file.Filename))
+		if uploadID == "" {
+			uploadID = uuid.NewString() // エンコードジョブの ID になる（進捗は購読されない）
+		}
+		tmpIn := filepath.Join(service.TempDir(), "hideme_in_"+uploadID+filepath.Ext(file.Filename))
 		src, err := file.Open()
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_file"})
@@ -218,131 +289,31 @@ func UploadToCollection(store storage.Storage, database *sql.DB, storageType str
 		}
 		dst.Close()
 
-		c.JSON(http.StatusAccepted, gin.H{"upload_id": uploadID, "status": "processing"})
-
-		go service.ProcessVideoBackground(store, database, storageType, uploadID, collectionID, userID, file.Filename, tmpIn, trimStart, trimEnd, volumeVal, resolution, fpsVal)
-	}
-}
-
-// processVideoFromPath encodes a video from disk path and uploads it (used by chunk upload).
-func processVideoFromPath(c *gin.Context, store storage.Storage, database *sql.DB, storageType, uploadID, fileName, inputPath string, trimStart, trimEnd float64, volumeVal int, resolution string, fpsVal int) {
-	collectionID := c.Param("id")
-
-	claims, _ := c.Get(middleware.ClaimsKey)
-	userID := ""
-	if claims != nil {
-		userID = claims.(*auth.Claims).UserID
-	}
-
-	tmpOut := filepath.Join(os.TempDir(), "hideme_out_"+uploadID+".mp4")
-	defer os.Remove(tmpOut)
-
-	totalSec, _ := service.GetVideoDuration(inputPath)
-	if trimEnd > 0.01 && trimEnd > trimStart {
-		totalSec = trimEnd - trimStart
-	}
-
-	height := service.ResolutionHeight(resolution)
-	ffArgs := service.BuildFFmpegArgs(inputPath, tmpOut, trimStart, trimEnd, volumeVal, height, fpsVal)
-	log.Printf("[FFMPEG/CHUNK] start: %s -> %s crf=%d", fileName, resolution, service.CRFForHeight(height))
-
-	if err := service.RunFFmpeg(ffArgs, totalSec, func(pct float64) {
-		if uploadID != "" {
-			progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: pct})
-		}
-	}); err != nil {
-		log.Printf("[FFMPEG/CHUNK] error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "encoding_failed", "detail": err.Error()})
-		if uploadID != "" {
-			progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "encoding_failed"})
-		}
-		return
-	}
-
-	if uploadID != "" {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: 100})
-	}
-
-	outFile, err := os.Open(tmpOut)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_output"})
-		return
-	}
-	defer outFile.Close()
-
-	outInfo, _ := outFile.Stat()
-	outFileName := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".mp4"
-
-	item, err := store.UploadWithProgress(
-		context.Background(),
-		outFileName,
-		outFile,
-		outInfo.Size(),
-		func(loaded, total int64) {
-			if uploadID != "" && total > 0 {
-				progress.Global.Send(uploadID, progress.Event{
-					Phase:   progress.PhaseNAS,
-					Percent: math.Min(float64(loaded)/float64(total)*100, 99),
-				})
-			}
-		},
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_save_file"})
-		if uploadID != "" {
-			progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "nas_failed"})
-		}
-		return
-	}
-
-	cf, err := db.AddFileToCollection(database, collectionID, item.Name, "", storageType, item.Size, userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_record_file"})
-		return
-	}
-
-	if uploadID != "" {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID})
-	}
-
-	log.Printf("[UPLOAD/CHUNK] done: id=%s size=%dMB", cf.ID, outInfo.Size()/1024/1024)
-	c.JSON(http.StatusOK, cf)
-}
-
-// uploadNonVideoFromReader uploads a non-video from an io.Reader (used by chunk upload).
-func uploadNonVideoFromReader(c *gin.Context, store storage.Storage, database *sql.DB, collectionID, storageType, uploadID string, fh *multipart.FileHeader, r io.Reader) {
-	claims, _ := c.Get(middleware.ClaimsKey)
-	userID := ""
-	if claims != nil {
-		userID = claims.(*auth.Claims).UserID
-	}
-
-	if uploadID != "" {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseNAS, Percent: 0})
-	}
-
-	item, err := store.Upload(c.Request.Context(), fh.Filename, r, fh.Size)
-	if err != nil {
-		log.Printf("[UPLOAD/CHUNK] non-video error: %v", err)
-		if uploadID != "" {
-			progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "nas_failed"})
+		_, err = service.EnqueueEncodeJob(database, db.EncodeJob{
+			ID:           uploadID,
+			OwnerID:      userID,
+			UploadedBy:   userID,
+			CollectionID: collectionID,
+			StorageType:  storageType,
+			FileName:     file.Filename,
+			InputPath:    tmpIn,
+			QuotaKey:     quotaKey,
+			TrimStart:    trimStart,
+			TrimEnd:      trimEnd,
+			Volume:       volumeVal,
+			Resolution:   resolution,
+			FPS:          fpsVal,
+			Priority:     service.EncodePriorityNormal,
+		})
+		if err != nil {
+			log.Printf("[UPLOAD] %s: failed to queue: %v", uploadID, err)
+			os.Remove(tmpIn)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_queue"})
+			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_save_file"})
-		return
-	}
-
-	cf, err := db.AddFileToCollection(database, collectionID, item.Name, "", storageType, item.Size, userID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_record_file"})
-		return
-	}
-
-	if uploadID != "" {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseNAS, Percent: 100})
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID})
+		keepQuota = true // 一時ファイルと確保はキューが片付ける
+		c.JSON(http.StatusAccepted, gin.H{"upload_id": uploadID, "status": "processing"})
 	}
-
-	c.JSON(http.StatusCreated, cf)
 }
 
 // PatchCollectionFile updates file metadata (display name, thumbnail, collection).
@@ -382,31 +353,45 @@ func PatchCollectionFile(database *sql.DB, storeFor StoreSelector, storageType s
 			newUploadedBy = c.PostForm("uploaded_by")
 		}
 
+		store := storeFor(storageType)
 		if thumbFile, err := c.FormFile("thumbnail"); err == nil {
 			ts, err := thumbFile.Open()
 			if err == nil {
 				defer ts.Close()
-				store := storeFor(storageType)
-				thumbPath := "thumbnails/" + uuid.NewString() + filepath.Ext(thumbFile.Filename)
+				thumbPath := storage.NewThumbnailKey(thumbFile.Filename)
 				if _, err := store.Upload(c.Request.Context(), thumbPath, ts, thumbFile.Size); err == nil {
-					if cf.ThumbnailName != "" {
-						_ = store.Delete(c.Request.Context(), cf.ThumbnailName)
-					}
 					thumbnailName = thumbPath
 				}
 			}
 		}
+		newThumbnail := thumbnailName != cf.ThumbnailName
 
-		if err := db.UpdateCollectionFile(database, fileID, displayName, thumbnailName, newCollectionID, newUploadedBy); err != nil {
+		// 別のコレクションへ移すときは移動先の容量制限を確かめる
+		err = service.MoveFileWithinQuota(database, fileID, cf.CollectionID, newCollectionID, func() error {
+			return db.UpdateCollectionFile(database, fileID, displayName, thumbnailName, newCollectionID, newUploadedBy)
+		})
+		if err != nil {
+			// 更新できなかったので、新しいサムネイルを捨てて元のサムネイルを残す
+			if newThumbnail {
+				_ = store.Delete(context.WithoutCancel(c.Request.Context()), thumbnailName)
+			}
+			if errors.Is(err, service.ErrQuotaExceeded) {
+				c.JSON(quotaErrorBody(err))
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_update"})
 			return
 		}
-		go service.BroadcastActivity(database, "edit", cl.UserID, cl.Username, cl.AvatarURL, cf.FileName)
+		if newThumbnail && cf.ThumbnailName != "" {
+			_ = store.Delete(c.Request.Context(), cf.ThumbnailName)
+		}
+		go service.BroadcastActivity(database, "edit", cl.UserID, cl.Username, cl.AvatarURL, cf.Label())
 		c.JSON(http.StatusOK, gin.H{"updated": true})
 	}
 }
 
-func DeleteCollectionFile(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
+// DeleteCollectionFile はファイルをゴミ箱に入れる（実体は保持期間が過ぎたら消える）
+func DeleteCollectionFile(database *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		fileID := c.Param("fileID")
 
@@ -434,23 +419,13 @@ func DeleteCollectionFile(database *sql.DB, storeFor StoreSelector) gin.HandlerF
 			}
 		}
 
-		if err := db.DeleteFileFromCollection(database, fileID); err != nil {
+		if err := db.TrashFile(database, fileID, cl.UserID); err != nil {
 			log.Printf("[ERROR] DeleteCollectionFile db: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_delete_file"})
 			return
 		}
-		go service.BroadcastActivity(database, "delete", cl.UserID, cl.Username, cl.AvatarURL, cf.FileName)
-
-		store := storeFor(cf.StorageType)
-		if err := store.Delete(c.Request.Context(), cf.FileName); err != nil && !errors.Is(err, storage.ErrNotFound) {
-			log.Printf("[WARN] delete file (%s): %v", cf.StorageType, err)
-		}
-		if cf.ThumbnailName != "" {
-			if err := store.Delete(c.Request.Context(), cf.ThumbnailName); err != nil && !errors.Is(err, storage.ErrNotFound) {
-				log.Printf("[WARN] delete thumbnail (%s): %v", cf.StorageType, err)
-			}
-		}
+		go service.BroadcastActivity(database, "delete", cl.UserID, cl.Username, cl.AvatarURL, cf.Label())
 
-		c.JSON(http.StatusOK, gin.H{"deleted": true})
+		c.JSON(http.StatusOK, gin.H{"deleted": true, "trashed": true})
 	}
 }
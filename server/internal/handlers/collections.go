@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,7 +11,9 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/BBSHSH/HideMe/server/internal/auth"
 	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
 	"github.com/BBSHSH/HideMe/server/internal/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -109,49 +112,22 @@ func UpdateCollection(database *sql.DB) gin.HandlerFunc {
 	}
 }
 
-func DeleteCollection(database *sql.DB, store storage.Storage) gin.HandlerFunc {
+// DeleteCollection はコレクションを中のファイルごとゴミ箱に入れる。
+// 実体は保持期間（trash.retention_days）が過ぎたら消える。
+func DeleteCollection(database *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
 
-		// コレクション情報（アイコン画像 URL）を取得
-		col, err := db.GetCollectionByID(database, id)
-		if err != nil && err != db.ErrCollectionNotFound {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_collection"})
-			return
-		}
-
-		// コレクション内の全ファイルを取得
-		files, err := db.ListFilesByCollection(database, id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_list_files"})
-			return
-		}
-
-		// 各ファイル（動画 + サムネイル）をストレージから削除
-		for _, file := range files {
-			if err := store.Delete(c.Request.Context(), file.FileName); err != nil {
-				log.Printf("[WARN] delete video failed: %s, %v", file.FileName, err)
+		if err := db.TrashCollection(database, id, cl.UserID); err != nil {
+			if errors.Is(err, db.ErrCollectionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "collection_not_found"})
+				return
 			}
-			if file.ThumbnailName != "" {
-				if err := store.Delete(c.Request.Context(), file.ThumbnailName); err != nil {
-					log.Printf("[WARN] delete thumbnail failed: %s, %v", file.ThumbnailName, err)
-				}
-			}
-		}
-
-		// コレクションアイコン画像を削除（image_url はフル URL なので末尾のファイル名を抽出）
-		if iconName := fileNameFromURL(col.ImageURL); iconName != "" {
-			if err := store.Delete(c.Request.Context(), iconName); err != nil {
-				log.Printf("[WARN] delete collection icon failed: %s, %v", iconName, err)
-			}
-		}
-
-		// DB から削除（ON DELETE CASCADE で collection_files も自動削除）
-		if err := db.DeleteCollection(database, id); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_delete_collection"})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"deleted": true})
+		c.JSON(http.StatusOK, gin.H{"deleted": true, "trashed": true})
 	}
 }
 
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// ListEncodeJobs はエンコードジョブを新しい順に返す（admin は全員分、それ以外は自分のアップロードの分）
+// GET /v1/encode-jobs?status=queued&limit=100
+func ListEncodeJobs(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		ownerID := cl.UserID
+		if cl.Role == "admin" {
+			ownerID = c.Query("owner_id")
+		}
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		if limit <= 0 || limit > 500 {
+			limit = 100
+		}
+		jobs, err := db.ListEncodeJobs(database, ownerID, c.Query("status"), limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": jobs})
+	}
+}
+
+// GetEncodeJob はエンコードジョブ 1 件を返す（本人と admin のみ）
+// GET /v1/encode-jobs/:id
+func GetEncodeJob(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		j, ok := encodeJobFor(c, database)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, j)
+	}
+}
+
+// CancelEncodeJob はエンコードジョブを取り消す（本人と admin のみ。処理中なら ffmpeg・転送を止める）
+// POST /v1/encode-jobs/:id/cancel
+func CancelEncodeJob(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		j, ok := encodeJobFor(c, database)
+		if !ok {
+			return
+		}
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		if err := service.CancelUpload(database, j.ID, cl.UserID, cl.Role == "admin"); err != nil {
+			c.JSON(cancelErrorBody(j.ID, err))
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "cancelling", "upload_id": j.ID})
+	}
+}
+
+// SetEncodeJobPriority は順番待ちのエンコードジョブの優先度を変える（admin only。大きいほど先に処理する）
+// PUT /v1/admin/encode-jobs/:id/priority
+func SetEncodeJobPriority(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Priority *int `json:"priority" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		if err := db.SetEncodeJobPriority(database, c.Param("id"), *body.Priority); err != nil {
+			switch {
+			case errors.Is(err, db.ErrEncodeJobNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "job_not_found"})
+			case errors.Is(err, db.ErrEncodeJobState):
+				c.JSON(http.StatusConflict, gin.H{"error": "job_not_queued"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"updated": true})
+	}
+}
+
+// encodeJobFor は :id のジョブを返す。本人か admin でなければ見つからないことにする
+func encodeJobFor(c *gin.Context, database *sql.DB) (db.EncodeJob, bool) {
+	j, err := db.GetEncodeJob(database, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, db.ErrEncodeJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job_not_found"})
+			return j, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+		return j, false
+	}
+	cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+	if j.OwnerID != cl.UserID && cl.Role != "admin" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job_not_found"})
+		return j, false
+	}
+	return j, true
+}
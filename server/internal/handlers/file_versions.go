@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ReplaceCollectionFile はファイルの中身を差し替える。ID・表示名・視聴回数はそのままで、
+// 差し替え前の内容は旧バージョンとして残る（動画もエンコードせずにそのまま保存する）。
+// POST /v1/collections/:id/files/:fileID/replace  （multipart: file, thumbnail）
+func ReplaceCollectionFile(store storage.Storage, database *sql.DB, storeFor StoreSelector, storageType string, defaultKeep int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cf, cl, ok := fileForWrite(c, database)
+		if !ok {
+			return
+		}
+
+		quotaKey := "replace:" + uuid.NewString()
+		if err := service.ReserveQuota(database, quotaKey, "", cl.UserID, cl.Role, cf.CollectionID, c.Request.ContentLength); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+		defer service.ReleaseQuota(quotaKey)
+
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file_required"})
+			return
+		}
+		src, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_file"})
+			return
+		}
+		defer src.Close()
+
+		ctx := c.Request.Context()
+		item, err := store.Upload(ctx, storage.NewObjectKey(file.Filename), src, file.Size)
+		if err != nil {
+			if errors.Is(err, storage.ErrFileTooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file_too_large"})
+				return
+			}
+			log.Printf("[VERSIONS] replace upload error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_save_file"})
+			return
+		}
+
+		thumbnailName := ""
+		if thumb, err := c.FormFile("thumbnail"); err == nil {
+			if ts, err := thumb.Open(); err == nil {
+				defer ts.Close()
+				thumbPath := storage.NewThumbnailKey(thumb.Filename)
+				if _, err := store.Upload(ctx, thumbPath, ts, thumb.Size); err == nil {
+					thumbnailName = thumbPath
+				}
+			}
+		}
+
+		archived, err := db.ReplaceFileContents(database, cf.ID, db.FileContents{
+			FileName:      item.Name,
+			OriginalName:  file.Filename,
+			FileSize:      item.Size,
+			ThumbnailName: thumbnailName,
+			StorageType:   storageType,
+			UploadedBy:    cf.UploadedBy,
+		}, cl.UserID)
+		if err != nil {
+			log.Printf("[VERSIONS] replace %s: %v", cf.ID, err)
+			_ = store.Delete(ctx, item.Name)
+			if thumbnailName != "" {
+				_ = store.Delete(ctx, thumbnailName)
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_record_file"})
+			return
+		}
+		pruneVersions(c, database, storeFor, cf, defaultKeep)
+
+		updated, err := db.GetFileByID(database, cf.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_file"})
+			return
+		}
+		go service.BroadcastActivity(database, "edit", cl.UserID, cl.Username, cl.AvatarURL, cf.Label())
+		c.JSON(http.StatusOK, gin.H{"file": uploadedFile{CollectionFile: updated, Deduplicated: item.Deduplicated}, "archived_version": archived.Version})
+	}
+}
+
+// ListFileVersions はファイルの旧バージョンを新しい順に返す
+// GET /v1/collections/:id/files/:fileID/versions
+func ListFileVersions(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cf, ok := lookupFile(c, database)
+		if !ok {
+			return
+		}
+		versions, err := db.ListFileVersions(database, cf.ID)
+		if err != nil {
+			log.Printf("[VERSIONS] list %s: %v", cf.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_list_versions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": versions})
+	}
+}
+
+// DownloadFileVersion は旧バージョンの中身を返す（Range 対応）
+// GET /v1/collections/:id/files/:fileID/versions/:version/download
+func DownloadFileVersion(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cf, ok := lookupFile(c, database)
+		if !ok {
+			return
+		}
+		v, ok := lookupVersion(c, database, cf.ID)
+		if !ok {
+			return
+		}
+
+		reader, item, err := storeFor(v.StorageType).OpenSeeker(c.Request.Context(), v.FileName)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "file_not_found"})
+				return
+			}
+			log.Printf("[VERSIONS] open %s (%s): %v", v.FileName, v.StorageType, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_file"})
+			return
+		}
+		defer reader.Close()
+
+		downloadName := v.OriginalName
+		if downloadName == "" {
+			downloadName = v.FileName
+		}
+		c.Header("Content-Type", videoMimeType(item.Name))
+		c.Header("Content-Disposition", contentDisposition(downloadName))
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, item.Size, item.Modified.UnixNano()))
+		http.ServeContent(c.Writer, c.Request, item.Name, item.Modified, reader)
+	}
+}
+
+// RestoreFileVersion は旧バージョンを現在の内容に戻す（現在の内容は新しい旧バージョンになる）
+// POST /v1/collections/:id/files/:fileID/versions/:version/restore
+func RestoreFileVersion(database *sql.DB, storeFor StoreSelector, defaultKeep int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cf, cl, ok := fileForWrite(c, database)
+		if !ok {
+			return
+		}
+		version, err := strconv.Atoi(c.Param("version"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_version"})
+			return
+		}
+		archived, err := db.RestoreFileVersion(database, cf.ID, version, cl.UserID)
+		if err != nil {
+			if errors.Is(err, db.ErrVersionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "version_not_found"})
+				return
+			}
+			log.Printf("[VERSIONS] restore %s v%d: %v", cf.ID, version, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_restore_version"})
+			return
+		}
+		pruneVersions(c, database, storeFor, cf, defaultKeep)
+		go service.BroadcastActivity(database, "edit", cl.UserID, cl.Username, cl.AvatarURL, cf.Label())
+		c.JSON(http.StatusOK, gin.H{"restored": version, "archived_version": archived.Version})
+	}
+}
+
+// SetVersionRetention はコレクションの旧バージョンの保持数を設定する（admin only）。
+// keep を null にすると設定ファイルの既定値に戻る。
+// PUT /v1/admin/collections/:id/versions  {"keep": 5}
+func SetVersionRetention(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Keep *int `json:"keep"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || (body.Keep != nil && *body.Keep < 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		if err := db.SetCollectionVersionRetention(database, c.Param("id"), body.Keep); err != nil {
+			if errors.Is(err, db.ErrCollectionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "collection_not_found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		// 減らした分は次に差し替え・復元したときに消える
+		c.JSON(http.StatusOK, gin.H{"keep": body.Keep})
+	}
+}
+
+// lookupFile は :fileID のファイルを返す。URL の :id と違うコレクションのファイルは無いものとして 404 にする
+func lookupFile(c *gin.Context, database *sql.DB) (db.CollectionFile, bool) {
+	cf, err := db.GetFileByID(database, c.Param("fileID"))
+	if err == nil && cf.CollectionID != c.Param("id") {
+		err = db.ErrFileNotFound
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrFileNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "file_not_found"})
+			return db.CollectionFile{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_file"})
+		return db.CollectionFile{}, false
+	}
+	return cf, true
+}
+
+// fileForWrite はファイルを返す。アップロードした本人か admin でなければ 403 を返して false。
+func fileForWrite(c *gin.Context, database *sql.DB) (db.CollectionFile, *auth.Claims, bool) {
+	cf, ok := lookupFile(c, database)
+	if !ok {
+		return db.CollectionFile{}, nil, false
+	}
+	cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+	if cl.Role != "admin" && (cf.UploadedBy == "" || cl.UserID != cf.UploadedBy) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return db.CollectionFile{}, nil, false
+	}
+	return cf, cl, true
+}
+
+func lookupVersion(c *gin.Context, database *sql.DB, fileID string) (db.FileVersion, bool) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_version"})
+		return db.FileVersion{}, false
+	}
+	v, err := db.GetFileVersion(database, fileID, version)
+	if err != nil {
+		if errors.Is(err, db.ErrVersionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "version_not_found"})
+			return db.FileVersion{}, false
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_version"})
+		return db.FileVersion{}, false
+	}
+	return v, true
+}
+
+// pruneVersions は保持数を超えた旧バージョンを消す（失敗しても差し替え自体は成功扱い）
+func pruneVersions(c *gin.Context, database *sql.DB, storeFor StoreSelector, cf db.CollectionFile, defaultKeep int) {
+	keep, err := service.VersionRetention(database, cf.CollectionID, defaultKeep)
+	if err == nil {
+		err = service.PruneFileVersions(c.Request.Context(), database, storeFor, cf.ID, keep)
+	}
+	if err != nil {
+		log.Printf("[VERSIONS] WARN prune %s: %v", cf.ID, err)
+	}
+}
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,18 +30,27 @@ type FileItem struct {
 	Modified time.Time `json:"modified"`
 }
 
+// ListFiles はストレージ上のファイルをサブフォルダも含めてキー順に返す（ファイルブラウザ用）。
+// ?prefix=thumbnails/ で絞り込み、next_cursor を ?cursor= に渡すと続きを返す。
+// GET /v1/files?prefix=&cursor=&limit=
 func ListFiles(store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		items, err := store.List(c.Request.Context())
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		page, err := store.ListPage(c.Request.Context(), storage.ListOptions{
+			Prefix: c.Query("prefix"),
+			Cursor: c.Query("cursor"),
+			Limit:  limit,
+		})
 		if err != nil {
+			log.Printf("[FILES] list error: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_list_files"})
 			return
 		}
-		response := make([]FileItem, 0, len(items))
-		for _, item := range items {
+		response := make([]FileItem, 0, len(page.Items))
+		for _, item := range page.Items {
 			response = append(response, FileItem{Name: item.Name, Size: item.Size, Modified: item.Modified})
 		}
-		c.JSON(http.StatusOK, gin.H{"items": response})
+		c.JSON(http.StatusOK, gin.H{"items": response, "next_cursor": page.NextCursor})
 	}
 }
 
@@ -92,7 +104,7 @@ func UploadFile(store storage.Storage) gin.HandlerFunc {
 			uploadName = folder + "/" + uuid.NewString() + ext
 		}
 
-		_, err = store.Upload(c.Request.Context(), uploadName, src, file.Size)
+		item, err := store.Upload(c.Request.Context(), uploadName, src, file.Size)
 		if err != nil {
 			if errors.Is(err, storage.ErrFileTooLarge) {
 				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file_too_large"})
@@ -102,8 +114,13 @@ func UploadFile(store storage.Storage) gin.HandlerFunc {
 			return
 		}
 
+		// 重複排除が有効だとトップレベルのファイルはハッシュ名で保存される
+		if folder == "" {
+			uploadName = item.Name
+		}
+
 		// uploadName にはすでに folder/ プレフィックスが含まれる
-		c.JSON(http.StatusCreated, gin.H{"file_name": uploadName, "file_size": file.Size, "uploaded": true})
+		c.JSON(http.StatusCreated, gin.H{"file_name": uploadName, "file_size": file.Size, "uploaded": true, "deduplicated": item.Deduplicated})
 	}
 }
 
@@ -112,13 +129,16 @@ func DownloadFile(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
 		// *name は先頭に "/" が付く
 		name := strings.TrimPrefix(c.Param("name"), "/")
 
-		// DB でファイルのストレージ種別を確認
+		// DB でファイルのストレージ種別と元のファイル名を確認
 		storageType := "nas"
+		downloadName := path.Base(name)
+		// サムネイルは本体と同じストレージにある
 		if rows, err := database.Query(
-			`SELECT COALESCE(storage_type,'nas') FROM collection_files WHERE file_name = ? LIMIT 1`, name,
+			`SELECT COALESCE(storage_type,'nas'), CASE WHEN file_name = ? THEN COALESCE(original_name, file_name) ELSE ? END
+			 FROM collection_files WHERE file_name = ? OR thumbnail_name = ? LIMIT 1`, name, downloadName, name, name,
 		); err == nil {
 			if rows.Next() {
-				_ = rows.Scan(&storageType)
+				_ = rows.Scan(&storageType, &downloadName)
 			}
 			rows.Close()
 		}
@@ -127,11 +147,14 @@ func DownloadFile(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Content-Type, Range")
-		c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, ETag")
 		c.Header("Accept-Ranges", "bytes")
 
+		// 暗号化していればローカルでも復号しながら配信する（ファイルを直接は返せない）
+		_, encrypted := storage.As[*storage.EncryptedStorage](storeFor("local"))
+
 		// ─── ローカル: gin の c.File() で Range / シーク / ETag に完全対応 ───
-		if ls, ok := storeFor("local").(*storage.LocalStorage); ok && storageType == "local" {
+		if ls, ok := storage.Unwrap(storeFor("local")).(*storage.LocalStorage); ok && storageType == "local" && !encrypted {
 			path := ls.FilePath(name)
 			// Content-Type を明示的に設定（拡張子が正しく解決されない環境対策）
 			c.Header("Content-Type", videoMimeType(name))
@@ -139,13 +162,16 @@ func DownloadFile(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
 			return
 		}
 
-		// ─── NAS: ストリーミング（local フォールバックあり） ───
+		// ─── NAS / S3: http.ServeContent で Range / If-Range / 304 に対応（local フォールバックあり） ───
 		store := storeFor(storageType)
-		reader, item, err := store.Open(c.Request.Context(), name)
+		reader, item, err := store.OpenSeeker(c.Request.Context(), name)
+		if errors.Is(err, storage.ErrNotFound) && encrypted && storageType != "local" {
+			reader, item, err = storeFor("local").OpenSeeker(c.Request.Context(), name)
+		}
 		if err != nil {
 			// NAS に見つからない場合は local も試みる
 			if errors.Is(err, storage.ErrNotFound) {
-				if ls, ok := storeFor("local").(*storage.LocalStorage); ok {
+				if ls, ok := storage.Unwrap(storeFor("local")).(*storage.LocalStorage); ok && !encrypted {
 					path := ls.FilePath(name)
 					c.Header("Content-Type", videoMimeType(name))
 					c.File(path)
@@ -155,21 +181,37 @@ func DownloadFile(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
 				return
 			}
 			log.Printf("[FILES] store.Open(%q, type=%s) error: %v", name, storageType, err)
+			if errors.Is(err, storage.ErrHostKeyMismatch) {
+				c.JSON(http.StatusBadGateway, gin.H{"error": "nas_host_key_mismatch"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_file"})
 			return
 		}
 		defer reader.Close()
 
 		mt := videoMimeType(item.Name)
-		if mt == "video/mp4" || mt == "video/webm" {
-			c.Header("Content-Type", mt)
-		} else {
-			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, item.Name))
+		c.Header("Content-Type", mt)
+		if mt != "video/mp4" && mt != "video/webm" {
+			c.Header("Content-Disposition", contentDisposition(downloadName))
 		}
-		c.DataFromReader(http.StatusOK, item.Size, mt, reader, nil)
+		// サイズと更新時刻から ETag を作る（If-Range / If-None-Match 用）
+		c.Header("ETag", fmt.Sprintf(`"%x-%x"`, item.Size, item.Modified.UnixNano()))
+		http.ServeContent(c.Writer, c.Request, item.Name, item.Modified, reader)
 	}
 }
 
+// contentDisposition は元のファイル名（日本語を含む）で保存させるヘッダ値を返す
+func contentDisposition(name string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, ascii, url.PathEscape(name))
+}
+
 func videoMimeType(name string) string {
 	lower := strings.ToLower(name)
 	switch {
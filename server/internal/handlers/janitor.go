@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// GetJanitorReport は直近の一時ファイルの片付けで消したものと、起動してからの合計を返す（admin only）
+// GET /v1/admin/janitor
+func GetJanitorReport() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, service.GetJanitorStatus())
+	}
+}
+
+// RunJanitor は一時ファイルの片付けをすぐに実行し、その結果を返す（admin only）
+// POST /v1/admin/janitor/run
+func RunJanitor(database *sql.DB, opts service.JanitorOptions) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, service.RunJanitor(c.Request.Context(), database, opts))
+	}
+}
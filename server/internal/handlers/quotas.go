@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// GetStorageUsage はログイン中のメンバーの使用量と容量制限を返す
+// GET /v1/storage-usage
+func GetStorageUsage(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		usage, err := service.GetQuotaUsage(database, cl.UserID, cl.Role)
+		if err != nil {
+			log.Printf("[QUOTA] usage: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_usage"})
+			return
+		}
+		c.JSON(http.StatusOK, usage)
+	}
+}
+
+// ListQuotas は設定済みの容量制限を返す（admin only）
+// GET /v1/admin/quotas
+func ListQuotas(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		quotas, err := db.ListQuotas(database)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"items": quotas})
+	}
+}
+
+// SetQuota はユーザー・ロール・コレクションの容量制限を設定する（admin only）
+// PUT /v1/admin/quotas
+func SetQuota(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Scope    string `json:"scope"  binding:"required"`
+			Target   string `json:"target" binding:"required"`
+			MaxBytes *int64 `json:"max_bytes" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || !validQuotaScope(body.Scope) || *body.MaxBytes < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_request"})
+			return
+		}
+		if err := db.SetQuota(database, body.Scope, body.Target, *body.MaxBytes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"updated": true})
+	}
+}
+
+// DeleteQuota は容量制限を外す（admin only）
+// DELETE /v1/admin/quotas/:scope/:target
+func DeleteQuota(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := c.Param("scope")
+		if !validQuotaScope(scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_scope"})
+			return
+		}
+		if err := db.DeleteQuota(database, scope, c.Param("target")); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"deleted": true})
+	}
+}
+
+func validQuotaScope(scope string) bool {
+	switch scope {
+	case db.QuotaScopeUser, db.QuotaScopeRole, db.QuotaScopeCollection:
+		return true
+	}
+	return false
+}
+
+// quotaErrorBody は ReserveQuota のエラーをレスポンスのステータスと本文に変換する
+func quotaErrorBody(err error) (int, gin.H) {
+	var qe *service.QuotaExceededError
+	switch {
+	case errors.As(err, &qe):
+		return http.StatusRequestEntityTooLarge, gin.H{
+			"error":           "quota_exceeded",
+			"scope":           qe.Scope,
+			"limit_bytes":     qe.Limit,
+			"used_bytes":      qe.Used,
+			"requested_bytes": qe.Requested,
+		}
+	case errors.Is(err, service.ErrInsufficientSpace):
+		log.Printf("[UPLOAD] rejected: %v", err)
+		return http.StatusInsufficientStorage, gin.H{"error": "insufficient_disk_space"}
+	case errors.Is(err, service.ErrLengthRequired):
+		return http.StatusLengthRequired, gin.H{"error": "content_length_required"}
+	default:
+		log.Printf("[QUOTA] check failed: %v", err)
+		return http.StatusInternalServerError, gin.H{"error": "failed_to_check_quota"}
+	}
+}
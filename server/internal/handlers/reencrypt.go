@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+type reencryptStatus struct {
+	Status    string `json:"status"` // idle / running / done / error
+	Total     int    `json:"total"`
+	Done      int    `json:"done"`
+	Rewritten int    `json:"rewritten"` // 暗号化・再暗号化したファイル数（最新の鍵で暗号化済みのものは含まない）
+	Current   string `json:"current"`
+	Errors    int    `json:"errors"`
+	ErrMsg    string `json:"error,omitempty"`
+}
+
+var (
+	reencryptMu    sync.Mutex
+	reencryptState = &reencryptStatus{Status: "idle"}
+)
+
+// GetReencryptStatus は現在の再暗号化の状況を返す
+func GetReencryptStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		reencryptMu.Lock()
+		s := *reencryptState
+		reencryptMu.Unlock()
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+// StartReencrypt は保存済みの全ファイルを現在のマスター鍵で暗号化し直す（admin only）。
+// 平文のファイルは暗号化し、旧鍵で暗号化されたファイルは新しい鍵で書き直す。
+// POST /v1/admin/storage/reencrypt
+func StartReencrypt(database *sql.DB, store storage.Storage, storeFor StoreSelector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := storage.As[*storage.EncryptedStorage](store); !ok {
+			c.JSON(http.StatusConflict, gin.H{"error": "encryption_disabled"})
+			return
+		}
+
+		reencryptMu.Lock()
+		if reencryptState.Status == "running" {
+			reencryptMu.Unlock()
+			c.JSON(http.StatusConflict, gin.H{"error": "reencrypt already running"})
+			return
+		}
+		reencryptState = &reencryptStatus{Status: "running"}
+		reencryptMu.Unlock()
+
+		go runReencrypt(database, store, storeFor)
+		c.JSON(http.StatusAccepted, gin.H{"message": "reencrypt started"})
+	}
+}
+
+func runReencrypt(database *sql.DB, store storage.Storage, storeFor StoreSelector) {
+	ctx := context.Background()
+
+	type target struct {
+		store storage.Storage
+		name  string
+	}
+	var targets []target
+	seen := map[string]bool{}
+	add := func(storageType string, st storage.Storage, name string) {
+		if name == "" || seen[storageType+"/"+name] {
+			return
+		}
+		seen[storageType+"/"+name] = true
+		targets = append(targets, target{store: st, name: name})
+	}
+
+	// ── 1. 対象ファイルを収集（本体・サムネイル・旧バージョン・コレクションアイコン） ──
+	rows, err := database.Query(`
+		SELECT COALESCE(storage_type,'nas'), file_name, COALESCE(thumbnail_name,'')
+		FROM collection_files
+		UNION ALL
+		SELECT storage_type, file_name, thumbnail_name FROM file_versions
+	`)
+	if err != nil {
+		setReencryptError("DB query failed: " + err.Error())
+		return
+	}
+	type cfRow struct {
+		storageType, fileName, thumbnailName string
+	}
+	var cfRows []cfRow
+	for rows.Next() {
+		var r cfRow
+		if err := rows.Scan(&r.storageType, &r.fileName, &r.thumbnailName); err == nil {
+			cfRows = append(cfRows, r)
+		}
+	}
+	rows.Close()
+	for _, r := range cfRows {
+		st := storeFor(r.storageType)
+		add(r.storageType, st, r.fileName)
+		add(r.storageType, st, r.thumbnailName)
+	}
+
+	iconRows, err := database.Query(`SELECT COALESCE(image_url,'') FROM collections WHERE image_url != ''`)
+	if err == nil {
+		for iconRows.Next() {
+			var raw string
+			if err := iconRows.Scan(&raw); err == nil {
+				add("default", store, fileNameFromURL(raw))
+			}
+		}
+		iconRows.Close()
+	}
+
+	total := len(targets)
+	setReencryptProgress(total, 0, 0, "", 0)
+
+	// ── 2. 1 件ずつ書き直す ──────────────────────────────
+	done, rewritten, errCount := 0, 0, 0
+	for _, t := range targets {
+		setReencryptProgress(total, done, rewritten, t.name, errCount)
+
+		enc, ok := storage.As[*storage.EncryptedStorage](t.store)
+		if !ok {
+			done++
+			continue
+		}
+		changed, err := enc.Reencrypt(ctx, t.name, service.TempDir())
+		if err != nil {
+			log.Printf("[reencrypt] WARN %s: %v", t.name, err)
+			errCount++
+		} else if changed {
+			rewritten++
+		}
+		done++
+	}
+
+	// ── 3. 完了 ──────────────────────────────────────────────
+	reencryptMu.Lock()
+	reencryptState = &reencryptStatus{
+		Status:    "done",
+		Total:     total,
+		Done:      done,
+		Rewritten: rewritten,
+		Errors:    errCount,
+	}
+	reencryptMu.Unlock()
+	log.Printf("[reencrypt] done: %d/%d files, rewritten %d (errors: %d)", done, total, rewritten, errCount)
+}
+
+func setReencryptProgress(total, done, rewritten int, current string, errors int) {
+	reencryptMu.Lock()
+	reencryptState.Total = total
+	reencryptState.Done = done
+	reencryptState.Rewritten = rewritten
+	reencryptState.Current = current
+	reencryptState.Errors = errors
+	reencryptMu.Unlock()
+}
+
+func setReencryptError(msg string) {
+	reencryptMu.Lock()
+	reencryptState.Status = "error"
+	reencryptState.ErrMsg = msg
+	reencryptMu.Unlock()
+}
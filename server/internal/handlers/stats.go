@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/BBSHSH/HideMe/server/internal/db"
 	"github.com/BBSHSH/HideMe/server/internal/storage"
 	"github.com/gin-gonic/gin"
 )
@@ -15,23 +16,29 @@ type StatsResponse struct {
 	StorageTotalB   uint64 `json:"storage_total_bytes,omitempty"`
 	StorageUsedB    uint64 `json:"storage_used_bytes,omitempty"`
 	StorageFreeB    uint64 `json:"storage_free_bytes,omitempty"`
+	// 重複排除で節約できた容量（dedup 無効時は 0）
+	DedupSavedB     int64  `json:"dedup_saved_bytes"`
+	DedupBlobs      int    `json:"dedup_blobs"`
+	DedupReferences int    `json:"dedup_references"`
+	// NAS の読み込みキャッシュ（無効時は省略）
+	Cache *storage.CacheStats `json:"cache,omitempty"`
 }
 
-func GetStats(_ *sql.DB, store storage.Storage) gin.HandlerFunc {
+func GetStats(database *sql.DB, store storage.Storage, storeFor StoreSelector) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 実際のストレージ内のファイルを数える（DBではなく実体ベース）
-		items, err := store.List(c.Request.Context())
-		if err != nil {
-			log.Printf("[STATS] store.List error: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_stats"})
-			return
-		}
-
+		// 実際のストレージ内のファイルを数える（DBではなく実体ベース。thumbnails/ などのサブフォルダも含む）
+		// 一覧はページごとに読むので、共有フォルダが大きくても全件をメモリに載せない
 		var totalFiles int
 		var totalSize int64
-		for _, it := range items {
+		err := storage.ListAll(c.Request.Context(), store, "", func(it storage.FileItem) error {
 			totalFiles++
 			totalSize += it.Size
+			return nil
+		})
+		if err != nil {
+			log.Printf("[STATS] list error: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_stats"})
+			return
 		}
 
 		resp := StatsResponse{
@@ -39,9 +46,17 @@ func GetStats(_ *sql.DB, store storage.Storage) gin.HandlerFunc {
 			TotalSizeB: totalSize,
 		}
 
-		// NASStorage の場合は StatVFS でディスク合計容量を取得
+		if ds, err := db.GetDedupStats(database); err == nil {
+			resp.DedupSavedB = ds.SavedB
+			resp.DedupBlobs = ds.Blobs
+			resp.DedupReferences = ds.References
+		} else {
+			log.Printf("[STATS] dedup stats error (non-fatal): %v", err)
+		}
+
+		// NAS (SFTP / SMB) の場合はディスク合計容量を取得
 		// 使用量は HideMe のアップロードフォルダ内のファイルのみ（disk.UsedBytes は NAS 全体なので使わない）
-		if nas, ok := store.(*storage.NASStorage); ok {
+		if nas, ok := storage.Unwrap(store).(storage.DiskStater); ok {
 			if disk, err := nas.DiskStat(c.Request.Context()); err == nil {
 				resp.StorageTotalB = disk.TotalBytes
 				resp.StorageUsedB  = uint64(totalSize) // HideMe フォルダ内のみ
@@ -51,6 +66,11 @@ func GetStats(_ *sql.DB, store storage.Storage) gin.HandlerFunc {
 			}
 		}
 
+		if cache, ok := storage.As[*storage.CachedStorage](storeFor("nas")); ok {
+			cs := cache.Stats()
+			resp.Cache = &cs
+		}
+
 		c.JSON(http.StatusOK, resp)
 	}
 }
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// GetStoragePoolStats は NAS の SFTP / SMB コネクションプールの統計を返す（admin only）
+// GET /v1/admin/storage/pool
+func GetStoragePoolStats(nas storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pooled, ok := nas.(interface{ PoolStats() storage.PoolStats })
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no_connection_pool"})
+			return
+		}
+		c.JSON(http.StatusOK, pooled.PoolStats())
+	}
+}
+
+// GetNASHostKey はホスト鍵の検証モード・ピン留めされた指紋・直近に提示された鍵を返す（admin only）
+// GET /v1/admin/storage/host-key
+func GetNASHostKey(nas *storage.NASStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if nas == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "nas_protocol_not_sftp"})
+			return
+		}
+		st, err := nas.HostKeyStatus()
+		if err != nil {
+			log.Printf("[STORAGE] host key status: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_host_key"})
+			return
+		}
+		c.JSON(http.StatusOK, st)
+	}
+}
+
+// RepinNASHostKey は NAS の現在のホスト鍵を DB にピン留めし直す（admin only, TOFU モードのみ）。
+// body の fingerprint（NAS 上で ssh-keygen -lf で確認したもの）は必須で、NAS が提示した鍵と一致する場合だけ保存する。
+// POST /v1/admin/storage/host-key/repin
+func RepinNASHostKey(nas *storage.NASStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			Fingerprint string `json:"fingerprint"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || strings.TrimSpace(body.Fingerprint) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "fingerprint_required"})
+			return
+		}
+
+		if nas == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "nas_protocol_not_sftp"})
+			return
+		}
+		if st, _ := nas.HostKeyStatus(); st.Mode != "tofu" {
+			c.JSON(http.StatusConflict, gin.H{"error": "host_key_not_managed_by_db", "mode": st.Mode})
+			return
+		}
+
+		info, err := nas.RepinHostKey(c.Request.Context(), body.Fingerprint)
+		if err != nil {
+			if errors.Is(err, storage.ErrHostKeyMismatch) {
+				c.JSON(http.StatusConflict, gin.H{"error": "host_key_mismatch", "detail": err.Error(), "presented": info})
+				return
+			}
+			log.Printf("[STORAGE] repin host key: %v", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed_to_probe_host_key", "detail": err.Error()})
+			return
+		}
+		log.Printf("[STORAGE] NAS host key re-pinned: %s %s", info.Host, info.Fingerprint)
+		c.JSON(http.StatusOK, gin.H{"pinned": true, "host_key": info})
+	}
+}
+
+// RepairStorageKeys は同じ保存キーを共有している collection_files を検出・修復する（admin only）。
+// ?dry_run=true で計画だけを返す。
+// POST /v1/admin/repair-storage-keys
+func RepairStorageKeys(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dryRun := c.Query("dry_run") == "true"
+		report, err := service.RepairKeyCollisions(c.Request.Context(), database, storeFor, dryRun)
+		if err != nil {
+			log.Printf("[STORAGE] repair keys: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_repair_keys"})
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// GetReplicaStatus はミラーの各レプリカの健全性・状態ごとのファイル数・修復待ちのファイルを返す（admin only）
+// GET /v1/admin/storage/replicas
+func GetReplicaStatus(database *sql.DB, mirror *storage.MirrorStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if mirror == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "mirror_not_configured"})
+			return
+		}
+		counts, err := db.CountReplicaStates(database)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		unhealthy, err := db.ListUnhealthyReplicas(database, 500)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"replicas":  mirror.Health(),
+			"counts":    counts,
+			"unhealthy": unhealthy,
+			"repair":    service.GetReplicaRepairStatus(),
+		})
+	}
+}
+
+// StartReplicaRepair は欠けたレプリカの修復をバックグラウンドで開始する（admin only）。
+// ?full=true でミラー上の全ファイルを確認してから修復する。
+// POST /v1/admin/storage/replicas/repair
+func StartReplicaRepair(database *sql.DB, mirror *storage.MirrorStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if mirror == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "mirror_not_configured"})
+			return
+		}
+		if service.GetReplicaRepairStatus().Status == "running" {
+			c.JSON(http.StatusConflict, gin.H{"error": "repair already running"})
+			return
+		}
+		fullScan := c.Query("full") == "true"
+		go func() {
+			if err := service.RepairReplicas(context.Background(), database, mirror, fullScan); err != nil {
+				log.Printf("[STORAGE] replica repair: %v", err)
+			}
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"message": "repair started"})
+	}
+}
+
+// GetStorageReconcile は整合性チェックの状況と未対応の結果を返す（admin only）。
+// ?status=quarantined などで対応済みの履歴も見られる。
+// GET /v1/admin/storage/reconcile
+func GetStorageReconcile(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := c.DefaultQuery("status", "open")
+		if status == "all" {
+			status = ""
+		}
+		findings, err := db.ListStorageFindings(database, status, 1000)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		counts, err := db.CountStorageFindings(database)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"scan":     service.GetReconcileStatus(),
+			"counts":   counts,
+			"findings": findings,
+		})
+	}
+}
+
+// StartStorageReconcile は全バックエンドと DB の突き合わせをバックグラウンドで開始する（admin only）
+// POST /v1/admin/storage/reconcile
+func StartStorageReconcile(database *sql.DB, backends map[string]storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if service.GetReconcileStatus().Status == "running" {
+			c.JSON(http.StatusConflict, gin.H{"error": "reconcile already running"})
+			return
+		}
+		go func() {
+			if err := service.ReconcileStorage(context.Background(), database, backends); err != nil {
+				log.Printf("[STORAGE] reconcile: %v", err)
+			}
+		}()
+		c.JSON(http.StatusAccepted, gin.H{"message": "reconcile started"})
+	}
+}
+
+// ResolveStorageFindings は整合性チェックの結果に対応する（admin only）。
+// action: quarantine / delete（orphan）、delete / relink（dangling）。
+// relink_to に orphan の ID を指定すると、dangling の参照をそのファイルに付け替える。
+// POST /v1/admin/storage/reconcile/resolve
+func ResolveStorageFindings(database *sql.DB, backends map[string]storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body struct {
+			IDs      []int64 `json:"ids" binding:"required"`
+			Action   string  `json:"action" binding:"required"`
+			RelinkTo int64   `json:"relink_to"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if service.GetReconcileStatus().Status == "running" {
+			c.JSON(http.StatusConflict, gin.H{"error": "reconcile already running"})
+			return
+		}
+		results, err := service.ResolveStorageFindings(c.Request.Context(), database, backends, body.IDs, body.Action, body.RelinkTo)
+		if err != nil {
+			if errors.Is(err, service.ErrInvalidResolve) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("[STORAGE] resolve findings: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_resolve"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"results": results})
+	}
+}
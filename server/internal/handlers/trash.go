@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+type trashItem struct {
+	db.TrashItem
+	PurgeAt *time.Time `json:"purge_at,omitempty"` // この日時を過ぎると実体ごと消える
+}
+
+// ListTrash はゴミ箱の中身を返す。メンバーは自分が削除した・アップロードしたものだけ、
+// admin は ?all=true で全員分を見られる。retention が 0 以下なら自動では消えない。
+// GET /v1/trash
+func ListTrash(database *sql.DB, retention time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		userID := cl.UserID
+		if cl.Role == "admin" && c.Query("all") == "true" {
+			userID = ""
+		}
+		items, err := db.ListTrash(database, userID)
+		if err != nil {
+			log.Printf("[TRASH] list: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_list_trash"})
+			return
+		}
+		out := make([]trashItem, len(items))
+		for i, it := range items {
+			out[i] = trashItem{TrashItem: it}
+			if retention > 0 {
+				at := it.DeletedAt.Add(retention)
+				out[i].PurgeAt = &at
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"items": out, "retention_days": int(retention / (24 * time.Hour))})
+	}
+}
+
+// RestoreTrashItem はゴミ箱のファイル・コレクションを元に戻す（admin only）
+// POST /v1/admin/trash/:kind/:id/restore  （kind: files / collections）
+func RestoreTrashItem(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var err error
+		switch c.Param("kind") {
+		case "files":
+			err = db.RestoreFile(database, id)
+		case "collections":
+			err = db.RestoreCollection(database, id)
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown_kind"})
+			return
+		}
+		if err != nil {
+			trashError(c, "restore", err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"restored": true})
+	}
+}
+
+// PurgeTrashItem はゴミ箱のファイル・コレクションを保持期間を待たずに完全に消す（admin only）
+// DELETE /v1/admin/trash/:kind/:id
+func PurgeTrashItem(database *sql.DB, storeFor StoreSelector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		var err error
+		switch c.Param("kind") {
+		case "files":
+			err = service.PurgeTrashedFile(c.Request.Context(), database, storeFor, id)
+		case "collections":
+			err = service.PurgeTrashedCollection(c.Request.Context(), database, storeFor, id)
+		default:
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown_kind"})
+			return
+		}
+		if err != nil {
+			trashError(c, "purge", err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"purged": true})
+	}
+}
+
+func trashError(c *gin.Context, op string, err error) {
+	switch {
+	case errors.Is(err, db.ErrFileNotFound), errors.Is(err, db.ErrCollectionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "not_in_trash"})
+	case errors.Is(err, db.ErrCollectionTrashed):
+		c.JSON(http.StatusConflict, gin.H{"error": "collection_in_trash"})
+	default:
+		log.Printf("[TRASH] %s: %v", op, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_" + op})
+	}
+}
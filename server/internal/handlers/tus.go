@@ -0,0 +1,491 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/progress"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// tus 1.0（https://tus.io/protocols/resumable-upload）のサーバー。
+// 拡張は creation・termination・checksum に対応する。
+// 受信中のデータは一時フォルダの hideme_tus_<ID>、状態は hideme_tus_<ID>.json に置くので、再起動しても続きから受け取れる。
+// 受信し終わったら MergeAndUpload と同じ処理に回し、進捗は <ID> を upload ID として SSE・ポーリングで取れる。
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum"
+	tusChecksums  = "sha1,md5,sha256"
+	tusOctets     = "application/offset+octet-stream"
+
+	// statusChecksumMismatch は checksum 拡張で決められた「チェックサムが合わない」の応答
+	statusChecksumMismatch = 460
+)
+
+// tusUpload は tus のアップロード 1 件の状態
+type tusUpload struct {
+	ID           string        `json:"id"`
+	Owner        string        `json:"owner"` // 作成したユーザー（続きを送れるのはこのユーザーだけ）
+	Role         string        `json:"role"`
+	CollectionID string        `json:"collection_id"`
+	FileName     string        `json:"file_name"`
+	Length       int64         `json:"length"`
+	Uploader     uploader      `json:"uploader"` // ファイルを記録するユーザー（admin は uploaded_by で変えられる）
+	Encode       encodeOptions `json:"encode"`
+	Completed    bool          `json:"completed"` // 受信し終わって処理に回した
+	CreatedAt    time.Time     `json:"created_at"`
+}
+
+func tusDataPath(id string) string {
+	return filepath.Join(service.TempDir(), "hideme_tus_"+id)
+}
+
+func tusInfoPath(id string) string {
+	return tusDataPath(id) + ".json"
+}
+
+func tusQuotaKey(id string) string {
+	return "tus:" + id
+}
+
+func loadTusUpload(id string) (*tusUpload, error) {
+	// ID はパスに使うので、こちらで発行した UUID の形のものしか受け付けない
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, err
+	}
+	var u tusUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (u *tusUpload) save() error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := tusInfoPath(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tusInfoPath(u.ID))
+}
+
+// offset は受信済みのバイト数
+func (u *tusUpload) offset() (int64, error) {
+	if u.Completed {
+		return u.Length, nil
+	}
+	info, err := os.Stat(tusDataPath(u.ID))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// 同じアップロードへの PATCH・DELETE が重ならないようにする
+var (
+	tusMu   sync.Mutex
+	tusBusy = map[string]bool{}
+)
+
+func tusAcquire(id string) bool {
+	tusMu.Lock()
+	defer tusMu.Unlock()
+	if tusBusy[id] {
+		return false
+	}
+	tusBusy[id] = true
+	return true
+}
+
+func tusRelease(id string) {
+	tusMu.Lock()
+	delete(tusBusy, id)
+	tusMu.Unlock()
+}
+
+// tusResumable は Tus-Resumable を付け、クライアントのバージョンが違えば 412 で止める
+func tusResumable(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusUploadFor は :uploadId のアップロードを読み込む（本人のもの以外は admin を除いて見えないことにする）
+func tusUploadFor(c *gin.Context, allowAdmin bool) (*tusUpload, bool) {
+	u, err := loadTusUpload(c.Param("uploadId"))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("[TUS] load %s: %v", c.Param("uploadId"), err)
+		}
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+	if u.Owner != cl.UserID && !(allowAdmin && cl.Role == "admin") {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil, false
+	}
+	return u, true
+}
+
+// TusOptions は対応しているバージョンと拡張を返す
+// OPTIONS /v1/tus, /v1/tus/:uploadId
+func TusOptions(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", tusVersion)
+		c.Header("Tus-Version", tusVersion)
+		c.Header("Tus-Extension", tusExtensions)
+		c.Header("Tus-Checksum-Algorithm", tusChecksums)
+		if maxBytes > 0 {
+			c.Header("Tus-Max-Size", strconv.FormatInt(maxBytes, 10))
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// TusCreate はアップロードを作る（creation 拡張）。
+// Upload-Metadata には filename（または name）・collection_id と、動画なら trim_start・trim_end・volume・
+// resolution・fps・skip_encode を入れる。admin は uploaded_by で記録するユーザーを変えられる。
+// POST /v1/tus
+func TusCreate(database *sql.DB, maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusResumable(c) {
+			return
+		}
+		length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			// Upload-Defer-Length（creation-defer-length 拡張）と空のファイルは受け付けない
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_upload_length"})
+			return
+		}
+		if maxBytes > 0 && length > maxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "file_too_large"})
+			return
+		}
+
+		meta, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_upload_metadata"})
+			return
+		}
+		fileName := meta["filename"]
+		if fileName == "" {
+			fileName = meta["name"]
+		}
+		collectionID := meta["collection_id"]
+		if fileName == "" || collectionID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "filename_and_collection_id_required"})
+			return
+		}
+		if _, err := db.GetCollectionByID(database, collectionID); err != nil {
+			if errors.Is(err, db.ErrCollectionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "collection_not_found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_get_collection"})
+			return
+		}
+
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		u := &tusUpload{
+			ID:           uuid.NewString(),
+			Owner:        cl.UserID,
+			Role:         cl.Role,
+			CollectionID: collectionID,
+			FileName:     fileName,
+			Length:       length,
+			Uploader:     uploader{UserID: cl.UserID, Username: cl.Username, Avatar: cl.AvatarURL},
+			CreatedAt:    time.Now().UTC(),
+		}
+		if cl.Role == "admin" && meta["uploaded_by"] != "" {
+			u.Uploader.UserID = meta["uploaded_by"]
+		}
+		u.Encode.TrimStart, _ = strconv.ParseFloat(meta["trim_start"], 64)
+		u.Encode.TrimEnd, _ = strconv.ParseFloat(meta["trim_end"], 64)
+		u.Encode.Volume, _ = strconv.Atoi(meta["volume"])
+		u.Encode.Resolution = meta["resolution"]
+		u.Encode.FPS, _ = strconv.Atoi(meta["fps"])
+		u.Encode.Skip = meta["skip_encode"] == "true"
+
+		// 受信を始める前に申告サイズで空き容量と容量制限を確認する（DB に記録されるまで確保）
+		if err := service.CheckTempSpace(u.Length); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+		if err := service.ReserveQuota(database, tusQuotaKey(u.ID), "", u.Owner, u.Role, u.CollectionID, u.Length); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+
+		f, err := os.OpenFile(tusDataPath(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			err = f.Close()
+		}
+		if err == nil {
+			err = u.save()
+		}
+		if err != nil {
+			log.Printf("[TUS] create %s: %v", u.ID, err)
+			service.ReleaseQuota(tusQuotaKey(u.ID))
+			os.Remove(tusDataPath(u.ID))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_create_upload"})
+			return
+		}
+		progress.Global.Begin(u.ID, u.Owner, u.FileName)
+		log.Printf("[TUS] created %s: %s (%d bytes)", u.ID, u.FileName, u.Length)
+
+		c.Header("Location", "/v1/tus/"+u.ID)
+		c.Header("X-Upload-ID", u.ID)
+		c.Status(http.StatusCreated)
+	}
+}
+
+// TusHead は受信済みのバイト数を返す
+// HEAD /v1/tus/:uploadId
+func TusHead() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusResumable(c) {
+			return
+		}
+		u, ok := tusUploadFor(c, false)
+		if !ok {
+			return
+		}
+		offset, err := u.offset()
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.Header("Upload-Length", strconv.FormatInt(u.Length, 10))
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+	}
+}
+
+// TusPatch は Upload-Offset の位置から続きを受け取る。Upload-Checksum があれば
+// このリクエストの分を検証し、合わなければ受け取った分を捨てて 460 を返す。
+// 最後まで受け取ったらエンコード・保存をバックグラウンドで始める。
+// PATCH /v1/tus/:uploadId
+func TusPatch(store storage.Storage, database *sql.DB, storageType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusResumable(c) {
+			return
+		}
+		if c.ContentType() != tusOctets {
+			c.AbortWithStatus(http.StatusUnsupportedMediaType)
+			return
+		}
+		u, ok := tusUploadFor(c, false)
+		if !ok {
+			return
+		}
+		if !tusAcquire(u.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload_in_progress"})
+			return
+		}
+		defer tusRelease(u.ID)
+
+		offset, err := u.offset()
+		if err != nil {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		clientOffset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_upload_offset"})
+			return
+		}
+		if u.Completed || clientOffset != offset {
+			c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+			c.JSON(http.StatusConflict, gin.H{"error": "offset_mismatch"})
+			return
+		}
+		remaining := u.Length - offset
+		if c.Request.ContentLength > remaining {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "exceeds_upload_length"})
+			return
+		}
+
+		var sum hash.Hash
+		var want []byte
+		if header := c.GetHeader("Upload-Checksum"); header != "" {
+			if sum, want, err = parseTusChecksum(header); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid_upload_checksum"})
+				return
+			}
+		}
+
+		// 再起動で確保が消えていても、続きを受け取る前に確保し直す（長いアップロードで期限切れにならないように）
+		if err := service.ReserveQuota(database, tusQuotaKey(u.ID), "", u.Owner, u.Role, u.CollectionID, u.Length); err != nil {
+			c.JSON(quotaErrorBody(err))
+			return
+		}
+
+		f, err := os.OpenFile(tusDataPath(u.ID), os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			log.Printf("[TUS] open %s: %v", u.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_open_upload"})
+			return
+		}
+		var w io.Writer = f
+		if sum != nil {
+			w = io.MultiWriter(f, sum)
+		}
+		n, copyErr := io.Copy(w, io.LimitReader(c.Request.Body, remaining))
+		if sum != nil && (copyErr != nil || string(sum.Sum(nil)) != string(want)) {
+			// チェックサム付きのリクエストは全部受け取れて一致したときだけ残す
+			f.Truncate(offset)
+			f.Close()
+			if copyErr != nil {
+				log.Printf("[TUS] %s: receive failed: %v", u.ID, copyErr)
+				c.JSON(http.StatusBadRequest, gin.H{"error": "failed_to_receive"})
+				return
+			}
+			c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+			c.JSON(statusChecksumMismatch, gin.H{"error": "checksum_mismatch"})
+			return
+		}
+		if err := f.Close(); err != nil && copyErr == nil {
+			copyErr = err
+		}
+		offset += n
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		if copyErr != nil {
+			// 受け取れた分は残す（クライアントは HEAD で位置を確かめて続きを送る）
+			log.Printf("[TUS] %s: receive interrupted at %d/%d: %v", u.ID, offset, u.Length, copyErr)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed_to_receive"})
+			return
+		}
+
+		if offset == u.Length {
+			if !finishTusUpload(c, u) {
+				return
+			}
+			u.Uploader.OwnerID = u.Owner
+			if err := processAssembledUpload(store, database, storageType, u.ID, u.CollectionID, u.Uploader, u.FileName, tusDataPath(u.ID), tusQuotaKey(u.ID), u.Encode); err != nil {
+				log.Printf("[TUS] %s: failed to queue: %v", u.ID, err)
+				os.Remove(tusDataPath(u.ID))
+				service.ReleaseQuota(tusQuotaKey(u.ID))
+				os.Remove(tusInfoPath(u.ID))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_queue"})
+				return
+			}
+			// 受信し終わった記録は HEAD に答えられるように残す（janitor が片付ける）
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// finishTusUpload は受信し終わったことを記録する（以後の PATCH・DELETE は受け付けない）
+func finishTusUpload(c *gin.Context, u *tusUpload) bool {
+	u.Completed = true
+	if err := u.save(); err != nil {
+		log.Printf("[TUS] save %s: %v", u.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_save_upload"})
+		return false
+	}
+	log.Printf("[TUS] received %s: %s (%d bytes)", u.ID, u.FileName, u.Length)
+	return true
+}
+
+// TusDelete は受信途中のアップロードを捨てる（termination 拡張。本人と admin のみ）
+// DELETE /v1/tus/:uploadId
+func TusDelete() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tusResumable(c) {
+			return
+		}
+		u, ok := tusUploadFor(c, true)
+		if !ok {
+			return
+		}
+		if !tusAcquire(u.ID) {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload_in_progress"})
+			return
+		}
+		defer tusRelease(u.ID)
+		if u.Completed {
+			c.JSON(http.StatusConflict, gin.H{"error": "upload_completed"})
+			return
+		}
+
+		os.Remove(tusDataPath(u.ID))
+		os.Remove(tusInfoPath(u.ID))
+		service.ReleaseQuota(tusQuotaKey(u.ID))
+		log.Printf("[TUS] terminated %s", u.ID)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// parseTusMetadata は Upload-Metadata（"キー base64値" をカンマで区切ったもの）を読む
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, err
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// parseTusChecksum は Upload-Checksum（"アルゴリズム base64値"）を読む
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+	alg, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, nil, errors.New("malformed checksum")
+	}
+	want, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch alg {
+	case "sha1":
+		return sha1.New(), want, nil
+	case "md5":
+		return md5.New(), want, nil
+	case "sha256":
+		return sha256.New(), want, nil
+	default:
+		return nil, nil, errors.New("unsupported checksum algorithm")
+	}
+}
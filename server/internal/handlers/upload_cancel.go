@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/gin-gonic/gin"
+)
+
+// CancelUpload は受け付けたアップロードを取り消す（アップロードした本人と admin のみ）。
+// 受信中の WebSocket アップロード・保存中・エンコード中・順番待ちのものを止め、一時ファイルと保存途中のファイルを消す。
+// 結果は進捗の cancelled で通知する。
+// POST /v1/uploads/:uploadId/cancel
+func CancelUpload(database *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cl := c.MustGet(middleware.ClaimsKey).(*auth.Claims)
+		uploadID := c.Param("uploadId")
+		if err := service.CancelUpload(database, uploadID, cl.UserID, cl.Role == "admin"); err != nil {
+			c.JSON(cancelErrorBody(uploadID, err))
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": "cancelling", "upload_id": uploadID})
+	}
+}
+
+// cancelErrorBody は CancelUpload のエラーをレスポンスのステータスと本文に変換する
+func cancelErrorBody(uploadID string, err error) (int, gin.H) {
+	switch {
+	case errors.Is(err, service.ErrUploadNotFound):
+		return http.StatusNotFound, gin.H{"error": "upload_not_found"}
+	case errors.Is(err, service.ErrUploadFinished):
+		return http.StatusConflict, gin.H{"error": "upload_finished"}
+	}
+	log.Printf("[UPLOAD] cancel %s: %v", uploadID, err)
+	return http.StatusInternalServerError, gin.H{"error": "failed_to_cancel"}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/middleware"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/dav"
+
+// WebDAV はコレクションをフォルダとして見せる WebDAV サーバー。
+// 認証は Bearer の JWT か、Basic 認証のユーザー名 + アプリパスワード（/v1/app-passwords で発行）。
+// PUT はブラウザからのアップロードと同じくクォータを確認してから保存し、
+// DELETE（ゴミ箱へ移動）・MOVE（名前の変更・コレクション間の移動）はアップロードした本人か admin だけができる。
+// コレクションの作成・名前の変更・削除は admin only。
+// /dav/*  （GET HEAD PUT DELETE OPTIONS PROPFIND PROPPATCH MKCOL COPY MOVE LOCK UNLOCK）
+func WebDAV(store storage.Storage, database *sql.DB, storeFor StoreSelector, storageType string, versionsKeep int, encodeVideos bool) gin.HandlerFunc {
+	fsys := &davFS{
+		database:     database,
+		store:        store,
+		storeFor:     storeFor,
+		storageType:  storageType,
+		versionsKeep: versionsKeep,
+		encodeVideos: encodeVideos,
+	}
+	h := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fsys,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, os.ErrPermission) {
+				log.Printf("[DAV] %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	return func(c *gin.Context) {
+		cl, ok := davAuthenticate(c, database)
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="HideMe", charset="UTF-8"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set(middleware.ClaimsKey, cl)
+
+		req := &davRequest{claims: cl, quotaKey: "dav:" + uuid.NewString(), expectSize: -1}
+		defer func() {
+			if !req.keepQuota {
+				service.ReleaseQuota(req.quotaKey)
+			}
+		}()
+		if !fsys.precheck(c, req) {
+			return
+		}
+
+		ctx := context.WithValue(c.Request.Context(), davRequestKey{}, req)
+		h.ServeHTTP(c.Writer, c.Request.WithContext(ctx))
+	}
+}
+
+// davAuthenticate は Bearer の JWT か Basic 認証のアプリパスワードからログイン情報を返す
+func davAuthenticate(c *gin.Context, database *sql.DB) (*auth.Claims, bool) {
+	header := c.GetHeader("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		// 強制ログアウトの確認はルートの CheckForceLogout で済んでいる
+		cl, err := auth.ParseToken(strings.TrimPrefix(header, "Bearer "))
+		return cl, err == nil
+	}
+	username, password, ok := c.Request.BasicAuth()
+	if !ok || !strings.HasPrefix(password, auth.AppPasswordPrefix) {
+		return nil, false
+	}
+	m, err := db.GetAppPasswordMember(database, auth.HashAppPassword(password))
+	if err != nil {
+		if !errors.Is(err, db.ErrAppPasswordNotFound) {
+			log.Printf("[DAV] app password lookup: %v", err)
+		}
+		return nil, false
+	}
+	if !strings.EqualFold(username, m.Username) {
+		return nil, false
+	}
+	return &auth.Claims{
+		UserID:     m.ID,
+		Username:   m.Username,
+		Role:       m.Role,
+		AvatarURL:  m.Avatar,
+		AuthMethod: "app_password",
+	}, true
+}
+
+// precheck は webdav.Handler に渡す前に権限とクォータを確認する。
+// webdav.Handler は FileSystem のエラーをまとめて 404 / 405 にしてしまうので、
+// 権限不足（403）・クォータ超過（413）はここで返す。
+func (fsys *davFS) precheck(c *gin.Context, req *davRequest) bool {
+	switch c.Request.Method {
+	case http.MethodPut:
+		parts := splitDavPath(strings.TrimPrefix(c.Request.URL.Path, davPrefix))
+		if len(parts) != 2 || davIgnoredName(parts[1]) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+		col, err := fsys.findCollection(parts[0])
+		if err != nil {
+			return true // 404 / 409 は webdav.Handler に任せる
+		}
+		if existing, err := fsys.findFile(col.col.ID, parts[1]); err == nil && !req.canWrite(existing.file.UploadedBy) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+		req.expectSize = c.Request.ContentLength
+		if err := service.CheckTempSpace(req.expectSize); err != nil {
+			c.AbortWithStatusJSON(quotaErrorBody(err))
+			return false
+		}
+		// Content-Length の無いチャンク転送は、受け取り終えてから commit で実際のサイズを確保する
+		if req.expectSize >= 0 {
+			if err := service.ReserveQuota(fsys.database, req.quotaKey, "", req.claims.UserID, req.claims.Role, col.col.ID, req.expectSize); err != nil {
+				c.AbortWithStatusJSON(quotaErrorBody(err))
+				return false
+			}
+		}
+	case "MKCOL":
+		if req.claims.Role != "admin" {
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+	case http.MethodDelete:
+		node, err := fsys.resolve(splitDavPath(strings.TrimPrefix(c.Request.URL.Path, davPrefix)))
+		if err != nil {
+			return true
+		}
+		if node.col == nil || (node.file == nil && req.claims.Role != "admin") ||
+			(node.file != nil && !req.canWrite(node.file.file.UploadedBy)) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,591 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/service"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/google/uuid"
+	"golang.org/x/net/webdav"
+)
+
+// davFS は webdav.FileSystem の実装。ルート直下がコレクション、その下がファイル（表示名）になる。
+// 書き込みはブラウザからのアップロード・編集・削除と同じ DB 関数を通し、権限も同じ規則で確認する。
+type davFS struct {
+	database     *sql.DB
+	store        storage.Storage // 新しくアップロードするファイルの保存先
+	storeFor     StoreSelector
+	storageType  string
+	versionsKeep int
+	encodeVideos bool
+}
+
+type davRequestKey struct{}
+
+// davRequest は WebDAV リクエスト 1 件分の認証情報とアップロードの状態（context で FileSystem に渡す）
+type davRequest struct {
+	claims     *auth.Claims
+	quotaKey   string
+	expectSize int64 // PUT の Content-Length（不明・PUT 以外は -1）
+	keepQuota  bool  // バックグラウンドのエンコードに確保分を引き継いだ
+}
+
+func davRequestFrom(ctx context.Context) *davRequest {
+	req, _ := ctx.Value(davRequestKey{}).(*davRequest)
+	if req == nil {
+		return &davRequest{claims: &auth.Claims{}, expectSize: -1}
+	}
+	return req
+}
+
+func (r *davRequest) canWrite(uploadedBy string) bool {
+	return r.claims.Role == "admin" || (uploadedBy != "" && r.claims.UserID == uploadedBy)
+}
+
+type davCollection struct {
+	name string
+	col  db.Collection
+}
+
+type davFile struct {
+	name string
+	file db.CollectionFileWithUploader
+}
+
+// davNode はパスが指すもの。col が nil ならルート、file が nil ならコレクションのフォルダ。
+type davNode struct {
+	col  *davCollection
+	file *davFile
+}
+
+func splitDavPath(name string) []string {
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if clean == "" {
+		return nil
+	}
+	return strings.Split(clean, "/")
+}
+
+// davSafeName はフォルダ・ファイル名に使えない文字を置き換える（空なら fallback）
+func davSafeName(name, fallback string) string {
+	name = strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(name))
+	if name == "" || name == "." || name == ".." {
+		return fallback
+	}
+	return name
+}
+
+// davUniqueName は同じ名前が既にあれば拡張子の前に ID の先頭を付けて区別する（例: "clip (0b6f3c1e).mp4"）
+func davUniqueName(name, id string, used map[string]bool) string {
+	if used[name] {
+		ext := path.Ext(name)
+		name = strings.TrimSuffix(name, ext) + " (" + id[:min(8, len(id))] + ")" + ext
+	}
+	used[name] = true
+	return name
+}
+
+// davIgnoredName は OS が勝手に作るメタデータファイル（コレクションに入れない）
+func davIgnoredName(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(name, "._") || lower == ".ds_store" || lower == "thumbs.db" || lower == "desktop.ini"
+}
+
+func (fsys *davFS) collections() ([]davCollection, error) {
+	cols, err := db.ListCollections(fsys.database)
+	if err != nil {
+		return nil, err
+	}
+	used := map[string]bool{}
+	out := make([]davCollection, len(cols))
+	for i, col := range cols {
+		out[i] = davCollection{name: davUniqueName(davSafeName(col.Name, col.ID), col.ID, used), col: col}
+	}
+	return out, nil
+}
+
+func (fsys *davFS) files(collectionID string) ([]davFile, error) {
+	files, err := db.ListFilesByCollectionWithUploader(fsys.database, collectionID)
+	if err != nil {
+		return nil, err
+	}
+	// 新しい順に返るので、古いファイルほど元の名前のままになるよう逆から名前を決める
+	used := map[string]bool{}
+	out := make([]davFile, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		out[i] = davFile{name: davUniqueName(davSafeName(f.DisplayName, f.FileName), f.ID, used), file: f}
+	}
+	return out, nil
+}
+
+func (fsys *davFS) findCollection(name string) (*davCollection, error) {
+	cols, err := fsys.collections()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cols {
+		if c.name == name {
+			return &c, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fsys *davFS) findFile(collectionID, name string) (*davFile, error) {
+	files, err := fsys.files(collectionID)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.name == name {
+			return &f, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fsys *davFS) resolve(parts []string) (davNode, error) {
+	if len(parts) == 0 {
+		return davNode{}, nil
+	}
+	if len(parts) > 2 {
+		return davNode{}, os.ErrNotExist
+	}
+	col, err := fsys.findCollection(parts[0])
+	if err != nil {
+		return davNode{}, err
+	}
+	if len(parts) == 1 {
+		return davNode{col: col}, nil
+	}
+	file, err := fsys.findFile(col.col.ID, parts[1])
+	if err != nil {
+		return davNode{}, err
+	}
+	return davNode{col: col, file: file}, nil
+}
+
+func (n davNode) info() *davInfo {
+	switch {
+	case n.col == nil:
+		return &davInfo{name: "/", dir: true}
+	case n.file == nil:
+		return &davInfo{name: n.col.name, dir: true}
+	}
+	return &davInfo{name: n.file.name, size: n.file.file.FileSize, modified: n.file.file.UploadedAt}
+}
+
+func (fsys *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	node, err := fsys.resolve(splitDavPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return node.info(), nil
+}
+
+func (fsys *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	parts := splitDavPath(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return fsys.create(ctx, parts, flag)
+	}
+	node, err := fsys.resolve(parts)
+	if err != nil {
+		return nil, err
+	}
+	if node.file == nil {
+		return &davDir{fsys: fsys, node: node}, nil
+	}
+	return &davReadFile{
+		ctx:   ctx,
+		store: fsys.storeFor(node.file.file.StorageType),
+		key:   node.file.file.FileName,
+		info:  node.info(),
+	}, nil
+}
+
+// create は PUT（と COPY の書き込み側）で開くファイル。中身は一時ファイルに溜め、Close でアップロードする。
+func (fsys *davFS) create(ctx context.Context, parts []string, flag int) (webdav.File, error) {
+	req := davRequestFrom(ctx)
+	if len(parts) != 2 || davIgnoredName(parts[1]) {
+		return nil, os.ErrPermission // ファイルはコレクションの中にしか置けない
+	}
+	col, err := fsys.findCollection(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	existing, err := fsys.findFile(col.col.ID, parts[1])
+	switch {
+	case err == nil:
+		if flag&os.O_EXCL != 0 {
+			return nil, os.ErrExist
+		}
+		if !req.canWrite(existing.file.UploadedBy) {
+			return nil, os.ErrPermission
+		}
+	case errors.Is(err, os.ErrNotExist):
+		existing = nil
+	default:
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(service.TempDir(), "hideme_dav_*"+path.Ext(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	return &davWriteFile{fsys: fsys, ctx: ctx, req: req, col: col.col, name: parts[1], existing: existing, tmp: tmp}, nil
+}
+
+func (fsys *davFS) RemoveAll(ctx context.Context, name string) error {
+	req := davRequestFrom(ctx)
+	node, err := fsys.resolve(splitDavPath(name))
+	if err != nil {
+		return err
+	}
+	cl := req.claims
+	switch {
+	case node.col == nil:
+		return os.ErrPermission
+	case node.file == nil:
+		if cl.Role != "admin" {
+			return os.ErrPermission
+		}
+		return db.TrashCollection(fsys.database, node.col.col.ID, cl.UserID)
+	}
+	if !req.canWrite(node.file.file.UploadedBy) {
+		return os.ErrPermission
+	}
+	if err := db.TrashFile(fsys.database, node.file.file.ID, cl.UserID); err != nil {
+		return err
+	}
+	go service.BroadcastActivity(fsys.database, "delete", cl.UserID, cl.Username, cl.AvatarURL, node.file.name)
+	return nil
+}
+
+// Rename はファイルの表示名の変更・別のコレクションへの移動、コレクション名の変更（admin）に使う
+func (fsys *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	req := davRequestFrom(ctx)
+	cl := req.claims
+	src, dst := splitDavPath(oldName), splitDavPath(newName)
+	node, err := fsys.resolve(src)
+	if err != nil {
+		return err
+	}
+	if _, err := fsys.resolve(dst); err == nil {
+		return os.ErrExist // 上書きの MOVE は webdav.Handler が先に消してから呼ぶ
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	switch {
+	case len(src) == 1 && len(dst) == 1:
+		if cl.Role != "admin" {
+			return os.ErrPermission
+		}
+		c := node.col.col
+		return db.UpdateCollection(fsys.database, c.ID, dst[0], c.Description, c.Color, c.Icon, c.ImageURL, c.Genre)
+	case len(src) == 2 && len(dst) == 2:
+		if davIgnoredName(dst[1]) || !req.canWrite(node.file.file.UploadedBy) {
+			return os.ErrPermission
+		}
+		target, err := fsys.findCollection(dst[0])
+		if err != nil {
+			return err
+		}
+		f := node.file.file
+		// 別のコレクションへ移すときは移動先の容量制限を確かめる（超える場合は 403 で断る）
+		err = service.MoveFileWithinQuota(fsys.database, f.ID, f.CollectionID, target.col.ID, func() error {
+			return db.UpdateCollectionFile(fsys.database, f.ID, dst[1], f.ThumbnailName, target.col.ID, "")
+		})
+		if errors.Is(err, service.ErrQuotaExceeded) {
+			return fmt.Errorf("%w: %w", os.ErrPermission, err)
+		}
+		if err != nil {
+			return err
+		}
+		go service.BroadcastActivity(fsys.database, "edit", cl.UserID, cl.Username, cl.AvatarURL, dst[1])
+		return nil
+	}
+	return os.ErrPermission
+}
+
+// Mkdir はルート直下ならコレクションを作る（admin only）。コレクションの中にフォルダは作れない。
+func (fsys *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	cl := davRequestFrom(ctx).claims
+	parts := splitDavPath(name)
+	if len(parts) != 1 {
+		if len(parts) == 0 {
+			return os.ErrExist
+		}
+		return os.ErrPermission
+	}
+	if _, err := fsys.findCollection(parts[0]); err == nil {
+		return os.ErrExist
+	}
+	if cl.Role != "admin" {
+		return os.ErrPermission
+	}
+	_, err := db.CreateCollection(fsys.database, parts[0], "", "", "", "", "")
+	return err
+}
+
+// commit は PUT で受け取った内容を UploadToCollection と同じ手順で保存する
+// （既存のファイルへの PUT は中身の差し替えになり、前の内容は旧バージョンに残る）
+func (fsys *davFS) commit(ctx context.Context, f *davWriteFile) error {
+	req, cl := f.req, f.req.claims
+	// precheck と同じキー・パートなので、Content-Length で確保した分を実際のサイズで置き換える（足し合わせない）
+	if err := service.ReserveQuota(fsys.database, req.quotaKey, "", cl.UserID, cl.Role, f.col.ID, f.size); err != nil {
+		return err
+	}
+
+	if f.existing == nil && fsys.encodeVideos && service.IsVideoFilename(f.name) {
+		// 同期クライアントは結果を待たないので、ブラウザからのアップロードより後に回す
+		_, err := service.EnqueueEncodeJob(fsys.database, db.EncodeJob{
+			ID:           "dav_" + uuid.NewString(),
+			OwnerID:      cl.UserID,
+			UploadedBy:   cl.UserID,
+			Username:     cl.Username,
+			Avatar:       cl.AvatarURL,
+			CollectionID: f.col.ID,
+			StorageType:  fsys.storageType,
+			FileName:     f.name,
+			InputPath:    f.tmp.Name(),
+			QuotaKey:     req.quotaKey,
+			Volume:       100,
+			Resolution:   "720p",
+			FPS:          30,
+			Priority:     service.EncodePriorityBackground,
+		})
+		if err != nil {
+			return err
+		}
+		f.tmp.Close()
+		f.tmp = nil // 一時ファイルと確保はキューが片付ける
+		req.keepQuota = true
+		return nil
+	}
+
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	item, err := fsys.store.Upload(ctx, storage.NewObjectKey(f.name), f.tmp, f.size)
+	if err != nil {
+		return err
+	}
+
+	if f.existing != nil {
+		old := f.existing.file
+		_, err := db.ReplaceFileContents(fsys.database, old.ID, db.FileContents{
+			FileName:     item.Name,
+			OriginalName: f.name,
+			FileSize:     item.Size,
+			StorageType:  fsys.storageType,
+			UploadedBy:   old.UploadedBy,
+		}, cl.UserID)
+		if err != nil {
+			_ = fsys.store.Delete(ctx, item.Name)
+			return err
+		}
+		keep, err := service.VersionRetention(fsys.database, f.col.ID, fsys.versionsKeep)
+		if err == nil {
+			err = service.PruneFileVersions(ctx, fsys.database, fsys.storeFor, old.ID, keep)
+		}
+		if err != nil {
+			log.Printf("[DAV] WARN prune %s: %v", old.ID, err)
+		}
+		go service.BroadcastActivity(fsys.database, "edit", cl.UserID, cl.Username, cl.AvatarURL, f.name)
+		return nil
+	}
+
+	if _, err := db.AddFileToCollection(fsys.database, f.col.ID, item.Name, f.name, "", fsys.storageType, item.Size, cl.UserID); err != nil {
+		_ = fsys.store.Delete(ctx, item.Name)
+		return err
+	}
+	go service.BroadcastActivity(fsys.database, "upload", cl.UserID, cl.Username, cl.AvatarURL, f.name)
+	return nil
+}
+
+// davInfo は os.FileInfo の実装
+type davInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+func (i *davInfo) Name() string       { return i.name }
+func (i *davInfo) Size() int64        { return i.size }
+func (i *davInfo) ModTime() time.Time { return i.modified }
+func (i *davInfo) IsDir() bool        { return i.dir }
+func (i *davInfo) Sys() any           { return nil }
+func (i *davInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType は拡張子から決める（webdav.Handler が中身を読んで判定しないように）
+func (i *davInfo) ContentType(ctx context.Context) (string, error) {
+	if ct := mime.TypeByExtension(path.Ext(i.name)); ct != "" {
+		return ct, nil
+	}
+	return videoMimeType(i.name), nil
+}
+
+// davDir はルート・コレクションのフォルダ
+type davDir struct {
+	fsys *davFS
+	node davNode
+	read bool
+}
+
+func (d *davDir) Close() error                   { return nil }
+func (d *davDir) Read([]byte) (int, error)       { return 0, fs.ErrInvalid }
+func (d *davDir) Seek(int64, int) (int64, error) { return 0, fs.ErrInvalid }
+func (d *davDir) Write([]byte) (int, error)      { return 0, os.ErrPermission }
+func (d *davDir) Stat() (os.FileInfo, error)     { return d.node.info(), nil }
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	var infos []fs.FileInfo
+	if d.node.col == nil {
+		cols, err := d.fsys.collections()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cols {
+			infos = append(infos, davNode{col: &c}.info())
+		}
+	} else {
+		files, err := d.fsys.files(d.node.col.col.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			infos = append(infos, davNode{col: d.node.col, file: &f}.info())
+		}
+	}
+	return infos, nil
+}
+
+// davReadFile は GET 用。ストアは最初に読むときに開く（PROPFIND で開くだけのときに NAS へ接続しない）。
+type davReadFile struct {
+	ctx   context.Context
+	store storage.Storage
+	key   string
+	info  *davInfo
+	r     io.ReadSeekCloser
+}
+
+func (f *davReadFile) open() error {
+	if f.r != nil {
+		return nil
+	}
+	r, _, err := f.store.OpenSeeker(f.ctx, f.key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return os.ErrNotExist
+		}
+		return err
+	}
+	f.r = r
+	return nil
+}
+
+func (f *davReadFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
+
+func (f *davReadFile) Seek(offset int64, whence int) (int64, error) {
+	if f.r == nil && offset == 0 && (whence == io.SeekStart || whence == io.SeekEnd) {
+		// http.ServeContent はサイズを知るために末尾へシークする。開かずに答えられる分は答える
+		if whence == io.SeekEnd {
+			return f.info.size, nil
+		}
+		return 0, nil
+	}
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *davReadFile) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	return f.r.Close()
+}
+
+func (f *davReadFile) Readdir(int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f *davReadFile) Stat() (os.FileInfo, error)         { return f.info, nil }
+func (f *davReadFile) Write([]byte) (int, error)          { return 0, os.ErrPermission }
+
+// davWriteFile は PUT の受け口。Close で内容を確かめてから保存する。
+type davWriteFile struct {
+	fsys     *davFS
+	ctx      context.Context
+	req      *davRequest
+	col      db.Collection
+	name     string
+	existing *davFile
+	tmp      *os.File
+	size     int64
+}
+
+func (f *davWriteFile) Write(p []byte) (int, error) {
+	n, err := f.tmp.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *davWriteFile) Close() error {
+	defer func() {
+		if f.tmp != nil {
+			f.tmp.Close()
+			os.Remove(f.tmp.Name())
+		}
+	}()
+	// 途中で切れた PUT は保存しない（webdav.Handler はコピーに失敗しても Close を呼ぶ）
+	if err := f.ctx.Err(); err != nil {
+		return err
+	}
+	if f.req.expectSize >= 0 && f.size != f.req.expectSize {
+		return fmt.Errorf("dav: incomplete upload (%d of %d bytes)", f.size, f.req.expectSize)
+	}
+	if err := f.fsys.commit(f.ctx, f); err != nil {
+		log.Printf("[DAV] save %s/%s: %v", f.col.Name, f.name, err)
+		return err
+	}
+	return nil
+}
+
+func (f *davWriteFile) Stat() (os.FileInfo, error) {
+	return &davInfo{name: f.name, size: f.size, modified: time.Now().UTC()}, nil
+}
+
+func (f *davWriteFile) Read([]byte) (int, error)           { return 0, fs.ErrInvalid }
+func (f *davWriteFile) Seek(int64, int) (int64, error)     { return 0, fs.ErrInvalid }
+func (f *davWriteFile) Readdir(int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
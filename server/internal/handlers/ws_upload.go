@@ -8,8 +8,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BBSHSH/HideMe/server/internal/auth"
+	"github.com/BBSHSH/HideMe/server/internal/db"
 	"github.com/BBSHSH/HideMe/server/internal/progress"
 	"github.com/BBSHSH/HideMe/server/internal/service"
 	"github.com/BBSHSH/HideMe/server/internal/storage"
@@ -72,22 +76,49 @@ func WSUpload(store storage.Storage, database *sql.DB, storageType string) gin.H
 			return
 		}
 
-		log.Printf("[WS] upload start: %s (%d bytes) upload_id=%s", meta.FileName, meta.FileSize, meta.UploadID)
+		uploadID := resolveUploadID(database, meta.UploadID)
+		log.Printf("[WS] upload start: %s (%d bytes) upload_id=%s", meta.FileName, meta.FileSize, uploadID)
+
+		// 受信を始める前に申告サイズで空き容量と容量制限を確認する（DB に記録されるまで確保）
+		quotaKey := "ws:" + uploadID
+		err = service.CheckTempSpace(meta.FileSize)
+		if err == nil {
+			err = service.ReserveQuota(database, quotaKey, "", userID, claims.Role, meta.CollectionID, meta.FileSize)
+		}
+		if err != nil {
+			_, body := quotaErrorBody(err)
+			data, _ := json.Marshal(body)
+			conn.WriteMessage(websocket.TextMessage, data)
+			return
+		}
+		keepQuota := false
+		defer func() {
+			if !keepQuota {
+				service.ReleaseQuota(quotaKey)
+			}
+		}()
 
 		sendProgress := func(phase, msg string, percent float64) {
 			data, _ := json.Marshal(map[string]interface{}{
-				"type":    "progress",
-				"phase":   phase,
-				"percent": percent,
-				"message": msg,
+				"type":      "progress",
+				"upload_id": uploadID,
+				"phase":     phase,
+				"percent":   percent,
+				"message":   msg,
 			})
 			conn.WriteMessage(websocket.TextMessage, data)
 		}
 
+		progress.Global.Begin(uploadID, userID, meta.FileName)
 		sendProgress("receiving", "", 0)
 
-		tmpPath := filepath.Join(os.TempDir(), "hideme_ws_"+meta.UploadID+filepath.Ext(meta.FileName))
-		defer os.Remove(tmpPath)
+		tmpPath := filepath.Join(service.TempDir(), "hideme_ws_"+uploadID+filepath.Ext(meta.FileName))
+		keepTmp := false
+		defer func() {
+			if !keepTmp {
+				os.Remove(tmpPath)
+			}
+		}()
 
 		tmpFile, err := os.Create(tmpPath)
 		if err != nil {
@@ -95,12 +126,34 @@ func WSUpload(store storage.Storage, database *sql.DB, storageType string) gin.H
 			return
 		}
 
+		// 受信中に CancelUpload されたら受信待ちを打ち切る（書き込みはこのゴルーチンだけが行う）
+		var cancelled atomic.Bool
+		stopTracking := sync.OnceFunc(service.TrackUpload(uploadID, userID, func() {
+			cancelled.Store(true)
+			conn.SetReadDeadline(time.Now())
+		}))
+		defer stopTracking()
+
 		var received int64
 		for received < meta.FileSize {
 			_, data, err := conn.ReadMessage()
 			if err != nil {
+				tmpFile.Close()
+				if cancelled.Load() {
+					log.Printf("[WS] %s: cancelled while receiving", uploadID)
+					sendProgress(string(progress.PhaseCancelled), "", float64(received)/float64(meta.FileSize)*100)
+					progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseCancelled})
+					return
+				}
 				log.Printf("[WS] read data error: %v", err)
+				return
+			}
+
+			// 申告サイズを超えて送られてきた場合は打ち切る（容量制限の回避を防ぐ）
+			if received+int64(len(data)) > meta.FileSize {
+				log.Printf("[WS] %s: received more than the declared %d bytes", uploadID, meta.FileSize)
 				tmpFile.Close()
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"error":"size_mismatch"}`))
 				return
 			}
 
@@ -115,36 +168,48 @@ func WSUpload(store storage.Storage, database *sql.DB, storageType string) gin.H
 			sendProgress("receiving", "", pct)
 		}
 		tmpFile.Close()
+		stopTracking() // ここからは保存・エンコードの側で取り消せる
 
 		log.Printf("[WS] received %d bytes for %s", received, meta.FileName)
 		sendProgress("received", "", 100)
 
-		uploadID := meta.UploadID
 		collectionID := meta.CollectionID
 
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: 0})
-
 		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"processing"}`))
 
-		go func() {
-			if service.IsVideoFilename(meta.FileName) {
-				vol := meta.Volume
-				if vol == 0 {
-					vol = 100
-				}
-				res := meta.Resolution
-				if res == "" {
-					res = "720p"
-				}
-				fps := meta.FPS
-				if fps == 0 {
-					fps = 30
-				}
-				service.ProcessVideoBackground(store, database, storageType, uploadID, collectionID, userID, meta.FileName, tmpPath, meta.TrimStart, meta.TrimEnd, vol, res, fps)
-			} else {
-				service.UploadNonVideoBackground(store, database, storageType, uploadID, collectionID, userID, meta.FileName, tmpPath)
+		// 一時ファイルと確保は保存の側が片付ける
+		keepTmp, keepQuota = true, true
+		if service.IsVideoFilename(meta.FileName) {
+			opts := encodeOptions{TrimStart: meta.TrimStart, TrimEnd: meta.TrimEnd, Volume: meta.Volume, Resolution: meta.Resolution, FPS: meta.FPS}.withDefaults()
+			_, err := service.EnqueueEncodeJob(database, db.EncodeJob{
+				ID:           uploadID,
+				OwnerID:      userID,
+				UploadedBy:   userID,
+				CollectionID: collectionID,
+				StorageType:  storageType,
+				FileName:     meta.FileName,
+				InputPath:    tmpPath,
+				QuotaKey:     quotaKey,
+				TrimStart:    opts.TrimStart,
+				TrimEnd:      opts.TrimEnd,
+				Volume:       opts.Volume,
+				Resolution:   opts.Resolution,
+				FPS:          opts.FPS,
+				Priority:     service.EncodePriorityNormal,
+			})
+			if err != nil {
+				log.Printf("[WS] %s: failed to queue: %v", uploadID, err)
+				keepTmp, keepQuota = false, false
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"error":"failed_to_queue"}`))
+				return
 			}
-		}()
+		} else {
+			go func() {
+				defer service.ReleaseQuota(quotaKey)
+				defer os.Remove(tmpPath)
+				service.UploadNonVideoBackground(store, database, storageType, uploadID, collectionID, userID, userID, meta.FileName, tmpPath)
+			}()
+		}
 
 		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"accepted","upload_id":"`+uploadID+`"}`))
 	}
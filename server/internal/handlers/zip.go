@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"archive/zip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/progress"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// DownloadCollectionZip はコレクションのファイルを ZIP にまとめて返す。
+// 一時ファイルは作らず、ストアから読みながらそのまま送る（動画は圧縮が効かないので無圧縮で格納）。
+// files を指定するとそのファイルだけ（カンマ区切り、POST のフォームでは複数指定も可）。
+// 送信済みの割合はレスポンスヘッダー X-Progress-ID の ID で /v1/upload-status/:id・/v1/upload-progress/:id から見られる
+// （ID はサーバーで決める。認証なしのルートなので、呼び出し側が他の進捗に書き込めないようにする）。
+// GET  /v1/collections/:id/zip?files=id1,id2
+// POST /v1/collections/:id/zip  （form: files）
+func DownloadCollectionZip(database *sql.DB, storeFor StoreSelector, maxBytes int64, maxFiles int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		col, err := db.GetCollectionByID(database, c.Param("id"))
+		if err != nil {
+			if errors.Is(err, db.ErrCollectionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "collection_not_found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "db_error"})
+			return
+		}
+		files, err := db.ListFilesByCollectionWithUploader(database, col.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed_to_list_files"})
+			return
+		}
+
+		if selected := zipSelection(c); len(selected) > 0 {
+			picked := files[:0]
+			for _, f := range files {
+				if selected[f.ID] {
+					picked = append(picked, f)
+					delete(selected, f.ID)
+				}
+			}
+			if len(selected) > 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "file_not_found"}) // 別のコレクション・ゴミ箱のファイル
+				return
+			}
+			files = picked
+		}
+		if len(files) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no_files"})
+			return
+		}
+
+		var total int64
+		for _, f := range files {
+			total += f.FileSize
+		}
+		if len(files) > maxFiles || total > maxBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error":     "zip_too_large",
+				"files":     len(files),
+				"bytes":     total,
+				"max_files": maxFiles,
+				"max_bytes": maxBytes,
+			})
+			return
+		}
+
+		zipName := davSafeName(col.Name, col.ID) + ".zip"
+		progressID := uuid.NewString()
+		progress.Global.Begin(progressID, "", zipName)
+		pw := &zipProgress{w: c.Writer, id: progressID, total: total}
+
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", contentDisposition(zipName))
+		c.Header("X-Progress-ID", progressID)
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		// 古い順に入れる（同じ名前が重なったら後のものに番号を付ける）
+		zw := zip.NewWriter(pw)
+		used := map[string]bool{}
+		ctx := c.Request.Context()
+		for i := len(files) - 1; i >= 0; i-- {
+			f := files[i]
+			name := zipEntryName(davSafeName(f.DisplayName, path.Base(f.FileName)), used)
+			if err := writeZipEntry(c, zw, storeFor(f.StorageType), f, name); err != nil {
+				if errors.Is(err, storage.ErrNotFound) {
+					// ヘッダーは送ってしまったのでエラーにはできない。抜けたファイルはログに残す
+					log.Printf("[ZIP] %s: %s is missing from %s, skipped", col.ID, f.FileName, f.StorageType)
+					continue
+				}
+				if ctx.Err() == nil {
+					log.Printf("[ZIP] %s: %s: %v", col.ID, f.FileName, err)
+				}
+				pw.send(progress.Event{Phase: progress.PhaseError, Message: "zip_aborted"})
+				return
+			}
+		}
+		if err := zw.Close(); err != nil {
+			pw.send(progress.Event{Phase: progress.PhaseError, Message: "zip_aborted"})
+			return
+		}
+		pw.send(progress.Event{Phase: progress.PhaseDone, Percent: 100})
+	}
+}
+
+func writeZipEntry(c *gin.Context, zw *zip.Writer, store storage.Storage, f db.CollectionFileWithUploader, name string) error {
+	r, _, err := store.Open(c.Request.Context(), f.FileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name, // UTF-8 のフラグは zip.Writer が ASCII 以外を含む名前に付ける
+		Method:   zip.Store,
+		Modified: f.UploadedAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// zipSelection はリクエストで指定されたファイル ID（指定がなければ nil）
+func zipSelection(c *gin.Context) map[string]bool {
+	values := append(c.QueryArray("files"), c.PostFormArray("files")...)
+	var selected map[string]bool
+	for _, v := range values {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				if selected == nil {
+					selected = map[string]bool{}
+				}
+				selected[id] = true
+			}
+		}
+	}
+	return selected
+}
+
+// zipEntryName は ZIP 内で重ならない名前を返す（"clip.mp4" → "clip (2).mp4"）
+func zipEntryName(name string, used map[string]bool) string {
+	name = strings.ToValidUTF8(name, "_")
+	key := strings.ToLower(name) // 大文字小文字を区別しない OS で展開しても重ならないように
+	if used[key] {
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+			if !used[strings.ToLower(candidate)] {
+				name, key = candidate, strings.ToLower(candidate)
+				break
+			}
+		}
+	}
+	used[key] = true
+	return name
+}
+
+// zipProgress は送信したバイト数を数えて 1% ごとに進捗を送る
+type zipProgress struct {
+	w       io.Writer
+	id      string
+	total   int64
+	written int64
+	percent int
+}
+
+func (p *zipProgress) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	if p.total > 0 {
+		if pct := int(min(p.written*100/p.total, 99)); pct > p.percent {
+			p.percent = pct
+			p.send(progress.Event{Phase: progress.PhaseZip, Percent: float64(pct)})
+		}
+	}
+	return n, err
+}
+
+func (p *zipProgress) send(ev progress.Event) {
+	progress.Global.Send(p.id, ev)
+}
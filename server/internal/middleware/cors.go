@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,10 +18,12 @@ func CORS() gin.HandlerFunc {
 		c.Header("Vary", "Origin")
 
 		c.Header("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Upload-ID, X-Chunk-Index, X-Total-Chunks, X-File-Name, X-Trim-Start, X-Trim-End, X-Volume, X-Resolution, X-FPS, X-Skip-Encode")
-		c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Upload-ID, X-Chunk-Index, X-Total-Chunks, X-File-Name, X-Trim-Start, X-Trim-End, X-Volume, X-Resolution, X-FPS, X-Skip-Encode, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset, Upload-Checksum")
+		c.Header("Access-Control-Expose-Headers", "Content-Length, Content-Range, Location, X-Upload-ID, X-Progress-ID, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length")
 
-		if c.Request.Method == http.MethodOptions {
+		// WebDAV の OPTIONS（DAV ヘッダーで対応を確認する）は handlers.WebDAV に、
+		// tus の OPTIONS（Tus-Version などを返す）は handlers.TusOptions に任せる
+		if c.Request.Method == http.MethodOptions && !strings.HasPrefix(c.Request.URL.Path, "/dav") && !strings.HasPrefix(c.Request.URL.Path, "/v1/tus") {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
@@ -1,81 +1,243 @@
 package progress
 
 import (
+	"sort"
 	"sync"
+	"time"
 )
 
 // Phase はアップロードのフェーズを表す
 type Phase string
 
 const (
-	PhaseFFmpeg Phase = "ffmpeg" // サーバー側エンコード
-	PhaseNAS    Phase = "nas"    // NAS への転送
-	PhaseDone   Phase = "done"
-	PhaseError  Phase = "error"
+	PhaseQueued    Phase = "queued" // エンコードの順番待ち（再試行の待ちも含む）
+	PhaseFFmpeg    Phase = "ffmpeg" // サーバー側エンコード
+	PhaseNAS       Phase = "nas"    // NAS への転送
+	PhaseZip       Phase = "zip"    // ZIP ダウンロードの送信
+	PhaseDone      Phase = "done"
+	PhaseError     Phase = "error"
+	PhaseCancelled Phase = "cancelled" // 取り消された（一時ファイル・保存途中のファイルは消してある）
 )
 
+// Finished はこれ以上イベントが来ない最後のフェーズかどうか
+func (p Phase) Finished() bool {
+	return p == PhaseDone || p == PhaseError || p == PhaseCancelled
+}
+
 // Event は進捗イベント
 type Event struct {
+	// ID は Tracker 全体の連番（SSE の id。Last-Event-ID で続きから購読できる）。
+	// 履歴を捨てた後に同じアップロードのイベントが来ても、前より小さい番号にはならない
+	ID      uint64  `json:"id,omitempty"`
 	Phase   Phase   `json:"phase"`
 	Percent float64 `json:"percent,omitempty"`
 	FileID  string  `json:"file_id,omitempty"`
 	Message string  `json:"message,omitempty"`
+	// Deduplicated は同じ内容のファイルが既にあり、保存を省略したことを示す（done のみ）
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+const (
+	historySize = 64              // アップロードごとに残すイベントの数（購読を始めたときに流し直す）
+	subBuffer   = historySize * 2 // 購読者ごとのバッファ。溢れたら購読を切る（続きから購読し直せる）
+)
+
+// Upload はアップロード 1 件の状態（進行中のアップロードの一覧用）
+type Upload struct {
+	ID        string    `json:"upload_id"`
+	FileName  string    `json:"file_name,omitempty"`
+	Latest    *Event    `json:"latest,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type upload struct {
+	owner     string
+	fileName  string
+	history   []Event // 古い順。historySize 件まで
+	subs      map[*Subscription]struct{}
+	startedAt time.Time
+	updated   time.Time
 }
 
-// Tracker は uploadId ごとにチャネルと最新状態を管理する
+// Subscription は 1 つの購読。C から届いた順にイベントを受け取り、使い終わったら Close する
+type Subscription struct {
+	C      <-chan Event
+	ch     chan Event
+	t      *Tracker
+	id     string
+	closed bool // Tracker.mu で守る
+}
+
+// Tracker は uploadId ごとにイベントの履歴と購読者を管理する。
+// 1 つのアップロードを何人でも購読でき、購読を始める前のイベントも履歴から受け取れる。
 type Tracker struct {
-	mu       sync.Mutex
-	channels map[string]chan Event
-	latest   map[string]Event // ポーリング用に最新イベントを保持
+	mu      sync.Mutex
+	uploads map[string]*upload
+	lastID  uint64
+	onEvent func(ownerID, uploadID string, ev Event)
+}
+
+var Global = NewTracker()
+
+func NewTracker() *Tracker {
+	return &Tracker{uploads: make(map[string]*upload)}
+}
+
+// get は id のアップロードを返す（無ければ作る）。t.mu を持って呼ぶ。
+// 作るのはサーバー側（Begin・Send）だけで、購読・ポーリングからは作らない
+func (t *Tracker) get(id string) *upload {
+	u, ok := t.uploads[id]
+	if !ok {
+		now := time.Now()
+		u = &upload{subs: make(map[*Subscription]struct{}), startedAt: now, updated: now}
+		t.uploads[id] = u
+	}
+	return u
 }
 
-var Global = &Tracker{
-	channels: make(map[string]chan Event),
-	latest:   make(map[string]Event),
+// Begin は id のアップロードをした人とファイル名を記録する（Active の一覧・OnEvent の宛先に使う）
+func (t *Tracker) Begin(id, ownerID, fileName string) {
+	if id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.get(id)
+	u.owner, u.fileName = ownerID, fileName
 }
 
-func (t *Tracker) Register(id string) chan Event {
-	ch := make(chan Event, 64)
+// OnEvent は Begin で持ち主が分かっているアップロードのイベントごとに fn を呼ぶようにする（チャットの WebSocket への中継用）
+func (t *Tracker) OnEvent(fn func(ownerID, uploadID string, ev Event)) {
 	t.mu.Lock()
-	t.channels[id] = ch
+	t.onEvent = fn
 	t.mu.Unlock()
-	return ch
 }
 
 func (t *Tracker) Send(id string, ev Event) {
 	t.mu.Lock()
-	ch, ok := t.channels[id]
-	t.latest[id] = ev // 最新状態を常に保持
-	t.mu.Unlock()
-	if ok {
+	u := t.get(id)
+	t.lastID++
+	ev.ID = t.lastID
+	u.history = append(u.history, ev)
+	if len(u.history) > historySize {
+		u.history = u.history[len(u.history)-historySize:]
+	}
+	u.updated = time.Now()
+	for sub := range u.subs {
 		select {
-		case ch <- ev:
+		case sub.ch <- ev:
 		default:
+			// 読むのが遅れている購読者は切る（Last-Event-ID を付けて購読し直せば続きから受け取れる）
+			t.drop(u, sub)
+		}
+	}
+	owner, notify := u.owner, t.onEvent
+	t.mu.Unlock()
+
+	if notify != nil && owner != "" {
+		notify(owner, id, ev)
+	}
+}
+
+// Subscribe は id の進捗を購読する。afterID より後の履歴を先に流し、その後は届いた順に流す
+// （afterID が 0 なら残っている履歴をすべて流す）。
+// Begin されていない（または Prune で捨てた）id は購読できず、false を返す。
+func (t *Tracker) Subscribe(id string, afterID uint64) (*Subscription, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u, ok := t.uploads[id]
+	if !ok {
+		return nil, false
+	}
+	ch := make(chan Event, subBuffer)
+	sub := &Subscription{C: ch, ch: ch, t: t, id: id}
+	for _, ev := range u.history {
+		if ev.ID > afterID {
+			ch <- ev
 		}
 	}
+	u.subs[sub] = struct{}{}
+	return sub, true
+}
+
+// Close は購読をやめる（他の購読者には影響しない）
+func (s *Subscription) Close() {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	if u, ok := s.t.uploads[s.id]; ok {
+		s.t.drop(u, s)
+	}
+}
+
+// drop は購読者を外して C を閉じる。t.mu を持って呼ぶ
+func (t *Tracker) drop(u *upload, sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(u.subs, sub)
+	close(sub.ch)
+}
+
+// Has は id のアップロードが登録されているかどうか（イベントがまだ無くても true）
+func (t *Tracker) Has(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.uploads[id]
+	return ok
 }
 
 // Latest は指定 ID の最新イベントを返す（ポーリング用）
 func (t *Tracker) Latest(id string) (Event, bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	ev, ok := t.latest[id]
-	return ev, ok
+	u, ok := t.uploads[id]
+	if !ok || len(u.history) == 0 {
+		return Event{}, false
+	}
+	return u.history[len(u.history)-1], true
 }
 
-func (t *Tracker) Close(id string) {
+// Active は ownerID のアップロードのうち、まだ終わっていないものを始めた順に返す
+func (t *Tracker) Active(ownerID string) []Upload {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	if ch, ok := t.channels[id]; ok {
-		close(ch)
-		delete(t.channels, id)
+	list := []Upload{}
+	for id, u := range t.uploads {
+		if u.owner != ownerID {
+			continue
+		}
+		item := Upload{ID: id, FileName: u.fileName, StartedAt: u.startedAt, UpdatedAt: u.updated}
+		if n := len(u.history); n > 0 {
+			latest := u.history[n-1]
+			if latest.Phase.Finished() {
+				continue
+			}
+			item.Latest = &latest
+		}
+		list = append(list, item)
 	}
-	// latest は done/error 後も一定時間保持（ポーリングが間に合うように）
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
 }
 
-// CleanLatest は最新状態を削除する（done/error 確認後に呼ぶ）
-func (t *Tracker) CleanLatest(id string) {
+// Prune は ttl より長く更新されず、購読されてもいないアップロードの履歴を捨て、捨てた数を返す
+// （ポーリングされないまま終わったアップロードの分が残り続けないように）。
+// エンコードの順番待ちのものは、待ちが長くても持ち主が分からなくならないように残す。
+func (t *Tracker) Prune(ttl time.Duration) int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	delete(t.latest, id)
+	n := 0
+	for id, u := range t.uploads {
+		if len(u.subs) > 0 || time.Since(u.updated) <= ttl {
+			continue
+		}
+		if len(u.history) > 0 && u.history[len(u.history)-1].Phase == PhaseQueued {
+			continue
+		}
+		delete(t.uploads, id)
+		n++
+	}
+	return n
 }
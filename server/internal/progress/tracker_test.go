@@ -0,0 +1,121 @@
+package progress
+
+import (
+	"testing"
+	"time"
+)
+
+func recv(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-sub.C:
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+// 購読・ポーリングでは登録されない（認証の無い SSE から好きな ID で作れないように）
+func TestSubscribeUnknownID(t *testing.T) {
+	tr := NewTracker()
+	if sub, ok := tr.Subscribe("nope", 0); ok || sub != nil {
+		t.Errorf("Subscribe(unknown) = %v, %v, want nil, false", sub, ok)
+	}
+	if _, ok := tr.Latest("nope"); ok {
+		t.Error("Latest(unknown) should report false")
+	}
+	if tr.Has("nope") || len(tr.uploads) != 0 {
+		t.Errorf("lookups created entries: %v", tr.uploads)
+	}
+}
+
+// 購読前のイベントは履歴から流し、afterID より後だけを受け取れる
+func TestSubscribeReplay(t *testing.T) {
+	tr := NewTracker()
+	tr.Begin("u1", "alice", "a.mp4")
+	if !tr.Has("u1") {
+		t.Fatal("Begin did not register the upload")
+	}
+	if sub, ok := tr.Subscribe("u1", 0); !ok {
+		t.Fatal("Subscribe after Begin failed")
+	} else {
+		sub.Close()
+	}
+
+	tr.Send("u1", Event{Phase: PhaseFFmpeg, Percent: 10})
+	tr.Send("u1", Event{Phase: PhaseFFmpeg, Percent: 50})
+
+	all, _ := tr.Subscribe("u1", 0)
+	defer all.Close()
+	first, second := recv(t, all), recv(t, all)
+	if first.Percent != 10 || second.Percent != 50 || second.ID <= first.ID {
+		t.Fatalf("replay = %+v, %+v", first, second)
+	}
+
+	rest, _ := tr.Subscribe("u1", first.ID)
+	defer rest.Close()
+	if ev := recv(t, rest); ev.ID != second.ID {
+		t.Errorf("after %d got %+v, want id %d", first.ID, ev, second.ID)
+	}
+
+	tr.Send("u1", Event{Phase: PhaseDone})
+	for _, sub := range []*Subscription{all, rest} {
+		if ev := recv(t, sub); ev.Phase != PhaseDone {
+			t.Errorf("live event = %+v", ev)
+		}
+	}
+}
+
+// Prune で履歴を捨てた後も、同じアップロードの ID は前より大きくなる（Last-Event-ID で取りこぼさない）
+func TestEventIDsIncreaseAcrossPrune(t *testing.T) {
+	tr := NewTracker()
+	tr.Begin("u1", "alice", "a.mp4")
+	tr.Send("u1", Event{Phase: PhaseNAS, Percent: 10})
+	before, _ := tr.Latest("u1")
+
+	time.Sleep(time.Millisecond)
+	if n := tr.Prune(0); n != 1 || tr.Has("u1") {
+		t.Fatalf("Prune = %d, Has = %v", n, tr.Has("u1"))
+	}
+	if _, ok := tr.Subscribe("u1", before.ID); ok {
+		t.Error("pruned upload should not be subscribable")
+	}
+
+	tr.Send("u1", Event{Phase: PhaseNAS, Percent: 20})
+	sub, ok := tr.Subscribe("u1", before.ID)
+	if !ok {
+		t.Fatal("Send should register the upload again")
+	}
+	defer sub.Close()
+	if ev := recv(t, sub); ev.Percent != 20 || ev.ID <= before.ID {
+		t.Errorf("after prune = %+v, want id > %d", ev, before.ID)
+	}
+}
+
+// 購読中のもの・エンコード待ちのものは Prune で捨てない
+func TestPruneKeepsSubscribedAndQueued(t *testing.T) {
+	tr := NewTracker()
+	tr.Begin("watched", "alice", "a.mp4")
+	tr.Send("watched", Event{Phase: PhaseNAS})
+	sub, _ := tr.Subscribe("watched", 0)
+	tr.Begin("queued", "alice", "b.mp4")
+	tr.Send("queued", Event{Phase: PhaseQueued})
+	tr.Begin("idle", "alice", "c.mp4")
+
+	time.Sleep(time.Millisecond)
+	if n := tr.Prune(0); n != 1 {
+		t.Errorf("Prune = %d, want 1", n)
+	}
+	if !tr.Has("watched") || !tr.Has("queued") || tr.Has("idle") {
+		t.Errorf("after Prune: watched %v, queued %v, idle %v", tr.Has("watched"), tr.Has("queued"), tr.Has("idle"))
+	}
+
+	sub.Close()
+	if n := tr.Prune(0); n != 1 || tr.Has("watched") {
+		t.Errorf("Prune after Close = %d, watched %v", n, tr.Has("watched"))
+	}
+}
@@ -0,0 +1,502 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/klauspost/compress/zstd"
+)
+
+// バックアップは tar を zstd で圧縮した 1 ファイル（hideme-<日時>-full.tar.zst など）。
+// 中身は hideme.db（VACUUM INTO のスナップショット）・blobs/<バックエンド>/<キー>・manifest.json の順
+// （目録は書き込み中に消えたファイルを外してから最後に書く）。
+// 増分では前回から変わったファイルだけを入れ、変わっていないものはマニフェストで前のアーカイブを指す。
+// 同じフォルダにマニフェストだけのファイル（.manifest.json）も置き、次の増分と整理に使う。
+const (
+	backupManifestEntry = "manifest.json"
+	backupDBEntry       = "hideme.db"
+	backupBlobPrefix    = "blobs/"
+	backupSuffix        = ".tar.zst"
+	backupManifestExt   = ".manifest.json"
+)
+
+// BackupBlob はバックアップ時点でバックエンドにあったファイル 1 件
+type BackupBlob struct {
+	Backend  string    `json:"backend"`
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Archive  string    `json:"archive"` // 中身が入っているアーカイブ（増分では前回以前のもののことがある）
+}
+
+// BackupManifest はバックアップ 1 回分の目録。Blobs には全バックエンドの全ファイルが入る。
+type BackupManifest struct {
+	Name      string       `json:"name"`
+	Kind      string       `json:"kind"`           // full / incremental
+	Base      string       `json:"base,omitempty"` // 増分の元にしたバックアップ
+	Chain     int          `json:"chain"`          // 直前のフルから数えた増分の回数（フルは 0）
+	CreatedAt time.Time    `json:"created_at"`
+	Blobs     []BackupBlob `json:"blobs"`
+}
+
+type BackupOptions struct {
+	Dir         string
+	Incremental bool // 前回のバックアップがあれば増分にする
+	FullEvery   int  // 増分をこの回数続けたら次はフルにする（0 以下なら制限なし）
+	Keep        int  // 残すフルバックアップの数（古いものは増分ごと消す。0 以下なら消さない）
+}
+
+// RunBackup は DB のスナップショットと全バックエンドのファイルを opts.Dir に書き出す。
+// stores は暗号化・重複排除で包む前のストア（保存されているバイト列をそのまま残す）。
+// スナップショットより後にできたファイルも入るが、DB から参照されないだけなので整合性チェックで見つかる。
+func RunBackup(ctx context.Context, database *sql.DB, stores map[string]storage.Storage, opts BackupOptions) (BackupManifest, error) {
+	if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+		return BackupManifest{}, err
+	}
+
+	now := time.Now().UTC()
+	m := BackupManifest{Kind: "full", CreatedAt: now}
+	var base *BackupManifest
+	if opts.Incremental {
+		prev, err := latestBackup(opts.Dir)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		if prev != nil && (opts.FullEvery <= 0 || prev.Chain+1 < opts.FullEvery) {
+			base = prev
+			m.Kind, m.Base, m.Chain = "incremental", prev.Name, prev.Chain+1
+		}
+	}
+	m.Name = "hideme-" + now.Format("20060102T150405Z") + "-" + m.Kind + backupSuffix
+
+	snapshot := filepath.Join(opts.Dir, m.Name+".db.tmp")
+	_ = os.Remove(snapshot)
+	if err := db.SnapshotTo(database, snapshot); err != nil {
+		return BackupManifest{}, err
+	}
+	defer os.Remove(snapshot)
+
+	blobs, err := listBackupBlobs(ctx, stores, m.Name, base)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	m.Blobs = blobs
+
+	archivePath := filepath.Join(opts.Dir, m.Name)
+	m, err = writeBackupArchive(ctx, archivePath, snapshot, stores, m)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if err := writeJSONFile(strings.TrimSuffix(archivePath, backupSuffix)+backupManifestExt, m); err != nil {
+		return BackupManifest{}, err
+	}
+
+	if opts.Keep > 0 {
+		if err := pruneBackups(opts.Dir, opts.Keep); err != nil {
+			log.Printf("[BACKUP] WARN prune: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// listBackupBlobs は全バックエンドのファイルを一覧にする。
+// base があれば、サイズと更新日時が同じファイルは base 側のアーカイブを指したままにする。
+func listBackupBlobs(ctx context.Context, stores map[string]storage.Storage, archive string, base *BackupManifest) ([]BackupBlob, error) {
+	prev := map[string]BackupBlob{}
+	if base != nil {
+		for _, b := range base.Blobs {
+			prev[b.Backend+"/"+b.Key] = b
+		}
+	}
+
+	backends := make([]string, 0, len(stores))
+	for name := range stores {
+		backends = append(backends, name)
+	}
+	sort.Strings(backends)
+
+	var blobs []BackupBlob
+	for _, backend := range backends {
+		err := storage.ListAll(ctx, stores[backend], "", func(it storage.FileItem) error {
+			b := BackupBlob{Backend: backend, Key: it.Name, Size: it.Size, Modified: it.Modified.UTC(), Archive: archive}
+			if p, ok := prev[backend+"/"+it.Name]; ok && p.Size == b.Size && p.Modified.Equal(b.Modified) {
+				b.Archive = p.Archive
+			}
+			blobs = append(blobs, b)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", backend, err)
+		}
+	}
+	return blobs, nil
+}
+
+// writeBackupArchive はアーカイブを書き、途中で消えていたファイルを外した目録を返す。
+// 書き終わるまでは .partial の名前にしておく。
+func writeBackupArchive(ctx context.Context, path, snapshot string, stores map[string]storage.Storage, m BackupManifest) (BackupManifest, error) {
+	partial := path + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return m, err
+	}
+	ok := false
+	defer func() {
+		f.Close()
+		if !ok {
+			os.Remove(partial)
+		}
+	}()
+
+	// 動画は圧縮が効かないので一番速いレベルにする
+	zw, err := zstd.NewWriter(f, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return m, err
+	}
+	tw := tar.NewWriter(zw)
+
+	dbFile, err := os.Open(snapshot)
+	if err != nil {
+		return m, err
+	}
+	info, err := dbFile.Stat()
+	if err == nil {
+		err = writeTarEntry(tw, backupDBEntry, info.Size(), m.CreatedAt, dbFile)
+	}
+	dbFile.Close()
+	if err != nil {
+		return m, err
+	}
+
+	missing := map[string]bool{}
+	var written int
+	for _, b := range m.Blobs {
+		if b.Archive != m.Name {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return m, err
+		}
+		r, _, err := stores[b.Backend].Open(ctx, b.Key)
+		if errors.Is(err, storage.ErrNotFound) {
+			missing[b.Backend+"/"+b.Key] = true
+			continue
+		}
+		if err != nil {
+			return m, fmt.Errorf("open %s/%s: %w", b.Backend, b.Key, err)
+		}
+		err = writeTarEntry(tw, backupBlobPrefix+b.Backend+"/"+b.Key, b.Size, b.Modified, r)
+		r.Close()
+		if err != nil {
+			return m, fmt.Errorf("copy %s/%s: %w", b.Backend, b.Key, err)
+		}
+		written++
+	}
+
+	if len(missing) > 0 {
+		// 一覧を取った後に消えたファイル（アーカイブに無いので目録からも外す）
+		kept := make([]BackupBlob, 0, len(m.Blobs)-len(missing))
+		for _, b := range m.Blobs {
+			if !missing[b.Backend+"/"+b.Key] {
+				kept = append(kept, b)
+			}
+		}
+		m.Blobs = kept
+		log.Printf("[BACKUP] %d file(s) disappeared during backup", len(missing))
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return m, err
+	}
+	if err := writeTarEntry(tw, backupManifestEntry, int64(len(manifest)), m.CreatedAt, bytes.NewReader(manifest)); err != nil {
+		return m, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	if err := zw.Close(); err != nil {
+		return m, err
+	}
+	if err := f.Sync(); err != nil {
+		return m, err
+	}
+	if err := f.Close(); err != nil {
+		return m, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		return m, err
+	}
+	ok = true
+	log.Printf("[BACKUP] wrote %s (%s, %d of %d file(s))", filepath.Base(path), m.Kind, written, len(m.Blobs))
+	return m, nil
+}
+
+// writeTarEntry は size バイトちょうどを書く（一覧の後でファイルが変わって長さが合わなければエラー）
+func writeTarEntry(tw *tar.Writer, name string, size int64, modified time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0o640,
+		Size:     size,
+		ModTime:  modified,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX, // 長いキー・日本語のキーをそのまま入れる
+	}); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+// ReadBackupManifest はアーカイブの目録を返す（横に置いた .manifest.json があればそれを、なければアーカイブの中のものを読む）
+func ReadBackupManifest(archivePath string) (BackupManifest, error) {
+	var m BackupManifest
+	if data, err := os.ReadFile(strings.TrimSuffix(archivePath, backupSuffix) + backupManifestExt); err == nil {
+		return m, json.Unmarshal(data, &m)
+	}
+	// 目録はアーカイブの末尾にある（以前の形式では先頭）
+	found := false
+	err := readBackupArchive(archivePath, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if hdr.Name != backupManifestEntry {
+			return true, nil
+		}
+		found = true
+		return false, json.NewDecoder(r).Decode(&m)
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s: manifest not found", archivePath)
+	}
+	return m, err
+}
+
+// RestoreDatabase はアーカイブの DB で dbPath を置き換える（サーバーを止めてから実行する）。
+// dbPath が既にある場合は force が必要。
+func RestoreDatabase(archivePath, dbPath string, force bool) error {
+	if _, err := os.Stat(dbPath); err == nil && !force {
+		return fmt.Errorf("%s already exists (use -force to overwrite)", dbPath)
+	}
+	tmp := dbPath + ".restoring"
+	found := false
+	err := readBackupArchive(archivePath, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if hdr.Name != backupDBEntry {
+			return true, nil
+		}
+		found = true
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return false, err
+		}
+		return false, f.Close()
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s: database not found", archivePath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// 古い WAL が残っていると新しい DB に適用されてしまう
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+	return os.Rename(tmp, dbPath)
+}
+
+// RestoreBlobs は目録のファイルを各バックエンドに書き戻す。同じキー・同じサイズで既にあるものは飛ばす。
+// 増分の場合は目録が指す前のアーカイブ（同じフォルダにあるもの）からも読む。
+func RestoreBlobs(ctx context.Context, dir string, m BackupManifest, stores map[string]storage.Storage) (restored, skipped int, err error) {
+	wanted := map[string]map[string]BackupBlob{} // アーカイブ → tar のエントリ名 → ファイル
+	backends := map[string]bool{}
+	for _, b := range m.Blobs {
+		if stores[b.Backend] == nil {
+			log.Printf("[RESTORE] WARN backend %q is not configured, skipping %s", b.Backend, b.Key)
+			continue
+		}
+		if wanted[b.Archive] == nil {
+			wanted[b.Archive] = map[string]BackupBlob{}
+		}
+		wanted[b.Archive][backupBlobPrefix+b.Backend+"/"+b.Key] = b
+		backends[b.Backend] = true
+	}
+
+	// 既にあるファイル（途中で止めた復元のやり直し・ストアが無事だった場合）
+	existing := map[string]int64{}
+	for backend := range backends {
+		err := storage.ListAll(ctx, stores[backend], "", func(it storage.FileItem) error {
+			existing[backend+"/"+it.Name] = it.Size
+			return nil
+		})
+		if err != nil {
+			return restored, skipped, fmt.Errorf("list %s: %w", backend, err)
+		}
+	}
+
+	archives := make([]string, 0, len(wanted))
+	for name := range wanted {
+		archives = append(archives, name)
+	}
+	sort.Strings(archives)
+	for _, archive := range archives {
+		entries := wanted[archive]
+		err := readBackupArchive(filepath.Join(dir, archive), func(hdr *tar.Header, r io.Reader) (bool, error) {
+			b, ok := entries[hdr.Name]
+			if !ok {
+				return true, nil
+			}
+			delete(entries, hdr.Name)
+			if size, ok := existing[b.Backend+"/"+b.Key]; ok && size == hdr.Size {
+				skipped++
+				return len(entries) > 0, nil
+			}
+			if _, err := stores[b.Backend].Upload(ctx, b.Key, r, hdr.Size); err != nil {
+				return false, fmt.Errorf("restore %s/%s: %w", b.Backend, b.Key, err)
+			}
+			restored++
+			return len(entries) > 0, ctx.Err()
+		})
+		if err != nil {
+			return restored, skipped, err
+		}
+		for name := range entries {
+			log.Printf("[RESTORE] WARN %s is not in %s", strings.TrimPrefix(name, backupBlobPrefix), archive)
+		}
+	}
+	return restored, skipped, nil
+}
+
+// readBackupArchive はアーカイブのエントリを順に fn に渡す（fn が false を返したらそこでやめる）
+func readBackupArchive(path string, fn func(hdr *tar.Header, r io.Reader) (bool, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		more, err := fn(hdr, tr)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// listBackups は dir のバックアップの目録を古い順に返す
+func listBackups(dir string) ([]BackupManifest, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "hideme-*"+backupManifestExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths) // 名前に日時が入っているので名前順 = 古い順
+	var out []BackupManifest
+	for _, p := range paths {
+		var m BackupManifest
+		data, err := os.ReadFile(p)
+		if err == nil {
+			err = json.Unmarshal(data, &m)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(p), err)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func latestBackup(dir string) (*BackupManifest, error) {
+	backups, err := listBackups(dir)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	return &backups[len(backups)-1], nil
+}
+
+// pruneBackups は新しい keep 個のフルより前のバックアップ（とそれに続く増分）を消す
+func pruneBackups(dir string, keep int) error {
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	var fulls []string
+	for _, m := range backups {
+		if m.Kind == "full" {
+			fulls = append(fulls, m.Name)
+		}
+	}
+	if len(fulls) <= keep {
+		return nil
+	}
+	cutoff := fulls[len(fulls)-keep]
+	for _, m := range backups {
+		if m.Name >= cutoff {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, m.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Remove(filepath.Join(dir, strings.TrimSuffix(m.Name, backupSuffix)+backupManifestExt)); err != nil {
+			return err
+		}
+		log.Printf("[BACKUP] removed old backup %s", m.Name)
+	}
+	return nil
+}
+
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// StartBackupLoop は interval ごとにバックアップを取る（ctx が終わるまで。起動直後には取らない）
+func StartBackupLoop(ctx context.Context, database *sql.DB, stores map[string]storage.Storage, opts BackupOptions, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := RunBackup(ctx, database, stores, opts); err != nil && ctx.Err() == nil {
+				log.Printf("[BACKUP] scheduled backup failed: %v", err)
+			}
+		}
+	}()
+}
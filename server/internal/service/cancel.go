@@ -0,0 +1,87 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrUploadFinished は保存・エンコードが終わっていて取り消せない場合のエラー
+	ErrUploadFinished = errors.New("upload already finished")
+)
+
+// cancelEntry は処理中のアップロード 1 件（受信中・保存中・エンコード中）
+type cancelEntry struct {
+	ownerID string
+	cancel  func()
+}
+
+var (
+	cancelMu sync.Mutex
+	cancels  = map[string]cancelEntry{}
+)
+
+// TrackUpload は処理中のアップロードを CancelUpload で取り消せるようにする。処理が終わったら返り値を呼ぶ。
+// cancel は処理を止めるだけでよい（片付けと cancelled の進捗は処理の側で行う）。
+func TrackUpload(uploadID, ownerID string, cancel func()) func() {
+	if uploadID == "" {
+		return func() {}
+	}
+	cancelMu.Lock()
+	cancels[uploadID] = cancelEntry{ownerID: ownerID, cancel: cancel}
+	cancelMu.Unlock()
+	return func() {
+		cancelMu.Lock()
+		delete(cancels, uploadID)
+		cancelMu.Unlock()
+	}
+}
+
+// CancelUpload は受け付けたアップロードを取り消す（アップロードした本人と admin のみ）。
+// 処理中なら ffmpeg・ストレージへの転送を止め、順番待ちのエンコードならキューから外す。
+func CancelUpload(database *sql.DB, uploadID, userID string, admin bool) error {
+	for attempt := 0; ; attempt++ {
+		cancelMu.Lock()
+		e, ok := cancels[uploadID]
+		cancelMu.Unlock()
+		if ok {
+			if e.ownerID != userID && !admin {
+				return ErrUploadNotFound
+			}
+			e.cancel()
+			return nil
+		}
+
+		j, err := db.GetEncodeJob(database, uploadID)
+		if errors.Is(err, db.ErrEncodeJobNotFound) {
+			return ErrUploadNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if j.OwnerID != userID && !admin {
+			return ErrUploadNotFound
+		}
+		switch j.Status {
+		case db.EncodeJobQueued:
+			err := CancelEncodeJob(database, uploadID)
+			if !errors.Is(err, db.ErrEncodeJobState) {
+				return err
+			}
+			// 確かめている間にワーカーが取り出した。処理中として取り消し直す
+		case db.EncodeJobRunning:
+			// ワーカーが取り出してから取り消せるようになるまでのわずかな間。少し待って確かめ直す
+			if attempt >= 20 {
+				return ErrUploadFinished
+			}
+			time.Sleep(50 * time.Millisecond)
+		default:
+			return ErrUploadFinished
+		}
+	}
+}
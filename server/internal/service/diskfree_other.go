@@ -0,0 +1,8 @@
+//go:build !unix
+
+package service
+
+// diskFreeBytes は空き容量を取れない環境では -1 を返す（容量の検査はしない）
+func diskFreeBytes(dir string) int64 {
+	return -1
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package service
+
+import "syscall"
+
+func diskFreeBytes(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
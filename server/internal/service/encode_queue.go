@@ -0,0 +1,225 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/progress"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+// エンコードジョブの優先度（大きいほど先に処理する）
+const (
+	EncodePriorityNormal     = 0   // ブラウザ・アプリからのアップロード
+	EncodePriorityBackground = -10 // WebDAV など、待っている人がいないもの
+)
+
+// encodePollInterval は待ちのジョブが無いときに再試行の待ち明けを確かめる間隔
+const encodePollInterval = 5 * time.Second
+
+type EncodeQueueOptions struct {
+	Workers     int           // 同時に動かすエンコードの数
+	MaxAttempts int           // 1 つのジョブを試す回数の上限
+	RetryDelay  time.Duration // 1 回目の再試行までの待ち時間（以後は試すごとに倍にする）
+}
+
+var (
+	encodeMu       sync.Mutex
+	encodeDB       *sql.DB
+	encodeStoreFor func(storageType string) storage.Storage
+	encodeOpts     EncodeQueueOptions
+	encodeHolds    = map[string]func(){} // 待ち・処理中のジョブの入力（janitor に消されないように）
+	encodeWake     = make(chan struct{}, 1)
+)
+
+// StartEncodeQueue はエンコードキューのワーカーを起動する（ctx が終わるまで）。
+// 前回の起動で処理中のまま止まったジョブは待ちに戻して最初からやり直す。
+func StartEncodeQueue(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, opts EncodeQueueOptions) {
+	encodeMu.Lock()
+	encodeDB, encodeStoreFor, encodeOpts = database, storeFor, opts
+	encodeMu.Unlock()
+
+	if n, err := db.RequeueRunningEncodeJobs(database); err != nil {
+		log.Printf("[ENCODE] failed to requeue interrupted jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("[ENCODE] requeued %d interrupted job(s)", n)
+	}
+	jobs, err := db.ListEncodeJobsByStatus(database, db.EncodeJobQueued)
+	if err != nil {
+		log.Printf("[ENCODE] failed to list queued jobs: %v", err)
+	}
+	for _, j := range jobs {
+		holdEncodeInput(j)
+		progress.Global.Begin(j.ID, j.OwnerID, j.FileName)
+		progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseQueued})
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		go encodeWorker(ctx)
+	}
+	log.Printf("[ENCODE] %d worker(s), %d job(s) queued", opts.Workers, len(jobs))
+}
+
+// EnqueueEncodeJob は動画のエンコードをキューに入れる。
+// 入力ファイル（j.InputPath）と容量の確保（j.QuotaKey）はジョブが終わったらキューの側で片付ける。
+func EnqueueEncodeJob(database *sql.DB, j db.EncodeJob) (db.EncodeJob, error) {
+	encodeMu.Lock()
+	j.MaxAttempts = max(encodeOpts.MaxAttempts, 1)
+	encodeMu.Unlock()
+
+	j, err := db.CreateEncodeJob(database, j)
+	if err != nil {
+		return j, err
+	}
+	holdEncodeInput(j)
+	progress.Global.Begin(j.ID, j.OwnerID, j.FileName)
+	progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseQueued})
+	log.Printf("[ENCODE] queued %s: %s (priority %d)", j.ID, j.FileName, j.Priority)
+
+	select {
+	case encodeWake <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// CancelEncodeJob は待ちのジョブを取り消す（処理中のジョブは db.ErrEncodeJobState。CancelUpload で止める）
+func CancelEncodeJob(database *sql.DB, id string) error {
+	j, err := db.GetEncodeJob(database, id)
+	if err != nil {
+		return err
+	}
+	if err := db.CancelQueuedEncodeJob(database, id); err != nil {
+		return err
+	}
+	releaseEncodeJob(j)
+	progress.Global.Send(id, progress.Event{Phase: progress.PhaseCancelled})
+	log.Printf("[ENCODE] cancelled %s", id)
+	return nil
+}
+
+func encodeWorker(ctx context.Context) {
+	for {
+		j, err := db.ClaimNextEncodeJob(encodeDB)
+		if err == nil {
+			runEncodeJob(ctx, j)
+			continue
+		}
+		if !errors.Is(err, db.ErrEncodeJobNotFound) {
+			log.Printf("[ENCODE] failed to claim a job: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-encodeWake:
+		case <-time.After(encodePollInterval):
+		}
+	}
+}
+
+func runEncodeJob(ctx context.Context, j db.EncodeJob) {
+	// 進捗が捨てられていても、持ち主が分かるように記録し直す（進行中の一覧・チャットへの中継に使う）
+	progress.Global.Begin(j.ID, j.OwnerID, j.FileName)
+	if _, err := os.Stat(j.InputPath); err != nil {
+		// 入力が無ければ何度試しても同じなので、すぐ失敗にする
+		log.Printf("[ENCODE] %s: input is gone: %v", j.ID, err)
+		failEncodeJob(j, "input_missing", err)
+		return
+	}
+
+	// 取り消されたら ffmpeg・転送を止める
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer TrackUpload(j.ID, j.OwnerID, cancel)()
+
+	cf, deduplicated, code, err := encodeVideo(jobCtx, encodeStoreFor(j.StorageType), encodeDB, j)
+	if err == nil {
+		if err := db.FinishEncodeJob(encodeDB, j.ID, db.EncodeJobDone, "", cf.ID); err != nil {
+			log.Printf("[ENCODE] %s: failed to record completion: %v", j.ID, err)
+		}
+		releaseEncodeJob(j)
+		progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID, Deduplicated: deduplicated})
+		if j.Username != "" {
+			BroadcastActivity(encodeDB, "upload", j.UploadedBy, j.Username, j.Avatar, j.FileName)
+		}
+		return
+	}
+	if ctx.Err() != nil {
+		// 終了中。処理中のまま残し、次の起動で待ちに戻す
+		return
+	}
+	if jobCtx.Err() != nil {
+		if err := db.FinishEncodeJob(encodeDB, j.ID, db.EncodeJobCancelled, "", ""); err != nil {
+			log.Printf("[ENCODE] %s: failed to record cancellation: %v", j.ID, err)
+		}
+		releaseEncodeJob(j)
+		progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseCancelled})
+		log.Printf("[ENCODE] cancelled %s while running", j.ID)
+		return
+	}
+	if j.Attempts < j.MaxAttempts {
+		delay := encodeOpts.RetryDelay << (j.Attempts - 1)
+		if err := db.RetryEncodeJob(encodeDB, j.ID, encodeJobError(code, err), time.Now().Add(delay)); err != nil {
+			log.Printf("[ENCODE] %s: failed to schedule retry: %v", j.ID, err)
+		}
+		progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseQueued, Message: code})
+		log.Printf("[ENCODE] %s: attempt %d/%d failed (%s), retrying in %s", j.ID, j.Attempts, j.MaxAttempts, code, delay)
+		return
+	}
+	failEncodeJob(j, code, err)
+}
+
+func failEncodeJob(j db.EncodeJob, code string, err error) {
+	if err := db.FinishEncodeJob(encodeDB, j.ID, db.EncodeJobFailed, encodeJobError(code, err), ""); err != nil {
+		log.Printf("[ENCODE] %s: failed to record failure: %v", j.ID, err)
+	}
+	releaseEncodeJob(j)
+	progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseError, Message: code})
+	log.Printf("[ENCODE] %s: gave up after %d attempt(s): %s", j.ID, j.Attempts, code)
+}
+
+// encodeJobError はジョブに残すエラー（ffmpeg の出力までは残さない）
+func encodeJobError(code string, err error) string {
+	msg, _, _ := strings.Cut(err.Error(), "\n")
+	return code + ": " + msg
+}
+
+// holdEncodeInput はジョブが終わるまで入力ファイルを janitor に消させず、容量の確保も期限切れにしない
+func holdEncodeInput(j db.EncodeJob) {
+	if j.QuotaKey != "" {
+		var size int64
+		if info, err := os.Stat(j.InputPath); err == nil {
+			size = info.Size()
+		}
+		holdQuota(j.QuotaKey, j.OwnerID, j.CollectionID, size)
+	}
+	release := HoldTemp(j.InputPath)
+	encodeMu.Lock()
+	if prev, ok := encodeHolds[j.ID]; ok {
+		prev()
+	}
+	encodeHolds[j.ID] = release
+	encodeMu.Unlock()
+}
+
+// releaseEncodeJob は終わったジョブの入力ファイルと容量の確保を片付ける
+func releaseEncodeJob(j db.EncodeJob) {
+	encodeMu.Lock()
+	release, ok := encodeHolds[j.ID]
+	delete(encodeHolds, j.ID)
+	encodeMu.Unlock()
+	if ok {
+		release()
+	}
+	os.Remove(j.InputPath)
+	if j.QuotaKey != "" {
+		ReleaseQuota(j.QuotaKey)
+	}
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/progress"
+)
+
+// janitorPrefixes は janitor が片付ける一時ファイルの接頭辞と種類
+// （hideme_<種類>_<ID>[.拡張子]。ディレクトリは hideme_chunk_<ID> だけ）
+var janitorPrefixes = []struct{ prefix, kind string }{
+	{"hideme_chunk_", "chunk"},
+	{"hideme_merged_", "merged"},
+	{"hideme_ws_", "ws"},
+	{"hideme_in_", "in"},
+	{"hideme_out_", "out"},
+	{"hideme_tus_", "tus"},
+	{"hideme_dav_", "dav"},
+	{"hideme_mirror_", "mirror"},
+	{"hideme_dedup_", "dedup"},
+	{"hideme_reencrypt_", "reencrypt"},
+}
+
+type JanitorOptions struct {
+	TTL         time.Duration // この時間触られていない一時ファイル・チャンクのセッションを消す
+	ProgressTTL time.Duration // この時間更新されていない進捗の最新状態を捨てる
+}
+
+// JanitorRemoved は片付けた一時ファイル 1 件
+type JanitorRemoved struct {
+	Name       string    `json:"name"`
+	Kind       string    `json:"kind"`
+	Bytes      int64     `json:"bytes"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// JanitorReport は janitor 1 回分の結果
+type JanitorReport struct {
+	StartedAt       time.Time        `json:"started_at"`
+	FinishedAt      time.Time        `json:"finished_at"`
+	TempDir         string           `json:"temp_dir"`
+	Removed         []JanitorRemoved `json:"removed"`
+	ReclaimedBytes  int64            `json:"reclaimed_bytes"`
+	ExpiredSessions int              `json:"expired_sessions"` // 消したチャンクアップロードのセッション
+	PrunedProgress  int              `json:"pruned_progress"`  // 捨てたアップロードの進捗
+	FreeBytes       int64            `json:"free_bytes"`       // 片付けた後の空き容量（-1 は不明）
+	Errors          []string         `json:"errors,omitempty"`
+}
+
+// JanitorStatus は直近の結果と起動してからの合計（管理画面用）
+type JanitorStatus struct {
+	Last                *JanitorReport `json:"last"`
+	Runs                int            `json:"runs"`
+	TotalRemoved        int            `json:"total_removed"`
+	TotalReclaimedBytes int64          `json:"total_reclaimed_bytes"`
+	FreeBytes           int64          `json:"free_bytes"`
+}
+
+var (
+	janitorMu     sync.Mutex // 同時に 2 回走らせない
+	janitorStatus JanitorStatus
+)
+
+// GetJanitorStatus は直近の janitor の結果を返す
+func GetJanitorStatus() JanitorStatus {
+	janitorMu.Lock()
+	st := janitorStatus
+	janitorMu.Unlock()
+	st.FreeBytes = TempFreeBytes()
+	return st
+}
+
+// RunJanitor は放棄されたアップロードの一時ファイル・チャンクのセッション・進捗の最新状態を片付ける。
+// 処理中のもの（HoldTemp で守られたもの）と ttl 以内に触られたものは残す。
+func RunJanitor(ctx context.Context, database *sql.DB, opts JanitorOptions) JanitorReport {
+	janitorMu.Lock()
+	defer janitorMu.Unlock()
+
+	dir := TempDir()
+	r := JanitorReport{StartedAt: time.Now().UTC(), TempDir: dir, Removed: []JanitorRemoved{}}
+	cutoff := time.Now().Add(-opts.TTL)
+
+	// チャンクを送ってこなくなったセッション（チャンクのフォルダは下の走査で消える）。申告サイズで確保した容量も解放する
+	ids, err := db.DeleteStaleUploadSessions(database, cutoff.UTC())
+	if err != nil {
+		r.Errors = append(r.Errors, "upload sessions: "+err.Error())
+	}
+	for _, id := range ids {
+		ReleaseQuota(ChunkQuotaKey(id))
+	}
+	r.ExpiredSessions = len(ids)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		r.Errors = append(r.Errors, err.Error())
+	}
+
+	// 同じアップロードのファイル（hideme_tus_<ID> と hideme_tus_<ID>.json など）はまとめて、一番新しい更新日時で判断する
+	type group struct {
+		kind       string
+		paths      []string
+		bytes      int64
+		lastActive time.Time
+		held       bool
+	}
+	groups := map[string]*group{}
+	for _, e := range entries {
+		kind := janitorKind(e.Name())
+		if kind == "" {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		bytes, last, err := tempUsage(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r.Errors = append(r.Errors, err.Error())
+			}
+			continue
+		}
+		key, _, _ := strings.Cut(e.Name(), ".")
+		g := groups[key]
+		if g == nil {
+			g = &group{kind: kind}
+			groups[key] = g
+		}
+		g.paths = append(g.paths, path)
+		g.bytes += bytes
+		if last.After(g.lastActive) {
+			g.lastActive = last
+		}
+		g.held = g.held || isHeld(path)
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		g := groups[key]
+		if g.held || g.lastActive.After(cutoff) {
+			continue
+		}
+		removed := true
+		for _, path := range g.paths {
+			if err := os.RemoveAll(path); err != nil {
+				r.Errors = append(r.Errors, err.Error())
+				removed = false
+			}
+		}
+		if removed {
+			r.Removed = append(r.Removed, JanitorRemoved{Name: key, Kind: g.kind, Bytes: g.bytes, LastActive: g.lastActive.UTC()})
+			r.ReclaimedBytes += g.bytes
+		}
+	}
+
+	if opts.ProgressTTL > 0 {
+		r.PrunedProgress = progress.Global.Prune(opts.ProgressTTL)
+	}
+	r.FreeBytes = TempFreeBytes()
+	r.FinishedAt = time.Now().UTC()
+
+	janitorStatus.Last = &r
+	janitorStatus.Runs++
+	janitorStatus.TotalRemoved += len(r.Removed)
+	janitorStatus.TotalReclaimedBytes += r.ReclaimedBytes
+	if len(r.Removed) > 0 || r.ExpiredSessions > 0 || r.PrunedProgress > 0 {
+		log.Printf("[JANITOR] removed %d temp item(s) (%d bytes), %d upload session(s), %d progress entr(ies)",
+			len(r.Removed), r.ReclaimedBytes, r.ExpiredSessions, r.PrunedProgress)
+	}
+	return r
+}
+
+func janitorKind(name string) string {
+	for _, p := range janitorPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.kind
+		}
+	}
+	return ""
+}
+
+// tempUsage は path（ディレクトリなら中身も）の合計サイズと最終更新日時を返す
+func tempUsage(path string) (int64, time.Time, error) {
+	var bytes int64
+	var last time.Time
+	err := filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			bytes += info.Size()
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return bytes, last, err
+}
+
+// StartJanitorLoop は interval ごとに janitor を走らせる（ctx が終わるまで。起動直後にも 1 回走らせる）
+func StartJanitorLoop(ctx context.Context, database *sql.DB, opts JanitorOptions, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			RunJanitor(ctx, database, opts)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,406 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMigrationActive  = errors.New("another storage migration is running or paused")
+	ErrNoMigration      = errors.New("no storage migration to control")
+	ErrInvalidMigration = errors.New("invalid storage migration request")
+	ErrChecksumMismatch = errors.New("checksum mismatch after copy")
+)
+
+// MigrationRequest は移行の指定。Backends のキー（local / nas / s3 / mirror）で移行元・先を指定する
+type MigrationRequest struct {
+	Source       string `json:"source"`
+	Target       string `json:"target"`
+	CollectionID string `json:"collection_id"`
+	DeleteSource bool   `json:"delete_source"` // 検証後に移行元のファイルを消す
+}
+
+// MigrationPlan は dry-run の結果
+type MigrationPlan struct {
+	MigrationRequest
+	Files      int                       `json:"files"`
+	Thumbnails int                       `json:"thumbnails"`
+	Icons      int                       `json:"icons"`
+	TotalBytes int64                     `json:"total_bytes"` // サムネイル・アイコンは含まない
+	Items      []db.StorageMigrationItem `json:"items"`
+}
+
+// MigrationStatus は移行の状況（/v1/admin/migrate-status 用）
+type MigrationStatus struct {
+	Status  string `json:"status"` // idle / running / paused / canceled / done / error
+	Total   int    `json:"total"`
+	Done    int    `json:"done"` // 処理済み（成功・失敗・スキップ）
+	Current string `json:"current"`
+	Errors  int    `json:"errors"`
+	ErrMsg  string `json:"error,omitempty"`
+
+	Migration *db.StorageMigration      `json:"migration,omitempty"`
+	Counts    db.MigrationItemCounts    `json:"counts"`
+	Failed    []db.StorageMigrationItem `json:"failed,omitempty"`
+}
+
+// 実行中のワーカー（状態そのものは DB にある）
+var (
+	migMu      sync.Mutex
+	migID      string
+	migCtx     context.Context
+	migCancel  context.CancelFunc
+	migCurrent string
+	migWG      sync.WaitGroup
+)
+
+// PlanStorageMigration は移行対象を集めるだけで何も変更しない
+func PlanStorageMigration(database *sql.DB, backends map[string]storage.Storage, req MigrationRequest) (MigrationPlan, error) {
+	if err := validateMigration(backends, req); err != nil {
+		return MigrationPlan{}, err
+	}
+	items, err := db.PlanStorageMigration(database, req.Source, req.CollectionID, includeIcons(req))
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+	plan := MigrationPlan{MigrationRequest: req, Items: items}
+	for _, it := range items {
+		switch it.Kind {
+		case db.MigrationItemIcon:
+			plan.Icons++
+		default:
+			plan.Files++
+			plan.Thumbnails += len(it.Thumbnails)
+			plan.TotalBytes += it.Size
+		}
+	}
+	return plan, nil
+}
+
+// StartStorageMigration は移行ジョブを DB に登録してバックグラウンドで開始する
+func StartStorageMigration(database *sql.DB, backends map[string]storage.Storage, req MigrationRequest) (db.StorageMigration, error) {
+	if err := validateMigration(backends, req); err != nil {
+		return db.StorageMigration{}, err
+	}
+	if _, active, err := db.ActiveStorageMigration(database); err != nil {
+		return db.StorageMigration{}, err
+	} else if active {
+		return db.StorageMigration{}, ErrMigrationActive
+	}
+
+	items, err := db.PlanStorageMigration(database, req.Source, req.CollectionID, includeIcons(req))
+	if err != nil {
+		return db.StorageMigration{}, err
+	}
+	m := db.StorageMigration{
+		ID:           uuid.New().String(),
+		Source:       req.Source,
+		Target:       req.Target,
+		CollectionID: req.CollectionID,
+		DeleteSource: req.DeleteSource,
+		Status:       "running",
+	}
+	if err := db.CreateStorageMigration(database, m, items); err != nil {
+		return db.StorageMigration{}, err
+	}
+	log.Printf("[migrate] start %s: %s -> %s collection=%q delete_source=%v items=%d",
+		m.ID, m.Source, m.Target, m.CollectionID, m.DeleteSource, len(items))
+	if err := startMigrationWorker(database, backends, m); err != nil {
+		return db.StorageMigration{}, err
+	}
+	return m, nil
+}
+
+// PauseStorageMigration は実行中の移行を止める（処理中のファイルは未処理のまま残る）
+func PauseStorageMigration(database *sql.DB) error {
+	return stopStorageMigration(database, "paused", "running")
+}
+
+// CancelStorageMigration は移行を取り消す。移行済みのファイルはそのまま（移行先で使われる）。
+func CancelStorageMigration(database *sql.DB) error {
+	return stopStorageMigration(database, "canceled", "running", "paused")
+}
+
+func stopStorageMigration(database *sql.DB, status string, from ...string) error {
+	m, active, err := db.ActiveStorageMigration(database)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrNoMigration
+	}
+	ok, err := db.SetStorageMigrationStatus(database, m.ID, status, "", from...)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoMigration
+	}
+
+	migMu.Lock()
+	if migID == m.ID && migCancel != nil {
+		migCancel()
+	}
+	migMu.Unlock()
+	log.Printf("[migrate] %s %s", status, m.ID)
+	return nil
+}
+
+// ResumeStorageMigration は一時停止中の移行を再開する。失敗したファイルも再試行する。
+func ResumeStorageMigration(database *sql.DB, backends map[string]storage.Storage) error {
+	m, active, err := db.ActiveStorageMigration(database)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrNoMigration
+	}
+	if m.Status != "paused" {
+		return ErrMigrationActive
+	}
+	if _, err := db.RetryFailedMigrationItems(database, m.ID); err != nil {
+		return err
+	}
+	if _, err := db.SetStorageMigrationStatus(database, m.ID, "running", ""); err != nil {
+		return err
+	}
+	m.Status = "running"
+	return startMigrationWorker(database, backends, m)
+}
+
+// ResumeInterruptedMigration は再起動で中断された（running のままの）移行を続きから再開する
+func ResumeInterruptedMigration(database *sql.DB, backends map[string]storage.Storage) {
+	m, active, err := db.ActiveStorageMigration(database)
+	if err != nil {
+		log.Printf("[migrate] resume: %v", err)
+		return
+	}
+	if !active || m.Status != "running" {
+		return
+	}
+	log.Printf("[migrate] resuming %s: %s -> %s", m.ID, m.Source, m.Target)
+	if err := startMigrationWorker(database, backends, m); err != nil {
+		log.Printf("[migrate] resume %s: %v", m.ID, err)
+		_, _ = db.SetStorageMigrationStatus(database, m.ID, "error", err.Error())
+	}
+}
+
+// GetStorageMigrationStatus は直近の移行ジョブの状況を返す
+func GetStorageMigrationStatus(database *sql.DB) (MigrationStatus, error) {
+	m, ok, err := db.LatestStorageMigration(database)
+	if err != nil || !ok {
+		return MigrationStatus{Status: "idle"}, err
+	}
+	counts, err := db.CountMigrationItems(database, m.ID)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+	failed, err := db.FailedMigrationItems(database, m.ID, 100)
+	if err != nil {
+		return MigrationStatus{}, err
+	}
+
+	st := MigrationStatus{
+		Status:    m.Status,
+		Total:     counts.Total,
+		Done:      counts.Total - counts.Pending,
+		Errors:    counts.Failed,
+		ErrMsg:    m.Error,
+		Migration: &m,
+		Counts:    counts,
+		Failed:    failed,
+	}
+	migMu.Lock()
+	if migID == m.ID {
+		st.Current = migCurrent
+	}
+	migMu.Unlock()
+	return st, nil
+}
+
+func validateMigration(backends map[string]storage.Storage, req MigrationRequest) error {
+	if req.Source == req.Target {
+		return fmt.Errorf("%w: source and target are the same", ErrInvalidMigration)
+	}
+	if backends[req.Source] == nil {
+		return fmt.Errorf("%w: unknown source %q", ErrInvalidMigration, req.Source)
+	}
+	if backends[req.Target] == nil {
+		return fmt.Errorf("%w: unknown target %q", ErrInvalidMigration, req.Target)
+	}
+	// ミラーとそのレプリカの間で移すと、同じ実体を読みながら書き、delete_source で消してしまう
+	for _, pair := range [][2]string{{req.Source, req.Target}, {req.Target, req.Source}} {
+		if m, ok := storage.As[*storage.MirrorStorage](backends[pair[0]]); ok && slices.Contains(m.ReplicaNames(), pair[1]) {
+			return fmt.Errorf("%w: %q is a replica of %q", ErrInvalidMigration, pair[1], pair[0])
+		}
+	}
+	return nil
+}
+
+// includeIcons はアイコンも移すかどうか。アイコンは保存先を記録しておらず
+// 配信時は NAS → ローカルの順に探すため、その 2 つの間で全体を移すときだけ対象にする。
+func includeIcons(req MigrationRequest) bool {
+	legacy := func(s string) bool { return s == "nas" || s == "local" }
+	return req.CollectionID == "" && legacy(req.Source) && legacy(req.Target)
+}
+
+func startMigrationWorker(database *sql.DB, backends map[string]storage.Storage, m db.StorageMigration) error {
+	if err := validateMigration(backends, MigrationRequest{Source: m.Source, Target: m.Target}); err != nil {
+		return err // 再開時に設定が変わっていた場合も含む
+	}
+	src, dst := backends[m.Source], backends[m.Target]
+
+	migMu.Lock()
+	for migID != "" {
+		if migCtx.Err() == nil {
+			migMu.Unlock()
+			return ErrMigrationActive
+		}
+		// 一時停止・取り消しの直後: 前のワーカーが止まるのを待つ
+		migMu.Unlock()
+		migWG.Wait()
+		migMu.Lock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	migID, migCtx, migCancel, migCurrent = m.ID, ctx, cancel, ""
+	migWG.Add(1)
+	migMu.Unlock()
+
+	go func() {
+		defer migWG.Done()
+		defer func() {
+			cancel()
+			migMu.Lock()
+			migID, migCtx, migCancel, migCurrent = "", nil, nil, ""
+			migMu.Unlock()
+		}()
+		runStorageMigration(ctx, database, src, dst, m)
+	}()
+	return nil
+}
+
+func runStorageMigration(ctx context.Context, database *sql.DB, src, dst storage.Storage, m db.StorageMigration) {
+	const batch = 50
+	for {
+		items, err := db.PendingMigrationItems(database, m.ID, batch)
+		if err != nil {
+			log.Printf("[migrate] %s: %v", m.ID, err)
+			_, _ = db.SetStorageMigrationStatus(database, m.ID, "error", err.Error(), "running")
+			return
+		}
+		if len(items) == 0 {
+			break
+		}
+		for _, it := range items {
+			if ctx.Err() != nil {
+				return // 一時停止・取り消し（状態は呼び出し側が更新済み）
+			}
+			migMu.Lock()
+			migCurrent = it.Name
+			migMu.Unlock()
+
+			status, sum, err := migrateItem(ctx, database, src, dst, m, it)
+			if ctx.Err() != nil && status != "done" {
+				// 途中で止められたファイルは未処理のまま残す。
+				// 付け替えまで済んだものは移行元が消えているので、再開時にやり直さないよう結果を残す
+				return
+			}
+			errMsg := ""
+			if err != nil {
+				log.Printf("[migrate] WARN %s: %v", it.Name, err)
+				errMsg = err.Error()
+			}
+			if err := db.SetMigrationItemResult(database, m.ID, it.Name, status, sum, errMsg); err != nil {
+				log.Printf("[migrate] %s: %v", m.ID, err)
+				_, _ = db.SetStorageMigrationStatus(database, m.ID, "error", err.Error(), "running")
+				return
+			}
+		}
+	}
+
+	if ok, _ := db.SetStorageMigrationStatus(database, m.ID, "done", "", "running"); ok {
+		counts, _ := db.CountMigrationItems(database, m.ID)
+		log.Printf("[migrate] done %s: %d/%d files (failed: %d, skipped: %d)",
+			m.ID, counts.Done, counts.Total, counts.Failed, counts.Skipped)
+	}
+}
+
+// migrateItem はファイル（とサムネイル）を複製・検証し、DB を移行先に付け替えてから移行元を消す
+func migrateItem(ctx context.Context, database *sql.DB, src, dst storage.Storage, m db.StorageMigration, it db.StorageMigrationItem) (status, checksum string, err error) {
+	for _, thumb := range it.Thumbnails {
+		if _, err := copyVerified(ctx, src, dst, thumb); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return "failed", "", fmt.Errorf("thumbnail %s: %w", thumb, err)
+		}
+	}
+
+	sum, err := copyVerified(ctx, src, dst, it.Name)
+	if err != nil {
+		if it.Kind == db.MigrationItemIcon && errors.Is(err, storage.ErrNotFound) {
+			return "skipped", "", nil // このバックエンドには無いアイコン
+		}
+		return "failed", "", err
+	}
+
+	if it.Kind == db.MigrationItemFile {
+		// 重複排除で同じキーを共有している行もまとめて移し、ブロブの台帳も付け替える
+		if err := db.MoveFileStorage(database, it.Name, m.Source, m.Target); err != nil {
+			return "failed", sum, err
+		}
+		if err := db.MoveBlob(database, m.Source, m.Target, it.Name); err != nil {
+			log.Printf("[migrate] WARN move blob %s: %v", it.Name, err)
+		}
+	}
+
+	if m.DeleteSource {
+		// 付け替えは済んでいるので、消せなくても移行自体は成功扱い。
+		// ここで止められても移行元を残さないよう、一時停止・取り消しでは打ち切らない
+		delCtx := context.WithoutCancel(ctx)
+		for _, name := range append([]string{it.Name}, it.Thumbnails...) {
+			if err := src.Delete(delCtx, name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("[migrate] WARN delete source %s: %v", name, err)
+			}
+		}
+	}
+	return "done", sum, nil
+}
+
+// copyVerified は src から dst へ複製し、dst から読み直した SHA-256 が一致するか確かめる
+func copyVerified(ctx context.Context, src, dst storage.Storage, name string) (string, error) {
+	rc, item, err := src.Open(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = dst.Upload(ctx, name, io.TeeReader(rc, h), item.Size)
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+
+	vr, _, err := dst.Open(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("verify: %w", err)
+	}
+	defer vr.Close()
+	vh := sha256.New()
+	if _, err := io.Copy(vh, vr); err != nil {
+		return "", fmt.Errorf("verify: %w", err)
+	}
+	if got := hex.EncodeToString(vh.Sum(nil)); got != want {
+		return "", fmt.Errorf("%w: %s (source %s, target %s)", ErrChecksumMismatch, name, want, got)
+	}
+	return want, nil
+}
@@ -0,0 +1,270 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrLengthRequired はクォータがあるのにアップロードのサイズが分からない場合のエラー
+	ErrLengthRequired = errors.New("upload size is required to check the storage quota")
+)
+
+// QuotaExceededError はどの制限を超えたかを表す。
+// storage.ErrFileTooLarge としても扱えるので、既存の 413 応答にそのまま乗る。
+type QuotaExceededError struct {
+	Scope     string // "user" / "role" / "collection"
+	Target    string
+	Limit     int64
+	Used      int64 // 保存済み + アップロード中
+	Requested int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota for %s exceeded: %d of %d bytes used, %d more requested",
+		e.Scope, e.Target, e.Used, e.Limit, e.Requested)
+}
+
+func (e *QuotaExceededError) Unwrap() []error {
+	return []error{ErrQuotaExceeded, storage.ErrFileTooLarge}
+}
+
+// quotaReservationTTL を過ぎたアップロード中の確保分は放棄されたとみなす
+const quotaReservationTTL = 6 * time.Hour
+
+// quotaReservation はアップロード中（一時ファイルにあり DB にまだ無い）のバイト数
+type quotaReservation struct {
+	userID       string
+	collectionID string
+	parts        map[string]int64 // チャンク番号ごと（再送で二重に数えない）
+	touched      time.Time
+	held         bool // エンコードのキューにあるジョブの分（待ちが長くても期限切れにしない）
+}
+
+func (r *quotaReservation) total() int64 {
+	var n int64
+	for _, b := range r.parts {
+		n += b
+	}
+	return n
+}
+
+var (
+	quotaMu      sync.Mutex
+	reservations = map[string]*quotaReservation{}
+)
+
+// ReserveQuota はアップロード uploadKey の part に n バイトを確保する。
+// 保存済みの使用量と他のアップロード中の確保分を合わせてユーザー（個別 → ロールの順）と
+// コレクションの上限を超える場合は *QuotaExceededError を返す。
+// n < 0（サイズ不明）は上限が設定されていれば ErrLengthRequired になる。
+// 確保した分は ReleaseQuota で解放する（ファイルが DB に記録された後に呼ぶ）。
+func ReserveQuota(database *sql.DB, uploadKey, part, userID, role, collectionID string, n int64) error {
+	userLimit, userScope, err := userQuota(database, userID, role)
+	if err != nil {
+		return err
+	}
+	colLimit, colSet, err := db.GetQuota(database, db.QuotaScopeCollection, collectionID)
+	if err != nil {
+		return err
+	}
+	if userScope == "" && !colSet {
+		return nil // 制限なし
+	}
+	if n < 0 {
+		return ErrLengthRequired
+	}
+
+	// 保存済みの使用量はロックの中で読む。確保分はファイルが DB に記録されてから解放されるので、
+	// 読んだ後に終わったアップロードも DB か確保分のどちらかで必ず数えられる
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	pruneReservations()
+
+	userUsed, _, err := db.UserUsage(database, userID)
+	if err != nil {
+		return err
+	}
+	colUsed, _, err := db.CollectionUsage(database, collectionID)
+	if err != nil {
+		return err
+	}
+
+	var userPending, colPending int64
+	for key, r := range reservations {
+		pending := r.total()
+		if key == uploadKey {
+			pending -= r.parts[part] // 同じチャンクの再送は置き換える
+		}
+		if r.userID == userID {
+			userPending += pending
+		}
+		if r.collectionID == collectionID {
+			colPending += pending
+		}
+	}
+
+	if userScope != "" && userUsed+userPending+n > userLimit {
+		target := userID
+		if userScope == db.QuotaScopeRole {
+			target = role
+		}
+		return &QuotaExceededError{Scope: userScope, Target: target, Limit: userLimit, Used: userUsed + userPending, Requested: n}
+	}
+	if colSet && colUsed+colPending+n > colLimit {
+		return &QuotaExceededError{Scope: db.QuotaScopeCollection, Target: collectionID, Limit: colLimit, Used: colUsed + colPending, Requested: n}
+	}
+
+	r, ok := reservations[uploadKey]
+	if !ok {
+		r = &quotaReservation{userID: userID, collectionID: collectionID, parts: map[string]int64{}}
+		reservations[uploadKey] = r
+	}
+	r.parts[part] = n
+	r.touched = time.Now()
+	return nil
+}
+
+// MoveFileWithinQuota はファイル fileID をコレクション toCollectionID へ移す move を、移動先の上限を確かめてから呼ぶ。
+// 確かめてから移し終えるまで quotaMu を持つので、同時に進むアップロードの確保と合わせて上限を超えない。
+// 超える場合は move を呼ばずに *QuotaExceededError を返す。
+func MoveFileWithinQuota(database *sql.DB, fileID, fromCollectionID, toCollectionID string, move func() error) error {
+	if toCollectionID == fromCollectionID {
+		return move()
+	}
+	limit, ok, err := db.GetQuota(database, db.QuotaScopeCollection, toCollectionID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return move()
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	pruneReservations()
+
+	n, err := db.FileUsage(database, fileID)
+	if err != nil {
+		return err
+	}
+	used, _, err := db.CollectionUsage(database, toCollectionID)
+	if err != nil {
+		return err
+	}
+	for _, r := range reservations {
+		if r.collectionID == toCollectionID {
+			used += r.total()
+		}
+	}
+	if used+n > limit {
+		return &QuotaExceededError{Scope: db.QuotaScopeCollection, Target: toCollectionID, Limit: limit, Used: used, Requested: n}
+	}
+	return move()
+}
+
+// ChunkQuotaKey はチャンクアップロードのセッション uploadID の確保分のキー
+// （セッションを消すときは janitor も含めてこのキーで解放する）
+func ChunkQuotaKey(uploadID string) string {
+	return "chunk:" + uploadID
+}
+
+// ReleaseQuota はアップロード uploadKey の確保分を解放する（何度呼んでもよい）
+func ReleaseQuota(uploadKey string) {
+	quotaMu.Lock()
+	delete(reservations, uploadKey)
+	quotaMu.Unlock()
+}
+
+// holdQuota は uploadKey の確保分をキューに入ったジョブのものとして、ReleaseQuota まで期限切れにしない。
+// 再起動などで確保分が無くなっていれば n バイトで確保し直す（上限は受け付けたときに確かめてあるので確かめない）。
+func holdQuota(uploadKey, userID, collectionID string, n int64) {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	r, ok := reservations[uploadKey]
+	if !ok {
+		r = &quotaReservation{userID: userID, collectionID: collectionID, parts: map[string]int64{"": n}}
+		reservations[uploadKey] = r
+	}
+	r.held = true
+	r.touched = time.Now()
+}
+
+// pendingBytes はユーザーのアップロード中の確保分の合計を返す
+func pendingBytes(userID string) int64 {
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	pruneReservations()
+	var n int64
+	for _, r := range reservations {
+		if r.userID == userID {
+			n += r.total()
+		}
+	}
+	return n
+}
+
+// pruneReservations は放棄されたアップロードの確保分を捨てる（quotaMu を持って呼ぶ）
+func pruneReservations() {
+	for key, r := range reservations {
+		if !r.held && time.Since(r.touched) > quotaReservationTTL {
+			delete(reservations, key)
+		}
+	}
+}
+
+// userQuota はユーザーに適用される上限を返す。個別の設定がロールの設定より優先される。
+// scope が "" なら制限なし。
+func userQuota(database *sql.DB, userID, role string) (int64, string, error) {
+	if limit, ok, err := db.GetQuota(database, db.QuotaScopeUser, userID); err != nil || ok {
+		return limit, db.QuotaScopeUser, err
+	}
+	if role != "" {
+		if limit, ok, err := db.GetQuota(database, db.QuotaScopeRole, role); err != nil || ok {
+			return limit, db.QuotaScopeRole, err
+		}
+	}
+	return 0, "", nil
+}
+
+// QuotaUsage はメンバー自身の使用量と上限（/v1/storage-usage 用）
+type QuotaUsage struct {
+	UsedBytes      int64                    `json:"used_bytes"` // ゴミ箱・旧バージョンを含む
+	Files          int                      `json:"files"`
+	PendingBytes   int64                    `json:"pending_bytes"`         // アップロード・処理中
+	LimitBytes     *int64                   `json:"limit_bytes"`           // null = 無制限
+	LimitScope     string                   `json:"limit_scope,omitempty"` // "user" / "role"
+	RemainingBytes *int64                   `json:"remaining_bytes"`
+	Collections    []db.CollectionUsageItem `json:"collections"`
+}
+
+func GetQuotaUsage(database *sql.DB, userID, role string) (QuotaUsage, error) {
+	var u QuotaUsage
+	var err error
+	if u.UsedBytes, u.Files, err = db.UserUsage(database, userID); err != nil {
+		return u, err
+	}
+	if u.Collections, err = db.UserUsageByCollection(database, userID); err != nil {
+		return u, err
+	}
+	u.PendingBytes = pendingBytes(userID)
+
+	limit, scope, err := userQuota(database, userID, role)
+	if err != nil {
+		return u, err
+	}
+	if scope != "" {
+		remaining := max(limit-u.UsedBytes-u.PendingBytes, 0)
+		u.LimitBytes = &limit
+		u.LimitScope = scope
+		u.RemainingBytes = &remaining
+	}
+	return u, nil
+}
@@ -0,0 +1,440 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+var (
+	ErrReconcileRunning = errors.New("storage reconciliation already running")
+	ErrInvalidResolve   = errors.New("invalid resolve request")
+)
+
+// QuarantinePrefix は隔離したファイルの置き場所（各バックエンド内）。チェックの対象外。
+const QuarantinePrefix = ".quarantine/"
+
+// reconcileGrace より新しいファイルはアップロード途中（DB に登録される前）の可能性があるので orphan にしない
+const reconcileGrace = time.Hour
+
+// ReconcileStatus は整合性チェックの状況
+type ReconcileStatus struct {
+	Status      string            `json:"status"` // idle / running / done / error
+	Scanned     int               `json:"scanned"`
+	Orphans     int               `json:"orphans"`
+	OrphanBytes int64             `json:"orphan_bytes"`
+	Dangling    int               `json:"dangling"`
+	Skipped     map[string]string `json:"skipped,omitempty"` // 一覧を取れなかったバックエンドとエラー
+	StartedAt   *time.Time        `json:"started_at,omitempty"`
+	FinishedAt  *time.Time        `json:"finished_at,omitempty"`
+	ErrMsg      string            `json:"error,omitempty"`
+}
+
+var (
+	reconMu    sync.Mutex
+	reconState = ReconcileStatus{Status: "idle"}
+)
+
+// GetReconcileStatus は直近の整合性チェックの状況を返す
+func GetReconcileStatus() ReconcileStatus {
+	reconMu.Lock()
+	defer reconMu.Unlock()
+	return reconState
+}
+
+// ReconcileStorage は全バックエンドのファイル（thumbnails/ icons/ も含む）と DB の参照を突き合わせ、
+// DB から参照されていないファイル（orphan）と実体の無い参照（dangling）を storage_findings に記録する。
+// backends は装飾前のストア（local / nas / s3 / mirror）。ミラーは各レプリカとして調べる。
+func ReconcileStorage(ctx context.Context, database *sql.DB, backends map[string]storage.Storage) error {
+	reconMu.Lock()
+	if reconState.Status == "running" {
+		reconMu.Unlock()
+		return ErrReconcileRunning
+	}
+	now := time.Now().UTC()
+	reconState = ReconcileStatus{Status: "running", StartedAt: &now}
+	reconMu.Unlock()
+
+	err := reconcileStorage(ctx, database, backends)
+
+	reconMu.Lock()
+	done := time.Now().UTC()
+	reconState.FinishedAt = &done
+	if err != nil {
+		reconState.Status = "error"
+		reconState.ErrMsg = err.Error()
+	} else {
+		reconState.Status = "done"
+	}
+	s := reconState
+	reconMu.Unlock()
+
+	log.Printf("[RECONCILE] done: scanned=%d orphans=%d (%d bytes) dangling=%d skipped=%d",
+		s.Scanned, s.Orphans, s.OrphanBytes, s.Dangling, len(s.Skipped))
+	return err
+}
+
+func reconcileStorage(ctx context.Context, database *sql.DB, backends map[string]storage.Storage) error {
+	physical, replicas := physicalBackends(backends)
+
+	// 先にファイルを集める（DB を先に読むと、その後にアップロードされたファイルが orphan に見える）
+	present := map[string]map[string]storage.FileItem{}
+	for _, name := range physical {
+		files := map[string]storage.FileItem{}
+		err := storage.ListAll(ctx, backends[name], "", func(it storage.FileItem) error {
+			if strings.HasPrefix(it.Name, ".") {
+				return nil // 隔離したファイル・一時ファイル
+			}
+			files[it.Name] = it
+			return nil
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		reconMu.Lock()
+		if err != nil {
+			if reconState.Skipped == nil {
+				reconState.Skipped = map[string]string{}
+			}
+			reconState.Skipped[name] = err.Error()
+		} else {
+			reconState.Scanned += len(files)
+		}
+		reconMu.Unlock()
+		if err != nil {
+			log.Printf("[RECONCILE] WARN walk %s: %v", name, err)
+			continue
+		}
+		present[name] = files
+	}
+
+	refs, err := db.ListStorageReferences(database)
+	if err != nil {
+		return err
+	}
+
+	referenced := map[string]map[string]bool{} // バックエンド → 参照されているキー
+	icons := map[string]bool{}                 // アイコンはどのバックエンドにあってもよい
+	mark := func(backend, key string) {
+		if referenced[backend] == nil {
+			referenced[backend] = map[string]bool{}
+		}
+		referenced[backend][key] = true
+	}
+
+	var findings []db.StorageFinding
+	for _, ref := range refs {
+		if ref.Column == "image_url" {
+			key, ok := iconKey(ref.Key)
+			if !ok {
+				continue
+			}
+			icons[key] = true
+			if len(present) < len(physical) {
+				continue // 調べられなかったバックエンドにあるかもしれない
+			}
+			if locateKey(present, physical, key) == "" {
+				findings = append(findings, db.StorageFinding{
+					Kind: db.FindingDangling, Name: key, FileID: ref.ID, Column: ref.Column,
+				})
+			}
+			continue
+		}
+
+		// ミラーのファイルは各レプリカにあるはず（一部のレプリカだけに無いものはレプリカ修復の対象）
+		expected := []string{ref.Backend}
+		if ref.Backend == "mirror" {
+			expected = replicas
+		}
+		walked, found := 0, false
+		for _, b := range expected {
+			mark(b, ref.Key)
+			if files, ok := present[b]; ok {
+				walked++
+				if _, ok := files[ref.Key]; ok {
+					found = true
+				}
+			}
+		}
+		if found || (walked == 0 && backends[ref.Backend] != nil) || ref.Column == "version" {
+			continue // 実体がある、調べられなかった、または旧バージョン
+		}
+		f := db.StorageFinding{
+			Kind: db.FindingDangling, Backend: ref.Backend, Name: ref.Key, FileID: ref.ID, Column: ref.Column,
+			FoundIn: locateKey(present, physical, ref.Key),
+		}
+		if backends[ref.Backend] == nil {
+			f.Detail = "backend not configured"
+		}
+		findings = append(findings, f)
+	}
+
+	cutoff := time.Now().Add(-reconcileGrace)
+	for _, b := range physical {
+		files, ok := present[b]
+		if !ok {
+			continue
+		}
+		keys := make([]string, 0, len(files))
+		for key := range files {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			it := files[key]
+			if referenced[b][key] || icons[key] || it.Modified.After(cutoff) {
+				continue
+			}
+			findings = append(findings, db.StorageFinding{Kind: db.FindingOrphan, Backend: b, Name: key, Size: it.Size})
+		}
+	}
+
+	if err := db.ReplaceStorageFindings(database, findings); err != nil {
+		return err
+	}
+	reconMu.Lock()
+	for _, f := range findings {
+		if f.Kind == db.FindingOrphan {
+			reconState.Orphans++
+			reconState.OrphanBytes += f.Size
+		} else {
+			reconState.Dangling++
+		}
+	}
+	reconMu.Unlock()
+	return nil
+}
+
+// physicalBackends は実際にファイルを置くバックエンドの名前（ソート済み）とミラーのレプリカ名を返す
+func physicalBackends(backends map[string]storage.Storage) (physical, replicas []string) {
+	for name, s := range backends {
+		if m, ok := storage.As[*storage.MirrorStorage](s); ok {
+			replicas = m.ReplicaNames()
+			continue
+		}
+		physical = append(physical, name)
+	}
+	sort.Strings(physical)
+	return physical, replicas
+}
+
+// locateKey は key が見つかったバックエンドを返す（無ければ ""）
+func locateKey(present map[string]map[string]storage.FileItem, physical []string, key string) string {
+	for _, b := range physical {
+		if _, ok := present[b][key]; ok {
+			return b
+		}
+	}
+	return ""
+}
+
+// iconKey は collections.image_url（"http://.../v1/files/icon_xxx.png" など）から保存キーを取り出す
+func iconKey(raw string) (string, bool) {
+	if i := strings.IndexAny(raw, "?#"); i >= 0 {
+		raw = raw[:i]
+	}
+	if u, err := url.Parse(raw); err == nil {
+		raw = u.Path
+	}
+	key := storage.CleanSubPath(raw)
+	if key == "" {
+		return "", false
+	}
+	if strings.HasPrefix(key, "icons/") {
+		return key, true
+	}
+	if i := strings.Index(key, "/icons/"); i >= 0 {
+		return key[i+1:], true
+	}
+	return path.Base(key), true
+}
+
+// 不整合への対応
+const (
+	ResolveQuarantine = "quarantine" // orphan: .quarantine/ へ移す
+	ResolveDelete     = "delete"     // orphan: ファイルを消す / dangling: 参照を消す
+	ResolveRelink     = "relink"     // dangling: 見つかったバックエンド、または指定した orphan に付け替える
+)
+
+// ResolveResult は 1 件ごとの対応結果
+type ResolveResult struct {
+	ID     int64  `json:"id"`
+	OK     bool   `json:"ok"`
+	Status string `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ResolveStorageFindings は未対応の結果に action で対応する。
+// relinkTo（orphan の ID）を指定した relink は、dangling の参照をその orphan のファイルに付け替える。
+func ResolveStorageFindings(ctx context.Context, database *sql.DB, backends map[string]storage.Storage, ids []int64, action string, relinkTo int64) ([]ResolveResult, error) {
+	switch action {
+	case ResolveQuarantine, ResolveDelete, ResolveRelink:
+	default:
+		return nil, fmt.Errorf("%w: unknown action %q", ErrInvalidResolve, action)
+	}
+	if relinkTo != 0 && (action != ResolveRelink || len(ids) != 1) {
+		return nil, fmt.Errorf("%w: relink_to needs action relink and exactly one id", ErrInvalidResolve)
+	}
+
+	findings, err := db.GetStorageFindings(database, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := map[int64]db.StorageFinding{}
+	for _, f := range findings {
+		byID[f.ID] = f
+	}
+
+	var target *db.StorageFinding
+	if relinkTo != 0 {
+		got, err := db.GetStorageFindings(database, []int64{relinkTo})
+		if err != nil {
+			return nil, err
+		}
+		if len(got) == 0 || got[0].Kind != db.FindingOrphan || got[0].Status != "open" {
+			return nil, fmt.Errorf("%w: relink_to must be an open orphan", ErrInvalidResolve)
+		}
+		target = &got[0]
+	}
+
+	results := make([]ResolveResult, 0, len(ids))
+	for _, id := range ids {
+		r := ResolveResult{ID: id}
+		f, ok := byID[id]
+		switch {
+		case !ok:
+			r.Error = "not found"
+		case f.Status != "open":
+			r.Error = "already " + f.Status
+		default:
+			var detail string
+			r.Status, detail, err = resolveFinding(ctx, database, backends, f, action, target)
+			if err == nil {
+				_, err = db.ResolveStorageFinding(database, id, r.Status, detail)
+			}
+			if err != nil {
+				r.Status = ""
+				r.Error = err.Error()
+				log.Printf("[RECONCILE] %s %s %s: %v", action, f.Kind, f.Name, err)
+			} else {
+				r.OK = true
+				log.Printf("[RECONCILE] %s %s %s/%s", r.Status, f.Kind, f.Backend, f.Name)
+			}
+		}
+		results = append(results, r)
+	}
+
+	if target != nil && len(results) == 1 && results[0].OK {
+		detail := fmt.Sprintf("linked to finding %d", ids[0])
+		if _, err := db.ResolveStorageFinding(database, target.ID, "relinked", detail); err != nil {
+			log.Printf("[RECONCILE] WARN mark orphan %d relinked: %v", target.ID, err)
+		}
+	}
+	return results, nil
+}
+
+// resolveFinding は 1 件に対応し、記録する状態と補足を返す
+func resolveFinding(ctx context.Context, database *sql.DB, backends map[string]storage.Storage, f db.StorageFinding, action string, target *db.StorageFinding) (string, string, error) {
+	if f.Kind == db.FindingOrphan {
+		store := backends[f.Backend]
+		if store == nil {
+			return "", "", fmt.Errorf("backend %s is not configured", f.Backend)
+		}
+		switch action {
+		case ResolveQuarantine:
+			dst := QuarantinePrefix + f.Name
+			if _, err := storage.Copy(ctx, store, f.Name, store, dst); err != nil {
+				return "", "", err
+			}
+			if err := store.Delete(ctx, f.Name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return "", "", err
+			}
+			// 台帳に残っていると同じ内容のアップロードが消えたブロブを参照してしまう
+			if err := db.ForgetBlob(database, f.Backend, f.Name); err != nil {
+				return "", "", err
+			}
+			return "quarantined", dst, nil
+		case ResolveDelete:
+			if err := store.Delete(ctx, f.Name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return "", "", err
+			}
+			if err := db.ForgetBlob(database, f.Backend, f.Name); err != nil {
+				return "", "", err
+			}
+			return "deleted", "", nil
+		}
+		return "", "", fmt.Errorf("%w: %s does not apply to orphans", ErrInvalidResolve, action)
+	}
+
+	switch action {
+	case ResolveDelete:
+		var err error
+		switch f.Column {
+		case "file_name":
+			err = db.DeleteFileFromCollection(database, f.FileID)
+			if err == nil {
+				// 実体の無いブロブが台帳に残ると、同じ内容のアップロードが書き込みを省いてしまう
+				err = db.ForgetBlob(database, f.Backend, f.Name)
+			}
+		case "thumbnail_name":
+			err = db.UpdateFileKey(database, f.FileID, "thumbnail_name", "")
+		case "image_url":
+			err = db.SetCollectionImage(database, f.FileID, "")
+		}
+		return "deleted", "reference removed", err
+
+	case ResolveRelink:
+		if target != nil {
+			return relinkToOrphan(database, f, *target)
+		}
+		if f.FoundIn == "" {
+			return "", "", fmt.Errorf("%w: %s was not found in any backend; pass relink_to", ErrInvalidResolve, f.Name)
+		}
+		if f.Column != "file_name" {
+			// サムネイルは本体と同じバックエンドから配信されるので、本体ごと付け替える
+			return "", "", fmt.Errorf("%w: only file_name can follow found_in", ErrInvalidResolve)
+		}
+		if err := db.SetFileStorageType(database, f.FileID, f.FoundIn); err != nil {
+			return "", "", err
+		}
+		return "relinked", "storage_type -> " + f.FoundIn, nil
+	}
+	return "", "", fmt.Errorf("%w: %s does not apply to dangling references", ErrInvalidResolve, action)
+}
+
+// relinkToOrphan は dangling の参照を orphan のファイルに向け直す
+func relinkToOrphan(database *sql.DB, f, orphan db.StorageFinding) (string, string, error) {
+	detail := fmt.Sprintf("%s -> %s/%s", f.Column, orphan.Backend, orphan.Name)
+	switch f.Column {
+	case "file_name":
+		if err := db.UpdateFileKey(database, f.FileID, "file_name", orphan.Name); err != nil {
+			return "", "", err
+		}
+		if err := db.SetFileStorageType(database, f.FileID, orphan.Backend); err != nil {
+			return "", "", err
+		}
+	case "thumbnail_name":
+		if orphan.Backend != f.Backend {
+			return "", "", fmt.Errorf("%w: thumbnail must be on %s", ErrInvalidResolve, f.Backend)
+		}
+		if err := db.UpdateFileKey(database, f.FileID, "thumbnail_name", orphan.Name); err != nil {
+			return "", "", err
+		}
+	case "image_url":
+		if err := db.SetCollectionImage(database, f.FileID, orphan.Name); err != nil {
+			return "", "", err
+		}
+	}
+	return "relinked", detail, nil
+}
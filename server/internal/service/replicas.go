@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+// ErrRepairRunning は修復ジョブが既に実行中の場合のエラー
+var ErrRepairRunning = errors.New("replica repair already running")
+
+// ReplicaRepairStatus はレプリカ修復ジョブの状況
+type ReplicaRepairStatus struct {
+	Status     string     `json:"status"` // idle / running / done / error
+	FullScan   bool       `json:"full_scan"`
+	Checked    int        `json:"checked"`
+	Repaired   int        `json:"repaired"`
+	Errors     int        `json:"errors"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ErrMsg     string     `json:"error,omitempty"`
+}
+
+var (
+	repairMu    sync.Mutex
+	repairState = ReplicaRepairStatus{Status: "idle"}
+)
+
+// GetReplicaRepairStatus は直近の修復ジョブの状況を返す
+func GetReplicaRepairStatus() ReplicaRepairStatus {
+	repairMu.Lock()
+	defer repairMu.Unlock()
+	return repairState
+}
+
+// RepairReplicas は missing と記録されたレプリカへファイルを複製し直す。
+// fullScan の場合はミラー上の全ファイル（DB の storage_type = 'mirror'）を先に確認し、
+// 状態が記録されていない欠損も見つける。
+func RepairReplicas(ctx context.Context, database *sql.DB, mirror *storage.MirrorStorage, fullScan bool) error {
+	repairMu.Lock()
+	if repairState.Status == "running" {
+		repairMu.Unlock()
+		return ErrRepairRunning
+	}
+	now := time.Now().UTC()
+	repairState = ReplicaRepairStatus{Status: "running", FullScan: fullScan, StartedAt: &now}
+	repairMu.Unlock()
+
+	err := repairReplicas(ctx, database, mirror, fullScan)
+
+	repairMu.Lock()
+	done := time.Now().UTC()
+	repairState.FinishedAt = &done
+	if err != nil {
+		repairState.Status = "error"
+		repairState.ErrMsg = err.Error()
+	} else {
+		repairState.Status = "done"
+	}
+	s := repairState
+	repairMu.Unlock()
+
+	log.Printf("[REPLICA] repair done: checked=%d repaired=%d errors=%d full=%v", s.Checked, s.Repaired, s.Errors, fullScan)
+	return err
+}
+
+func repairReplicas(ctx context.Context, database *sql.DB, mirror *storage.MirrorStorage, fullScan bool) error {
+	if fullScan {
+		names, err := db.ListMirrorFileNames(database)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if _, err := mirror.Verify(ctx, name); err != nil {
+				return err
+			}
+			repairMu.Lock()
+			repairState.Checked++
+			repairMu.Unlock()
+		}
+	}
+
+	const batch = 200
+	seen := map[string]bool{}
+	for {
+		states, err := db.ListUnhealthyReplicas(database, batch)
+		if err != nil {
+			return err
+		}
+		progressed := false
+		for _, st := range states {
+			if seen[st.Name] {
+				continue // このジョブで修復できなかったもの
+			}
+			seen[st.Name] = true
+			progressed = true
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			repaired, err := mirror.Repair(ctx, st.Name)
+			repairMu.Lock()
+			repairState.Repaired += len(repaired)
+			if err != nil {
+				repairState.Errors++
+			}
+			repairMu.Unlock()
+			if err != nil {
+				log.Printf("[REPLICA] repair %s: %v", st.Name, err)
+			}
+		}
+		if !progressed || len(states) < batch {
+			return nil
+		}
+	}
+}
+
+// StartReplicaRepairLoop は interval ごとに修復ジョブを実行する（ctx が終わるまで）
+func StartReplicaRepairLoop(ctx context.Context, database *sql.DB, mirror *storage.MirrorStorage, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := RepairReplicas(ctx, database, mirror, false); err != nil && !errors.Is(err, ErrRepairRunning) {
+					log.Printf("[REPLICA] scheduled repair: %v", err)
+				}
+			}
+		}
+	}()
+}
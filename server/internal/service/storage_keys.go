@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+// KeyRepair は衝突していた 1 行に対する修復内容
+type KeyRepair struct {
+	FileID      string `json:"file_id"`
+	StorageType string `json:"storage_type"`
+	Column      string `json:"column"`
+	OldKey      string `json:"old_key"`
+	NewKey      string `json:"new_key,omitempty"`
+	// 後からアップロードされた同名ファイルで上書きされているため、
+	// 元の内容ではなく最新の内容が複製される
+	ContentOverwritten bool   `json:"content_overwritten"`
+	Error              string `json:"error,omitempty"`
+}
+
+// KeyRepairReport は RepairKeyCollisions の結果
+type KeyRepairReport struct {
+	DryRun     bool              `json:"dry_run"`
+	Collisions []db.KeyCollision `json:"collisions"`
+	Repairs    []KeyRepair       `json:"repairs"`
+}
+
+// RepairKeyCollisions は同じ保存キーを共有している行を検出し、
+// 最新の行以外に一意なキーの複製を割り当てる。これで片方の行を削除しても
+// もう片方の実体は消えなくなる。dryRun の場合は計画だけを返す。
+func RepairKeyCollisions(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, dryRun bool) (KeyRepairReport, error) {
+	report := KeyRepairReport{DryRun: dryRun, Repairs: []KeyRepair{}}
+
+	collisions, err := db.FindKeyCollisions(database)
+	if err != nil {
+		return report, err
+	}
+	if collisions == nil {
+		collisions = []db.KeyCollision{}
+	}
+	report.Collisions = collisions
+
+	for _, col := range collisions {
+		store := storeFor(col.StorageType)
+		// 先頭（最新）の行が現在の実体の持ち主なので、キーはそのまま残す
+		for _, id := range col.FileIDs[1:] {
+			r := KeyRepair{FileID: id, StorageType: col.StorageType, Column: col.Column, OldKey: col.Key, ContentOverwritten: true}
+			if col.Column == "thumbnail_name" {
+				r.NewKey = storage.NewThumbnailKey(col.Key)
+			} else {
+				r.NewKey = storage.NewObjectKey(col.Key)
+			}
+
+			if !dryRun {
+				// 重複排除が有効だと内容のハッシュのキーに保存されるので、返ってきたキーを使う
+				item, err := storage.Copy(ctx, store, col.Key, store, r.NewKey)
+				if err == nil {
+					r.NewKey = item.Name
+					if err = db.UpdateFileKey(database, id, col.Column, r.NewKey); err != nil {
+						log.Printf("[KEYS] update %s.%s: %v", id, col.Column, err)
+						_ = store.Delete(ctx, r.NewKey)
+					}
+				} else {
+					log.Printf("[KEYS] copy %s -> %s (%s): %v", col.Key, r.NewKey, col.StorageType, err)
+				}
+				if err != nil {
+					r.Error = err.Error()
+					r.NewKey = ""
+				}
+			}
+			report.Repairs = append(report.Repairs, r)
+		}
+	}
+
+	log.Printf("[KEYS] collisions=%d repairs=%d dry_run=%v", len(report.Collisions), len(report.Repairs), dryRun)
+	return report, nil
+}
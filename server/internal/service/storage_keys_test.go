@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+func TestRepairKeyCollisionsWithDedup(t *testing.T) {
+	database, err := db.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	ctx := context.Background()
+
+	raw := storage.NewLocalStorage(t.TempDir())
+	store := storage.NewDedupStorage(raw, "local", db.BlobIndex{DB: database})
+	store.SetTempDir(t.TempDir())
+
+	if _, err := database.Exec(`INSERT INTO collections (id, name) VALUES ('c1', 'test')`); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(id, key, at string) {
+		t.Helper()
+		if _, err := database.Exec(
+			`INSERT INTO collection_files (id, collection_id, file_name, storage_type, uploaded_at) VALUES (?, 'c1', ?, 'local', ?)`,
+			id, key, at,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 重複排除で共有しているブロブは衝突ではない
+	shared := []byte("shared content")
+	var sharedKey string
+	for _, id := range []string{"d1", "d2"} {
+		item, err := store.Upload(ctx, "a.mp4", bytes.NewReader(shared), int64(len(shared)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedKey = item.Name
+		insert(id, sharedKey, "2024-01-01 00:00:00")
+	}
+
+	// 保存キー導入前に同名で上書きされた 2 行
+	legacy := []byte("legacy content")
+	if _, err := raw.Upload(ctx, "legacy.mp4", bytes.NewReader(legacy), int64(len(legacy))); err != nil {
+		t.Fatal(err)
+	}
+	insert("old", "legacy.mp4", "2024-01-01 00:00:00")
+	insert("new", "legacy.mp4", "2024-02-01 00:00:00")
+
+	storeFor := func(string) storage.Storage { return store }
+	report, err := RepairKeyCollisions(ctx, database, storeFor, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Collisions) != 1 || report.Collisions[0].Key != "legacy.mp4" {
+		t.Fatalf("collisions = %+v, want only legacy.mp4", report.Collisions)
+	}
+	if len(report.Repairs) != 1 || report.Repairs[0].FileID != "old" || report.Repairs[0].Error != "" {
+		t.Fatalf("repairs = %+v", report.Repairs)
+	}
+
+	// 行は実際に書かれたキー（ハッシュのキー）を指し、参照数も 1 つ持つ
+	var key string
+	if err := database.QueryRow(`SELECT file_name FROM collection_files WHERE id = 'old'`).Scan(&key); err != nil {
+		t.Fatal(err)
+	}
+	if key != report.Repairs[0].NewKey {
+		t.Errorf("row key = %q, report key = %q", key, report.Repairs[0].NewKey)
+	}
+	rc, _, err := store.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", key, err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(b, legacy) {
+		t.Errorf("content = %q, want %q", b, legacy)
+	}
+	var refs int
+	if err := database.QueryRow(`SELECT refs FROM blobs WHERE backend = 'local' AND key = ?`, key).Scan(&refs); err != nil || refs != 1 {
+		t.Errorf("refs(%s) = %d, %v, want 1", key, refs, err)
+	}
+	if err := database.QueryRow(`SELECT refs FROM blobs WHERE backend = 'local' AND key = ?`, sharedKey).Scan(&refs); err != nil || refs != 2 {
+		t.Errorf("refs(shared) = %d, %v, want 2", refs, err)
+	}
+
+	// 修復後はもう衝突として報告されない
+	again, err := db.FindKeyCollisions(database)
+	if err != nil || len(again) != 0 {
+		t.Errorf("collisions after repair = %+v, %v", again, err)
+	}
+}
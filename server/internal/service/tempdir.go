@@ -0,0 +1,93 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrInsufficientSpace は一時フォルダの空き容量が足りずアップロードを受け付けられない場合のエラー
+var ErrInsufficientSpace = errors.New("insufficient disk space for upload")
+
+var (
+	tempMu      sync.RWMutex
+	tempDir     string // 空なら OS の一時フォルダ
+	tempMinFree int64  // アップロード受付後も残す空き容量（0 以下なら検査しない）
+)
+
+// ConfigureTemp はアップロードの一時ファイルの置き場と、受付時に残す空き容量を設定する（起動時に呼ぶ）
+func ConfigureTemp(dir string, minFree int64) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("create temp dir: %w", err)
+		}
+	}
+	tempMu.Lock()
+	tempDir, tempMinFree = dir, minFree
+	tempMu.Unlock()
+	return nil
+}
+
+// TempDir はアップロードの一時ファイルの置き場（hideme_* のファイルはここに作る）
+func TempDir() string {
+	tempMu.RLock()
+	defer tempMu.RUnlock()
+	if tempDir == "" {
+		return os.TempDir()
+	}
+	return tempDir
+}
+
+// TempFreeBytes は一時フォルダの空き容量を返す（取れない環境では -1）
+func TempFreeBytes() int64 {
+	return diskFreeBytes(TempDir())
+}
+
+// CheckTempSpace は n バイトのアップロードを受け付けても設定した空き容量が残るか確認する。
+// 受信したファイルと結合・エンコード後のファイルが同時に置かれるので 2 倍を見込む。
+func CheckTempSpace(n int64) error {
+	tempMu.RLock()
+	minFree := tempMinFree
+	tempMu.RUnlock()
+	if minFree <= 0 || n < 0 {
+		return nil
+	}
+	free := TempFreeBytes()
+	if free < 0 {
+		return nil
+	}
+	if free-2*n < minFree {
+		return fmt.Errorf("%w: %d bytes free, %d requested, %d kept free", ErrInsufficientSpace, free, 2*n, minFree)
+	}
+	return nil
+}
+
+// 処理中の一時ファイル（エンコード待ちなどで長く触られなくても janitor が消さない）
+var (
+	heldMu sync.Mutex
+	held   = map[string]int{}
+)
+
+// HoldTemp は path を処理中として janitor から守る。返した関数で解除する。
+func HoldTemp(path string) (release func()) {
+	heldMu.Lock()
+	held[path]++
+	heldMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			heldMu.Lock()
+			if held[path]--; held[path] <= 0 {
+				delete(held, path)
+			}
+			heldMu.Unlock()
+		})
+	}
+}
+
+func isHeld(path string) bool {
+	heldMu.Lock()
+	defer heldMu.Unlock()
+	return held[path] > 0
+}
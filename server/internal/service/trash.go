@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+// PurgeTrashedFile はゴミ箱のファイルを旧バージョンごと DB とストレージから完全に消す
+// （重複排除中のブロブは最後の参照のときだけ実体が消える）
+func PurgeTrashedFile(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, id string) error {
+	cf, err := db.GetTrashedFile(database, id)
+	if err != nil {
+		return err
+	}
+	versions, err := db.ListFileVersions(database, cf.ID)
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteFileFromCollection(database, cf.ID); err != nil {
+		return err
+	}
+	deleteFileObjects(ctx, storeFor, cf)
+	deleteVersionObjects(ctx, storeFor, versions)
+	return nil
+}
+
+// PurgeTrashedCollection はゴミ箱のコレクションを中の全ファイル・アイコンごと完全に消す
+func PurgeTrashedCollection(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, id string) error {
+	col, err := db.GetTrashedCollection(database, id)
+	if err != nil {
+		return err
+	}
+	files, err := db.ListCollectionFilesForPurge(database, id)
+	if err != nil {
+		return err
+	}
+	var versions []db.FileVersion
+	for _, cf := range files {
+		vs, err := db.ListFileVersions(database, cf.ID)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, vs...)
+	}
+	// DB から削除（ON DELETE CASCADE で collection_files も自動削除）
+	if err := db.DeleteCollection(database, id); err != nil {
+		return err
+	}
+	for _, cf := range files {
+		deleteFileObjects(ctx, storeFor, cf)
+	}
+	deleteVersionObjects(ctx, storeFor, versions)
+	if iconName := iconFileName(col.ImageURL); iconName != "" {
+		deleteIcon(ctx, storeFor, iconName)
+	}
+	return nil
+}
+
+// iconBackends はアイコンがあり得るバックエンド（DownloadFile と同じく nas → local の順に探す）
+var iconBackends = []string{"nas", "local", "s3", "mirror"}
+
+// deleteIcon はアイコンを消す。アイコンは保存先を記録していない（移行で移ることもある）ので、
+// ファイルと同じ storeFor で各バックエンドのストアを引き、見つかったところから消す
+func deleteIcon(ctx context.Context, storeFor func(storageType string) storage.Storage, name string) {
+	seen := map[storage.Storage]bool{}
+	for _, backend := range iconBackends {
+		store := storeFor(backend)
+		if store == nil || seen[store] {
+			continue // 未設定のバックエンドは既定のストアが返る
+		}
+		seen[store] = true
+		if err := store.Delete(ctx, name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("[TRASH] WARN delete collection icon %s (%s): %v", name, backend, err)
+		}
+	}
+}
+
+func deleteFileObjects(ctx context.Context, storeFor func(storageType string) storage.Storage, cf db.CollectionFile) {
+	store := storeFor(cf.StorageType)
+	if err := store.Delete(ctx, cf.FileName); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("[TRASH] WARN delete file %s (%s): %v", cf.FileName, cf.StorageType, err)
+	}
+	if cf.ThumbnailName != "" {
+		if err := store.Delete(ctx, cf.ThumbnailName); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("[TRASH] WARN delete thumbnail %s (%s): %v", cf.ThumbnailName, cf.StorageType, err)
+		}
+	}
+}
+
+// iconFileName は image_url（"http://.../v1/files/icon_xxx.png"）から保存キーを取り出す
+func iconFileName(imageURL string) string {
+	key, ok := iconKey(imageURL)
+	if !ok {
+		return ""
+	}
+	return key
+}
+
+// PurgeExpiredTrash は retention より前にゴミ箱に入れたものを完全に消し、消した件数を返す
+func PurgeExpiredTrash(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, retention time.Duration) (int, error) {
+	fileIDs, collectionIDs, err := db.ExpiredTrash(database, time.Now().UTC().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, id := range collectionIDs {
+		if ctx.Err() != nil {
+			return purged, ctx.Err()
+		}
+		if err := PurgeTrashedCollection(ctx, database, storeFor, id); err != nil {
+			log.Printf("[TRASH] purge collection %s: %v", id, err)
+			continue
+		}
+		purged++
+	}
+	for _, id := range fileIDs {
+		if ctx.Err() != nil {
+			return purged, ctx.Err()
+		}
+		if err := PurgeTrashedFile(ctx, database, storeFor, id); err != nil {
+			if !errors.Is(err, db.ErrFileNotFound) { // コレクションごと消えた
+				log.Printf("[TRASH] purge file %s: %v", id, err)
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartTrashPurgeLoop は interval ごとに保持期間を過ぎたゴミ箱の中身を消す（ctx が終わるまで）
+func StartTrashPurgeLoop(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, retention, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			n, err := PurgeExpiredTrash(ctx, database, storeFor, retention)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("[TRASH] purge: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[TRASH] purged %d item(s) older than %s", n, retention)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
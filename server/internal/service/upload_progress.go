@@ -0,0 +1,38 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/BBSHSH/HideMe/server/internal/chat"
+	"github.com/BBSHSH/HideMe/server/internal/progress"
+)
+
+// RelayProgressToChat はアップロードの進捗を、アップロードした本人のチャットの WebSocket にも流す
+// （type: "upload_progress"）。ffmpeg の細かい進捗は 1% 刻みに間引く。
+func RelayProgressToChat() {
+	type sent struct {
+		phase   progress.Phase
+		percent int
+	}
+	var mu sync.Mutex
+	last := map[string]sent{}
+
+	progress.Global.OnEvent(func(ownerID, uploadID string, ev progress.Event) {
+		cur := sent{phase: ev.Phase, percent: int(ev.Percent)}
+		mu.Lock()
+		prev, ok := last[uploadID]
+		if ev.Phase.Finished() {
+			delete(last, uploadID)
+		} else {
+			last[uploadID] = cur
+		}
+		mu.Unlock()
+		if ok && prev == cur {
+			return
+		}
+		chat.Global.SendTo(ownerID, chat.WSMessage{Type: "upload_progress", Data: map[string]any{
+			"upload_id": uploadID,
+			"event":     ev,
+		}})
+	})
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/BBSHSH/HideMe/server/internal/db"
+	"github.com/BBSHSH/HideMe/server/internal/storage"
+)
+
+// VersionRetention はコレクションの旧バージョンの保持数を返す（未設定なら defaultKeep、負の値は 0）
+func VersionRetention(database *sql.DB, collectionID string, defaultKeep int) (int, error) {
+	keep, ok, err := db.CollectionVersionRetention(database, collectionID)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		keep = defaultKeep
+	}
+	return max(keep, 0), nil
+}
+
+// PruneFileVersions は保持数を超えた古い旧バージョンを DB とストレージから消す
+func PruneFileVersions(ctx context.Context, database *sql.DB, storeFor func(storageType string) storage.Storage, fileID string, keep int) error {
+	pruned, err := db.PruneFileVersions(database, fileID, keep)
+	if err != nil {
+		return err
+	}
+	deleteVersionObjects(ctx, storeFor, pruned)
+	return nil
+}
+
+func deleteVersionObjects(ctx context.Context, storeFor func(storageType string) storage.Storage, versions []db.FileVersion) {
+	for _, v := range versions {
+		store := storeFor(v.StorageType)
+		if err := store.Delete(ctx, v.FileName); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("[VERSIONS] WARN delete %s (%s): %v", v.FileName, v.StorageType, err)
+		}
+		if v.ThumbnailName != "" {
+			if err := store.Delete(ctx, v.ThumbnailName); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("[VERSIONS] WARN delete thumbnail %s (%s): %v", v.ThumbnailName, v.StorageType, err)
+			}
+		}
+	}
+}
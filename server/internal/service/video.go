@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BBSHSH/HideMe/server/internal/chat"
 	"github.com/BBSHSH/HideMe/server/internal/db"
@@ -70,10 +71,12 @@ func GetVideoDuration(path string) (float64, error) {
 
 var reOutTime = regexp.MustCompile(`out_time_ms=(\d+)`)
 
-func RunFFmpeg(args []string, totalSec float64, onProgress func(float64)) error {
+// RunFFmpeg は ffmpeg を実行する。ctx が終わったら ffmpeg を止める（アップロードの取り消し・終了時）
+func RunFFmpeg(ctx context.Context, args []string, totalSec float64, onProgress func(float64)) error {
 	allArgs := append([]string{"-progress", "pipe:2", "-nostats"}, args...)
-	cmd := exec.Command(FFmpegPath(), allArgs...)
+	cmd := exec.CommandContext(ctx, FFmpegPath(), allArgs...)
 	cmd.Stdout = io.Discard
+	cmd.WaitDelay = time.Second // 止めた後、出力を握ったままの子プロセスを待ち続けない
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
@@ -83,6 +86,10 @@ func RunFFmpeg(args []string, totalSec float64, onProgress func(float64)) error
 		return fmt.Errorf("ffmpeg start: %w", err)
 	}
 
+	// 取り消されたら、出力を握ったままのプロセスが残っていても読み込みを打ち切る
+	stop := context.AfterFunc(ctx, func() { stderr.Close() })
+	defer stop()
+
 	var stderrBuf strings.Builder
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
@@ -98,6 +105,9 @@ func RunFFmpeg(args []string, totalSec float64, onProgress func(float64)) error
 	}
 
 	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		log.Printf("[FFMPEG] error output:\n%s", stderrBuf.String())
 		return fmt.Errorf("ffmpeg: %w\n%s", err, stderrBuf.String())
 	}
@@ -141,47 +151,47 @@ func IsVideoFilename(name string) bool {
 	return false
 }
 
-// ProcessVideoBackground encodes a video and uploads it to storage asynchronously.
-func ProcessVideoBackground(store storage.Storage, database *sql.DB, storageType, uploadID, collectionID, userID, fileName, inputPath string, trimStart, trimEnd float64, volumeVal int, resolution string, fpsVal int) {
-	tmpOut := filepath.Join(os.TempDir(), "hideme_out_"+uploadID+".mp4")
+// encodeVideo は j の入力をエンコードして保存し、DB に記録する（エンコードキューのワーカーから呼ぶ）。
+// 失敗したら進捗に出すエラーコード（encoding_failed など）と原因を返す。エラーの進捗は呼び出し側が出す。
+func encodeVideo(ctx context.Context, store storage.Storage, database *sql.DB, j db.EncodeJob) (cf db.CollectionFile, deduplicated bool, code string, err error) {
+	tmpOut := filepath.Join(TempDir(), "hideme_out_"+j.ID+".mp4")
 	defer os.Remove(tmpOut)
+	defer HoldTemp(tmpOut)()
 
-	totalSec, _ := GetVideoDuration(inputPath)
-	if trimEnd > 0.01 && trimEnd > trimStart {
-		totalSec = trimEnd - trimStart
+	totalSec, _ := GetVideoDuration(j.InputPath)
+	if j.TrimEnd > 0.01 && j.TrimEnd > j.TrimStart {
+		totalSec = j.TrimEnd - j.TrimStart
 	}
 
-	height := ResolutionHeight(resolution)
-	ffArgs := BuildFFmpegArgs(inputPath, tmpOut, trimStart, trimEnd, volumeVal, height, fpsVal)
-	log.Printf("[FFMPEG/BG] start: %s -> %s", fileName, resolution)
+	height := ResolutionHeight(j.Resolution)
+	ffArgs := BuildFFmpegArgs(j.InputPath, tmpOut, j.TrimStart, j.TrimEnd, j.Volume, height, j.FPS)
+	log.Printf("[FFMPEG/BG] start: %s -> %s (job %s, attempt %d)", j.FileName, j.Resolution, j.ID, j.Attempts)
 
-	if err := RunFFmpeg(ffArgs, totalSec, func(pct float64) {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: pct})
+	if err := RunFFmpeg(ctx, ffArgs, totalSec, func(pct float64) {
+		progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: pct})
 	}); err != nil {
 		log.Printf("[FFMPEG/BG] error: %v", err)
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "encoding_failed"})
-		return
+		return cf, false, "encoding_failed", err
 	}
-	progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: 100})
+	progress.Global.Send(j.ID, progress.Event{Phase: progress.PhaseFFmpeg, Percent: 100})
 
 	outFile, err := os.Open(tmpOut)
 	if err != nil {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "failed_to_open_output"})
-		return
+		return cf, false, "failed_to_open_output", err
 	}
 	defer outFile.Close()
 
 	outInfo, _ := outFile.Stat()
-	outFileName := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + ".mp4"
+	outFileName := strings.TrimSuffix(j.FileName, filepath.Ext(j.FileName)) + ".mp4"
 
 	item, err := store.UploadWithProgress(
-		context.Background(),
-		outFileName,
+		ctx,
+		storage.NewObjectKey(outFileName),
 		outFile,
 		outInfo.Size(),
 		func(loaded, total int64) {
 			if total > 0 {
-				progress.Global.Send(uploadID, progress.Event{
+				progress.Global.Send(j.ID, progress.Event{
 					Phase:   progress.PhaseNAS,
 					Percent: math.Min(float64(loaded)/float64(total)*100, 99),
 				})
@@ -190,45 +200,66 @@ func ProcessVideoBackground(store storage.Storage, database *sql.DB, storageType
 	)
 	if err != nil {
 		log.Printf("[NAS/BG] error: %v", err)
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "nas_failed"})
-		return
+		return cf, false, "nas_failed", err
+	}
+	if ctx.Err() != nil {
+		// 転送し終わった直後に取り消された。記録する前なので保存した分を消す
+		_ = store.Delete(context.Background(), item.Name)
+		return cf, false, "cancelled", ctx.Err()
 	}
 
-	cf, err := db.AddFileToCollection(database, collectionID, item.Name, "", storageType, item.Size, userID)
+	cf, err = db.AddFileToCollection(database, j.CollectionID, item.Name, outFileName, "", j.StorageType, item.Size, j.UploadedBy)
 	if err != nil {
-		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "db_failed"})
-		return
+		// 再試行で同じファイルがもう 1 つ保存されないように、記録できなかった分は消す
+		_ = store.Delete(context.Background(), item.Name)
+		return cf, false, "db_failed", err
 	}
 
-	progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID})
 	log.Printf("[UPLOAD/BG] done: id=%s size=%dMB", cf.ID, outInfo.Size()/1024/1024)
+	return cf, item.Deduplicated, "", nil
 }
 
 // UploadNonVideoBackground uploads a non-video file to storage asynchronously.
-func UploadNonVideoBackground(store storage.Storage, database *sql.DB, storageType, uploadID, collectionID, userID, fileName, filePath string) {
+// 保存中は ownerID（と admin）が CancelUpload で取り消せる。保存して記録できたら true を返す。
+func UploadNonVideoBackground(store storage.Storage, database *sql.DB, storageType, uploadID, collectionID, ownerID, userID, fileName, filePath string) bool {
+	defer HoldTemp(filePath)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer TrackUpload(uploadID, ownerID, cancel)()
+	progress.Global.Begin(uploadID, ownerID, fileName)
 	progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseNAS, Percent: 0})
 
 	f, err := os.Open(filePath)
 	if err != nil {
 		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "failed_to_open_file"})
-		return
+		return false
 	}
 	defer f.Close()
 
 	info, _ := f.Stat()
-	item, err := store.Upload(context.Background(), fileName, f, info.Size())
+	item, err := store.Upload(ctx, storage.NewObjectKey(fileName), f, info.Size())
+	if err == nil && ctx.Err() != nil {
+		_ = store.Delete(context.Background(), item.Name)
+	}
+	if ctx.Err() != nil {
+		log.Printf("[UPLOAD/BG] cancelled: %s", uploadID)
+		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseCancelled})
+		return false
+	}
 	if err != nil {
 		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "nas_failed"})
-		return
+		return false
 	}
 
-	cf, err := db.AddFileToCollection(database, collectionID, item.Name, "", storageType, item.Size, userID)
+	cf, err := db.AddFileToCollection(database, collectionID, item.Name, fileName, "", storageType, item.Size, userID)
 	if err != nil {
+		_ = store.Delete(context.Background(), item.Name)
 		progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseError, Message: "db_failed"})
-		return
+		return false
 	}
 
-	progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID})
+	progress.Global.Send(uploadID, progress.Event{Phase: progress.PhaseDone, FileID: cf.ID, Deduplicated: item.Deduplicated})
+	return true
 }
 
 // BroadcastActivity logs an activity event and broadcasts it over WebSocket.
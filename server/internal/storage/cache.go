@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CacheStats はキャッシュの統計（/v1/stats 用）
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Fills     int64 `json:"fills"`     // キャッシュに取り込んだファイル数
+	Evictions int64 `json:"evictions"` // 容量超過で捨てたファイル数
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	MaxBytes  int64 `json:"max_bytes"`
+}
+
+// cacheEntry は LRU リストの要素。item はバックエンドが返した情報で、ヒットしてもそのまま返す
+// （ETag・Last-Modified がヒットとミスで変わらないように）
+type cacheEntry struct {
+	name string
+	item FileItem
+}
+
+// CachedStorage は遅いバックエンド（NAS など）の前に置くローカルディスクの読み込みキャッシュ。
+// 読まれたファイルをバックグラウンドで dir/data に複製し、以後の Open / Range リクエストはディスクから返す。
+// バックエンドの FileItem は dir/meta に、読まれた順は data のファイルの更新時刻に残す。
+// 合計が maxBytes を超えたら最も長く読まれていないものから捨てる（LRU）。
+// Upload・Delete はこの層を通すこと（通さずに書き換えると古い内容を返し続ける）。
+type CachedStorage struct {
+	Storage
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	lru      *list.List               // 先頭が直近に読まれたもの
+	entries  map[string]*list.Element // name → *cacheEntry
+	bytes    int64
+	inflight map[string]bool // 取り込み中のもの
+	gen      map[string]int  // 取り込み中に書き換え・削除されたら増やす（古い内容を捨てるため）
+	stats    CacheStats
+}
+
+// NewCachedStorage は dir に既にあるキャッシュを読み込んで inner の前に置く
+func NewCachedStorage(inner Storage, dir string, maxBytes int64) (*CachedStorage, error) {
+	c := &CachedStorage{
+		Storage:  inner,
+		dir:      filepath.Clean(dir),
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		gen:      map[string]int{},
+		inflight: map[string]bool{},
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CachedStorage) Unwrap() Storage { return c.Storage }
+
+// Stats はヒット率などの統計を返す
+func (c *CachedStorage) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = len(c.entries)
+	s.Bytes = c.bytes
+	s.MaxBytes = c.maxBytes
+	return s
+}
+
+func (c *CachedStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
+	return c.UploadWithProgress(ctx, name, data, size, nil)
+}
+
+func (c *CachedStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	// 書き込み前後の両方で捨てる（書き込み中に始まった取り込みも無効にする）
+	c.invalidate(name)
+	defer c.invalidate(name)
+	return c.Storage.UploadWithProgress(ctx, name, data, size, onProgress)
+}
+
+func (c *CachedStorage) Delete(ctx context.Context, name string) error {
+	c.invalidate(name)
+	return c.Storage.Delete(ctx, name)
+}
+
+func (c *CachedStorage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
+	return c.OpenSeeker(ctx, name)
+}
+
+// OpenSeeker はキャッシュにあればディスクから返す。
+// 無ければバックエンドから返しつつ、別の接続でファイル全体をキャッシュに取り込む。
+func (c *CachedStorage) OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
+	key := CleanSubPath(name)
+	if f, item, ok := c.openCached(key); ok {
+		return f, item, nil
+	}
+
+	rc, item, err := c.Storage.OpenSeeker(ctx, name)
+	if err != nil {
+		return nil, FileItem{}, err
+	}
+	c.mu.Lock()
+	c.stats.Misses++
+	start := item.Size <= c.maxBytes && !c.inflight[key]
+	if start {
+		c.inflight[key] = true
+	}
+	gen := c.gen[key]
+	c.mu.Unlock()
+	if start {
+		go c.fill(key, gen)
+	}
+	return rc, item, nil
+}
+
+func (c *CachedStorage) openCached(key string) (io.ReadSeekCloser, FileItem, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	var item FileItem
+	if ok {
+		c.lru.MoveToFront(el)
+		item = el.Value.(*cacheEntry).item
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, FileItem{}, false
+	}
+
+	p := c.path(key)
+	f, err := os.Open(p)
+	if err != nil {
+		c.remove(key) // 外から消された
+		return nil, FileItem{}, false
+	}
+	// 再起動後も読まれた順を保つ（返す情報はバックエンドのもので、この時刻は使わない）
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+	return f, item, true
+}
+
+// fill はファイル全体をバックエンドから一時ファイルに読み、完了したらキャッシュに加える
+func (c *CachedStorage) fill(key string, gen int) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.inflight, key)
+		delete(c.gen, key)
+		c.mu.Unlock()
+	}()
+
+	tmpDir := filepath.Join(c.dir, ".tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+	tmp, err := os.CreateTemp(tmpDir, "fill-*")
+	if err != nil {
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	rc, item, err := c.Storage.Open(ctx, key)
+	if err != nil {
+		tmp.Close()
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+	n, err := io.Copy(tmp, rc)
+	rc.Close()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+	if n != item.Size {
+		return // 読んでいる間に書き換えられた
+	}
+	meta, err := json.Marshal(item)
+	if err != nil {
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen[key] != gen {
+		return // 取り込み中に書き換え・削除された
+	}
+	dst, metaPath := c.path(key), c.metaPath(key)
+	for _, dir := range []string{filepath.Dir(dst), filepath.Dir(metaPath)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("[CACHE] fill %s: %v", key, err)
+			return
+		}
+	}
+	if err := os.WriteFile(metaPath, meta, 0644); err != nil {
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(metaPath)
+		log.Printf("[CACHE] fill %s: %v", key, err)
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.bytes -= el.Value.(*cacheEntry).item.Size
+		c.lru.Remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{name: key, item: item})
+	c.bytes += n
+	c.stats.Fills++
+	c.evictLocked()
+}
+
+// evictLocked は合計が maxBytes 以下になるまで古いものから捨てる（mu を持って呼ぶ）
+func (c *CachedStorage) evictLocked() {
+	for c.bytes > c.maxBytes {
+		el := c.lru.Back()
+		if el == nil {
+			return
+		}
+		e := el.Value.(*cacheEntry)
+		c.lru.Remove(el)
+		delete(c.entries, e.name)
+		c.bytes -= e.item.Size
+		c.stats.Evictions++
+		if err := c.removeFiles(e.name); err != nil {
+			log.Printf("[CACHE] evict %s: %v", e.name, err)
+		}
+	}
+}
+
+// invalidate はキャッシュを捨て、取り込み中のものも無効にする
+func (c *CachedStorage) invalidate(name string) {
+	key := CleanSubPath(name)
+	c.mu.Lock()
+	if c.inflight[key] {
+		c.gen[key]++
+	}
+	c.mu.Unlock()
+	c.remove(key)
+}
+
+func (c *CachedStorage) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(el)
+	delete(c.entries, key)
+	c.bytes -= el.Value.(*cacheEntry).item.Size
+	if err := c.removeFiles(key); err != nil {
+		log.Printf("[CACHE] remove %s: %v", key, err)
+	}
+}
+
+// removeFiles はキャッシュしたファイルとその情報を消す
+func (c *CachedStorage) removeFiles(key string) error {
+	err := os.Remove(c.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(c.metaPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// path はキャッシュしたファイルの場所
+func (c *CachedStorage) path(key string) string {
+	return filepath.Join(c.dir, "data", filepath.FromSlash(key))
+}
+
+// metaPath はキャッシュしたファイルのバックエンドでの情報（FileItem の JSON）の場所
+func (c *CachedStorage) metaPath(key string) string {
+	return filepath.Join(c.dir, "meta", filepath.FromSlash(key)+".json")
+}
+
+// load は dir に残っているキャッシュを読まれた順（data の更新時刻の新しい順）に LRU に並べる。
+// 情報の無いもの・サイズの合わないものは取り込み途中で止まったものなので捨てる。
+func (c *CachedStorage) load() error {
+	dataDir := filepath.Join(c.dir, "data")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(filepath.Join(c.dir, ".tmp")) // 前回の取り込み途中のもの
+
+	type found struct {
+		key     string
+		item    FileItem
+		modTime time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(dataDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dataDir, p)
+		if err != nil {
+			return nil
+		}
+		key := filepath.ToSlash(rel)
+		var item FileItem
+		meta, err := os.ReadFile(c.metaPath(key))
+		if err == nil {
+			err = json.Unmarshal(meta, &item)
+		}
+		if err != nil || item.Size != info.Size() {
+			_ = c.removeFiles(key)
+			return nil
+		}
+		files = append(files, found{key: key, item: item, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		c.entries[f.key] = c.lru.PushBack(&cacheEntry{name: f.key, item: f.item})
+		c.bytes += f.item.Size
+	}
+	c.evictLocked()
+	return nil
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, maxBytes int64) (*CachedStorage, *LocalStorage, string) {
+	t.Helper()
+	inner := NewLocalStorage(t.TempDir())
+	dir := t.TempDir()
+	c, err := NewCachedStorage(inner, dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, inner, dir
+}
+
+// waitFills はバックグラウンドの取り込みが n 件終わるまで待つ
+func waitFills(t *testing.T, c *CachedStorage, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Fills < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("fills = %d, want %d", c.Stats().Fills, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readCached(t *testing.T, c *CachedStorage, name string) (string, FileItem) {
+	t.Helper()
+	rc, item, err := c.OpenSeeker(context.Background(), name)
+	if err != nil {
+		t.Fatalf("OpenSeeker(%s): %v", name, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), item
+}
+
+func sameItem(a, b FileItem) bool {
+	return a.Name == b.Name && a.Size == b.Size && a.Modified.Equal(b.Modified)
+}
+
+// ヒットしてもミスと同じ情報（バックエンドの更新時刻）を返す。再起動しても変わらない
+func TestCachedStorageHitKeepsMetadata(t *testing.T) {
+	c, _, dir := newTestCache(t, 1<<20)
+	ctx := context.Background()
+	if _, err := c.Upload(ctx, "thumbnails/a.jpg", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	body, miss := readCached(t, c, "thumbnails/a.jpg")
+	if body != "hello" {
+		t.Fatalf("miss body = %q", body)
+	}
+	waitFills(t, c, 1)
+
+	time.Sleep(20 * time.Millisecond) // ヒットで触った時刻が混ざれば分かるように
+	body, hit := readCached(t, c, "thumbnails/a.jpg")
+	if body != "hello" {
+		t.Errorf("hit body = %q", body)
+	}
+	if !sameItem(hit, miss) {
+		t.Errorf("hit = %+v, miss = %+v", hit, miss)
+	}
+	if st := c.Stats(); st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("hits = %d, misses = %d, want 1, 1", st.Hits, st.Misses)
+	}
+
+	reopened, err := NewCachedStorage(c.Unwrap(), dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, again := readCached(t, reopened, "thumbnails/a.jpg")
+	if !sameItem(again, miss) || reopened.Stats().Hits != 1 {
+		t.Errorf("after restart = %+v (hits %d), want %+v", again, reopened.Stats().Hits, miss)
+	}
+}
+
+// maxBytes を超えたら最も長く読まれていないものから捨てる
+func TestCachedStorageEviction(t *testing.T) {
+	c, _, _ := newTestCache(t, 10)
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := c.Upload(ctx, name, strings.NewReader(name+name+name+name), 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readCached(t, c, "a")
+	waitFills(t, c, 1)
+	readCached(t, c, "b")
+	waitFills(t, c, 2)
+	readCached(t, c, "a") // a を b より新しくする
+	readCached(t, c, "c")
+	waitFills(t, c, 3)
+
+	st := c.Stats()
+	if st.Evictions != 1 || st.Entries != 2 || st.Bytes != 8 {
+		t.Fatalf("stats = %+v, want 1 eviction, 2 entries, 8 bytes", st)
+	}
+	misses := st.Misses
+	readCached(t, c, "a")
+	readCached(t, c, "c")
+	if got := c.Stats().Misses; got != misses {
+		t.Errorf("a and c should still be cached (misses %d → %d)", misses, got)
+	}
+	body, _ := readCached(t, c, "b")
+	if got := c.Stats().Misses; got != misses+1 || body != "bbbb" {
+		t.Errorf("b should have been evicted (misses %d → %d, body %q)", misses, got, body)
+	}
+}
+
+// Delete・Upload を通すとキャッシュも捨てる
+func TestCachedStorageInvalidate(t *testing.T) {
+	c, _, _ := newTestCache(t, 1<<20)
+	ctx := context.Background()
+	if _, err := c.Upload(ctx, "a.mp4", strings.NewReader("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+	readCached(t, c, "a.mp4")
+	waitFills(t, c, 1)
+
+	if _, err := c.Upload(ctx, "a.mp4", strings.NewReader("newer"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if body, item := readCached(t, c, "a.mp4"); body != "newer" || item.Size != 5 {
+		t.Errorf("after Upload = %q (size %d), want the new content", body, item.Size)
+	}
+	waitFills(t, c, 2)
+
+	if err := c.Delete(ctx, "a.mp4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Open(ctx, "a.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrNotFound", err)
+	}
+	if st := c.Stats(); st.Entries != 0 || st.Bytes != 0 {
+		t.Errorf("stats after Delete = %+v, want empty", st)
+	}
+}
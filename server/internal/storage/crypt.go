@@ -0,0 +1,537 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// 暗号化ファイルのフォーマット
+//
+//	header (80 bytes):
+//	  magic       [8]  "HMENC001"
+//	  keyID       [8]  マスター鍵の SHA-256 先頭 8 バイト
+//	  chunkSize   [4]  平文チャンクのサイズ（big endian）
+//	  wrapNonce   [12]
+//	  wrappedKey  [48] マスター鍵で AES-GCM 暗号化したファイルごとのデータ鍵
+//	body:
+//	  平文を chunkSize ごとに AES-256-GCM で暗号化したチャンクの列（各チャンク +16 バイトのタグ）。
+//	  nonce はチャンク番号、AAD は最終チャンクかどうかのフラグ（切り詰め・並べ替えを検出する）。
+const (
+	cryptMagic      = "HMENC001"
+	cryptHeaderSize = 8 + 8 + 4 + 12 + 48
+	cryptTagSize    = 16
+
+	DefaultCryptChunkSize = 64 * 1024
+)
+
+var (
+	ErrDecrypt         = errors.New("encrypted file is corrupted or was tampered with")
+	ErrUnknownCryptKey = errors.New("file is encrypted with an unknown master key")
+	ErrNotEncrypted    = errors.New("file is not encrypted")
+)
+
+// MasterKey はデータ鍵を暗号化するための 32 バイトの鍵
+type MasterKey [32]byte
+
+func (k MasterKey) id() [8]byte {
+	sum := sha256.Sum256(k[:])
+	var id [8]byte
+	copy(id[:], sum[:8])
+	return id
+}
+
+// ID は鍵の識別子（ヘッダーに書かれる値の hex）
+func (k MasterKey) ID() string {
+	id := k.id()
+	return hex.EncodeToString(id[:])
+}
+
+// DeriveKey はマスター鍵から purpose 用の鍵を導出する（マスター鍵そのものを別の用途に使わないため）
+func (k MasterKey) DeriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, k[:])
+	mac.Write([]byte("hideme/" + purpose))
+	return mac.Sum(nil)
+}
+
+// ParseMasterKey は base64 / hex の文字列からマスター鍵を読む
+func ParseMasterKey(s string) (MasterKey, error) {
+	var k MasterKey
+	s = strings.TrimSpace(s)
+	for _, dec := range []func(string) ([]byte, error){
+		hex.DecodeString,
+		base64.StdEncoding.DecodeString,
+		base64.RawURLEncoding.DecodeString,
+	} {
+		if b, err := dec(s); err == nil && len(b) == len(k) {
+			copy(k[:], b)
+			return k, nil
+		}
+	}
+	return k, errors.New("master key must be 32 bytes encoded as hex or base64")
+}
+
+// LoadMasterKeyFile は鍵ファイルを読む（32 バイトのバイナリ、または hex / base64 のテキスト）
+func LoadMasterKeyFile(path string) (MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return MasterKey{}, err
+	}
+	var k MasterKey
+	if len(data) == len(k) {
+		copy(k[:], data)
+		return k, nil
+	}
+	k, err = ParseMasterKey(string(data))
+	if err != nil {
+		return k, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// EncryptedStorage は任意の Storage を包んで保存時に暗号化するデコレータ。
+// 読み込みはチャンク単位で復号するため、Range リクエストでも必要なチャンクだけを読む。
+// 暗号化されていないファイル（導入前のもの）は SetRequireEncrypted(true) にしない限りそのまま読める。
+type EncryptedStorage struct {
+	Storage
+	primary   MasterKey
+	keys      map[[8]byte]cipher.AEAD // 復号に使えるマスター鍵（旧鍵を含む）
+	chunkSize int
+	// ヘッダーの無いファイルを平文として返さない（改ざん・差し替えを検出できないため）
+	requireEncrypted bool
+}
+
+// NewEncryptedStorage は primary で暗号化し、primary と previous で復号するストアを作る
+func NewEncryptedStorage(inner Storage, primary MasterKey, previous []MasterKey, chunkSize int) (*EncryptedStorage, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultCryptChunkSize
+	}
+	s := &EncryptedStorage{
+		Storage:   inner,
+		primary:   primary,
+		keys:      make(map[[8]byte]cipher.AEAD),
+		chunkSize: chunkSize,
+	}
+	for _, k := range append([]MasterKey{primary}, previous...) {
+		aead, err := newGCM(k[:])
+		if err != nil {
+			return nil, err
+		}
+		s.keys[k.id()] = aead
+	}
+	return s, nil
+}
+
+// SetRequireEncrypted は暗号化されていないファイルの読み込みを ErrNotEncrypted で拒否するかどうかを変える。
+// 既存のファイルを全て再暗号化してから有効にする。
+func (s *EncryptedStorage) SetRequireEncrypted(on bool) {
+	s.requireEncrypted = on
+}
+
+// Unwrap は包んでいる下位ストアを返す
+func (s *EncryptedStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+func (s *EncryptedStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
+	return s.UploadWithProgress(ctx, name, data, size, nil)
+}
+
+// UploadWithProgress は data を暗号化しながら下位ストアへ書き込む。
+// 返す FileItem.Size は平文のサイズ。
+func (s *EncryptedStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	enc, err := s.newEncryptReader(data)
+	if err != nil {
+		return FileItem{}, err
+	}
+
+	encSize := int64(-1)
+	if size >= 0 {
+		encSize = s.encryptedSize(size)
+	}
+	item, err := s.Storage.UploadWithProgress(ctx, name, enc, encSize, onProgress)
+	if err != nil {
+		return FileItem{}, err
+	}
+	item.Size = enc.plainSize
+	return item, nil
+}
+
+func (s *EncryptedStorage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
+	return s.OpenSeeker(ctx, name)
+}
+
+// OpenSeeker は復号しながら読むストリームを返す。FileItem.Size は平文のサイズ。
+func (s *EncryptedStorage) OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
+	return s.openSeeker(ctx, name, !s.requireEncrypted)
+}
+
+// openSeeker は OpenSeeker の本体。allowPlain が false なら暗号化されていないファイルを拒否する。
+func (s *EncryptedStorage) openSeeker(ctx context.Context, name string, allowPlain bool) (io.ReadSeekCloser, FileItem, error) {
+	rc, item, err := s.Storage.OpenSeeker(ctx, name)
+	if err != nil {
+		return nil, FileItem{}, err
+	}
+
+	hdr := make([]byte, cryptHeaderSize)
+	n, err := io.ReadFull(rc, hdr)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		rc.Close()
+		return nil, FileItem{}, err
+	}
+	if n < cryptHeaderSize || string(hdr[:8]) != cryptMagic {
+		// 暗号化前のファイルは平文のまま返す
+		if !allowPlain {
+			rc.Close()
+			return nil, FileItem{}, fmt.Errorf("%s: %w", name, ErrNotEncrypted)
+		}
+		if _, err := rc.Seek(0, io.SeekStart); err != nil {
+			rc.Close()
+			return nil, FileItem{}, err
+		}
+		return rc, item, nil
+	}
+
+	aead, chunkSize, err := s.openHeader(hdr)
+	if err != nil {
+		rc.Close()
+		return nil, FileItem{}, fmt.Errorf("%s: %w", name, err)
+	}
+	plain, err := plainSize(item.Size, chunkSize)
+	if err != nil {
+		rc.Close()
+		return nil, FileItem{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	item.Size = plain
+	return &decryptReader{
+		src:       rc,
+		aead:      aead,
+		chunkSize: int64(chunkSize),
+		size:      plain,
+		srcPos:    cryptHeaderSize,
+		chunkIdx:  -1,
+	}, item, nil
+}
+
+// IsEncrypted は name が現在のマスター鍵で暗号化済みかどうかを返す
+func (s *EncryptedStorage) IsEncrypted(ctx context.Context, name string) (bool, error) {
+	rc, _, err := s.Storage.Open(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(rc, hdr); err != nil {
+		return false, nil
+	}
+	id := s.primary.id()
+	return string(hdr[:8]) == cryptMagic && bytes.Equal(hdr[8:16], id[:]), nil
+}
+
+// Reencrypt は name を現在のマスター鍵で暗号化し直す（平文のファイルは暗号化する）。既に最新なら false を返す。
+// 復号した内容を一時ファイルに退避し、隣の名前（name + ".reencrypt"）に書き終えてから元の名前へ写す。
+// 元の名前への書き戻しに失敗したときは、暗号化済みの隣の名前を残してエラーに含める（平文はディスクに残さない）。
+func (s *EncryptedStorage) Reencrypt(ctx context.Context, name, tempDir string) (bool, error) {
+	current, err := s.IsEncrypted(ctx, name)
+	if err != nil || current {
+		return false, err
+	}
+
+	// 平文のファイルを暗号化するため、require_encrypted でも読めるようにする
+	rc, _, err := s.openSeeker(ctx, name, true)
+	if err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(tempDir, "hideme_reencrypt_*")
+	if err != nil {
+		rc.Close()
+		return false, err
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	n, err := io.Copy(tmp, rc)
+	rc.Close()
+	if err != nil {
+		return false, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	// 1. 隣の名前に書く（失敗しても元のファイルはそのまま）
+	staged := name + ".reencrypt"
+	if _, err := s.Upload(ctx, staged, tmp, n); err != nil {
+		s.Storage.Delete(context.WithoutCancel(ctx), staged)
+		return false, err
+	}
+
+	// 2. 暗号文のまま元の名前へ写す（ここで失敗すると元のファイルは壊れているかもしれない）
+	//    隣の名前の暗号文は消さずに残し、それを元の名前へ写し直せば復旧できる
+	if err := s.copyRaw(ctx, staged, name); err != nil {
+		return false, fmt.Errorf("%s: rewrite failed, re-encrypted copy kept as %s: %w", name, staged, err)
+	}
+	if err := s.Storage.Delete(ctx, staged); err != nil && !errors.Is(err, ErrNotFound) {
+		return true, fmt.Errorf("%s: rewritten, but failed to remove %s: %w", name, staged, err)
+	}
+	return true, nil
+}
+
+// copyRaw は暗号文を復号せずに src から dst へ写す
+func (s *EncryptedStorage) copyRaw(ctx context.Context, src, dst string) error {
+	rc, item, err := s.Storage.Open(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = s.Storage.Upload(ctx, dst, rc, item.Size)
+	return err
+}
+
+func (s *EncryptedStorage) encryptedSize(plain int64) int64 {
+	chunks := (plain + int64(s.chunkSize) - 1) / int64(s.chunkSize)
+	if chunks == 0 {
+		chunks = 1 // 空ファイルも最終チャンク（タグのみ）を 1 つ書く
+	}
+	return cryptHeaderSize + plain + chunks*cryptTagSize
+}
+
+// plainSize は暗号化ファイル全体のサイズから平文のサイズを求める
+func plainSize(encSize int64, chunkSize int) (int64, error) {
+	body := encSize - cryptHeaderSize
+	full := int64(chunkSize) + cryptTagSize
+	chunks := (body + full - 1) / full
+	// 最終チャンクも少なくともタグ分の長さがあるはず
+	if body < cryptTagSize || body-(chunks-1)*full < cryptTagSize {
+		return 0, ErrDecrypt
+	}
+	return body - chunks*cryptTagSize, nil
+}
+
+func (s *EncryptedStorage) openHeader(hdr []byte) (cipher.AEAD, int, error) {
+	var id [8]byte
+	copy(id[:], hdr[8:16])
+	wrap, ok := s.keys[id]
+	if !ok {
+		return nil, 0, fmt.Errorf("%w (key id %x)", ErrUnknownCryptKey, id)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(hdr[16:20]))
+	if chunkSize <= 0 {
+		return nil, 0, ErrDecrypt
+	}
+	dataKey, err := wrap.Open(nil, hdr[20:32], hdr[32:80], hdr[:20])
+	if err != nil {
+		return nil, 0, ErrDecrypt
+	}
+	aead, err := newGCM(dataKey)
+	return aead, chunkSize, err
+}
+
+// encryptReader はヘッダーに続けて暗号化したチャンクを返す io.Reader
+type encryptReader struct {
+	src       *bufio.Reader
+	aead      cipher.AEAD
+	chunkSize int
+	buf       []byte // 未送出の出力
+	plain     []byte
+	idx       uint64
+	done      bool
+	plainSize int64
+}
+
+func (s *EncryptedStorage) newEncryptReader(data io.Reader) (*encryptReader, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 20, cryptHeaderSize)
+	copy(hdr, cryptMagic)
+	id := s.primary.id()
+	copy(hdr[8:16], id[:])
+	binary.BigEndian.PutUint32(hdr[16:20], uint32(s.chunkSize))
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aad := append([]byte(nil), hdr...)
+	hdr = append(hdr, nonce...)
+	hdr = s.keys[id].Seal(hdr, nonce, dataKey, aad)
+
+	return &encryptReader{
+		src:       bufio.NewReaderSize(data, s.chunkSize),
+		aead:      aead,
+		chunkSize: s.chunkSize,
+		buf:       hdr,
+		plain:     make([]byte, s.chunkSize),
+	}, nil
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *encryptReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	// 次の 1 バイトが無ければ最終チャンク
+	final := n < r.chunkSize
+	if !final {
+		if _, err := r.src.Peek(1); err != nil {
+			if !errors.Is(err, io.EOF) {
+				return err
+			}
+			final = true
+		}
+	}
+	r.plainSize += int64(n)
+	r.buf = r.aead.Seal(r.buf[:0], chunkNonce(r.idx), r.plain[:n], chunkAAD(final))
+	r.idx++
+	r.done = final
+	return nil
+}
+
+// decryptReader は暗号化ファイルを平文としてシーク・読み込みできるようにする
+type decryptReader struct {
+	src       io.ReadSeekCloser
+	aead      cipher.AEAD
+	chunkSize int64
+	size      int64 // 平文のサイズ
+	pos       int64 // 平文上の読み込み位置
+	srcPos    int64 // src の現在位置
+	chunkIdx  int64 // chunk に入っているチャンク番号（-1 = 未読込）
+	chunk     []byte
+	encBuf    []byte
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	idx := r.pos / r.chunkSize
+	if idx != r.chunkIdx {
+		if err := r.loadChunk(idx); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk[r.pos-idx*r.chunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) loadChunk(idx int64) error {
+	off := cryptHeaderSize + idx*(r.chunkSize+cryptTagSize)
+	if off != r.srcPos {
+		if _, err := r.src.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+		r.srcPos = off
+	}
+
+	last := (r.size - 1) / r.chunkSize
+	if r.size == 0 {
+		last = 0
+	}
+	plainLen := r.chunkSize
+	if idx == last {
+		plainLen = r.size - idx*r.chunkSize
+	}
+	if cap(r.encBuf) < int(plainLen+cryptTagSize) {
+		r.encBuf = make([]byte, r.chunkSize+cryptTagSize)
+	}
+	enc := r.encBuf[:plainLen+cryptTagSize]
+	n, err := io.ReadFull(r.src, enc)
+	r.srcPos += int64(n)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrDecrypt
+		}
+		return err
+	}
+
+	plain, err := r.aead.Open(r.chunk[:0], chunkNonce(uint64(idx)), enc, chunkAAD(idx == last))
+	if err != nil {
+		r.chunkIdx = -1
+		return ErrDecrypt
+	}
+	r.chunk = plain
+	r.chunkIdx = idx
+	return nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.pos + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("decryptReader.Seek: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("decryptReader.Seek: negative position")
+	}
+	r.pos = abs
+	return abs, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.src.Close()
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(idx uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], idx)
+	return nonce
+}
+
+func chunkAAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testCryptChunk = 16
+
+func newTestEncrypted(t *testing.T, inner Storage, primary MasterKey, previous ...MasterKey) *EncryptedStorage {
+	t.Helper()
+	s, err := NewEncryptedStorage(inner, primary, previous, testCryptChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testPlaintext(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7 + 3)
+	}
+	return b
+}
+
+func readAllFrom(t *testing.T, s Storage, name string) ([]byte, FileItem, error) {
+	t.Helper()
+	rc, item, err := s.Open(context.Background(), name)
+	if err != nil {
+		return nil, item, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	return b, item, err
+}
+
+// rawBytes は下位ストアに保存された暗号文を返す
+func rawBytes(t *testing.T, inner Storage, name string) []byte {
+	t.Helper()
+	b, _, err := readAllFrom(t, inner, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func putRaw(t *testing.T, inner Storage, name string, b []byte) {
+	t.Helper()
+	if _, err := inner.Upload(context.Background(), name, bytes.NewReader(b), int64(len(b))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	inner := NewLocalStorage(t.TempDir())
+	s := newTestEncrypted(t, inner, MasterKey{1})
+	ctx := context.Background()
+
+	for _, n := range []int{0, 1, testCryptChunk - 1, testCryptChunk, testCryptChunk + 1, 5*testCryptChunk + 3, 6 * testCryptChunk} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			name := fmt.Sprintf("f%d.mp4", n)
+			plain := testPlaintext(n)
+			item, err := s.Upload(ctx, name, bytes.NewReader(plain), int64(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.Size != int64(n) {
+				t.Errorf("Upload size = %d, want %d", item.Size, n)
+			}
+			if raw := rawBytes(t, inner, name); int64(len(raw)) != s.encryptedSize(int64(n)) {
+				t.Errorf("stored %d bytes, encryptedSize = %d", len(raw), s.encryptedSize(int64(n)))
+			} else if got, err := plainSize(int64(len(raw)), testCryptChunk); err != nil || got != int64(n) {
+				t.Errorf("plainSize = %d, %v, want %d", got, err, n)
+			}
+
+			b, item, err := readAllFrom(t, s, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, plain) || item.Size != int64(n) {
+				t.Errorf("read %d bytes (size %d), want %d", len(b), item.Size, n)
+			}
+		})
+	}
+
+	// サイズ不明のアップロードでも同じように読める
+	plain := testPlaintext(3*testCryptChunk + 5)
+	if _, err := s.Upload(ctx, "unknown.mp4", io.MultiReader(bytes.NewReader(plain)), -1); err != nil {
+		t.Fatal(err)
+	}
+	if b, _, err := readAllFrom(t, s, "unknown.mp4"); err != nil || !bytes.Equal(b, plain) {
+		t.Errorf("unknown size: %d bytes, %v", len(b), err)
+	}
+}
+
+// チャンクの境界をまたぐ Range の読み込み
+func TestEncryptedSeek(t *testing.T) {
+	inner := NewLocalStorage(t.TempDir())
+	s := newTestEncrypted(t, inner, MasterKey{1})
+	ctx := context.Background()
+	plain := testPlaintext(4*testCryptChunk + 7)
+	if _, err := s.Upload(ctx, "a.mp4", bytes.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := s.OpenSeeker(ctx, "a.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	ranges := []struct {
+		off    int64
+		whence int
+		n      int
+		want   int64 // 平文上の開始位置
+	}{
+		{testCryptChunk - 3, io.SeekStart, 6, testCryptChunk - 3},                      // 0 と 1 の境界
+		{2*testCryptChunk + 1, io.SeekStart, 2 * testCryptChunk, 2*testCryptChunk + 1}, // 3 チャンクにまたがる
+		{-4, io.SeekEnd, 4, int64(len(plain)) - 4},                                     // 最終チャンク
+		{0, io.SeekStart, 3, 0},                                                        // 先頭に戻る
+		{testCryptChunk, io.SeekCurrent, 5, testCryptChunk + 3},                        // 現在位置から
+	}
+	for _, r := range ranges {
+		pos, err := rc.Seek(r.off, r.whence)
+		if err != nil || pos != r.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v, want %d", r.off, r.whence, pos, err, r.want)
+		}
+		got := make([]byte, r.n)
+		if _, err := io.ReadFull(rc, got); err != nil {
+			t.Fatalf("read at %d: %v", pos, err)
+		}
+		if want := plain[pos : pos+int64(r.n)]; !bytes.Equal(got, want) {
+			t.Errorf("read at %d = %v, want %v", pos, got, want)
+		}
+	}
+
+	if _, err := rc.Seek(int64(len(plain))+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := rc.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read past end = %d, %v, want EOF", n, err)
+	}
+}
+
+// 切り詰め・改ざんは ErrDecrypt になり、平文として返さない
+func TestEncryptedTamper(t *testing.T) {
+	inner := NewLocalStorage(t.TempDir())
+	s := newTestEncrypted(t, inner, MasterKey{1})
+	ctx := context.Background()
+	plain := testPlaintext(3 * testCryptChunk)
+	if _, err := s.Upload(ctx, "a.mp4", bytes.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	raw := rawBytes(t, inner, "a.mp4")
+	full := testCryptChunk + cryptTagSize
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated at chunk boundary", raw[:cryptHeaderSize+2*full]},
+		{"truncated mid chunk", raw[:cryptHeaderSize+2*full+5]},
+		{"header only", raw[:cryptHeaderSize]},
+		{"flipped tag", flipByte(raw, len(raw)-1)},
+		{"flipped body", flipByte(raw, cryptHeaderSize+full+2)},
+		{"flipped chunk size", flipByte(raw, 19)},
+		{"flipped wrapped key", flipByte(raw, 40)},
+		{"swapped chunks", swapChunks(raw, full)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			putRaw(t, inner, "bad.mp4", tt.data)
+			if _, _, err := readAllFrom(t, s, "bad.mp4"); !errors.Is(err, ErrDecrypt) {
+				t.Errorf("read = %v, want ErrDecrypt", err)
+			}
+		})
+	}
+
+	putRaw(t, inner, "bad.mp4", flipByte(raw, 8)) // 鍵 ID
+	if _, _, err := readAllFrom(t, s, "bad.mp4"); !errors.Is(err, ErrUnknownCryptKey) {
+		t.Errorf("read with unknown key id = %v, want ErrUnknownCryptKey", err)
+	}
+}
+
+func flipByte(b []byte, i int) []byte {
+	out := bytes.Clone(b)
+	out[i] ^= 0x01
+	return out
+}
+
+func swapChunks(b []byte, full int) []byte {
+	out := bytes.Clone(b)
+	a := out[cryptHeaderSize : cryptHeaderSize+full]
+	c := out[cryptHeaderSize+full : cryptHeaderSize+2*full]
+	tmp := bytes.Clone(a)
+	copy(a, c)
+	copy(c, tmp)
+	return out
+}
+
+// 鍵を替えても旧鍵で暗号化したファイルは読め、Reencrypt で新しい鍵に移せる
+func TestEncryptedKeyRotation(t *testing.T) {
+	inner := NewLocalStorage(t.TempDir())
+	oldKey, newKey := MasterKey{1}, MasterKey{2}
+	old := newTestEncrypted(t, inner, oldKey)
+	rotated := newTestEncrypted(t, inner, newKey, oldKey)
+	ctx := context.Background()
+	tempDir := t.TempDir()
+
+	plain := testPlaintext(2*testCryptChunk + 9)
+	if _, err := old.Upload(ctx, "old.mp4", bytes.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.Upload(ctx, "current.mp4", bytes.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	putRaw(t, inner, "plain.mp4", plain)
+
+	if b, _, err := readAllFrom(t, rotated, "old.mp4"); err != nil || !bytes.Equal(b, plain) {
+		t.Fatalf("read with previous key: %d bytes, %v", len(b), err)
+	}
+	newOnly := newTestEncrypted(t, inner, newKey)
+	if _, _, err := readAllFrom(t, newOnly, "old.mp4"); !errors.Is(err, ErrUnknownCryptKey) {
+		t.Fatalf("read without previous key = %v, want ErrUnknownCryptKey", err)
+	}
+
+	currentRaw := rawBytes(t, inner, "current.mp4")
+	for _, tt := range []struct {
+		name    string
+		changed bool
+	}{
+		{"old.mp4", true},
+		{"plain.mp4", true},
+		{"current.mp4", false},
+	} {
+		changed, err := rotated.Reencrypt(ctx, tt.name, tempDir)
+		if err != nil || changed != tt.changed {
+			t.Errorf("Reencrypt(%s) = %v, %v, want %v", tt.name, changed, err, tt.changed)
+		}
+		if enc, err := rotated.IsEncrypted(ctx, tt.name); err != nil || !enc {
+			t.Errorf("IsEncrypted(%s) = %v, %v after Reencrypt", tt.name, enc, err)
+		}
+		if b, _, err := readAllFrom(t, newOnly, tt.name); err != nil || !bytes.Equal(b, plain) {
+			t.Errorf("read %s with the new key only: %d bytes, %v", tt.name, len(b), err)
+		}
+	}
+	if !bytes.Equal(rawBytes(t, inner, "current.mp4"), currentRaw) {
+		t.Error("Reencrypt rewrote a file that was already current")
+	}
+
+	if left, _ := os.ReadDir(tempDir); len(left) != 0 {
+		t.Errorf("temp files left: %v", left)
+	}
+	err := ListAll(ctx, inner, "", func(it FileItem) error {
+		if strings.HasSuffix(it.Name, ".reencrypt") {
+			t.Errorf("staged copy left: %s", it.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedRequireEncrypted(t *testing.T) {
+	inner := NewLocalStorage(t.TempDir())
+	s, err := NewEncryptedStorage(inner, MasterKey{1}, nil, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRequireEncrypted(true)
+	ctx := context.Background()
+
+	// 暗号化導入前のファイルは読めない
+	const plain = "written before encryption was enabled"
+	if _, err := inner.Upload(ctx, "old.mp4", strings.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Open(ctx, "old.mp4"); !errors.Is(err, ErrNotEncrypted) {
+		t.Fatalf("Open(plaintext) = %v, want ErrNotEncrypted", err)
+	}
+
+	// 再暗号化すれば読めるようになり、一時フォルダに平文は残らない
+	tempDir := t.TempDir()
+	changed, err := s.Reencrypt(ctx, "old.mp4", tempDir)
+	if err != nil || !changed {
+		t.Fatalf("Reencrypt = %v, %v", changed, err)
+	}
+	rc, item, err := s.Open(ctx, "old.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != plain || item.Size != int64(len(plain)) {
+		t.Errorf("Open = %q (size %d)", b, item.Size)
+	}
+	if left, _ := os.ReadDir(tempDir); len(left) != 0 {
+		t.Errorf("temp files left: %v", left)
+	}
+	if _, _, err := inner.Open(ctx, "old.mp4.reencrypt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("staged copy = %v, want ErrNotFound", err)
+	}
+}
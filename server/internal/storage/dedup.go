@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// BlobIndex はコンテンツアドレス方式のブロブと参照数の台帳（DB の blobs テーブル）。
+// キーは backend ごとに管理する。
+type BlobIndex interface {
+	// AcquireBlob は登録済みのブロブなら参照数を 1 増やして true を返す
+	AcquireBlob(backend, key string) (bool, error)
+	// RegisterBlob は新しいブロブを参照数 1 で登録する（登録済みなら参照数を 1 増やす）。
+	// sha256 はキーにした内容のハッシュ（SetHashKey を設定していれば HMAC-SHA256）
+	RegisterBlob(backend, key, sha256 string, size int64) error
+	// ReleaseBlob は参照数を 1 減らして残りを返す。台帳に無いキーなら ok=false。
+	// 残りが 0 になった行は台帳から削除される。
+	ReleaseBlob(backend, key string) (remaining int, ok bool, err error)
+}
+
+// DedupStorage は Storage をコンテンツアドレス方式で包むデコレータ。
+// トップレベルのアップロードは内容の SHA-256（SetHashKey を設定していれば HMAC-SHA256）で「<hash><拡張子>」のキーに保存し、
+// 同じ内容が既にあれば実体を書かずに既存のブロブを返す。Delete は参照数が 0 になったときだけ実体を消す。
+// thumbnails/ などサブフォルダのキーはそのまま下位ストアへ渡す。
+type DedupStorage struct {
+	Storage
+	backend string
+	index   BlobIndex
+	tempDir string
+	hashKey []byte // nil なら素の SHA-256
+
+	// 同じキーの参照の追加（確認 → 書き込み → 登録）と削除を 1 つずつ行う。
+	// 同じ内容の初回アップロードが同時に実体を書いたり、参照数 0 の削除が書き込み中のブロブを消したりしないようにする。
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func NewDedupStorage(inner Storage, backend string, index BlobIndex) *DedupStorage {
+	return &DedupStorage{Storage: inner, backend: backend, index: index, tempDir: os.TempDir(), locks: map[string]*keyLock{}}
+}
+
+// lock はキーのロックを取り、解放する関数を返す
+func (s *DedupStorage) lock(key string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &keyLock{}
+		s.locks[key] = l
+	}
+	l.waiters++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.waiters--; l.waiters == 0 {
+			delete(s.locks, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// SetTempDir はハッシュを計算する間の一時ファイルの置き場を変える（デフォルト OS の一時フォルダ）
+func (s *DedupStorage) SetTempDir(dir string) {
+	s.tempDir = dir
+}
+
+// SetHashKey はブロブのキーを key で HMAC-SHA256 したものにする。
+// 暗号化と組み合わせるときに設定する（素の SHA-256 だと、NAS のファイル名から既知のファイルを持っているか確かめられてしまう）。
+// 鍵を変えると以後のアップロードは設定前のブロブとは重複排除されない。
+func (s *DedupStorage) SetHashKey(key []byte) {
+	s.hashKey = key
+}
+
+// Unwrap は包んでいる下位ストアを返す
+func (s *DedupStorage) Unwrap() Storage {
+	return s.Storage
+}
+
+func (s *DedupStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
+	return s.UploadWithProgress(ctx, name, data, size, nil)
+}
+
+func (s *DedupStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	if strings.Contains(CleanSubPath(name), "/") {
+		return s.Storage.UploadWithProgress(ctx, name, data, size, onProgress)
+	}
+
+	// ハッシュを先に求める。シークできない入力は一時ファイルに退避する
+	body, hash, n, cleanup, err := s.hashInput(data)
+	if err != nil {
+		return FileItem{}, err
+	}
+	defer cleanup()
+	if size <= 0 {
+		size = n
+	}
+
+	key := hash + strings.ToLower(path.Ext(name))
+
+	unlock := s.lock(key)
+	defer unlock()
+
+	found, err := s.index.AcquireBlob(s.backend, key)
+	if err != nil {
+		return FileItem{}, err
+	}
+	if found {
+		if onProgress != nil {
+			onProgress(size, size)
+		}
+		return FileItem{Name: key, Size: size, Deduplicated: true}, nil
+	}
+
+	item, err := s.Storage.UploadWithProgress(ctx, key, body, size, onProgress)
+	if err != nil {
+		return FileItem{}, err
+	}
+	if err := s.index.RegisterBlob(s.backend, key, hash, item.Size); err != nil {
+		_ = s.Storage.Delete(context.WithoutCancel(ctx), key) // 台帳に無い実体は誰も参照していない
+		return FileItem{}, err
+	}
+	item.Name = key
+	return item, nil
+}
+
+// Delete はブロブの参照を 1 つ外し、最後の参照だったときだけ実体を削除する。
+// 台帳に無いキー（dedup 導入前のファイルやサムネイル）はそのまま削除する。
+func (s *DedupStorage) Delete(ctx context.Context, name string) error {
+	key := CleanSubPath(name)
+	unlock := s.lock(key)
+	defer unlock()
+
+	remaining, ok, err := s.index.ReleaseBlob(s.backend, key)
+	if err != nil {
+		return err
+	}
+	if ok && remaining > 0 {
+		return nil
+	}
+	return s.Storage.Delete(ctx, name)
+}
+
+// hashInput は data の SHA-256（hashKey があれば HMAC-SHA256）を計算し、先頭から読み直せるリーダーを返す
+func (s *DedupStorage) hashInput(data io.Reader) (io.Reader, string, int64, func(), error) {
+	var h hash.Hash
+	if s.hashKey != nil {
+		h = hmac.New(sha256.New, s.hashKey)
+	} else {
+		h = sha256.New()
+	}
+
+	if rs, ok := data.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			n, err := io.Copy(h, rs)
+			if err != nil {
+				return nil, "", 0, nil, err
+			}
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return nil, "", 0, nil, err
+			}
+			return rs, hex.EncodeToString(h.Sum(nil)), n, func() {}, nil
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.tempDir, "hideme_dedup_*")
+	if err != nil {
+		return nil, "", 0, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	n, err := io.Copy(io.MultiWriter(tmp, h), data)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, "", 0, nil, err
+	}
+	return tmp, hex.EncodeToString(h.Sum(nil)), n, cleanup, nil
+}
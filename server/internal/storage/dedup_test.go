@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memBlobIndex は BlobIndex のメモリ上の実装
+type memBlobIndex struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+func (m *memBlobIndex) AcquireBlob(backend, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.refs[key] == 0 {
+		return false, nil
+	}
+	m.refs[key]++
+	return true, nil
+}
+
+func (m *memBlobIndex) RegisterBlob(backend, key, sha256 string, size int64) error {
+	m.mu.Lock()
+	m.refs[key]++
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memBlobIndex) ReleaseBlob(backend, key string) (int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.refs[key]
+	if !ok {
+		return 0, false, nil
+	}
+	if n--; n <= 0 {
+		delete(m.refs, key)
+		return 0, true, nil
+	}
+	m.refs[key] = n
+	return n, true, nil
+}
+
+// slowStorage は書き込みを遅らせて、同じキーへの並行アップロード・削除が重なるようにする
+type slowStorage struct {
+	*LocalStorage
+	writes atomic.Int32
+}
+
+func (s *slowStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	s.writes.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	return s.LocalStorage.UploadWithProgress(ctx, name, data, size, onProgress)
+}
+
+func TestDedupConcurrentFirstUpload(t *testing.T) {
+	inner := &slowStorage{LocalStorage: NewLocalStorage(t.TempDir())}
+	index := &memBlobIndex{refs: map[string]int{}}
+	s := NewDedupStorage(inner, "local", index)
+	s.SetTempDir(t.TempDir())
+	ctx := context.Background()
+	data := []byte("same content")
+
+	const n = 8
+	names := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			item, err := s.Upload(ctx, "a.mp4", bytes.NewReader(data), int64(len(data)))
+			if err != nil {
+				t.Error(err)
+			}
+			names[i] = item.Name
+		}()
+	}
+	wg.Wait()
+
+	if w := inner.writes.Load(); w != 1 {
+		t.Errorf("blob written %d times, want 1", w)
+	}
+	if refs := index.refs[names[0]]; refs != n {
+		t.Errorf("refs = %d, want %d", refs, n)
+	}
+}
+
+func TestDedupDeleteDuringUpload(t *testing.T) {
+	inner := &slowStorage{LocalStorage: NewLocalStorage(t.TempDir())}
+	index := &memBlobIndex{refs: map[string]int{}}
+	s := NewDedupStorage(inner, "local", index)
+	s.SetTempDir(t.TempDir())
+	ctx := context.Background()
+	data := []byte("content")
+
+	first, err := s.Upload(ctx, "a.mp4", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 最後の参照の削除と、同じ内容のアップロードが重なっても、残った参照の実体は消えない
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := s.Delete(ctx, first.Name); err != nil {
+			t.Error(err)
+		}
+	}()
+	var second FileItem
+	go func() {
+		defer wg.Done()
+		second, err = s.Upload(ctx, "b.mp4", bytes.NewReader(data), int64(len(data)))
+	}()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index.refs[second.Name] != 1 {
+		t.Errorf("refs = %d, want 1", index.refs[second.Name])
+	}
+	rc, _, err := s.Open(ctx, second.Name)
+	if err != nil {
+		t.Fatalf("blob referenced by the second upload is gone: %v", err)
+	}
+	rc.Close()
+}
+
+// 鍵を設定するとブロブ名は内容の SHA-256 ではなく HMAC になる（NAS のファイル名から内容を確かめられない）
+func TestDedupHashKey(t *testing.T) {
+	data := []byte("known file")
+	sum := sha256.Sum256(data)
+	plainKey := hex.EncodeToString(sum[:]) + ".mp4"
+
+	var names []string
+	for _, key := range [][]byte{nil, MasterKey{1}.DeriveKey("dedup")} {
+		s := NewDedupStorage(NewLocalStorage(t.TempDir()), "local", &memBlobIndex{refs: map[string]int{}})
+		s.SetTempDir(t.TempDir())
+		s.SetHashKey(key)
+		item, err := s.Upload(context.Background(), "a.mp4", bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, item.Name)
+	}
+	if names[0] != plainKey {
+		t.Errorf("unkeyed blob = %s, want %s", names[0], plainKey)
+	}
+	if names[1] == plainKey || !strings.HasSuffix(names[1], ".mp4") || len(names[1]) != len(plainKey) {
+		t.Errorf("keyed blob = %s, want an HMAC-derived name", names[1])
+	}
+}
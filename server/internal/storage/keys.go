@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// NewObjectKey は元のファイル名から衝突しない保存キーを生成する。
+// 拡張子（小文字）だけを引き継ぎ、本体は UUID にする。元の名前は DB の original_name に残す。
+// 例: "クリップ.MP4" → "0b6f3c1e-....mp4"
+func NewObjectKey(originalName string) string {
+	return uuid.NewString() + strings.ToLower(path.Ext(CleanSubPath(originalName)))
+}
+
+// NewThumbnailKey はサムネイル用の保存キー（thumbnails/ 配下）を生成する
+func NewThumbnailKey(originalName string) string {
+	return "thumbnails/" + NewObjectKey(originalName)
+}
+
+// Copy は src の srcName を dst の dstName として複製する（同じストア内の複製にも使える）
+func Copy(ctx context.Context, src Storage, srcName string, dst Storage, dstName string) (FileItem, error) {
+	rc, item, err := src.Open(ctx, srcName)
+	if err != nil {
+		return FileItem{}, err
+	}
+	defer rc.Close()
+
+	return dst.Upload(ctx, dstName, rc, item.Size)
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultListLimit = 1000
+	MaxListLimit     = 10000
+)
+
+// ListOptions は ListPage の条件。キーはサブフォルダも含めたストア内のキー（例: "thumbnails/x.jpg"）。
+type ListOptions struct {
+	Prefix string // このキー接頭辞で始まるものだけ（例: "thumbnails/"。"" なら全部）
+	Cursor string // 前のページの NextCursor（"" なら先頭から）
+	Limit  int    // 1 ページの件数（0 以下なら DefaultListLimit、上限 MaxListLimit）
+}
+
+func (o ListOptions) limit() int {
+	switch {
+	case o.Limit <= 0:
+		return DefaultListLimit
+	case o.Limit > MaxListLimit:
+		return MaxListLimit
+	}
+	return o.Limit
+}
+
+// Page は ListPage の 1 ページ分。Items はキーのバイト順。
+type Page struct {
+	Items      []FileItem
+	NextCursor string // 続きがなければ ""
+}
+
+// ListAll は prefix で始まるファイルを 1 ページずつ取り出して fn に渡す（全件をメモリに載せない）
+func ListAll(ctx context.Context, s Storage, prefix string, fn func(FileItem) error) error {
+	opts := ListOptions{Prefix: prefix, Limit: MaxListLimit}
+	for {
+		page, err := s.ListPage(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, it := range page.Items {
+			if err := fn(it); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// listTree はディレクトリを持つストア（ローカル・SFTP・SMB）の ListPage の共通実装。
+// readDir はストアのルートからの相対パス（"" がルート）の中身を返す。存在しないフォルダは空として扱う。
+// 兄弟をキー順（フォルダは名前に "/" を付けて比較）に並べて深さ優先でたどると、
+// 全体がキーのバイト順になるので、カーソルより前・接頭辞に合わないフォルダは読まずに飛ばせる。
+func listTree(ctx context.Context, readDir func(rel string) ([]fs.FileInfo, error), opts ListOptions) (Page, error) {
+	limit := opts.limit()
+	prefix := CleanSubPath(opts.Prefix)
+	if strings.HasSuffix(opts.Prefix, "/") && prefix != "" {
+		prefix += "/"
+	}
+	items := make([]FileItem, 0, min(limit+1, 256))
+
+	var walk func(rel string) (bool, error)
+	walk = func(rel string) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		entries, err := readDir(rel)
+		if err != nil {
+			if isNotExist(err) || isSMBNotExist(err) {
+				return true, nil
+			}
+			return false, err
+		}
+		keys := make([]string, len(entries))
+		for i, e := range entries {
+			keys[i] = path.Join(rel, e.Name())
+			if e.IsDir() {
+				keys[i] += "/"
+			}
+		}
+		sort.Sort(byKey{keys, entries})
+
+		for i, e := range entries {
+			key := keys[i]
+			if e.IsDir() {
+				if !strings.HasPrefix(prefix, key) && !strings.HasPrefix(key, prefix) {
+					continue // 接頭辞に合わない
+				}
+				if opts.Cursor >= key && !strings.HasPrefix(opts.Cursor, key) {
+					continue // 中身はすべてカーソルより前
+				}
+				more, err := walk(strings.TrimSuffix(key, "/"))
+				if !more || err != nil {
+					return false, err
+				}
+				continue
+			}
+			if !strings.HasPrefix(key, prefix) || key <= opts.Cursor {
+				continue
+			}
+			items = append(items, FileItem{Name: key, Size: e.Size(), Modified: e.ModTime().UTC()})
+			if len(items) > limit {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	// 接頭辞のフォルダ部分から読み始める（"thumbnails/ab" → thumbnails/）
+	start := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = prefix[:i]
+	}
+	if _, err := walk(start); err != nil {
+		return Page{}, err
+	}
+	return pageOf(items, limit), nil
+}
+
+// pageOf は limit+1 件まで集めた items をページにする（limit を超えていれば続きがある）
+func pageOf(items []FileItem, limit int) Page {
+	if len(items) <= limit {
+		return Page{Items: items}
+	}
+	items = items[:limit]
+	return Page{Items: items, NextCursor: items[limit-1].Name}
+}
+
+type byKey struct {
+	keys    []string
+	entries []fs.FileInfo
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+}
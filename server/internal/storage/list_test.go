@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newListStorage(t *testing.T, names ...string) *LocalStorage {
+	t.Helper()
+	s := NewLocalStorage(t.TempDir())
+	for _, name := range names {
+		if _, err := s.Upload(context.Background(), name, strings.NewReader(name), int64(len(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+// listPages は limit 件ずつ最後までたどり、ページごとのキーを返す
+func listPages(t *testing.T, s Storage, prefix string, limit int) [][]string {
+	t.Helper()
+	var pages [][]string
+	opts := ListOptions{Prefix: prefix, Limit: limit}
+	for {
+		page, err := s.ListPage(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, it := range page.Items {
+			keys = append(keys, it.Name)
+		}
+		pages = append(pages, keys)
+		if page.NextCursor == "" {
+			return pages
+		}
+		if page.NextCursor != keys[len(keys)-1] {
+			t.Fatalf("cursor %q is not the last key of %v", page.NextCursor, keys)
+		}
+		if len(pages) > 20 {
+			t.Fatal("listing does not end")
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
+
+// フォルダとファイルが混ざっていてもキーのバイト順になる（"thumbnails-x" は "thumbnails/" より前）
+var listKeys = []string{"a.mp4", "b.mp4", "icons/i.png", "thumbnails-x.jpg", "thumbnails/a.jpg", "thumbnails/b.jpg", "z.mp4"}
+
+func TestListPageBoundaries(t *testing.T) {
+	s := newListStorage(t, "z.mp4", "thumbnails/b.jpg", "a.mp4", "thumbnails-x.jpg", "icons/i.png", "thumbnails/a.jpg", "b.mp4")
+
+	tests := []struct {
+		limit int
+		want  [][]string
+	}{
+		{2, [][]string{listKeys[0:2], listKeys[2:4], listKeys[4:6], listKeys[6:]}},
+		{3, [][]string{listKeys[0:3], listKeys[3:6], listKeys[6:]}},
+		{6, [][]string{listKeys[0:6], listKeys[6:]}},
+		{7, [][]string{listKeys}}, // ちょうど全件なら続きは無い
+		{0, [][]string{listKeys}}, // DefaultListLimit
+	}
+	for _, tt := range tests {
+		if got := listPages(t, s, "", tt.limit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("limit %d: pages = %v, want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestListPageCursor(t *testing.T) {
+	s := newListStorage(t, listKeys...)
+	ctx := context.Background()
+
+	// 最後のキーがカーソルなら空のページで終わる
+	page, err := s.ListPage(ctx, ListOptions{Cursor: "z.mp4"})
+	if err != nil || len(page.Items) != 0 || page.NextCursor != "" {
+		t.Errorf("cursor at the last key = %+v, %v", page, err)
+	}
+	// フォルダの中を指すカーソルは、そのフォルダの続きから
+	page, err = s.ListPage(ctx, ListOptions{Cursor: "thumbnails/a.jpg", Limit: 1})
+	if err != nil || len(page.Items) != 1 || page.Items[0].Name != "thumbnails/b.jpg" || page.NextCursor != "thumbnails/b.jpg" {
+		t.Errorf("cursor inside a folder = %+v, %v", page, err)
+	}
+	// 存在しないキーのカーソルでも、それより後ろから
+	page, err = s.ListPage(ctx, ListOptions{Cursor: "c"})
+	if err != nil || len(page.Items) == 0 || page.Items[0].Name != "icons/i.png" {
+		t.Errorf("cursor between keys = %+v, %v", page, err)
+	}
+}
+
+func TestListPagePrefix(t *testing.T) {
+	s := newListStorage(t, listKeys...)
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"thumbnails/", []string{"thumbnails/a.jpg", "thumbnails/b.jpg"}},
+		{"thumbnails", []string{"thumbnails-x.jpg", "thumbnails/a.jpg", "thumbnails/b.jpg"}},
+		{"thumbnails/b", []string{"thumbnails/b.jpg"}},
+		{"b", []string{"b.mp4"}},
+		{"missing/", []string{}},
+	}
+	for _, tt := range tests {
+		if got := listPages(t, s, tt.prefix, 1); !reflect.DeepEqual(flatten(got), tt.want) {
+			t.Errorf("prefix %q = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestListPageEmpty(t *testing.T) {
+	s := newListStorage(t)
+	page, err := s.ListPage(context.Background(), ListOptions{})
+	if err != nil || len(page.Items) != 0 || page.NextCursor != "" {
+		t.Errorf("empty store = %+v, %v", page, err)
+	}
+}
+
+// ミラーは全レプリカの同じ範囲をまとめ、同名は 1 つにする
+func TestMirrorListPageMerge(t *testing.T) {
+	a := newListStorage(t, "a.mp4", "c.mp4", "e.mp4", "thumbnails/t.jpg")
+	b := newListStorage(t, "b.mp4", "c.mp4", "d.mp4")
+	s, err := NewMirrorStorage([]Replica{{Name: "local", Store: a}, {Name: "nas", Store: b}}, &memReplicaIndex{states: map[string][]ReplicaState{}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.mp4", "b.mp4", "c.mp4", "d.mp4", "e.mp4", "thumbnails/t.jpg"}
+	for _, limit := range []int{1, 2, 4, 6, 10} {
+		pages := listPages(t, s, "", limit)
+		if got := flatten(pages); !reflect.DeepEqual(got, want) {
+			t.Errorf("limit %d: keys = %v, want %v", limit, pages, want)
+		}
+		for _, p := range pages {
+			if len(p) > limit {
+				t.Errorf("limit %d: page %v is too long", limit, p)
+			}
+		}
+	}
+}
+
+func flatten(pages [][]string) []string {
+	out := []string{}
+	for _, p := range pages {
+		out = append(out, p...)
+	}
+	return out
+}
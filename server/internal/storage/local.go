@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"time"
@@ -35,39 +36,29 @@ func (s *LocalStorage) FilePath(name string) string {
 	return s.filePath(name)
 }
 
-func (s *LocalStorage) List(_ context.Context) ([]FileItem, error) {
-	if err := s.ensureDir(); err != nil {
-		return nil, err
-	}
-
-	entries, err := os.ReadDir(s.uploadDir())
-	if err != nil {
-		return nil, err
-	}
-
-	items := make([]FileItem, 0, len(entries))
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		info, err := e.Info()
+// ListPage はサブフォルダも含めてキー順に 1 ページ分のファイルを返す
+func (s *LocalStorage) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	root := s.uploadDir()
+	return listTree(ctx, func(rel string) ([]fs.FileInfo, error) {
+		entries, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(rel)))
 		if err != nil {
-			continue
+			return nil, err
 		}
-		items = append(items, FileItem{
-			Name:     info.Name(),
-			Size:     info.Size(),
-			Modified: info.ModTime().UTC(),
-		})
-	}
-	return items, nil
+		infos := make([]fs.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil { // 読んでいる間に消されたものは飛ばす
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	}, opts)
 }
 
 func (s *LocalStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
 	return s.UploadWithProgress(ctx, name, data, size, nil)
 }
 
-func (s *LocalStorage) UploadWithProgress(_ context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+func (s *LocalStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
 	if err := s.ensureDir(); err != nil {
 		return FileItem{}, err
 	}
@@ -83,12 +74,15 @@ func (s *LocalStorage) UploadWithProgress(_ context.Context, name string, data i
 	}
 	defer f.Close()
 
-	var reader io.Reader = data
+	var reader io.Reader = &ctxReader{ctx: ctx, r: data}
 	if onProgress != nil && size > 0 {
-		reader = &progressReader{r: data, total: size, onProgress: onProgress}
+		reader = &progressReader{r: reader, total: size, onProgress: onProgress}
 	}
 
 	if _, err := io.Copy(f, reader); err != nil {
+		// 途中まで書いたファイルは残さない
+		f.Close()
+		os.Remove(dst)
 		return FileItem{}, err
 	}
 
@@ -104,7 +98,11 @@ func (s *LocalStorage) UploadWithProgress(_ context.Context, name string, data i
 	}, nil
 }
 
-func (s *LocalStorage) Open(_ context.Context, name string) (io.ReadCloser, FileItem, error) {
+func (s *LocalStorage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
+	return s.OpenSeeker(ctx, name)
+}
+
+func (s *LocalStorage) OpenSeeker(_ context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
 	dst := s.filePath(name)
 	f, err := os.Open(dst)
 	if err != nil {
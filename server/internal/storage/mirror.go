@@ -0,0 +1,439 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ReplicaOK      = "ok"
+	ReplicaMissing = "missing" // 書き込みに失敗した・読み込みで見つからなかった（修復待ち）
+)
+
+// ErrNoHealthyReplica は修復元にできるレプリカが 1 つも無い場合のエラー
+var ErrNoHealthyReplica = errors.New("no replica has a readable copy")
+
+// Replica はミラーを構成する 1 つのバックエンド
+type Replica struct {
+	Name  string // "local" / "nas" / "s3"
+	Store Storage
+}
+
+// ReplicaState はファイルごとのレプリカの状態（DB の file_replicas テーブル）
+type ReplicaState struct {
+	Name      string    `json:"name"`
+	Replica   string    `json:"replica"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ReplicaIndex はファイルごとのレプリカの状態の保存先
+type ReplicaIndex interface {
+	SetReplicaState(name, replica, state, errMsg string) error
+	ReplicaStates(name string) ([]ReplicaState, error)
+	DeleteReplicaStates(name string) error
+}
+
+// ReplicaHealth はレプリカ全体の健全性（管理画面用）
+type ReplicaHealth struct {
+	Name                string     `json:"name"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	LatencyMillis       float64    `json:"latency_ms"` // 成功した操作の応答時間（指数移動平均）
+}
+
+// unhealthyAfter 回続けて失敗したレプリカは読み込みの優先順位を最後にする
+const unhealthyAfter = 3
+
+// MirrorStorage は 2 つ以上のバックエンドに同じファイルを書き込むストレージ。
+// 読み込みは健全なレプリカから行い、見つからない・失敗した場合は次のレプリカへ自動で切り替える。
+// 書き込みに失敗したレプリカは ReplicaIndex に missing として記録され、Repair で複製し直す。
+type MirrorStorage struct {
+	replicas    []Replica
+	index       ReplicaIndex
+	writeQuorum int // Upload の成功に必要なレプリカ数
+	tempDir     string
+
+	mu     sync.Mutex
+	health []ReplicaHealth
+}
+
+func NewMirrorStorage(replicas []Replica, index ReplicaIndex, writeQuorum int) (*MirrorStorage, error) {
+	if len(replicas) < 2 {
+		return nil, errors.New("mirror: at least two replicas are required")
+	}
+	if writeQuorum <= 0 {
+		writeQuorum = 1
+	}
+	if writeQuorum > len(replicas) {
+		writeQuorum = len(replicas)
+	}
+	s := &MirrorStorage{
+		replicas:    replicas,
+		index:       index,
+		writeQuorum: writeQuorum,
+		tempDir:     os.TempDir(),
+		health:      make([]ReplicaHealth, len(replicas)),
+	}
+	for i, r := range replicas {
+		s.health[i] = ReplicaHealth{Name: r.Name, Healthy: true}
+	}
+	return s, nil
+}
+
+// SetTempDir は入力を各レプリカへ並行に流すための一時ファイルの置き場を変える（デフォルト OS の一時フォルダ）
+func (s *MirrorStorage) SetTempDir(dir string) {
+	s.tempDir = dir
+}
+
+// Health は各レプリカの健全性を返す
+func (s *MirrorStorage) Health() []ReplicaHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ReplicaHealth, len(s.health))
+	copy(out, s.health)
+	return out
+}
+
+// observe は操作の結果をレプリカの健全性に反映する（ErrNotFound は失敗に数えない）
+func (s *MirrorStorage) observe(i int, start time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h := &s.health[i]
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		now := time.Now().UTC()
+		h.ConsecutiveFailures++
+		h.LastError = err.Error()
+		h.LastErrorAt = &now
+		h.Healthy = h.ConsecutiveFailures < unhealthyAfter
+		return
+	}
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	if h.LatencyMillis == 0 {
+		h.LatencyMillis = ms
+	} else {
+		h.LatencyMillis = h.LatencyMillis*0.8 + ms*0.2
+	}
+	h.ConsecutiveFailures = 0
+	h.Healthy = true
+}
+
+// ordered はレプリカの番号を健全 → 応答が速い順に並べる（同じなら設定順）
+func (s *MirrorStorage) ordered() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	order := make([]int, len(s.replicas))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ha, hb := s.health[order[a]], s.health[order[b]]
+		if ha.Healthy != hb.Healthy {
+			return ha.Healthy
+		}
+		return ha.LatencyMillis < hb.LatencyMillis
+	})
+	return order
+}
+
+// ReplicaNames はレプリカの名前（"local" / "nas" / "s3"）を設定順に返す
+func (s *MirrorStorage) ReplicaNames() []string {
+	names := make([]string, len(s.replicas))
+	for i, r := range s.replicas {
+		names[i] = r.Name
+	}
+	return names
+}
+
+// ListPage は全レプリカの同じページをまとめて返す（同名は更新日時が新しい方）。
+// 続きのあるレプリカがあれば、そのレプリカが返した範囲より先はまだ揃っていないので次のページに回す。
+func (s *MirrorStorage) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	limit := opts.limit()
+	byName := map[string]FileItem{}
+	var lastErr error
+	listed, truncated := 0, false
+	for _, i := range s.ordered() {
+		start := time.Now()
+		page, err := s.replicas[i].Store.ListPage(ctx, opts)
+		s.observe(i, start, err)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		listed++
+		truncated = truncated || page.NextCursor != ""
+		for _, it := range page.Items {
+			if cur, ok := byName[it.Name]; !ok || it.Modified.After(cur.Modified) {
+				byName[it.Name] = it
+			}
+		}
+	}
+	if listed == 0 {
+		return Page{}, lastErr
+	}
+	items := make([]FileItem, 0, len(byName))
+	for _, it := range byName {
+		items = append(items, it)
+	}
+	sort.Slice(items, func(a, b int) bool { return items[a].Name < items[b].Name })
+	if len(items) > limit || (truncated && len(items) == limit) {
+		items = items[:limit]
+		return Page{Items: items, NextCursor: items[limit-1].Name}, nil
+	}
+	return Page{Items: items}, nil
+}
+
+func (s *MirrorStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
+	return s.UploadWithProgress(ctx, name, data, size, nil)
+}
+
+// UploadWithProgress は全レプリカへ並行に書き込む。writeQuorum 個以上成功すれば成功とし、
+// 失敗したレプリカは missing として記録する。進捗は最も健全なレプリカの転送量で通知する。
+func (s *MirrorStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	src, n, cleanup, err := s.replicaSource(data)
+	if err != nil {
+		return FileItem{}, err
+	}
+	defer cleanup()
+	if size < 0 {
+		size = n
+	}
+
+	order := s.ordered()
+	items := make([]FileItem, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for pos, i := range order {
+		var progress ProgressFunc
+		if pos == 0 {
+			progress = onProgress
+		}
+		wg.Go(func() {
+			start := time.Now()
+			items[i], errs[i] = s.replicas[i].Store.UploadWithProgress(ctx, name, io.NewSectionReader(src, 0, n), size, progress)
+			s.observe(i, start, errs[i])
+		})
+	}
+	wg.Wait()
+
+	var first *FileItem
+	ok := 0
+	for _, i := range order {
+		if errs[i] == nil {
+			ok++
+			if first == nil {
+				first = &items[i]
+			}
+		}
+	}
+	if ok < s.writeQuorum {
+		// 台帳に記録しないので修復・削除の対象にならない。書けたレプリカの分は残さずに消す
+		cleanupCtx := context.WithoutCancel(ctx)
+		for i, r := range s.replicas {
+			if errs[i] == nil {
+				if err := r.Store.Delete(cleanupCtx, name); err != nil && !errors.Is(err, ErrNotFound) {
+					log.Printf("[MIRROR] remove partial upload %s from %s: %v", name, r.Name, err)
+				}
+			}
+		}
+		return FileItem{}, fmt.Errorf("mirror: %d of %d replicas written (need %d): %w", ok, len(s.replicas), s.writeQuorum, errors.Join(errs...))
+	}
+
+	for i, r := range s.replicas {
+		state, msg := ReplicaOK, ""
+		if errs[i] != nil {
+			state, msg = ReplicaMissing, errs[i].Error()
+		}
+		if err := s.index.SetReplicaState(name, r.Name, state, msg); err != nil {
+			return FileItem{}, err
+		}
+	}
+	return *first, nil
+}
+
+func (s *MirrorStorage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
+	return s.OpenSeeker(ctx, name)
+}
+
+// OpenSeeker は健全なレプリカから順に開く。missing と記録されたレプリカは後回しにする。
+func (s *MirrorStorage) OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
+	missing := map[string]bool{}
+	if states, err := s.index.ReplicaStates(name); err == nil {
+		for _, st := range states {
+			missing[st.Replica] = st.State != ReplicaOK
+		}
+	}
+	order := s.ordered()
+	sort.SliceStable(order, func(a, b int) bool {
+		return !missing[s.replicas[order[a]].Name] && missing[s.replicas[order[b]].Name]
+	})
+
+	var lastErr error
+	notFound := 0
+	for _, i := range order {
+		start := time.Now()
+		rc, item, err := s.replicas[i].Store.OpenSeeker(ctx, name)
+		s.observe(i, start, err)
+		if err == nil {
+			return rc, item, nil
+		}
+		if errors.Is(err, ErrNotFound) {
+			notFound++
+			if !missing[s.replicas[i].Name] {
+				_ = s.index.SetReplicaState(name, s.replicas[i].Name, ReplicaMissing, "not found on read")
+			}
+		}
+		lastErr = err
+	}
+	if notFound == len(s.replicas) {
+		return nil, FileItem{}, ErrNotFound
+	}
+	return nil, FileItem{}, lastErr
+}
+
+// Delete は全レプリカから削除する。どれにも無ければ ErrNotFound を返す。
+func (s *MirrorStorage) Delete(ctx context.Context, name string) error {
+	var errs []error
+	notFound := 0
+	for i, r := range s.replicas {
+		start := time.Now()
+		err := r.Store.Delete(ctx, name)
+		s.observe(i, start, err)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			notFound++
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s: %w", r.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := s.index.DeleteReplicaStates(name); err != nil {
+		return err
+	}
+	if notFound == len(s.replicas) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Verify は全レプリカに name があるか確認し、状態を記録する
+func (s *MirrorStorage) Verify(ctx context.Context, name string) ([]ReplicaState, error) {
+	states := make([]ReplicaState, 0, len(s.replicas))
+	for i, r := range s.replicas {
+		start := time.Now()
+		rc, _, err := r.Store.OpenSeeker(ctx, name)
+		s.observe(i, start, err)
+		st := ReplicaState{Name: name, Replica: r.Name, State: ReplicaOK, UpdatedAt: time.Now().UTC()}
+		if err != nil {
+			st.State, st.Error = ReplicaMissing, err.Error()
+		} else {
+			rc.Close()
+		}
+		if err := s.index.SetReplicaState(name, r.Name, st.State, st.Error); err != nil {
+			return nil, err
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// Repair は missing と記録されたレプリカへ、読めるレプリカから name を複製し直す。
+// 複製したレプリカの名前を返す。
+func (s *MirrorStorage) Repair(ctx context.Context, name string) ([]string, error) {
+	states, err := s.index.ReplicaStates(name)
+	if err != nil {
+		return nil, err
+	}
+	missing := map[string]bool{}
+	for _, st := range states {
+		if st.State != ReplicaOK {
+			missing[st.Replica] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	// 修復元: missing でない健全なレプリカ
+	src := -1
+	for _, i := range s.ordered() {
+		if missing[s.replicas[i].Name] {
+			continue
+		}
+		rc, _, err := s.replicas[i].Store.OpenSeeker(ctx, name)
+		if err != nil {
+			continue
+		}
+		rc.Close()
+		src = i
+		break
+	}
+	if src < 0 {
+		return nil, ErrNoHealthyReplica
+	}
+
+	var repaired []string
+	var errs []error
+	for i, r := range s.replicas {
+		if !missing[r.Name] {
+			continue
+		}
+		start := time.Now()
+		_, err := Copy(ctx, s.replicas[src].Store, name, r.Store, name)
+		s.observe(i, start, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.Name, err))
+			_ = s.index.SetReplicaState(name, r.Name, ReplicaMissing, err.Error())
+			continue
+		}
+		if err := s.index.SetReplicaState(name, r.Name, ReplicaOK, ""); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, r.Name)
+	}
+	return repaired, errors.Join(errs...)
+}
+
+// replicaSource は各レプリカが並行に読めるよう data を io.ReaderAt にする。
+// ReaderAt を持たない入力は一時ファイルに退避する。
+func (s *MirrorStorage) replicaSource(data io.Reader) (io.ReaderAt, int64, func(), error) {
+	if f, ok := data.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		start, err := f.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := f.Seek(0, io.SeekEnd)
+			if err == nil {
+				return io.NewSectionReader(f, start, end-start), end - start, func() {}, nil
+			}
+		}
+	}
+
+	tmp, err := os.CreateTemp(s.tempDir, "hideme_mirror_*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	n, err := io.Copy(tmp, data)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return tmp, n, cleanup, nil
+}
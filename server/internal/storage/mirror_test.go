@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memReplicaIndex は ReplicaIndex のメモリ上の実装
+type memReplicaIndex struct {
+	mu     sync.Mutex
+	states map[string][]ReplicaState
+}
+
+func (m *memReplicaIndex) SetReplicaState(name, replica, state, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[name] = append(m.states[name], ReplicaState{Name: name, Replica: replica, State: state, Error: errMsg})
+	return nil
+}
+
+func (m *memReplicaIndex) ReplicaStates(name string) ([]ReplicaState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.states[name], nil
+}
+
+func (m *memReplicaIndex) DeleteReplicaStates(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.states, name)
+	return nil
+}
+
+// brokenStorage は書き込みが必ず失敗するレプリカ
+type brokenStorage struct{ *LocalStorage }
+
+func (s brokenStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	return FileItem{}, errors.New("replica is down")
+}
+
+// 書き込めたレプリカが writeQuorum に届かなければ、書けた分も消して何も残さない
+func TestMirrorQuorumFailureRemovesPartialReplicas(t *testing.T) {
+	good := NewLocalStorage(t.TempDir())
+	index := &memReplicaIndex{states: map[string][]ReplicaState{}}
+	s, err := NewMirrorStorage([]Replica{
+		{Name: "local", Store: good},
+		{Name: "nas", Store: brokenStorage{NewLocalStorage(t.TempDir())}},
+	}, index, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTempDir(t.TempDir())
+	ctx := context.Background()
+
+	if _, err := s.Upload(ctx, "a.mp4", strings.NewReader("data"), 4); err == nil {
+		t.Fatal("Upload succeeded without a write quorum")
+	}
+	if _, _, err := good.Open(ctx, "a.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("partial replica = %v, want ErrNotFound", err)
+	}
+	if states, _ := index.ReplicaStates("a.mp4"); len(states) != 0 {
+		t.Errorf("replica states recorded for a failed upload: %+v", states)
+	}
+}
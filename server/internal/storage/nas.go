@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/pkg/sftp"
@@ -27,11 +29,22 @@ type NASConfig struct {
 	MaxRetries     int
 	RetryDelay     int // 秒
 	ChunkSize      int // バイト
+	PoolSize       int // 同時に保持する SFTP セッションの上限
+	IdleTimeout    int // 秒。これ以上使われなかったセッションは閉じる
+
+	// ホスト鍵の検証（いずれか 1 つが必須）
+	KnownHostsPath     string       // OpenSSH 形式の known_hosts
+	HostKeyFingerprint string       // "SHA256:..." 形式の指紋
+	TrustOnFirstUse    bool         // 初回接続時の鍵を HostKeys に保存して以後それと照合する
+	HostKeys           HostKeyStore // TOFU のピン留め先
 }
 
-// NASStorage は NAS (SFTP/SSH) にファイルを保存するストレージ実装
+// NASStorage は NAS (SFTP/SSH) にファイルを保存するストレージ実装。
+// SFTP セッションはプールで使い回すため、1 つのインスタンスを共有して使う。
 type NASStorage struct {
-	cfg NASConfig
+	cfg     NASConfig
+	pool    *connPool[*sftpConn]
+	hostKey hostKeyState
 }
 
 func NewNASStorage(cfg NASConfig) *NASStorage {
@@ -54,22 +67,34 @@ func NewNASStorage(cfg NASConfig) *NASStorage {
 	if cfg.Share == "" {
 		cfg.Share = "HideMe/uploads"
 	}
-	return &NASStorage{cfg: cfg}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 8
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 300
+	}
+	s := &NASStorage{cfg: cfg}
+	s.pool = newConnPool(cfg.PoolSize, time.Duration(cfg.IdleTimeout)*time.Second, s.dial, isConnLost)
+	return s
 }
 
-func (s *NASStorage) Delete(ctx context.Context, name string) error {
-	client, sshClient, err := s.connect(ctx)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = client.Close()
-		_ = sshClient.Close()
-	}()
+// PoolStats は SFTP コネクションプールの統計を返す
+func (s *NASStorage) PoolStats() PoolStats {
+	return s.pool.snapshot()
+}
+
+// Close はプール内のアイドルセッションをすべて閉じる
+func (s *NASStorage) Close() {
+	s.pool.close()
+}
 
+func (s *NASStorage) Delete(ctx context.Context, name string) error {
 	target := s.uploadPath(name)
-	if err := client.Remove(target); err != nil {
-		if os.IsNotExist(err) {
+	err := s.pool.withConn(ctx, func(conn *sftpConn) error {
+		return conn.client.Remove(target)
+	})
+	if err != nil {
+		if isNotExist(err) {
 			return ErrNotFound
 		}
 		return err
@@ -77,56 +102,31 @@ func (s *NASStorage) Delete(ctx context.Context, name string) error {
 	return nil
 }
 
-func (s *NASStorage) List(ctx context.Context) ([]FileItem, error) {
-	client, sshClient, err := s.connect(ctx)
-	if err != nil {
-		return nil, err
-	}
-	defer func() {
-		_ = client.Close()
-		_ = sshClient.Close()
-	}()
-
-	if err := s.ensureDirs(client); err != nil {
-		return nil, err
-	}
-
-	entries, err := client.ReadDir(s.cfg.Share)
-	if err != nil {
-		return nil, err
-	}
-
-	items := make([]FileItem, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-		items = append(items, FileItem{
-			Name:     entry.Name(),
-			Size:     entry.Size(),
-			Modified: entry.ModTime().UTC(),
-		})
-	}
-	return items, nil
+// ListPage はサブフォルダも含めてキー順に 1 ページ分のファイルを返す（1 つの接続で読む）
+func (s *NASStorage) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	var page Page
+	err := s.pool.withConn(ctx, func(conn *sftpConn) error {
+		var err error
+		page, err = listTree(ctx, func(rel string) ([]fs.FileInfo, error) {
+			return conn.client.ReadDir(path.Join(s.cfg.Share, rel))
+		}, opts)
+		return err
+	})
+	return page, err
 }
 
 func (s *NASStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
 	return s.UploadWithProgress(ctx, name, data, size, nil)
 }
 
-func (s *NASStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
-	client, sshClient, err := s.connect(ctx)
+// UploadWithProgress はデータを消費するため、セッション切れでも再試行しない
+func (s *NASStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (item FileItem, err error) {
+	conn, err := s.pool.get(ctx)
 	if err != nil {
 		return FileItem{}, err
 	}
-	defer func() {
-		_ = client.Close()
-		_ = sshClient.Close()
-	}()
-
-	if err := s.ensureDirs(client); err != nil {
-		return FileItem{}, err
-	}
+	defer func() { s.pool.put(conn, uploadConnLost(err, isConnLost)) }()
+	client := conn.client
 
 	target := s.uploadPath(name)
 	// サブフォルダ (thumbnails/ icons/) を作成
@@ -141,12 +141,15 @@ func (s *NASStorage) UploadWithProgress(ctx context.Context, name string, data i
 	}
 	defer writer.Close()
 
-	var reader io.Reader = data
+	var reader io.Reader = &ctxReader{ctx: ctx, r: data}
 	if onProgress != nil && size > 0 {
-		reader = &progressReader{r: data, total: size, onProgress: onProgress}
+		reader = &progressReader{r: reader, total: size, onProgress: onProgress}
 	}
 	buf := make([]byte, s.cfg.ChunkSize)
-	if _, err := io.CopyBuffer(writer, reader, buf); err != nil {
+	if _, err := io.CopyBuffer(writer, &sourceReader{r: reader}, buf); err != nil {
+		// 途中まで書いたファイルは残さない
+		writer.Close()
+		_ = client.Remove(target)
 		return FileItem{}, err
 	}
 
@@ -163,49 +166,50 @@ func (s *NASStorage) UploadWithProgress(ctx context.Context, name string, data i
 }
 
 func (s *NASStorage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
-	client, sshClient, err := s.connect(ctx)
-	if err != nil {
-		return nil, FileItem{}, err
-	}
-
-	if err := s.ensureDirs(client); err != nil {
-		_ = client.Close()
-		_ = sshClient.Close()
-		return nil, FileItem{}, err
-	}
+	return s.OpenSeeker(ctx, name)
+}
 
+// OpenSeeker が返すストリームは共有セッションに相乗りする（SFTP は 1 本のセッションで複数のファイルを並行に読める）。
+// 再生中のストリームがプールのセッションを占有しないので、同時再生が多くても他の操作は待たされない。
+// Seek は SFTP の読み込みオフセットを移動するだけなので、先頭から読み直す必要はない。
+func (s *NASStorage) OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
 	target := s.uploadPath(name)
-	file, err := client.Open(target)
-	if err != nil {
-		_ = client.Close()
-		_ = sshClient.Close()
-		if os.IsNotExist(err) {
-			return nil, FileItem{}, ErrNotFound
-		}
-		var statusErr *sftp.StatusError
-		if errors.As(err, &statusErr) && statusErr.Code == uint32(sftp.ErrSSHFxNoSuchFile) {
-			return nil, FileItem{}, ErrNotFound
+	for attempt := 0; ; attempt++ {
+		sc, err := s.pool.share(ctx)
+		if err != nil {
+			return nil, FileItem{}, err
 		}
-		return nil, FileItem{}, err
-	}
 
-	info, err := file.Stat()
-	if err != nil {
-		_ = file.Close()
-		_ = client.Close()
-		_ = sshClient.Close()
-		return nil, FileItem{}, err
-	}
+		file, err := sc.conn.client.Open(target)
+		var info os.FileInfo
+		if err == nil {
+			info, err = file.Stat()
+			if err != nil {
+				_ = file.Close()
+			}
+		}
+		if err != nil {
+			lost := isConnLost(err)
+			s.pool.unshare(sc, lost)
+			if lost && attempt == 0 {
+				continue // 切れたセッションだったので新しいセッションでやり直す
+			}
+			if isNotExist(err) {
+				return nil, FileItem{}, ErrNotFound
+			}
+			return nil, FileItem{}, err
+		}
 
-	return &sftpReadCloser{
-			file:   file,
-			client: client,
-			ssh:    sshClient,
+		return &sftpReadCloser{
+			file: file,
+			conn: sc,
+			pool: s.pool,
 		}, FileItem{
 			Name:     info.Name(),
 			Size:     info.Size(),
 			Modified: info.ModTime().UTC(),
 		}, nil
+	}
 }
 
 // DiskStat は NAS のディスク使用量・空き容量・合計容量を返す。
@@ -216,17 +220,18 @@ type DiskStat struct {
 	UsedBytes  uint64
 }
 
-func (s *NASStorage) DiskStat(ctx context.Context) (DiskStat, error) {
-	client, sshClient, err := s.connect(ctx)
-	if err != nil {
-		return DiskStat{}, err
-	}
-	defer func() {
-		_ = client.Close()
-		_ = sshClient.Close()
-	}()
+// DiskStater は容量を取得できるストア（NASStorage / SMBStorage）
+type DiskStater interface {
+	DiskStat(ctx context.Context) (DiskStat, error)
+}
 
-	vfs, err := client.StatVFS(s.cfg.Share)
+func (s *NASStorage) DiskStat(ctx context.Context) (DiskStat, error) {
+	var vfs *sftp.StatVFS
+	err := s.pool.withConn(ctx, func(conn *sftpConn) error {
+		var err error
+		vfs, err = conn.client.StatVFS(s.cfg.Share)
+		return err
+	})
 	if err != nil {
 		return DiskStat{}, fmt.Errorf("StatVFS: %w", err)
 	}
@@ -258,6 +263,20 @@ func (s *NASStorage) ensureDirs(client *sftp.Client) error {
 	return nil
 }
 
+// dial はプール用に新しいセッションを張り、アップロード先ディレクトリを用意する
+func (s *NASStorage) dial(ctx context.Context) (*sftpConn, error) {
+	client, sshClient, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ensureDirs(client); err != nil {
+		_ = client.Close()
+		_ = sshClient.Close()
+		return nil, err
+	}
+	return &sftpConn{connMeta: connMeta{lastUsed: time.Now()}, client: client, ssh: sshClient}, nil
+}
+
 func (s *NASStorage) connect(ctx context.Context) (*sftp.Client, *ssh.Client, error) {
 	var lastErr error
 	retries := s.cfg.MaxRetries
@@ -267,6 +286,10 @@ func (s *NASStorage) connect(ctx context.Context) (*sftp.Client, *ssh.Client, er
 			return client, sshClient, nil
 		}
 		lastErr = err
+		// ホスト鍵の不一致・未設定は再試行しても解決しない
+		if errors.Is(err, ErrHostKeyMismatch) || errors.Is(err, ErrHostKeyUnverified) {
+			break
+		}
 
 		if attempt == retries {
 			break
@@ -301,14 +324,19 @@ func (s *NASStorage) connectOnce(ctx context.Context) (*sftp.Client, *ssh.Client
 		return nil, nil, errors.New("no auth method configured")
 	}
 
+	hostKeyCallback, err := s.hostKeyCallback()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	sshConfig := &ssh.ClientConfig{
 		User:            s.cfg.User,
 		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: production では known_hosts を使う
+		HostKeyCallback: hostKeyCallback,
 		Timeout:         time.Duration(s.cfg.Timeout) * time.Second,
 	}
 
-	addr := fmt.Sprintf("%s:%d", s.cfg.Host, s.cfg.Port)
+	addr := s.hostAddr()
 	dialer := net.Dialer{Timeout: time.Duration(s.cfg.Timeout) * time.Second}
 	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
@@ -330,18 +358,44 @@ func (s *NASStorage) connectOnce(ctx context.Context) (*sftp.Client, *ssh.Client
 	return sftpClient, sshClient, nil
 }
 
+// sftpReadCloser はシーク可能な SFTP ファイルで、Close 時に共有セッションから抜ける
 type sftpReadCloser struct {
 	file   *sftp.File
-	client *sftp.Client
-	ssh    *ssh.Client
+	conn   *sharedConn[*sftpConn]
+	pool   *connPool[*sftpConn]
+	broken bool
+	once   sync.Once
 }
 
 func (s *sftpReadCloser) Read(p []byte) (int, error) {
-	return s.file.Read(p)
+	n, err := s.file.Read(p)
+	if err != nil && err != io.EOF && isConnLost(err) {
+		s.broken = true
+	}
+	return n, err
+}
+
+func (s *sftpReadCloser) Seek(offset int64, whence int) (int64, error) {
+	n, err := s.file.Seek(offset, whence)
+	if err != nil && isConnLost(err) {
+		s.broken = true
+	}
+	return n, err
 }
 
 func (s *sftpReadCloser) Close() error {
-	_ = s.file.Close()
-	_ = s.client.Close()
-	return s.ssh.Close()
+	var err error
+	s.once.Do(func() {
+		err = s.file.Close()
+		s.pool.unshare(s.conn, s.broken || isConnLost(err))
+	})
+	return err
+}
+
+func isNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	var statusErr *sftp.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == uint32(sftp.ErrSSHFxNoSuchFile)
 }
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	ErrHostKeyMismatch   = errors.New("nas host key mismatch")
+	ErrHostKeyUnverified = errors.New("nas host key verification is not configured (set storage.nas.known_hosts, host_key_fingerprint or host_key_tofu)")
+)
+
+// HostKeyMismatchError は NAS が提示したホスト鍵がピン留めされた鍵と異なる場合のエラー。
+// 中間者攻撃の可能性があるため接続は拒否する。
+type HostKeyMismatchError struct {
+	Host     string
+	Source   string // "config" / "known_hosts" / "database"
+	Expected string
+	Got      string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("nas host key mismatch for %s: expected %s (%s), got %s — refusing to connect; "+
+		"if the NAS key was intentionally rotated, re-pin it from the admin panel", e.Host, e.Expected, e.Source, e.Got)
+}
+
+func (e *HostKeyMismatchError) Unwrap() error { return ErrHostKeyMismatch }
+
+// HostKeyStore は TOFU でピン留めしたホスト鍵の保存先（DB）
+type HostKeyStore interface {
+	// LoadHostKey は host ("host:port") の指紋を返す。未登録なら "" を返す。
+	LoadHostKey(host string) (string, error)
+	SaveHostKey(host, keyType, fingerprint string) error
+}
+
+// HostKeyInfo は NAS が提示したホスト鍵の情報
+type HostKeyInfo struct {
+	Host        string    `json:"host"`
+	KeyType     string    `json:"key_type"`
+	Fingerprint string    `json:"fingerprint"`
+	SeenAt      time.Time `json:"seen_at"`
+}
+
+// HostKeyStatus は管理画面に表示するホスト鍵の検証状態
+type HostKeyStatus struct {
+	Mode           string       `json:"mode"` // "fingerprint" / "known_hosts" / "tofu" / "none"
+	Host           string       `json:"host"`
+	ConfiguredKey  string       `json:"configured_fingerprint,omitempty"`
+	KnownHostsPath string       `json:"known_hosts,omitempty"`
+	PinnedKey      string       `json:"pinned_fingerprint,omitempty"`
+	LastPresented  *HostKeyInfo `json:"last_presented,omitempty"`
+}
+
+// hostKeyState は直近に提示された鍵を記録する（管理画面表示用）
+type hostKeyState struct {
+	mu   sync.Mutex
+	last *HostKeyInfo
+}
+
+func (s *NASStorage) hostAddr() string {
+	return net.JoinHostPort(s.cfg.Host, fmt.Sprintf("%d", s.cfg.Port))
+}
+
+func (s *NASStorage) hostKeyMode() string {
+	switch {
+	case s.cfg.HostKeyFingerprint != "":
+		return "fingerprint"
+	case s.cfg.KnownHostsPath != "":
+		return "known_hosts"
+	case s.cfg.TrustOnFirstUse && s.cfg.HostKeys != nil:
+		return "tofu"
+	default:
+		return "none"
+	}
+}
+
+// hostKeyCallback は設定に応じたホスト鍵検証を返す。
+// 優先順位: 設定の指紋 → known_hosts → TOFU (DB)。どれも無ければ接続しない。
+func (s *NASStorage) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	var verify ssh.HostKeyCallback
+	switch s.hostKeyMode() {
+	case "fingerprint":
+		want := normalizeFingerprint(s.cfg.HostKeyFingerprint)
+		verify = func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != want {
+				return &HostKeyMismatchError{Host: hostname, Source: "config", Expected: want, Got: got}
+			}
+			return nil
+		}
+	case "known_hosts":
+		cb, err := knownhosts.New(s.cfg.KnownHostsPath)
+		if err != nil {
+			return nil, fmt.Errorf("load known_hosts: %w", err)
+		}
+		verify = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := cb(hostname, remote, key)
+			var keyErr *knownhosts.KeyError
+			if errors.As(err, &keyErr) {
+				if len(keyErr.Want) == 0 {
+					return fmt.Errorf("nas host %s is not in %s (got %s)", hostname, s.cfg.KnownHostsPath, ssh.FingerprintSHA256(key))
+				}
+				return &HostKeyMismatchError{Host: hostname, Source: "known_hosts",
+					Expected: ssh.FingerprintSHA256(keyErr.Want[0].Key), Got: ssh.FingerprintSHA256(key)}
+			}
+			return err
+		}
+	case "tofu":
+		verify = func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			got := ssh.FingerprintSHA256(key)
+			pinned, err := s.cfg.HostKeys.LoadHostKey(hostname)
+			if err != nil {
+				return fmt.Errorf("load pinned host key: %w", err)
+			}
+			if pinned == "" {
+				// 初回接続: 提示された鍵を信頼して保存する
+				if err := s.cfg.HostKeys.SaveHostKey(hostname, key.Type(), got); err != nil {
+					return fmt.Errorf("pin host key: %w", err)
+				}
+				return nil
+			}
+			if pinned != got {
+				return &HostKeyMismatchError{Host: hostname, Source: "database", Expected: pinned, Got: got}
+			}
+			return nil
+		}
+	default:
+		return nil, ErrHostKeyUnverified
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		s.hostKey.mu.Lock()
+		s.hostKey.last = &HostKeyInfo{
+			Host:        hostname,
+			KeyType:     key.Type(),
+			Fingerprint: ssh.FingerprintSHA256(key),
+			SeenAt:      time.Now().UTC(),
+		}
+		s.hostKey.mu.Unlock()
+		return verify(hostname, remote, key)
+	}, nil
+}
+
+// HostKeyStatus は現在のホスト鍵検証の設定とピン留め状態を返す
+func (s *NASStorage) HostKeyStatus() (HostKeyStatus, error) {
+	st := HostKeyStatus{
+		Mode:           s.hostKeyMode(),
+		Host:           s.hostAddr(),
+		ConfiguredKey:  normalizeFingerprint(s.cfg.HostKeyFingerprint),
+		KnownHostsPath: s.cfg.KnownHostsPath,
+	}
+	if s.cfg.HostKeys != nil {
+		pinned, err := s.cfg.HostKeys.LoadHostKey(st.Host)
+		if err != nil {
+			return st, err
+		}
+		st.PinnedKey = pinned
+	}
+	s.hostKey.mu.Lock()
+	if s.hostKey.last != nil {
+		last := *s.hostKey.last
+		st.LastPresented = &last
+	}
+	s.hostKey.mu.Unlock()
+	return st, nil
+}
+
+// ProbeHostKey は認証せずに SSH ハンドシェイクだけを行い、NAS が提示するホスト鍵を取得する
+func (s *NASStorage) ProbeHostKey(ctx context.Context) (HostKeyInfo, error) {
+	var info HostKeyInfo
+	errProbed := errors.New("probed")
+	cfg := &ssh.ClientConfig{
+		User: s.cfg.User,
+		HostKeyCallback: func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+			info = HostKeyInfo{
+				Host:        hostname,
+				KeyType:     key.Type(),
+				Fingerprint: ssh.FingerprintSHA256(key),
+				SeenAt:      time.Now().UTC(),
+			}
+			return errProbed
+		},
+		Timeout: time.Duration(s.cfg.Timeout) * time.Second,
+	}
+
+	addr := s.hostAddr()
+	dialer := net.Dialer{Timeout: time.Duration(s.cfg.Timeout) * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return HostKeyInfo{}, err
+	}
+	defer conn.Close()
+
+	_, _, _, err = ssh.NewClientConn(conn, addr, cfg)
+	if info.Fingerprint == "" {
+		return HostKeyInfo{}, fmt.Errorf("probe host key: %w", err)
+	}
+	return info, nil
+}
+
+// RepinHostKey は NAS の現在のホスト鍵を DB にピン留めし直す（TOFU モード専用）。
+// 提示された鍵が expected と一致する場合のみ保存する（中間者の鍵をそのままピン留めしないため必須）。
+func (s *NASStorage) RepinHostKey(ctx context.Context, expected string) (HostKeyInfo, error) {
+	expected = normalizeFingerprint(expected)
+	if expected == "" {
+		return HostKeyInfo{}, errors.New("expected host key fingerprint is required")
+	}
+	if s.hostKeyMode() != "tofu" {
+		return HostKeyInfo{}, fmt.Errorf("host key is pinned by %s, not by the database", s.hostKeyMode())
+	}
+	info, err := s.ProbeHostKey(ctx)
+	if err != nil {
+		return HostKeyInfo{}, err
+	}
+	if expected != info.Fingerprint {
+		return info, &HostKeyMismatchError{Host: info.Host, Source: "request", Expected: expected, Got: info.Fingerprint}
+	}
+	if err := s.cfg.HostKeys.SaveHostKey(info.Host, info.KeyType, info.Fingerprint); err != nil {
+		return HostKeyInfo{}, err
+	}
+	// 古い鍵で張ったセッションは使わない
+	s.pool.drain()
+	return info, nil
+}
+
+// normalizeFingerprint は "SHA256:" の有無を揃える
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimSpace(fp)
+	if fp == "" {
+		return ""
+	}
+	if !strings.HasPrefix(fp, "SHA256:") {
+		fp = "SHA256:" + fp
+	}
+	return fp
+}
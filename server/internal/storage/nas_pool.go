@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// PoolStats は NAS コネクションプール（SFTP / SMB）の統計（管理画面用）
+type PoolStats struct {
+	MaxOpen        int   `json:"max_open"`
+	Open           int   `json:"open"`
+	Idle           int   `json:"idle"`
+	InUse          int   `json:"in_use"`
+	Dials          int64 `json:"dials"`
+	DialErrors     int64 `json:"dial_errors"`
+	Reused         int64 `json:"reused"`
+	Reconnects     int64 `json:"reconnects"`
+	IdleEvicted    int64 `json:"idle_evicted"`
+	HealthFailures int64 `json:"health_failures"`
+	WaitCount      int64 `json:"wait_count"`
+	WaitMillis     int64 `json:"wait_millis"`
+	Shared         int   `json:"shared"`  // ストリームで共有しているセッション数
+	Streams        int   `json:"streams"` // 共有セッション上で開いているストリーム数
+}
+
+// pooledConn はプールが保持する 1 本のセッション
+type pooledConn interface {
+	close()
+	healthy() bool // 軽量なリクエストでセッションが生きているか確認する
+	meta() *connMeta
+}
+
+// connMeta はプールがセッションごとに管理する情報
+type connMeta struct {
+	lastUsed time.Time
+	gen      int // drain 前に張られたセッションは返却時に捨てる
+}
+
+// sftpConn はプールが保持する 1 本の SSH + SFTP セッション
+type sftpConn struct {
+	connMeta
+	client *sftp.Client
+	ssh    *ssh.Client
+}
+
+func (c *sftpConn) meta() *connMeta { return &c.connMeta }
+
+func (c *sftpConn) close() {
+	_ = c.client.Close()
+	_ = c.ssh.Close()
+}
+
+func (c *sftpConn) healthy() bool {
+	_, err := c.client.Getwd()
+	return err == nil
+}
+
+// streamsPerConn は 1 本の共有セッションで同時に開くストリームの上限
+const streamsPerConn = 16
+
+// sharedConn は複数のストリームで同時に使っているセッション
+type sharedConn[C pooledConn] struct {
+	conn   C
+	refs   int
+	broken bool
+}
+
+// connPool は最大 maxOpen 本のセッションを使い回す。
+// 取得時にしばらく使っていないセッションは疎通確認し、idleTimeout を過ぎたものは閉じる。
+// 長く開いたままになるストリームは share で 1 本のセッションに相乗りさせ、他の操作のセッションを塞がない。
+type connPool[C pooledConn] struct {
+	dial        func(ctx context.Context) (C, error)
+	lost        func(err error) bool // セッション自体が使えなくなったエラーかどうか
+	sem         chan struct{}        // 同時に貸し出せる本数を制限する
+	idleTimeout time.Duration
+	checkAfter  time.Duration // これ以上アイドルだったセッションは貸し出し前に疎通確認する
+
+	mu    sync.Mutex
+	idle  []C // 末尾が直近に返却されたもの
+	open  int
+	gen   int
+	stats PoolStats
+
+	shared  []*sharedConn[C]
+	shareMu sync.Mutex // 共有セッションを同時に 2 本張らないようにする
+
+	stop chan struct{}
+}
+
+func newConnPool[C pooledConn](maxOpen int, idleTimeout time.Duration, dial func(ctx context.Context) (C, error), lost func(error) bool) *connPool[C] {
+	p := &connPool[C]{
+		dial:        dial,
+		lost:        lost,
+		sem:         make(chan struct{}, maxOpen),
+		idleTimeout: idleTimeout,
+		checkAfter:  15 * time.Second,
+		stop:        make(chan struct{}),
+	}
+	p.stats.MaxOpen = maxOpen
+	go p.evictLoop()
+	return p
+}
+
+// get はアイドルのセッションを返す。無ければ新しく接続する。
+// 上限に達している場合は返却されるか ctx がキャンセルされるまで待つ。
+func (p *connPool[C]) get(ctx context.Context) (C, error) {
+	select {
+	case p.sem <- struct{}{}:
+	default:
+		start := time.Now()
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			var zero C
+			return zero, ctx.Err()
+		}
+		p.mu.Lock()
+		p.stats.WaitCount++
+		p.stats.WaitMillis += time.Since(start).Milliseconds()
+		p.mu.Unlock()
+	}
+
+	for {
+		p.mu.Lock()
+		n := len(p.idle)
+		if n == 0 {
+			p.mu.Unlock()
+			break
+		}
+		conn := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+
+		if time.Since(conn.meta().lastUsed) < p.checkAfter || conn.healthy() {
+			p.mu.Lock()
+			p.stats.Reused++
+			p.mu.Unlock()
+			return conn, nil
+		}
+		p.mu.Lock()
+		p.stats.HealthFailures++
+		p.mu.Unlock()
+		p.discard(conn)
+	}
+
+	conn, err := p.dial(ctx)
+	p.mu.Lock()
+	p.stats.Dials++
+	if err != nil {
+		p.stats.DialErrors++
+		p.mu.Unlock()
+		<-p.sem
+		var zero C
+		return zero, err
+	}
+	p.open++
+	conn.meta().gen = p.gen
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// put はセッションをプールに戻す。broken の場合は閉じて捨てる。
+func (p *connPool[C]) put(conn C, broken bool) {
+	p.mu.Lock()
+	stale := conn.meta().gen != p.gen
+	p.mu.Unlock()
+	if broken || stale {
+		p.discard(conn)
+	} else {
+		conn.meta().lastUsed = time.Now()
+		p.mu.Lock()
+		p.idle = append(p.idle, conn)
+		p.mu.Unlock()
+	}
+	<-p.sem
+}
+
+func (p *connPool[C]) discard(conn C) {
+	conn.close()
+	p.mu.Lock()
+	p.open--
+	p.mu.Unlock()
+}
+
+// withConn はセッションを借りて fn を実行する。
+// セッションが切れていた場合は 1 回だけ新しいセッションで再実行する（冪等な操作専用）。
+func (p *connPool[C]) withConn(ctx context.Context, fn func(C) error) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := p.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(conn)
+		broken := p.lost(err)
+		p.put(conn, broken)
+		if !broken || attempt > 0 {
+			return err
+		}
+		p.mu.Lock()
+		p.stats.Reconnects++
+		p.mu.Unlock()
+	}
+}
+
+// share は複数のストリームで同時に使うセッションを返す（1 本あたり streamsPerConn まで相乗りする）。
+// 空きのある共有セッションが無ければプールから 1 本借りて共有にする。使い終わったら unshare で返す。
+func (p *connPool[C]) share(ctx context.Context) (*sharedConn[C], error) {
+	p.shareMu.Lock()
+	defer p.shareMu.Unlock()
+
+	p.mu.Lock()
+	var best *sharedConn[C]
+	for _, sc := range p.shared {
+		if sc.refs < streamsPerConn && (best == nil || sc.refs < best.refs) {
+			best = sc
+		}
+	}
+	if best != nil {
+		best.refs++
+		p.mu.Unlock()
+		return best, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc := &sharedConn[C]{conn: conn, refs: 1}
+	p.mu.Lock()
+	p.shared = append(p.shared, sc)
+	p.mu.Unlock()
+	return sc, nil
+}
+
+// unshare はストリームを閉じたときに呼ぶ。broken の場合は以後そのセッションに相乗りさせない。
+// 最後のストリームが閉じたらセッションをプールへ返す。
+func (p *connPool[C]) unshare(sc *sharedConn[C], broken bool) {
+	p.mu.Lock()
+	sc.refs--
+	if broken && !sc.broken {
+		sc.broken = true
+		p.removeShared(sc)
+	}
+	last := sc.refs == 0
+	if last && !sc.broken {
+		p.removeShared(sc)
+	}
+	p.mu.Unlock()
+	if last {
+		p.put(sc.conn, sc.broken)
+	}
+}
+
+// removeShared は p.mu を持って呼ぶ
+func (p *connPool[C]) removeShared(sc *sharedConn[C]) {
+	for i, s := range p.shared {
+		if s == sc {
+			p.shared = append(p.shared[:i], p.shared[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *connPool[C]) snapshot() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Open = p.open
+	s.Idle = len(p.idle)
+	s.InUse = p.open - len(p.idle)
+	s.Shared = len(p.shared)
+	for _, sc := range p.shared {
+		s.Streams += sc.refs
+	}
+	return s
+}
+
+func (p *connPool[C]) evictLoop() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			p.evictIdle()
+		}
+	}
+}
+
+func (p *connPool[C]) evictIdle() {
+	var expired []C
+	p.mu.Lock()
+	kept := p.idle[:0]
+	for _, c := range p.idle {
+		if time.Since(c.meta().lastUsed) >= p.idleTimeout {
+			expired = append(expired, c)
+		} else {
+			kept = append(kept, c)
+		}
+	}
+	p.idle = kept
+	p.open -= len(expired)
+	p.stats.IdleEvicted += int64(len(expired))
+	p.mu.Unlock()
+
+	for _, c := range expired {
+		c.close()
+	}
+}
+
+func (p *connPool[C]) close() {
+	close(p.stop)
+	p.drain()
+}
+
+// drain はアイドルのセッションをすべて閉じる。貸し出し中のものは返却時に閉じる。
+func (p *connPool[C]) drain() {
+	p.mu.Lock()
+	p.gen++
+	idle := p.idle
+	p.idle = nil
+	p.open -= len(idle)
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.close()
+	}
+}
+
+// isConnLost は SSH セッション自体が使えなくなったエラーかどうかを判定する
+func isConnLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// fakeConn はネットワークを使わない pooledConn
+type fakeConn struct {
+	connMeta
+	closed bool
+}
+
+func (c *fakeConn) close()          { c.closed = true }
+func (c *fakeConn) healthy() bool   { return !c.closed }
+func (c *fakeConn) meta() *connMeta { return &c.connMeta }
+
+func newFakePool(maxOpen int) *connPool[*fakeConn] {
+	p := newConnPool(maxOpen, time.Minute, func(ctx context.Context) (*fakeConn, error) {
+		return &fakeConn{connMeta: connMeta{lastUsed: time.Now()}}, nil
+	}, func(err error) bool { return err != nil })
+	return p
+}
+
+func TestConnPoolSharedStreams(t *testing.T) {
+	p := newFakePool(2)
+	defer p.close()
+	ctx := context.Background()
+
+	// 上限を超える数のストリームを開いても 1 本のセッションに相乗りする
+	var streams []*sharedConn[*fakeConn]
+	for range streamsPerConn {
+		sc, err := p.share(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, sc)
+	}
+	if st := p.snapshot(); st.Shared != 1 || st.Streams != streamsPerConn || st.Open != 1 {
+		t.Fatalf("stats = %+v, want 1 shared session with %d streams", st, streamsPerConn)
+	}
+
+	// ストリームが開いたままでも他の操作はセッションを借りられる
+	waitCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := p.withConn(waitCtx, func(*fakeConn) error { return nil }); err != nil {
+		t.Fatalf("withConn while streaming: %v", err)
+	}
+
+	// 1 本の上限に達したら 2 本目を共有にする
+	extra, err := p.share(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if extra.conn == streams[0].conn {
+		t.Error("stream beyond streamsPerConn reused the full session")
+	}
+	p.unshare(extra, false)
+
+	// 切れたセッションにはそれ以上相乗りさせず、最後のストリームが閉じたら捨てる
+	broken := streams[0].conn
+	p.unshare(streams[0], true)
+	sc, err := p.share(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.conn == broken {
+		t.Error("new stream joined a broken session")
+	}
+	p.unshare(sc, false)
+	for _, s := range streams[1:] {
+		p.unshare(s, false)
+	}
+	if !broken.closed {
+		t.Error("broken session was not closed after its last stream")
+	}
+	if st := p.snapshot(); st.Shared != 0 || st.Streams != 0 || st.InUse != 0 {
+		t.Errorf("stats after close = %+v", st)
+	}
+}
+
+// failingWriter は書き込み先のセッションが切れた状態
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write(p []byte) (int, error) { return 0, w.err }
+
+// アップロード元のエラー（クライアントの中断）ではセッションを捨てず、書き込み先のエラーでだけ捨てる
+func TestUploadConnLost(t *testing.T) {
+	abort := &sourceReader{r: io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF))}
+	_, err := io.Copy(io.Discard, abort)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("source error = %v, want it to wrap io.ErrUnexpectedEOF", err)
+	}
+	if uploadConnLost(err, isConnLost) {
+		t.Errorf("source error %v marked the session lost", err)
+	}
+
+	_, err = io.Copy(failingWriter{err: io.ErrUnexpectedEOF}, &sourceReader{r: strings.NewReader("data")})
+	if !uploadConnLost(err, isConnLost) {
+		t.Errorf("destination error %v did not mark the session lost", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = io.Copy(io.Discard, &sourceReader{r: &ctxReader{ctx: ctx, r: strings.NewReader("data")}})
+	if !errors.Is(err, context.Canceled) || uploadConnLost(err, isConnLost) {
+		t.Errorf("cancelled upload = %v, lost = %v", err, uploadConnLost(err, isConnLost))
+	}
+}
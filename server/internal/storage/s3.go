@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"sync/atomic"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config は S3 互換オブジェクトストレージ（MinIO / Garage など）の設定
+type S3Config struct {
+	Endpoint  string // host:port（スキームなし）
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+	Prefix    string // バケット内のキー接頭辞（例: hideme/uploads）
+	PartSize  uint64 // マルチパートの 1 パートのサイズ（バイト）
+	ListBatch int    // ListObjects の 1 リクエストあたりの件数
+}
+
+// S3Storage は S3 互換 API でオブジェクトを保存するストレージ実装
+type S3Storage struct {
+	cfg    S3Config
+	client *minio.Client
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	// デフォルト補完
+	if cfg.PartSize == 0 {
+		cfg.PartSize = 16 * 1024 * 1024 // 16 MB
+	}
+	if cfg.ListBatch == 0 {
+		cfg.ListBatch = 1000
+	}
+	cfg.Prefix = strings.Trim(CleanSubPath(cfg.Prefix), "/")
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3: bucket is required")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+		// LAN 内の MinIO / Garage は仮想ホスト形式の DNS を持たないことが多い
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+	return &S3Storage{cfg: cfg, client: client}, nil
+}
+
+func (s *S3Storage) objectKey(name string) string {
+	sub := CleanSubPath(name)
+	if s.cfg.Prefix == "" {
+		return sub
+	}
+	return path.Join(s.cfg.Prefix, sub)
+}
+
+func (s *S3Storage) listPrefix() string {
+	if s.cfg.Prefix == "" {
+		return ""
+	}
+	return s.cfg.Prefix + "/"
+}
+
+// ListPage はサブフォルダ（プレフィックス）も含めてキー順に 1 ページ分のオブジェクトを返す。
+// カーソルは ListObjectsV2 の StartAfter にそのまま渡す。
+func (s *S3Storage) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	limit := opts.limit()
+	prefix := s.listPrefix()
+	lo := minio.ListObjectsOptions{
+		Prefix:    prefix + opts.Prefix,
+		Recursive: true,
+		MaxKeys:   min(s.cfg.ListBatch, limit+1),
+	}
+	if opts.Cursor != "" {
+		lo.StartAfter = prefix + opts.Cursor
+	}
+	items := make([]FileItem, 0, min(limit+1, 256))
+	for obj := range s.client.ListObjects(ctx, s.cfg.Bucket, lo) {
+		if obj.Err != nil {
+			return Page{}, obj.Err
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			continue // フォルダのマーカー
+		}
+		items = append(items, FileItem{
+			Name:     strings.TrimPrefix(obj.Key, prefix),
+			Size:     obj.Size,
+			Modified: obj.LastModified.UTC(),
+		})
+		if len(items) > limit {
+			break
+		}
+	}
+	return pageOf(items, limit), nil
+}
+
+func (s *S3Storage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
+	return s.UploadWithProgress(ctx, name, data, size, nil)
+}
+
+// UploadWithProgress は PartSize を超えるファイルをマルチパートでアップロードする。
+// 進捗は各パートの送信ごとに onProgress へ通知される。
+func (s *S3Storage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error) {
+	key := s.objectKey(name)
+
+	opts := minio.PutObjectOptions{
+		ContentType: contentTypeFor(name),
+		PartSize:    s.cfg.PartSize,
+	}
+	if onProgress != nil && size > 0 {
+		opts.Progress = &s3ProgressHook{total: size, onProgress: onProgress}
+	}
+
+	if _, err := s.client.PutObject(ctx, s.cfg.Bucket, key, data, size, opts); err != nil {
+		return FileItem{}, fmt.Errorf("s3 put %s: %w", key, err)
+	}
+
+	info, err := s.client.StatObject(ctx, s.cfg.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return FileItem{}, err
+	}
+
+	return FileItem{
+		Name:     path.Base(key),
+		Size:     info.Size,
+		Modified: info.LastModified.UTC(),
+	}, nil
+}
+
+func (s *S3Storage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
+	return s.OpenSeeker(ctx, name)
+}
+
+// OpenSeeker は GetObject のストリームを返す。本体は Read されるまで取得せず、
+// Seek 後の Read はそのオフセットからの Range GET になる。
+func (s *S3Storage) OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
+	key := s.objectKey(name)
+	obj, err := s.client.GetObject(ctx, s.cfg.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, FileItem{}, s.mapErr(err)
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		_ = obj.Close()
+		return nil, FileItem{}, s.mapErr(err)
+	}
+
+	return obj, FileItem{
+		Name:     path.Base(key),
+		Size:     info.Size,
+		Modified: info.LastModified.UTC(),
+	}, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, name string) error {
+	key := s.objectKey(name)
+	// RemoveObject は存在しないキーでも成功するため、先に存在確認する
+	if _, err := s.client.StatObject(ctx, s.cfg.Bucket, key, minio.StatObjectOptions{}); err != nil {
+		return s.mapErr(err)
+	}
+	return s.client.RemoveObject(ctx, s.cfg.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) mapErr(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NotFound":
+		return ErrNotFound
+	}
+	return err
+}
+
+// s3ProgressHook は minio の Progress フックとして送信済みバイト数を数える
+type s3ProgressHook struct {
+	total      int64
+	loaded     atomic.Int64
+	onProgress ProgressFunc
+}
+
+func (h *s3ProgressHook) Read(p []byte) (int, error) {
+	n := len(p)
+	h.onProgress(h.loaded.Add(int64(n)), h.total)
+	return n, nil
+}
+
+func contentTypeFor(name string) string {
+	if mt := mime.TypeByExtension(path.Ext(name)); mt != "" {
+		return mt
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 は S3Storage が使う API だけを持つ、プロセス内の S3 互換サーバー
+// （PUT / マルチパート / HEAD / Range GET / DELETE / ListObjectsV2）。署名は検証しない。
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	uploads map[string]map[int][]byte // uploadId → パート番号 → 内容
+	nextID  int
+	puts    int // 受け取ったパートを含む PUT の数
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{bucket: bucket, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, q)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = readS3Body(r)
+		f.puts++
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, n))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		nums := make([]int, 0, len(parts))
+		for n := range parts {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		var buf bytes.Buffer
+		for _, n := range nums {
+			buf.Write(parts[n])
+		}
+		f.objects[key] = buf.Bytes()
+		delete(f.uploads, q.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"multipart"`})
+	case r.Method == http.MethodPut:
+		f.objects[key] = readS3Body(r)
+		f.puts++
+		w.Header().Set("ETag", `"single"`)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Unix(1700000000, 0).UTC().Format(http.TimeFormat))
+		w.Header().Set("Accept-Ranges", "bytes")
+		body, status := data, http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			var start, end int
+			spec := strings.TrimPrefix(rng, "bytes=")
+			s, e, _ := strings.Cut(spec, "-")
+			start, _ = strconv.Atoi(s)
+			end = len(data) - 1
+			if e != "" {
+				end, _ = strconv.Atoi(e)
+			}
+			end = min(end, len(data)-1)
+			body, status = data[start:end+1], http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(body)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// list は ListObjectsV2（continuation-token は次のページの先頭キー）
+func (f *fakeS3) list(w http.ResponseWriter, q url.Values) {
+	prefix, after := q.Get("prefix"), q.Get("start-after")
+	token := q.Get("continuation-token")
+	maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > after && k >= token {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified string
+		ETag         string
+	}
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: f.bucket, Prefix: prefix, MaxKeys: maxKeys}
+	if len(keys) > maxKeys {
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[maxKeys]
+		keys = keys[:maxKeys]
+	}
+	for _, k := range keys {
+		res.Contents = append(res.Contents, content{
+			Key:          k,
+			Size:         int64(len(f.objects[k])),
+			LastModified: time.Unix(1700000000, 0).UTC().Format(time.RFC3339),
+			ETag:         `"etag"`,
+		})
+	}
+	res.KeyCount = len(res.Contents)
+	writeXML(w, res)
+}
+
+// readS3Body は本文を読む。HTTP の minio-go は aws-chunked（チャンクごとの署名付き）で送ってくる。
+func readS3Body(r *http.Request) []byte {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		b, _ := io.ReadAll(r.Body)
+		return b
+	}
+	var out bytes.Buffer
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return out.Bytes()
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || n == 0 {
+			return out.Bytes()
+		}
+		io.CopyN(&out, br, n)
+		br.ReadString('\n')
+	}
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func newTestS3Storage(t *testing.T, cfg S3Config) (*S3Storage, *fakeS3) {
+	f, srv := newFakeS3(t, "hideme")
+	cfg.Endpoint = strings.TrimPrefix(srv.URL, "http://")
+	cfg.Bucket = "hideme"
+	cfg.Region = "us-east-1"
+	cfg.AccessKey, cfg.SecretKey = "test", "testtest"
+	s, err := NewS3Storage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, f
+}
+
+func TestS3StorageUploadOpen(t *testing.T) {
+	s, f := newTestS3Storage(t, S3Config{Prefix: "/hideme/uploads/"})
+	ctx := context.Background()
+	data := []byte("0123456789abcdefghij")
+
+	item, err := s.Upload(ctx, "thumbnails/a.jpg", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "a.jpg" || item.Size != int64(len(data)) {
+		t.Errorf("Upload = %+v", item)
+	}
+	if _, ok := f.objects["hideme/uploads/thumbnails/a.jpg"]; !ok {
+		t.Fatalf("object not stored under the prefix: %v", f.objects)
+	}
+
+	rc, item, err := s.Open(ctx, "thumbnails/a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) || item.Size != int64(len(data)) {
+		t.Errorf("Open = %q (size %d)", got, item.Size)
+	}
+}
+
+func TestS3StorageOpenSeekerRange(t *testing.T) {
+	s, _ := newTestS3Storage(t, S3Config{})
+	ctx := context.Background()
+	data := []byte("0123456789abcdefghij")
+	if _, err := s.Upload(ctx, "v.mp4", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	rs, _, err := s.OpenSeeker(ctx, "v.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	if _, err := rs.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(rs, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "abcde" {
+		t.Errorf("read after Seek(10) = %q, want %q", buf, "abcde")
+	}
+	if _, err := rs.Seek(-3, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(rs)
+	if string(rest) != "hij" {
+		t.Errorf("read after Seek(-3, end) = %q, want %q", rest, "hij")
+	}
+}
+
+func TestS3StorageNotFound(t *testing.T) {
+	s, _ := newTestS3Storage(t, S3Config{})
+	ctx := context.Background()
+
+	if _, _, err := s.Open(ctx, "missing.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open(missing) = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "missing.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete(missing) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3StorageDelete(t *testing.T) {
+	s, f := newTestS3Storage(t, S3Config{})
+	ctx := context.Background()
+	if _, err := s.Upload(ctx, "a.txt", strings.NewReader("x"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.objects) != 0 {
+		t.Errorf("objects after Delete = %v", f.objects)
+	}
+	if _, _, err := s.Open(ctx, "a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3StorageListPage(t *testing.T) {
+	// ListBatch を小さくして、minio-go の continuation-token とこちらのカーソルの両方を通す
+	s, f := newTestS3Storage(t, S3Config{Prefix: "p", ListBatch: 2})
+	ctx := context.Background()
+	names := []string{"a.mp4", "b.mp4", "c.mp4", "thumbnails/a.jpg", "thumbnails/b.jpg"}
+	for _, n := range names {
+		if _, err := s.Upload(ctx, n, strings.NewReader(n), int64(len(n))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.objects["p/thumbnails/"] = nil // フォルダのマーカーは返さない
+	f.objects["other/x.mp4"] = []byte("x")
+
+	var got []string
+	opts := ListOptions{Limit: 2}
+	pages := 0
+	for {
+		page, err := s.ListPage(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, it := range page.Items {
+			got = append(got, it.Name)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if strings.Join(got, ",") != strings.Join(names, ",") {
+		t.Errorf("ListPage = %v, want %v", got, names)
+	}
+	if pages != 3 {
+		t.Errorf("pages = %d, want 3", pages)
+	}
+
+	page, err := s.ListPage(ctx, ListOptions{Prefix: "thumbnails/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[0].Name != "thumbnails/a.jpg" || page.NextCursor != "" {
+		t.Errorf("ListPage(prefix) = %+v", page)
+	}
+}
+
+func TestS3StorageMultipartProgress(t *testing.T) {
+	const partSize = 5 * 1024 * 1024 // minio-go が受け付ける最小のパートサイズ
+	s, f := newTestS3Storage(t, S3Config{PartSize: partSize})
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*partSize+1024)/16)
+
+	var mu sync.Mutex
+	var last, total int64
+	item, err := s.UploadWithProgress(ctx, "big.mp4", io.MultiReader(bytes.NewReader(data)), int64(len(data)), func(loaded, t int64) {
+		mu.Lock()
+		last, total = max(last, loaded), t
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Size != int64(len(data)) {
+		t.Errorf("size = %d, want %d", item.Size, len(data))
+	}
+	if f.puts != 3 {
+		t.Errorf("parts = %d, want 3", f.puts)
+	}
+	if !bytes.Equal(f.objects["big.mp4"], data) {
+		t.Error("assembled object differs from the upload")
+	}
+	if last != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("progress = %d/%d, want %d/%d", last, total, len(data), len(data))
+	}
+}
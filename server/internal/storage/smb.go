@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// SMBConfig は SMB2/3 で接続する NAS ストレージの設定
+type SMBConfig struct {
+	Host     string
+	User     string
+	Password string
+	Domain   string
+	// Share は "共有名/ディレクトリ" の形式（例: HideMe/uploads → 共有 HideMe の uploads 以下に保存）
+	Share          string
+	Port           int // SMB は通常 445
+	RequireSigning bool
+	Timeout        int // 秒
+	MaxRetries     int
+	RetryDelay     int // 秒
+	ChunkSize      int // バイト
+	PoolSize       int // 同時に保持する SMB セッションの上限
+	IdleTimeout    int // 秒。これ以上使われなかったセッションは閉じる
+
+	// Dial はサーバーへの接続を張る。nil なら TCP で接続する（テストで in-process のサーバーに繋ぐ用）
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// SMBStorage は NAS (SMB) にファイルを保存するストレージ実装。
+// SMB セッションはプールで使い回すため、1 つのインスタンスを共有して使う。
+type SMBStorage struct {
+	cfg       SMBConfig
+	shareName string // マウントする共有名
+	dir       string // 共有内のアップロード先ディレクトリ（"" なら共有の直下）
+	pool      *connPool[*smbConn]
+}
+
+func NewSMBStorage(cfg SMBConfig) *SMBStorage {
+	// デフォルト補完
+	if cfg.Port == 0 {
+		cfg.Port = 445
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 30
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryDelay == 0 {
+		cfg.RetryDelay = 5
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = 1048576 // 1 MB
+	}
+	if cfg.Share == "" {
+		cfg.Share = "HideMe/uploads"
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 8
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = 300
+	}
+	if cfg.Dial == nil {
+		dialer := &net.Dialer{Timeout: time.Duration(cfg.Timeout) * time.Second}
+		cfg.Dial = dialer.DialContext
+	}
+	shareName, dir, _ := strings.Cut(CleanSubPath(cfg.Share), "/")
+	s := &SMBStorage{cfg: cfg, shareName: shareName, dir: dir}
+	s.pool = newConnPool(cfg.PoolSize, time.Duration(cfg.IdleTimeout)*time.Second, s.dial, isSMBConnLost)
+	return s
+}
+
+// PoolStats は SMB コネクションプールの統計を返す
+func (s *SMBStorage) PoolStats() PoolStats {
+	return s.pool.snapshot()
+}
+
+// Close はプール内のアイドルセッションをすべて閉じる
+func (s *SMBStorage) Close() {
+	s.pool.close()
+}
+
+func (s *SMBStorage) Delete(ctx context.Context, name string) error {
+	target := s.uploadPath(name)
+	err := s.pool.withConn(ctx, func(conn *smbConn) error {
+		return conn.share.WithContext(ctx).Remove(target)
+	})
+	if err != nil {
+		if isSMBNotExist(err) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// ListPage はサブフォルダも含めてキー順に 1 ページ分のファイルを返す（1 つの接続で読む）
+func (s *SMBStorage) ListPage(ctx context.Context, opts ListOptions) (Page, error) {
+	var page Page
+	err := s.pool.withConn(ctx, func(conn *smbConn) error {
+		share := conn.share.WithContext(ctx)
+		var err error
+		page, err = listTree(ctx, func(rel string) ([]fs.FileInfo, error) {
+			return share.ReadDir(path.Join(s.dir, rel))
+		}, opts)
+		return err
+	})
+	return page, err
+}
+
+func (s *SMBStorage) Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error) {
+	return s.UploadWithProgress(ctx, name, data, size, nil)
+}
+
+// UploadWithProgress はデータを消費するため、セッション切れでも再試行しない
+func (s *SMBStorage) UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (item FileItem, err error) {
+	conn, err := s.pool.get(ctx)
+	if err != nil {
+		return FileItem{}, err
+	}
+	defer func() { s.pool.put(conn, uploadConnLost(err, isSMBConnLost)) }()
+	share := conn.share.WithContext(ctx)
+
+	target := s.uploadPath(name)
+	// サブフォルダ (thumbnails/ icons/) を作成
+	if dir := path.Dir(target); dir != "." && dir != s.dir {
+		if err := share.MkdirAll(dir, 0755); err != nil {
+			return FileItem{}, fmt.Errorf("mkdir %s: %w", dir, err)
+		}
+	}
+	writer, err := share.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return FileItem{}, err
+	}
+	defer writer.Close()
+
+	var reader io.Reader = &ctxReader{ctx: ctx, r: data}
+	if onProgress != nil && size > 0 {
+		reader = &progressReader{r: reader, total: size, onProgress: onProgress}
+	}
+	buf := make([]byte, s.cfg.ChunkSize)
+	if _, err := io.CopyBuffer(writer, &sourceReader{r: reader}, buf); err != nil {
+		// 途中まで書いたファイルは残さない
+		writer.Close()
+		_ = conn.share.Remove(target)
+		return FileItem{}, err
+	}
+
+	info, err := writer.Stat()
+	if err != nil {
+		return FileItem{}, err
+	}
+
+	return FileItem{
+		Name:     path.Base(target),
+		Size:     info.Size(),
+		Modified: info.ModTime().UTC(),
+	}, nil
+}
+
+func (s *SMBStorage) Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error) {
+	return s.OpenSeeker(ctx, name)
+}
+
+// OpenSeeker が返すストリームは共有セッションに相乗りする（SMB2 は 1 本のセッションで複数のファイルを並行に読める）。
+// 再生中のストリームがプールのセッションを占有しないので、同時再生が多くても他の操作は待たされない。
+func (s *SMBStorage) OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error) {
+	target := s.uploadPath(name)
+	for attempt := 0; ; attempt++ {
+		sc, err := s.pool.share(ctx)
+		if err != nil {
+			return nil, FileItem{}, err
+		}
+
+		// 読み込みはリクエストより長く続くことがあるので ctx は引き継がない
+		file, err := sc.conn.share.Open(target)
+		var info os.FileInfo
+		if err == nil {
+			info, err = file.Stat()
+			if err != nil {
+				_ = file.Close()
+			}
+		}
+		if err != nil {
+			lost := isSMBConnLost(err)
+			s.pool.unshare(sc, lost)
+			if lost && attempt == 0 {
+				continue // 切れたセッションだったので新しいセッションでやり直す
+			}
+			if isSMBNotExist(err) {
+				return nil, FileItem{}, ErrNotFound
+			}
+			return nil, FileItem{}, err
+		}
+
+		return &smbReadCloser{
+			file: file,
+			conn: sc,
+			pool: s.pool,
+		}, FileItem{
+			Name:     path.Base(target),
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		}, nil
+	}
+}
+
+// DiskStat は共有のディスク使用量・空き容量・合計容量を返す
+func (s *SMBStorage) DiskStat(ctx context.Context) (DiskStat, error) {
+	var fs smb2.FileFsInfo
+	err := s.pool.withConn(ctx, func(conn *smbConn) error {
+		var err error
+		fs, err = conn.share.WithContext(ctx).Statfs(s.dir)
+		return err
+	})
+	if err != nil {
+		return DiskStat{}, fmt.Errorf("Statfs: %w", err)
+	}
+
+	// 割り当て単位 = セクタサイズ × セクタ数
+	unit := fs.BlockSize() * fs.FragmentSize()
+	total := fs.TotalBlockCount() * unit
+	free := fs.AvailableBlockCount() * unit
+	return DiskStat{
+		TotalBytes: total,
+		FreeBytes:  free,
+		UsedBytes:  total - free,
+	}, nil
+}
+
+func (s *SMBStorage) uploadPath(name string) string {
+	return path.Join(s.dir, CleanSubPath(name))
+}
+
+// dial はプール用に新しいセッションを張り、アップロード先ディレクトリを用意する
+func (s *SMBStorage) dial(ctx context.Context) (*smbConn, error) {
+	var lastErr error
+	retries := s.cfg.MaxRetries
+	for attempt := 0; attempt <= retries; attempt++ {
+		conn, err := s.connectOnce(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		// 認証エラーは再試行しても解決しない
+		if isSMBAuthError(err) {
+			break
+		}
+
+		if attempt == retries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(s.cfg.RetryDelay) * time.Second):
+		}
+	}
+	return nil, lastErr
+}
+
+func (s *SMBStorage) connectOnce(ctx context.Context) (*smbConn, error) {
+	if s.shareName == "" {
+		return nil, errors.New("smb share name is not configured")
+	}
+
+	addr := net.JoinHostPort(s.cfg.Host, strconv.Itoa(s.cfg.Port))
+	tcp, err := s.cfg.Dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &smb2.Dialer{
+		Negotiator: smb2.Negotiator{RequireMessageSigning: s.cfg.RequireSigning},
+		Initiator: &smb2.NTLMInitiator{
+			User:     s.cfg.User,
+			Password: s.cfg.Password,
+			Domain:   s.cfg.Domain,
+		},
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Timeout)*time.Second)
+	defer cancel()
+	session, err := dialer.DialContext(timeoutCtx, tcp)
+	if err != nil {
+		_ = tcp.Close()
+		return nil, err
+	}
+
+	share, err := session.WithContext(timeoutCtx).Mount(s.shareName)
+	if err != nil {
+		_ = session.Logoff()
+		_ = tcp.Close()
+		return nil, fmt.Errorf("mount %s: %w", s.shareName, err)
+	}
+
+	conn := &smbConn{connMeta: connMeta{lastUsed: time.Now()}, tcp: tcp, session: session, share: share, root: s.dir}
+	if s.dir != "" {
+		if err := share.WithContext(timeoutCtx).MkdirAll(s.dir, 0755); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// smbConn はプールが保持する 1 本の SMB セッション（共有はマウント済み）
+type smbConn struct {
+	connMeta
+	tcp     net.Conn
+	session *smb2.Session
+	share   *smb2.Share
+	root    string
+}
+
+func (c *smbConn) meta() *connMeta { return &c.connMeta }
+
+func (c *smbConn) close() {
+	_ = c.share.Umount()
+	_ = c.session.Logoff()
+	_ = c.tcp.Close()
+}
+
+func (c *smbConn) healthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := c.share.WithContext(ctx).Stat(c.root)
+	return err == nil
+}
+
+// smbReadCloser はシーク可能な SMB ファイルで、Close 時に共有セッションから抜ける
+type smbReadCloser struct {
+	file   *smb2.File
+	conn   *sharedConn[*smbConn]
+	pool   *connPool[*smbConn]
+	broken bool
+	once   sync.Once
+}
+
+func (s *smbReadCloser) Read(p []byte) (int, error) {
+	n, err := s.file.Read(p)
+	if err != nil && err != io.EOF && isSMBConnLost(err) {
+		s.broken = true
+	}
+	return n, err
+}
+
+func (s *smbReadCloser) Seek(offset int64, whence int) (int64, error) {
+	n, err := s.file.Seek(offset, whence)
+	if err != nil && isSMBConnLost(err) {
+		s.broken = true
+	}
+	return n, err
+}
+
+func (s *smbReadCloser) Close() error {
+	var err error
+	s.once.Do(func() {
+		err = s.file.Close()
+		s.pool.unshare(s.conn, s.broken || isSMBConnLost(err))
+	})
+	return err
+}
+
+// NTSTATUS（[MS-ERREF] 2.3）
+const (
+	ntStatusLogonFailure          = 0xC000006D
+	ntStatusAccessDenied          = 0xC0000022
+	ntStatusObjectNameNotFound    = 0xC0000034
+	ntStatusObjectPathNotFound    = 0xC000003A
+	ntStatusNetworkNameDeleted    = 0xC00000C9
+	ntStatusUserSessionDeleted    = 0xC0000203
+	ntStatusNetworkSessionExpired = 0xC000035C
+)
+
+func smbStatus(err error) (uint32, bool) {
+	var respErr *smb2.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.Code, true
+	}
+	return 0, false
+}
+
+func isSMBNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	code, ok := smbStatus(err)
+	return ok && (code == ntStatusObjectNameNotFound || code == ntStatusObjectPathNotFound)
+}
+
+func isSMBAuthError(err error) bool {
+	code, ok := smbStatus(err)
+	return ok && (code == ntStatusLogonFailure || code == ntStatusAccessDenied)
+}
+
+// isSMBConnLost は SMB セッション自体が使えなくなったエラーかどうかを判定する
+func isSMBConnLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	var transportErr *smb2.TransportError
+	if errors.As(err, &transportErr) {
+		return true
+	}
+	switch code, _ := smbStatus(err); code {
+	case ntStatusNetworkNameDeleted, ntStatusUserSessionDeleted, ntStatusNetworkSessionExpired:
+		return true
+	}
+	return isConnLost(err)
+}
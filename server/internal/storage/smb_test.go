@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// SMB のテストは Samba に接続する。無ければスキップする。
+// 例: docker run -d -p 1445:445 dperson/samba -u "hideme;hideme" -s "HideMe;/share;yes;no;no;hideme"
+//
+//	HIDEME_TEST_SMB_ADDR=127.0.0.1:1445 HIDEME_TEST_SMB_USER=hideme HIDEME_TEST_SMB_PASSWORD=hideme \
+//	HIDEME_TEST_SMB_SHARE=HideMe go test ./internal/storage -run SMB
+func smbTestConfig(t *testing.T) SMBConfig {
+	t.Helper()
+	addr := os.Getenv("HIDEME_TEST_SMB_ADDR")
+	if addr == "" {
+		t.Skip("HIDEME_TEST_SMB_ADDR is not set")
+	}
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Skipf("samba is not reachable at %s: %v", addr, err)
+	}
+	conn.Close()
+
+	host, port, _ := net.SplitHostPort(addr)
+	var portNum int
+	fmt.Sscan(port, &portNum)
+	return SMBConfig{
+		Host:       host,
+		Port:       portNum,
+		User:       os.Getenv("HIDEME_TEST_SMB_USER"),
+		Password:   os.Getenv("HIDEME_TEST_SMB_PASSWORD"),
+		Share:      os.Getenv("HIDEME_TEST_SMB_SHARE") + fmt.Sprintf("/hideme-test-%d", time.Now().UnixNano()),
+		Timeout:    5,
+		MaxRetries: 1,
+		RetryDelay: 1,
+		PoolSize:   2,
+	}
+}
+
+// dropConns は張った TCP 接続を覚えておき、まとめて切れるようにする（NAS の再起動・回線断の代わり）
+type dropConns struct {
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *dropConns) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err == nil {
+		d.mu.Lock()
+		d.conns = append(d.conns, c)
+		d.mu.Unlock()
+	}
+	return c, err
+}
+
+func (d *dropConns) dropAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.conns {
+		c.Close()
+	}
+	d.conns = nil
+}
+
+func newTestSMBStorage(t *testing.T) (*SMBStorage, *dropConns) {
+	cfg := smbTestConfig(t)
+	d := &dropConns{}
+	cfg.Dial = d.dial
+	s := NewSMBStorage(cfg)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ListAll(ctx, s, "", func(it FileItem) error {
+			return s.Delete(ctx, it.Name)
+		})
+		s.Close()
+	})
+	return s, d
+}
+
+func TestSMBStorageNotFound(t *testing.T) {
+	s, _ := newTestSMBStorage(t)
+	ctx := context.Background()
+
+	if _, _, err := s.Open(ctx, "missing.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open(missing) = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, "missing.mp4"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete(missing) = %v, want ErrNotFound", err)
+	}
+	page, err := s.ListPage(ctx, ListOptions{Prefix: "thumbnails/"})
+	if err != nil || len(page.Items) != 0 {
+		t.Errorf("ListPage(missing folder) = %+v, %v", page, err)
+	}
+}
+
+func TestSMBStorageReconnect(t *testing.T) {
+	s, d := newTestSMBStorage(t)
+	ctx := context.Background()
+	if _, err := s.Upload(ctx, "thumbnails/a.jpg", strings.NewReader("hello"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	// プールにあるセッションの TCP を切る。次の操作は切れたセッションを引き、新しいセッションでやり直すはず
+	d.dropAll()
+	page, err := s.ListPage(ctx, ListOptions{})
+	if err != nil {
+		t.Fatalf("ListPage after drop: %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Name != "thumbnails/a.jpg" {
+		t.Errorf("ListPage = %+v", page.Items)
+	}
+	if st := s.PoolStats(); st.Reconnects != 1 {
+		t.Errorf("reconnects = %d, want 1", st.Reconnects)
+	}
+
+	d.dropAll()
+	rc, item, err := s.Open(ctx, "thumbnails/a.jpg")
+	if err != nil {
+		t.Fatalf("Open after drop: %v", err)
+	}
+	b, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(b) != "hello" || item.Size != 5 {
+		t.Errorf("Open = %q (size %d)", b, item.Size)
+	}
+
+	d.dropAll()
+	if err := s.Delete(ctx, "thumbnails/a.jpg"); err != nil {
+		t.Fatalf("Delete after drop: %v", err)
+	}
+	if _, _, err := s.Open(ctx, "thumbnails/a.jpg"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+// 開いたままのストリームがプールの上限 (PoolSize: 2) を超えても、他の操作は待たされない
+func TestSMBStorageStreamsShareSession(t *testing.T) {
+	s, _ := newTestSMBStorage(t)
+	ctx := context.Background()
+	if _, err := s.Upload(ctx, "a.mp4", strings.NewReader("video"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	var streams []io.ReadCloser
+	for i := 0; i < 4; i++ {
+		rc, _, err := s.Open(ctx, "a.mp4")
+		if err != nil {
+			t.Fatalf("Open #%d: %v", i, err)
+		}
+		streams = append(streams, rc)
+	}
+	defer func() {
+		for _, rc := range streams {
+			rc.Close()
+		}
+	}()
+
+	opCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := s.Upload(opCtx, "b.jpg", strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("Upload while streaming: %v", err)
+	}
+	if st := s.PoolStats(); st.Shared != 1 || st.Streams != 4 {
+		t.Errorf("shared = %d, streams = %d, want 1, 4", st.Shared, st.Streams)
+	}
+}
+
+// エラーの判定は Samba なしで確かめる
+func TestSMBErrorClassification(t *testing.T) {
+	tests := []struct {
+		err                   error
+		notExist, lost, authn bool
+	}{
+		{&smb2.ResponseError{Code: ntStatusObjectNameNotFound}, true, false, false},
+		{&smb2.ResponseError{Code: ntStatusObjectPathNotFound}, true, false, false},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, true, false, false},
+		{&smb2.ResponseError{Code: ntStatusNetworkNameDeleted}, false, true, false},
+		{&smb2.ResponseError{Code: ntStatusUserSessionDeleted}, false, true, false},
+		{&smb2.TransportError{Err: io.EOF}, false, true, false},
+		{net.ErrClosed, false, true, false},
+		{&smb2.ResponseError{Code: ntStatusLogonFailure}, false, false, true},
+		{&smb2.ResponseError{Code: ntStatusAccessDenied}, false, false, true},
+	}
+	for _, tt := range tests {
+		if got := isSMBNotExist(tt.err); got != tt.notExist {
+			t.Errorf("isSMBNotExist(%v) = %v, want %v", tt.err, got, tt.notExist)
+		}
+		if got := isSMBConnLost(tt.err); got != tt.lost {
+			t.Errorf("isSMBConnLost(%v) = %v, want %v", tt.err, got, tt.lost)
+		}
+		if got := isSMBAuthError(tt.err); got != tt.authn {
+			t.Errorf("isSMBAuthError(%v) = %v, want %v", tt.err, got, tt.authn)
+		}
+		// アップロード中は書き込み先のエラーだけでセッションを捨て、アップロード元の同じエラーでは捨てない
+		if got := uploadConnLost(tt.err, isSMBConnLost); got != tt.lost {
+			t.Errorf("uploadConnLost(%v) = %v, want %v", tt.err, got, tt.lost)
+		}
+		if uploadConnLost(&sourceError{err: tt.err}, isSMBConnLost) {
+			t.Errorf("uploadConnLost(source %v) = true, want false", tt.err)
+		}
+	}
+}
@@ -26,19 +26,88 @@ type FileItem struct {
 	Name     string
 	Size     int64
 	Modified time.Time
+	// Deduplicated は同じ内容のブロブが既にあり、実体を書かなかったことを示す（DedupStorage のみ）
+	Deduplicated bool
 }
 
 // ProgressFunc は転送済みバイト数と総バイト数を受け取るコールバック
 type ProgressFunc func(loaded, total int64)
 
 type Storage interface {
-	List(ctx context.Context) ([]FileItem, error)
+	// ListPage はサブフォルダも含めたファイルをキー順に 1 ページずつ返す（ListOptions で接頭辞・カーソルを指定）
+	ListPage(ctx context.Context, opts ListOptions) (Page, error)
 	Upload(ctx context.Context, name string, data io.Reader, size int64) (FileItem, error)
 	UploadWithProgress(ctx context.Context, name string, data io.Reader, size int64, onProgress ProgressFunc) (FileItem, error)
 	Open(ctx context.Context, name string) (io.ReadCloser, FileItem, error)
+	// OpenSeeker はシーク可能なストリームを返す（Range リクエスト・動画のシーク用）
+	OpenSeeker(ctx context.Context, name string) (io.ReadSeekCloser, FileItem, error)
 	Delete(ctx context.Context, name string) error
 }
 
+// Unwrap はデコレータ（DedupStorage など）を剥がして最下層のストアを返す。
+// NAS の容量取得やローカルファイルの直接配信など、実装固有の機能を使うときに使う。
+func Unwrap(s Storage) Storage {
+	for {
+		u, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			return s
+		}
+		s = u.Unwrap()
+	}
+}
+
+// As はデコレータのチェーンをたどって T 型のストアを探す
+func As[T Storage](s Storage) (T, bool) {
+	for {
+		if t, ok := s.(T); ok {
+			return t, true
+		}
+		u, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		s = u.Unwrap()
+	}
+}
+
+// ctxReader は ctx が終わったら読み込みを打ち切る（取り消されたアップロードの転送を途中で止める）
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// sourceError はアップロード元（呼び出し側のリーダー）のエラー。
+// クライアントの中断などでセッションが切れたと判定して捨てないように、書き込み先のエラーと区別する。
+type sourceError struct{ err error }
+
+func (e *sourceError) Error() string { return e.err.Error() }
+func (e *sourceError) Unwrap() error { return e.err }
+
+// sourceReader は r のエラー（io.EOF を除く）を sourceError で包む
+type sourceReader struct{ r io.Reader }
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &sourceError{err: err}
+	}
+	return n, err
+}
+
+// uploadConnLost はアップロードのエラーでセッションを捨てるかどうかを返す（アップロード元のエラーでは捨てない）
+func uploadConnLost(err error, lost func(error) bool) bool {
+	var se *sourceError
+	return !errors.As(err, &se) && lost(err)
+}
+
 // progressReader は読み込み進捗を報告する
 type progressReader struct {
 	r          io.Reader